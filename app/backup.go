@@ -0,0 +1,305 @@
+package relixdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+)
+
+// online backups of a read snapshot, writers are not blocked.
+// the backup format:
+// | sig | page_size | flags | version | base | root | npages | ttl | pages... |
+// | 16B |    4B     |  4B   |   8B    |  8B  |  8B  |   8B   | 8B  |
+// followed by the pages reachable from the root and the TTL tree:
+// | ptr | hash | size | data |
+// | 8B  |  8B  |  4B  |      |
+// only the used part of a node is stored. incremental backups omit
+// the data (size 0) of the pages that are unchanged from the base backup.
+// the first version of the format has no TTL tree.
+
+const (
+	BACKUP_SIG    = "RelxDBBackup0002"
+	BACKUP_SIG_V1 = "RelxDBBackup0001" // without the ttl field
+)
+
+const BACKUP_INCREMENTAL = 1 // the flag of incremental backups
+
+// the manifest of a backup
+type BackupInfo struct {
+	Version     uint64 // the version of the snapshot
+	Incremental bool
+	Base        uint64 // the version of the base backup, if incremental
+	PageSize    int
+	Root        uint64
+	TTLRoot     uint64            // the expiries, see ttl.go
+	Pages       map[uint64]uint64 // the reachable pages and the hashes of their data
+}
+
+// write a full backup of the current version
+func (db *KV) Backup(w io.Writer) (*BackupInfo, error) {
+	return db.backup(w, nil)
+}
+
+// write a backup with only the pages that are changed since the `base` backup.
+// restoring it requires the base backup and the backups between them.
+func (db *KV) BackupIncremental(w io.Writer, base *BackupInfo) (*BackupInfo, error) {
+	if base == nil {
+		return nil, fmt.Errorf("no base backup")
+	}
+	if base.PageSize != db.tree.pageSize() {
+		return nil, fmt.Errorf("page size mismatch with the base backup")
+	}
+	return db.backup(w, base)
+}
+
+func (db *KV) backup(w io.Writer, base *BackupInfo) (*BackupInfo, error) {
+	tx := KVReader{}
+	db.BeginRead(&tx)
+	defer db.EndRead(&tx)
+
+	info := &BackupInfo{
+		Version:  tx.version,
+		PageSize: tx.tree.pageSize(),
+		Root:     tx.tree.root,
+		TTLRoot:  tx.ttl.root,
+		Pages:    map[uint64]uint64{},
+	}
+	if base != nil {
+		info.Incremental, info.Base = true, base.Version
+	}
+
+	// collect the reachable pages
+	ptrs := []uint64{}
+	stack := []uint64{}
+	for _, root := range []uint64{tx.tree.root, tx.ttl.root} {
+		if root != 0 {
+			stack = append(stack, root)
+		}
+	}
+	for len(stack) > 0 {
+		ptr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := tx.tree.get(ptr)
+		ptrs = append(ptrs, ptr)
+		info.Pages[ptr] = pageHash(pageData(node))
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				stack = append(stack, node.getPtr(i))
+			}
+		}
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+
+	bw := bufio.NewWriter(w)
+	var hdr [64]byte
+	copy(hdr[:16], BACKUP_SIG)
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(info.PageSize))
+	if info.Incremental {
+		binary.LittleEndian.PutUint32(hdr[20:], BACKUP_INCREMENTAL)
+	}
+	binary.LittleEndian.PutUint64(hdr[24:], info.Version)
+	binary.LittleEndian.PutUint64(hdr[32:], info.Base)
+	binary.LittleEndian.PutUint64(hdr[40:], info.Root)
+	binary.LittleEndian.PutUint64(hdr[48:], uint64(len(ptrs)))
+	binary.LittleEndian.PutUint64(hdr[56:], info.TTLRoot)
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+
+	for _, ptr := range ptrs {
+		hash := info.Pages[ptr]
+		data := pageData(tx.tree.get(ptr))
+		if base != nil && base.Pages[ptr] == hash {
+			data = nil // unchanged
+		}
+		var rec [20]byte
+		binary.LittleEndian.PutUint64(rec[0:], ptr)
+		binary.LittleEndian.PutUint64(rec[8:], hash)
+		binary.LittleEndian.PutUint32(rec[16:], uint32(len(data)))
+		if _, err := bw.Write(rec[:]); err != nil {
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+		if _, err := bw.Write(data); err != nil {
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	return info, nil
+}
+
+// the used part of a node
+func pageData(node BNode) []byte {
+	return node.data[:node.nbytes()]
+}
+
+func pageHash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// read and verify a backup, returns its manifest
+func ReadBackupInfo(r io.Reader) (*BackupInfo, error) {
+	return readBackup(r, nil, nil)
+}
+
+// read a backup. `header` is called before the pages, `page` is called
+// for each page with the data if it's included.
+func readBackup(
+	r io.Reader,
+	header func(info *BackupInfo) error,
+	page func(ptr uint64, hash uint64, data []byte) error,
+) (*BackupInfo, error) {
+	br := bufio.NewReader(r)
+	var hdr [64]byte
+	if _, err := io.ReadFull(br, hdr[:56]); err != nil {
+		return nil, fmt.Errorf("read backup: %w", err)
+	}
+	switch string(hdr[:16]) {
+	case BACKUP_SIG:
+		if _, err := io.ReadFull(br, hdr[56:]); err != nil {
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+	case BACKUP_SIG_V1:
+	default:
+		return nil, fmt.Errorf("bad backup signature")
+	}
+	info := &BackupInfo{
+		PageSize:    int(binary.LittleEndian.Uint32(hdr[16:])),
+		Incremental: binary.LittleEndian.Uint32(hdr[20:])&BACKUP_INCREMENTAL != 0,
+		Version:     binary.LittleEndian.Uint64(hdr[24:]),
+		Base:        binary.LittleEndian.Uint64(hdr[32:]),
+		Root:        binary.LittleEndian.Uint64(hdr[40:]),
+		TTLRoot:     binary.LittleEndian.Uint64(hdr[56:]),
+		Pages:       map[uint64]uint64{},
+	}
+	if err := checkPageSize(info.PageSize); err != nil {
+		return nil, fmt.Errorf("bad backup: %w", err)
+	}
+	if header != nil {
+		if err := header(info); err != nil {
+			return nil, err
+		}
+	}
+
+	npages := binary.LittleEndian.Uint64(hdr[48:])
+	data := make([]byte, info.PageSize)
+	for i := uint64(0); i < npages; i++ {
+		var rec [20]byte
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+		ptr := binary.LittleEndian.Uint64(rec[0:])
+		hash := binary.LittleEndian.Uint64(rec[8:])
+		size := int(binary.LittleEndian.Uint32(rec[16:]))
+		if ptr == 0 || size > info.PageSize || (size == 0 && !info.Incremental) {
+			return nil, fmt.Errorf("bad backup page: %d", ptr)
+		}
+		if _, err := io.ReadFull(br, data[:size]); err != nil {
+			return nil, fmt.Errorf("read backup: %w", err)
+		}
+		if size > 0 && pageHash(data[:size]) != hash {
+			return nil, fmt.Errorf("bad backup page: %d: hash mismatch", ptr)
+		}
+		info.Pages[ptr] = hash
+		if page == nil {
+			continue
+		}
+		var err error
+		if size > 0 {
+			err = page(ptr, hash, data[:size])
+		} else {
+			err = page(ptr, hash, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, root := range []uint64{info.Root, info.TTLRoot} {
+		if _, ok := info.Pages[root]; !ok && root != 0 {
+			return nil, fmt.Errorf("bad backup: the root is missing")
+		}
+	}
+	return info, nil
+}
+
+// rebuild a database at `path` from a full backup followed by
+// a chain of incremental backups. the file must be empty or not exist.
+func Restore(path string, backups ...io.Reader) error {
+	if len(backups) == 0 {
+		return fmt.Errorf("restore: no backups")
+	}
+
+	db := KV{Path: path}
+	opened := false
+	defer func() {
+		if opened {
+			db.Close()
+		}
+	}()
+
+	var prev *BackupInfo
+	for _, r := range backups {
+		header := func(info *BackupInfo) error {
+			if prev == nil {
+				if info.Incremental {
+					return fmt.Errorf("restore: the first backup is incremental")
+				}
+				if err := db.Open(Options{PageSize: info.PageSize}); err != nil {
+					return fmt.Errorf("restore: %w", err)
+				}
+				opened = true
+				if db.mmap.file != 0 {
+					return fmt.Errorf("restore: the file is not empty")
+				}
+				return nil
+			}
+			if !info.Incremental || info.Base != prev.Version || info.PageSize != prev.PageSize {
+				return fmt.Errorf("restore: the backups are not a chain")
+			}
+			return nil
+		}
+		page := func(ptr uint64, hash uint64, data []byte) error {
+			if data == nil {
+				// unchanged, already written
+				if prev.Pages[ptr] != hash {
+					return fmt.Errorf("restore: page %d is missing from the base backup", ptr)
+				}
+				return nil
+			}
+			buf := make([]byte, db.tree.pageSize())
+			copy(buf, data)
+			if _, err := db.fp.WriteAt(buf, int64(ptr)*int64(len(buf))); err != nil {
+				return fmt.Errorf("restore: %w", err)
+			}
+			return nil
+		}
+		info, err := readBackup(r, header, page)
+		if err != nil {
+			return err
+		}
+		prev = info
+	}
+
+	// the pages are in place, put the unused ones into the free list
+	used := uint64(1)
+	for ptr := range prev.Pages {
+		used = max(used, ptr+1)
+	}
+	unused := []uint64{}
+	for ptr := uint64(1); ptr < used; ptr++ {
+		if _, ok := prev.Pages[ptr]; !ok {
+			unused = append(unused, ptr)
+		}
+	}
+	db.ttl.root = prev.TTLRoot
+	if err := adoptPages(&db, prev.Root, used, prev.Version, unused); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package relixdb
+
+// a batch of updates applied atomically with a single write to the disk
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key []byte
+	val []byte
+	del bool
+}
+
+// add or replace a key. the key and value are copied.
+func (b *WriteBatch) Put(key []byte, val []byte) {
+	b.ops = append(b.ops, batchOp{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	})
+}
+
+// remove a key. the key is copied.
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: append([]byte(nil), key...), del: true})
+}
+
+// number of buffered updates
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// discard the buffered updates so the batch can be reused
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// apply the batch in order. either all or none of the updates are persisted.
+// `sync` is SYNC_ON or SYNC_OFF.
+func (db *KV) Write(b *WriteBatch, sync int) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	for _, op := range b.ops {
+		if err := db.tree.checkKV(op.key, op.val); err != nil {
+			return err
+		}
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	for _, op := range b.ops {
+		if op.del {
+			db.tree.Delete(op.key)
+		} else {
+			db.tree.Insert(op.key, op.val)
+		}
+		ttlClear(db, op.key)
+	}
+	return flushPages(db, saved, sync)
+}
@@ -16,6 +16,8 @@ type BTree struct {
 	get func(uint64) BNode // dereference a pointer
 	new func(BNode) uint64 // allocate a new page
 	del func(uint64)       // deallocate a page
+	// the page size, 0: BTREE_PAGE_SIZE
+	psize int
 }
 
 func init() {
@@ -25,6 +27,19 @@ func init() {
 	}
 }
 
+func (tree *BTree) pageSize() int {
+	if tree.psize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.psize
+}
+
+// the value limit grows with the page size, a KV of the maximum size
+// always fits in a single node.
+func (tree *BTree) maxValSize() int {
+	return BTREE_MAX_VAL_SIZE + tree.pageSize() - BTREE_PAGE_SIZE
+}
+
 // Implementing an Assert function
 func Assert(cond bool, msg string) {
 	if !cond {
@@ -59,45 +74,70 @@ func (node BNode) setPtr(idx uint16, val uint64) {
 	binary.LittleEndian.PutUint64(node.data[pos:], val)
 }
 
-// offset list
-func offsetPos(node BNode, idx uint16) uint16 {
+// offset list.
+// the pages use 16-bit offsets. the temporary nodes of an insert can be
+// twice the page size, those larger than 64K use 32-bit offsets.
+func (node BNode) offsetSize() uint32 {
+	if len(node.data) > 1<<16 {
+		return 4
+	}
+	return 2
+}
+
+func offsetPos(node BNode, idx uint16) uint32 {
 	Assert(1 <= idx && idx <= node.nkeys(), "Index out of bounds in offsetPos")
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return HEADER + 8*uint32(node.nkeys()) + node.offsetSize()*uint32(idx-1)
 }
 
-func (node BNode) getOffset(idx uint16) uint16 {
+func (node BNode) getOffset(idx uint16) uint32 {
 	if idx == 0 {
 		return 0
 	}
-	return binary.LittleEndian.Uint16(node.data[offsetPos(node, idx):])
+	pos := offsetPos(node, idx)
+	if node.offsetSize() == 4 {
+		return binary.LittleEndian.Uint32(node.data[pos:])
+	}
+	return uint32(binary.LittleEndian.Uint16(node.data[pos:]))
 }
 
-func (node BNode) setOffset(idx uint16, offset uint16) {
-	binary.LittleEndian.PutUint16(node.data[offsetPos(node, idx):], offset)
+func (node BNode) setOffset(idx uint16, offset uint32) {
+	pos := offsetPos(node, idx)
+	if node.offsetSize() == 4 {
+		binary.LittleEndian.PutUint32(node.data[pos:], offset)
+		return
+	}
+	Assert(offset <= 0xffff, "offset exceeds 16 bits")
+	binary.LittleEndian.PutUint16(node.data[pos:], uint16(offset))
 }
 
 // key-values
-func (node BNode) kvPos(idx uint16) uint16 {
+func (node BNode) kvPos(idx uint16) uint32 {
 	Assert(idx <= node.nkeys(), "Index out of bounds in kvPos")
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	nkeys := uint32(node.nkeys())
+	return HEADER + 8*nkeys + node.offsetSize()*nkeys + node.getOffset(idx)
 }
 
 func (node BNode) getKey(idx uint16) []byte {
 	Assert(idx < node.nkeys(), "Index out of bounds in getKey")
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.data[pos:])
+	klen := uint32(binary.LittleEndian.Uint16(node.data[pos:]))
 	return node.data[pos+4 : pos+4+klen]
 }
 
 func (node BNode) getVal(idx uint16) []byte {
 	Assert(idx < node.nkeys(), "Index out of bounds in getVal")
 	pos := node.kvPos(idx)
-	klen := binary.LittleEndian.Uint16(node.data[pos:])
-	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	klen := uint32(binary.LittleEndian.Uint16(node.data[pos:]))
+	vlen := uint32(binary.LittleEndian.Uint16(node.data[pos+2:]))
 	return node.data[pos+4+klen : pos+4+klen+vlen]
 }
 
 // node size in bytes
-func (node BNode) nbytes() uint16 {
+func (node BNode) nbytes() uint32 {
 	return node.kvPos(node.nkeys())
 }
+
+// node size in bytes as a page, with 16-bit offsets
+func (node BNode) pageBytes() uint32 {
+	return HEADER + 10*uint32(node.nkeys()) + node.getOffset(node.nkeys())
+}
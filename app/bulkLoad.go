@@ -0,0 +1,501 @@
+package relixdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"iter"
+)
+
+// bulk loading: sorted KVs are merged into the tree bottom-up instead of
+// being inserted one by one. the subtrees without new keys are reused,
+// the rest are rebuilt into new pages appended to the file sequentially.
+
+// options for bulk loading
+type BulkOpts struct {
+	// the fraction of the page to fill in (0, 1], 0: full.
+	// leave room for later inserts to avoid splitting every node.
+	Fill float64
+}
+
+func checkBulkOpts(opts []BulkOpts) (float64, error) {
+	if len(opts) > 1 {
+		return 0, fmt.Errorf("more than one set of options")
+	}
+	if len(opts) == 0 {
+		return 0, nil
+	}
+	fill := opts[0].Fill
+	if fill < 0 || fill > 1 {
+		return 0, fmt.Errorf("bad fill factor: %v", fill)
+	}
+	return fill, nil
+}
+
+// add or replace KVs in ascending order of the keys in a single update.
+// an unsorted or duplicated key fails the whole load.
+func (db *KV) BulkLoad(kvs iter.Seq2[[]byte, []byte], opts ...BulkOpts) error {
+	fill, err := checkBulkOpts(opts)
+	if err != nil {
+		return err
+	}
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+
+	// the TTLs of the replaced keys are dropped after the merge,
+	// the TTL tree can't allocate pages while the pages are written directly.
+	next, stop := iter.Pull2(kvs)
+	defer stop()
+	expiring := [][]byte{}
+	input := func() ([]byte, []byte, bool, error) {
+		key, val, ok := next()
+		if _, ttl := ttlGet(&db.ttl, key); ok && ttl {
+			expiring = append(expiring, append([]byte(nil), key...))
+		}
+		return key, val, ok, nil
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	if err := bulkMerge(db, fill, input); err != nil {
+		db.rollback(saved)
+		return err
+	}
+	for _, key := range expiring {
+		ttlClear(db, key)
+	}
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// the source of a bulk merge, returns false at the end
+type bulkInput func() (key []byte, val []byte, ok bool, err error)
+
+type bulkMerger struct {
+	db    *KV
+	b     bulkBuilder
+	input bulkInput
+	// the current input KV
+	ok  bool
+	key []byte
+	val []byte
+	// the pages replaced by the new ones
+	freed []uint64
+}
+
+// merge the sorted KVs of `input` into the tree. the tree is not changed
+// until the input is exhausted, so it can still be read by `input`.
+func bulkMerge(db *KV, fill float64, input bulkInput) error {
+	start := db.page.flushed + uint64(db.page.nappend)
+	m := bulkMerger{db: db, input: input}
+	m.b = bulkBuilder{db: db, next: start, fill: fill}
+	if err := m.advance(); err != nil {
+		return err
+	}
+	if !m.ok {
+		return nil // nothing to load
+	}
+
+	var err error
+	if db.tree.root == 0 {
+		// the dummy key, same as BTree.Insert
+		if err = m.b.add(0, nil, nil, 0); err == nil {
+			err = m.emit(nil)
+		}
+	} else {
+		err = m.merge(db.tree.root, treeHeight(&db.tree), nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+	root, err := m.b.finish()
+	if err != nil {
+		return err
+	}
+
+	// the new pages are already in the file
+	db.page.nappend += int(m.b.next - start)
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	db.mmap.file = int(fi.Size())
+	if err := extendMmap(db, int(m.b.next)); err != nil {
+		return err
+	}
+	for _, ptr := range m.freed {
+		db.tree.del(ptr)
+	}
+	db.tree.root = root
+	return nil
+}
+
+// the number of levels of a non-empty tree
+func treeHeight(tree *BTree) int {
+	height := 1
+	for node := tree.get(tree.root); node.btype() == BNODE_NODE; height++ {
+		node = tree.get(node.getPtr(0))
+	}
+	return height
+}
+
+// the next input KV, it must be after the current one
+func (m *bulkMerger) advance() error {
+	key, val, ok, err := m.input()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		m.ok = false
+		return nil
+	}
+	if err := m.db.tree.checkKV(key, val); err != nil {
+		return err
+	}
+	if m.ok && bytes.Compare(key, m.key) <= 0 {
+		return fmt.Errorf("bulk load: the keys are not in ascending order")
+	}
+	m.ok = true
+	m.key = append(m.key[:0], key...)
+	m.val = val
+	return nil
+}
+
+// add the input KVs before `hi`, nil for all of them
+func (m *bulkMerger) emit(hi []byte) error {
+	for m.ok && (hi == nil || bytes.Compare(m.key, hi) < 0) {
+		if err := m.b.add(0, m.key, m.val, 0); err != nil {
+			return err
+		}
+		if err := m.advance(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge the input KVs before `hi` into the subtree at `ptr` with
+// `height` levels. `first` is the key of the subtree in its parent.
+func (m *bulkMerger) merge(ptr uint64, height int, first []byte, hi []byte) error {
+	if !m.ok || (hi != nil && bytes.Compare(m.key, hi) >= 0) {
+		return m.b.addTree(height, first, ptr) // unchanged
+	}
+	m.freed = append(m.freed, ptr)
+	node := m.db.tree.get(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			end := hi
+			if i+1 < node.nkeys() {
+				end = node.getKey(i + 1)
+			}
+			if err := m.merge(node.getPtr(i), height-1, node.getKey(i), end); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := node.getKey(i)
+		if err := m.emit(key); err != nil {
+			return err
+		}
+		if m.ok && bytes.Equal(m.key, key) {
+			continue // replaced, added by the next emit()
+		}
+		if err := m.b.add(0, key, node.getVal(i), 0); err != nil {
+			return err
+		}
+	}
+	return m.emit(hi)
+}
+
+// insert rows into an empty table in ascending order of the primary key.
+// the indexes are built from externally sorted index keys.
+// returns the number of rows.
+func (db *DB) BulkInsert(table string, rows iter.Seq[Record], opts ...BulkOpts) (int, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	n, err := tx.BulkInsert(table, rows, opts...)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	return n, db.Commit(&tx)
+}
+
+func (tx *DBTX) BulkInsert(table string, rows iter.Seq[Record], opts ...BulkOpts) (int, error) {
+	fill, err := checkBulkOpts(opts)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.db.kv.checkWrite(); err != nil {
+		return 0, err
+	}
+	tdef := getTableDef(tx.db, table)
+	if tdef == nil {
+		return 0, fmt.Errorf("table not found: %s", table)
+	}
+	return dbBulkInsert(tx.db, tdef, rows, fill)
+}
+
+func dbBulkInsert(db *DB, tdef *TableDef, rows iter.Seq[Record], fill float64) (int, error) {
+	prefix := encodeKey(nil, tdef.Prefix, nil)
+	if it := db.kv.tree.Seek(prefix, CMP_GE); it.Valid() {
+		if key, _ := it.Deref(); bytes.HasPrefix(key, prefix) {
+			return 0, fmt.Errorf("bulk insert: the table is not empty: %s", tdef.Name)
+		}
+	}
+
+	b := bulkIndexes{
+		tdef:  tdef,
+		index: make([]extSorter, len(tdef.Indexes)),
+		text:  make([]extSorter, len(tdef.TextIndexes)),
+		docs:  make([]int64, len(tdef.TextIndexes)),
+		total: make([]int64, len(tdef.TextIndexes)),
+	}
+	defer b.discard()
+	// the old events are deleted before the merges
+	if st := changelogFor(db, tdef); st != nil {
+		if err := changelogBegin(db, st); err != nil {
+			return 0, err
+		}
+		b.db = db
+	}
+
+	// the auto-increment counter is updated once at the end
+	var last int64
+	if tdef.AutoIncrement {
+		var err error
+		if last, _, err = metaGetInt(db, META_AUTOINC+tdef.Name); err != nil {
+			return 0, err
+		}
+	}
+	counter := last
+
+	// the rows are merged first, their index keys are sorted meanwhile
+	n := 0
+	next, stop := iter.Pull(rows)
+	defer stop()
+	input := func() ([]byte, []byte, bool, error) {
+		rec, ok := next()
+		if !ok {
+			return nil, nil, false, nil
+		}
+		if tdef.AutoIncrement {
+			var err error
+			if rec, counter, err = bulkAutoIncrement(tdef, rec, counter); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		values, err := checkRecord(tdef, rec, tdef.PKeys)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if err := applyConstraints(tdef, values); err != nil {
+			return nil, nil, false, err
+		}
+		if err := fkCheckRow(db, tdef, values); err != nil {
+			return nil, nil, false, err
+		}
+		if err := b.add(values); err != nil {
+			return nil, nil, false, err
+		}
+		n++
+		key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+		return key, encodeValues(nil, values[tdef.PKeys:]), true, nil
+	}
+	if err := bulkMerge(&db.kv, fill, input); err != nil {
+		return 0, fmt.Errorf("bulk insert: %w", err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	// the index prefixes are after the table prefix and in order,
+	// the changelog prefix is the last
+	keys, err := b.keys()
+	if err != nil {
+		return 0, fmt.Errorf("bulk insert: %w", err)
+	}
+	knext, kstop := iter.Pull2(keys)
+	defer kstop()
+	kinput := func() ([]byte, []byte, bool, error) {
+		item, err, ok := knext()
+		if !ok || err != nil {
+			return nil, nil, false, err
+		}
+		return sortItemKey(item), sortItemPayload(item), true, nil
+	}
+	if err := bulkMerge(&db.kv, fill, kinput); err != nil {
+		return 0, fmt.Errorf("bulk insert: %w", err)
+	}
+
+	if counter > last {
+		if err := metaSetInt(db, META_AUTOINC+tdef.Name, counter); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// assign the primary key like autoIncrement() without touching `@meta`
+func bulkAutoIncrement(tdef *TableDef, rec Record, last int64) (Record, int64, error) {
+	col := tdef.Cols[0]
+	if v := rec.Get(col); v != nil {
+		if v.Type != TYPE_INT64 {
+			return rec, last, fmt.Errorf("auto-increment column %s must be int64", col)
+		}
+		return rec, max(last, v.I64), nil
+	}
+	if last == 1<<63-1 {
+		return rec, last, fmt.Errorf("auto-increment overflow: %s", tdef.Name)
+	}
+	out := Record{
+		Cols: append([]string{col}, rec.Cols...),
+		Vals: append([]Value{{Type: TYPE_INT64, I64: last + 1}}, rec.Vals...),
+	}
+	return out, last + 1, nil
+}
+
+// the index keys of the bulk inserted rows, sorted per index
+type bulkIndexes struct {
+	tdef  *TableDef
+	index []extSorter // secondary indexes
+	text  []extSorter // full-text indexes
+	// the full-text index stats
+	docs   []int64
+	total  []int64
+	sorted []sortedIter // the outputs of the sorts
+	// the changelog events, if the table has a changelog
+	db      *DB
+	changes extSorter
+}
+
+func (b *bulkIndexes) add(vals []Value) error {
+	tdef := b.tdef
+	for i := range tdef.Indexes {
+		key, err := indexKey(nil, tdef, i, vals)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue // not in the partial index
+		}
+		if err := b.index[i].add(sortItem(key, nil)); err != nil {
+			return err
+		}
+	}
+	for i := range tdef.TextIndexes {
+		// the same KVs as textIndexOp()
+		prefix := tdef.TextPrefixes[i]
+		pk := encodeValues(nil, vals[:tdef.PKeys])
+		terms, length := textTerms(tdef, &tdef.TextIndexes[i], vals)
+		doc := append(textDocPrefix(prefix), pk...)
+		if err := b.text[i].add(sortItem(doc, binary.AppendUvarint(nil, uint64(length)))); err != nil {
+			return err
+		}
+		for term, pos := range terms {
+			var val []byte
+			for j, p := range pos {
+				if j > 0 {
+					p -= pos[j-1]
+				}
+				val = binary.AppendUvarint(val, uint64(p))
+			}
+			key := append(textPostingPrefix(prefix, term), pk...)
+			if err := b.text[i].add(sortItem(key, val)); err != nil {
+				return err
+			}
+		}
+		b.docs[i]++
+		b.total[i] += int64(length)
+	}
+	if b.db != nil {
+		for _, kv := range changelogEvent(b.db, tdef, nil, vals) {
+			if err := b.changes.add(sortItem(kv[0], kv[1])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// all the sorted index keys in the order of the index prefixes
+func (b *bulkIndexes) keys() (iter.Seq2[[]byte, error], error) {
+	tdef := b.tdef
+	sorted := []sortedIter{}
+	for i := range b.index {
+		out, err := b.index[i].finish()
+		if err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, out)
+	}
+	for i := range b.text {
+		out, err := b.text[i].finish()
+		if err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, out)
+	}
+	if b.db != nil {
+		out, err := b.changes.finish()
+		if err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, out)
+	}
+	b.sorted = sorted
+
+	return func(yield func([]byte, error) bool) {
+		for i, out := range sorted {
+			var prev []byte
+			for {
+				item, ok, err := out.next()
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if !ok {
+					break
+				}
+				key := sortItemKey(item)
+				if i < len(tdef.Indexes) && bytes.Equal(key, prev) {
+					err := fmt.Errorf("duplicate key in index %v of table %s", tdef.Indexes[i], tdef.Name)
+					yield(nil, err)
+					return
+				}
+				prev = key
+				if !yield(item, nil) {
+					return
+				}
+			}
+			if i >= len(tdef.Indexes) && i < len(tdef.Indexes)+len(tdef.TextIndexes) {
+				// the stats key is after the doc and posting keys
+				j := i - len(tdef.Indexes)
+				stats := make([]byte, 16)
+				binary.LittleEndian.PutUint64(stats[0:], uint64(b.docs[j]))
+				binary.LittleEndian.PutUint64(stats[8:], uint64(b.total[j]))
+				if !yield(sortItem(textStatsKey(tdef.TextPrefixes[j]), stats), nil) {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+// release the temporary files of the sorts
+func (b *bulkIndexes) discard() {
+	for i := range b.index {
+		b.index[i].discard()
+	}
+	for i := range b.text {
+		b.text[i].discard()
+	}
+	b.changes.discard()
+	for _, out := range b.sorted {
+		out.close()
+	}
+}
@@ -0,0 +1,447 @@
+package relixdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// change data capture: the row changes are recorded under CHANGELOG_PREFIX
+// in the same transactions as the rows, so the log is durable and ordered
+// by the committed versions. an event is up to 3 KVs:
+// | prefix | version | seq | part |
+// |   4B   |   8B    | 8B  |  8B  |
+// part 0: | table | op | time | primary key |
+// part 1: the old row without the primary key, as stored in the table
+// part 2: the new row without the primary key
+// the internal tables are not recorded.
+
+const META_CHANGELOG = "changelog:opts" // the JSON of changelogState
+
+// the number of events read by a subscription at a time
+const CHANGELOG_BATCH = 100
+
+var (
+	// the events after the position of a subscription are deleted
+	ErrChangesTrimmed     = errors.New("the changes are trimmed from the changelog")
+	ErrSubscriptionClosed = errors.New("the subscription is closed")
+)
+
+// the retention of the changelog. older events are deleted by later commits.
+type ChangelogOpts struct {
+	MaxVersions uint64        // keep the events of the last N versions, 0: no limit
+	MaxAge      time.Duration // keep the events committed within the duration, 0: no limit
+}
+
+// the settings in `@meta`
+type changelogState struct {
+	ChangelogOpts
+	Trimmed uint64 // the events up to this version are not in the log
+}
+
+// a row change
+type ChangeEvent struct {
+	Version uint64 // the version committed by the transaction
+	Time    time.Time
+	Table   string
+	Op      int     // CHANGE_INSERT, CHANGE_UPDATE or CHANGE_DELETE
+	Key     Record  // the primary key
+	Old     *Record // the row before, nil for inserts
+	New     *Record // the row after, nil for deletes
+}
+
+// the changelog state of the current transaction
+type changelogCache struct {
+	state   *changelogState // nil: disabled
+	loaded  bool
+	version uint64 // the version of the transaction, 0: no events yet
+	seq     int64
+	time    int64
+	pending bool // the transaction has events
+	// notifies the subscriptions of commits
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced by commits with events
+}
+
+// start recording the row changes, or change the retention
+func (db *DB) EnableChangelog(opts ChangelogOpts) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	st := changelogLoad(db)
+	if st == nil {
+		// the changes before it are not recorded
+		st = &changelogState{Trimmed: db.kv.version}
+	}
+	st.ChangelogOpts = opts
+	if err := changelogStore(db, st); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+// stop recording and delete the events
+func (db *DB) DisableChangelog() error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if changelogLoad(db) == nil {
+		db.Abort(&tx)
+		return nil
+	}
+	db.kv.tree.DeleteRange(changelogKey(0, 0, 0), nil)
+	meta := (&Record{}).AddStr("key", []byte(META_CHANGELOG))
+	if _, err := dbDelete(db, TDEF_META, *meta); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	db.changelog.state, db.changelog.loaded = nil, true
+	return db.Commit(&tx)
+}
+
+func changelogKey(version uint64, seq int64, part int64) []byte {
+	return encodeKey(nil, CHANGELOG_PREFIX, []Value{
+		{Type: TYPE_INT64, I64: int64(version)},
+		{Type: TYPE_INT64, I64: seq},
+		{Type: TYPE_INT64, I64: part},
+	})
+}
+
+func changelogKeyDecode(key []byte) (version uint64, seq int64, part int64) {
+	vals := []Value{{Type: TYPE_INT64}, {Type: TYPE_INT64}, {Type: TYPE_INT64}}
+	decodeValues(key[4:], vals)
+	return uint64(vals[0].I64), vals[1].I64, vals[2].I64
+}
+
+// the settings, cached until the transaction ends
+func changelogLoad(db *DB) *changelogState {
+	if db.changelog.loaded {
+		return db.changelog.state
+	}
+	meta := (&Record{}).AddStr("key", []byte(META_CHANGELOG))
+	ok, err := dbGet(db, TDEF_META, meta)
+	Assert(err == nil, "unable to get the changelog settings")
+	db.changelog.state = nil
+	if ok {
+		st := &changelogState{}
+		err := json.Unmarshal(meta.Get("val").Str, st)
+		Assert(err == nil, "bad changelog settings")
+		db.changelog.state = st
+	}
+	db.changelog.loaded = true
+	return db.changelog.state
+}
+
+func changelogStore(db *DB, st *changelogState) error {
+	val, err := json.Marshal(st)
+	Assert(err == nil, "unable to marshal the changelog settings")
+	meta := (&Record{}).AddStr("key", []byte(META_CHANGELOG)).AddStr("val", val)
+	if _, err := dbUpdate(db, TDEF_META, *meta, MODE_UPSERT); err != nil {
+		return err
+	}
+	db.changelog.state, db.changelog.loaded = st, true
+	return nil
+}
+
+// the settings if the changes of the table are recorded
+func changelogFor(db *DB, tdef *TableDef) *changelogState {
+	if tdef.Name == "" || tdef.Name[0] == '@' {
+		return nil // internal
+	}
+	return changelogLoad(db)
+}
+
+// called before the first event of a transaction: delete the old events
+func changelogBegin(db *DB, st *changelogState) error {
+	c := &db.changelog
+	version := db.kv.version + 1
+	if c.version == version {
+		return nil
+	}
+	c.version, c.seq, c.time = version, 0, time.Now().UnixNano()
+
+	cut := st.Trimmed
+	if st.MaxVersions > 0 && version > st.MaxVersions {
+		cut = max(cut, version-st.MaxVersions)
+	}
+	if st.MaxAge > 0 {
+		// the events are in the order of their times
+		deadline := c.time - int64(st.MaxAge)
+		prefix := encodeKey(nil, CHANGELOG_PREFIX, nil)
+		for it := db.kv.tree.Seek(prefix, CMP_GE); it.Valid(); it.Next() {
+			key, val := it.Deref()
+			if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+			v, _, part := changelogKeyDecode(key)
+			if part != 0 {
+				continue
+			}
+			if hdr := changelogHeader(val); hdr[2].I64 >= deadline {
+				break
+			}
+			cut = max(cut, v)
+		}
+	}
+	if cut <= st.Trimmed {
+		return nil
+	}
+	db.kv.tree.DeleteRange(changelogKey(0, 0, 0), changelogKey(cut+1, 0, 0))
+	next := *st
+	next.Trimmed = cut
+	return changelogStore(db, &next)
+}
+
+// the KVs of an event. `old` or `new` is nil for inserts and deletes.
+func changelogEvent(db *DB, tdef *TableDef, old []Value, new []Value) [][2][]byte {
+	c := &db.changelog
+	op, pk := CHANGE_UPDATE, new
+	switch {
+	case old == nil:
+		op = CHANGE_INSERT
+	case new == nil:
+		op, pk = CHANGE_DELETE, old
+	}
+	hdr := encodeValues(nil, []Value{
+		{Type: TYPE_BYTES, Str: []byte(tdef.Name)},
+		{Type: TYPE_INT64, I64: int64(op)},
+		{Type: TYPE_INT64, I64: c.time},
+		{Type: TYPE_BYTES, Str: encodeValues(nil, pk[:tdef.PKeys])},
+	})
+	kvs := [][2][]byte{{changelogKey(c.version, c.seq, 0), hdr}}
+	if old != nil {
+		kvs = append(kvs, [2][]byte{changelogKey(c.version, c.seq, 1), encodeValues(nil, old[tdef.PKeys:])})
+	}
+	if new != nil {
+		kvs = append(kvs, [2][]byte{changelogKey(c.version, c.seq, 2), encodeValues(nil, new[tdef.PKeys:])})
+	}
+	c.seq++
+	c.pending = true
+	return kvs
+}
+
+// record a row change of the transaction
+func changelogAdd(db *DB, tdef *TableDef, old []Value, new []Value) error {
+	st := changelogFor(db, tdef)
+	if st == nil {
+		return nil
+	}
+	if err := changelogBegin(db, st); err != nil {
+		return err
+	}
+	for _, kv := range changelogEvent(db, tdef, old, new) {
+		db.kv.tree.Insert(kv[0], kv[1])
+	}
+	return nil
+}
+
+// | table | op | time | primary key |
+func changelogHeader(val []byte) []Value {
+	hdr := []Value{{Type: TYPE_BYTES}, {Type: TYPE_INT64}, {Type: TYPE_INT64}, {Type: TYPE_BYTES}}
+	decodeValues(val, hdr)
+	return hdr
+}
+
+// called by Commit and Abort. returns whether the transaction has events.
+func changelogEnd(db *DB, abort bool) bool {
+	c := &db.changelog
+	pending := c.pending
+	c.pending, c.version = false, 0
+	if abort {
+		c.state, c.loaded = nil, false
+	}
+	return pending
+}
+
+// wake up the subscriptions
+func changelogNotify(db *DB) {
+	c := &db.changelog
+	c.mu.Lock()
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+	c.mu.Unlock()
+}
+
+// closed by the next commit with events
+func changelogWait(db *DB) <-chan struct{} {
+	c := &db.changelog
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.changed
+}
+
+// tails the changelog from a version
+type Subscription struct {
+	db     *DB
+	next   uint64 // the next version to read
+	oldest bool   // from the oldest event, not checked against the trimmed version
+	buf    []ChangeEvent
+	tdefs  map[string]*TableDef
+	closed chan struct{}
+	once   sync.Once
+}
+
+// read the events of the versions at or after `fromVersion`, 0 for the
+// oldest event in the log. to resume, subscribe from the version after
+// the last processed event, the events of a version are read together.
+func (db *DB) Subscribe(fromVersion uint64) *Subscription {
+	return &Subscription{
+		db:     db,
+		next:   fromVersion,
+		oldest: fromVersion == 0,
+		tdefs:  map[string]*TableDef{},
+		closed: make(chan struct{}),
+	}
+}
+
+// the next event, blocks until there is one
+func (s *Subscription) Next() (ChangeEvent, error) {
+	for {
+		// taken before reading, so that no commit is missed
+		wait := changelogWait(s.db)
+		ev, ok, err := s.Poll()
+		if err != nil || ok {
+			return ev, err
+		}
+		select {
+		case <-wait:
+		case <-s.closed:
+			return ChangeEvent{}, ErrSubscriptionClosed
+		}
+	}
+}
+
+// the next event if there is one, doesn't block
+func (s *Subscription) Poll() (ChangeEvent, bool, error) {
+	select {
+	case <-s.closed:
+		return ChangeEvent{}, false, ErrSubscriptionClosed
+	default:
+	}
+	if len(s.buf) == 0 {
+		if err := s.fill(); err != nil {
+			return ChangeEvent{}, false, err
+		}
+	}
+	if len(s.buf) == 0 {
+		return ChangeEvent{}, false, nil
+	}
+	ev := s.buf[0]
+	s.buf = s.buf[1:]
+	return ev, true, nil
+}
+
+// unblock Next
+func (s *Subscription) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+// read the events of the next versions from a snapshot
+func (s *Subscription) fill() error {
+	tx := KVReader{}
+	s.db.kv.BeginRead(&tx)
+	defer s.db.kv.EndRead(&tx)
+
+	st, err := readerChangelogState(&tx)
+	if err != nil {
+		return err
+	}
+	if st != nil && !s.oldest && s.next <= st.Trimmed {
+		return ErrChangesTrimmed
+	}
+
+	prefix := encodeKey(nil, CHANGELOG_PREFIX, nil)
+	var tdef *TableDef
+	var pk []Value
+	for it := tx.Seek(changelogKey(s.next, 0, 0), CMP_GE); it.Valid(); it.Next() {
+		key, val := it.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		// the values are decoded in place, copy them out of the snapshot
+		val = append([]byte(nil), val...)
+		version, _, part := changelogKeyDecode(key)
+		if part != 0 {
+			row := Record{Cols: tdef.Cols, Vals: decodeRow(tdef, pk, val)}
+			if ev := &s.buf[len(s.buf)-1]; part == 1 {
+				ev.Old = &row
+			} else {
+				ev.New = &row
+			}
+			continue
+		}
+		// the events of a version are read together
+		if n := len(s.buf); n >= CHANGELOG_BATCH && s.buf[n-1].Version != version {
+			break
+		}
+
+		hdr := changelogHeader(val)
+		if tdef, err = s.tableDef(&tx, string(hdr[0].Str)); err != nil {
+			return err
+		}
+		pk = make([]Value, tdef.PKeys)
+		for i := range pk {
+			pk[i].Type = tdef.Types[i]
+		}
+		decodeValues(hdr[3].Str, pk)
+		s.buf = append(s.buf, ChangeEvent{
+			Version: version,
+			Time:    time.Unix(0, hdr[2].I64),
+			Table:   tdef.Name,
+			Op:      int(hdr[1].I64),
+			Key:     Record{Cols: tdef.Cols[:tdef.PKeys], Vals: pk},
+		})
+	}
+	if n := len(s.buf); n > 0 {
+		s.next = s.buf[n-1].Version + 1
+		s.oldest = false
+	}
+	return nil
+}
+
+// the table definition in the snapshot, tables are never changed
+func (s *Subscription) tableDef(tx *KVReader, name string) (*TableDef, error) {
+	if tdef := s.tdefs[name]; tdef != nil {
+		return tdef, nil
+	}
+	val, ok := readerGet(tx, TDEF_TABLE, name)
+	if !ok {
+		return nil, fmt.Errorf("changelog: table not found: %s", name)
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(val, tdef); err != nil {
+		return nil, fmt.Errorf("changelog: bad table definition: %s", name)
+	}
+	s.tdefs[name] = tdef
+	return tdef, nil
+}
+
+func readerChangelogState(tx *KVReader) (*changelogState, error) {
+	val, ok := readerGet(tx, TDEF_META, META_CHANGELOG)
+	if !ok {
+		return nil, nil
+	}
+	st := &changelogState{}
+	if err := json.Unmarshal(val, st); err != nil {
+		return nil, fmt.Errorf("changelog: bad settings")
+	}
+	return st, nil
+}
+
+// the value column of the internal tables in a snapshot
+func readerGet(tx *KVReader, tdef *TableDef, key string) ([]byte, bool) {
+	val, ok := tx.Get(encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_BYTES, Str: []byte(key)}}))
+	if !ok {
+		return nil, false
+	}
+	out := []Value{{Type: TYPE_BYTES}}
+	decodeValues(val, out)
+	return append([]byte(nil), out[0].Str...), true
+}
@@ -0,0 +1,399 @@
+package relixdb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// compaction: the free pages are not returned to the OS, and the nodes
+// can be underfull after deletes. a compacted file only has the live pages.
+
+// rewrite the current version into a new file at `dst` with full leaves.
+// the file must be empty or not exist. writers are not blocked.
+// the named snapshots and the history are not copied, the TTLs are.
+func (db *KV) Compact(dst string) error {
+	tx := KVReader{}
+	db.BeginRead(&tx)
+	defer db.EndRead(&tx)
+
+	out := KV{Path: dst}
+	if err := out.Open(Options{PageSize: tx.tree.pageSize()}); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	defer out.Close()
+	if out.mmap.file != 0 {
+		return fmt.Errorf("compact: the file is not empty")
+	}
+
+	b := bulkBuilder{db: &out, next: 1}
+	if tx.tree.root != 0 {
+		err := walkLeaves(&tx.tree, tx.tree.root, func(key []byte, val []byte) error {
+			return b.add(0, key, val, 0)
+		})
+		if err != nil {
+			return fmt.Errorf("compact: %w", err)
+		}
+	}
+	root, err := b.finish()
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	// the TTL tree after it
+	ttl := bulkBuilder{db: &out, next: b.next}
+	if tx.ttl.root != 0 {
+		err := walkLeaves(&tx.ttl, tx.ttl.root, func(key []byte, val []byte) error {
+			return ttl.add(0, key, val, 0)
+		})
+		if err != nil {
+			return fmt.Errorf("compact: %w", err)
+		}
+	}
+	if out.ttl.root, err = ttl.finish(); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := adoptPages(&out, root, ttl.next, tx.version, nil); err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	return nil
+}
+
+// call `fn` with the KVs of the subtree in order, including the dummy key
+func walkLeaves(tree *BTree, ptr uint64, fn func(key []byte, val []byte) error) error {
+	node := tree.get(ptr)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		var err error
+		if node.btype() == BNODE_LEAF {
+			err = fn(node.getKey(i), node.getVal(i))
+		} else {
+			err = walkLeaves(tree, node.getPtr(i), fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// builds a B-tree bottom-up from sorted KVs, the nodes are filled
+// up to the page size and written to consecutive pages.
+type bulkBuilder struct {
+	db     *KV
+	next   uint64  // the next page
+	fill   float64 // the fraction of the page to fill, 0: full
+	levels []bulkLevel
+}
+
+// the node being filled at a level, 0 is the leaf level
+type bulkLevel struct {
+	keys  [][]byte
+	vals  [][]byte
+	ptrs  []uint64
+	size  int // the node size
+	nodes int // the number of nodes written
+}
+
+func (b *bulkBuilder) add(level int, key []byte, val []byte, ptr uint64) error {
+	for level >= len(b.levels) {
+		b.levels = append(b.levels, bulkLevel{size: HEADER})
+	}
+	l := &b.levels[level]
+	size := 8 + 2 + 4 + len(key) + len(val)
+	if len(l.keys) > 0 && l.size+size > b.limit() {
+		if err := b.flush(level); err != nil {
+			return err
+		}
+		l = &b.levels[level]
+	}
+	l.keys = append(l.keys, append([]byte(nil), key...))
+	l.vals = append(l.vals, append([]byte(nil), val...))
+	l.ptrs = append(l.ptrs, ptr)
+	l.size += size
+	return nil
+}
+
+// the node size limit
+func (b *bulkBuilder) limit() int {
+	psize := b.db.tree.pageSize()
+	if b.fill == 0 {
+		return psize
+	}
+	return max(HEADER, int(b.fill*float64(psize)))
+}
+
+// write the nodes below `level` and add the subtree at `ptr` to it.
+// the subtree has `level` levels, its first key is `key`.
+func (b *bulkBuilder) addTree(level int, key []byte, ptr uint64) error {
+	for i := 0; i < level && i < len(b.levels); i++ {
+		if len(b.levels[i].keys) > 0 {
+			if err := b.flush(i); err != nil {
+				return err
+			}
+		}
+	}
+	return b.add(level, key, nil, ptr)
+}
+
+// write the node of a level and add it to the upper level
+func (b *bulkBuilder) flush(level int) error {
+	ptr, err := b.write(level)
+	if err != nil {
+		return err
+	}
+	l := &b.levels[level]
+	first := l.keys[0]
+	l.keys, l.vals, l.ptrs = nil, nil, nil
+	l.size = HEADER
+	l.nodes++
+	return b.add(level+1, first, nil, ptr)
+}
+
+func (b *bulkBuilder) write(level int) (uint64, error) {
+	l := &b.levels[level]
+	btype := uint16(BNODE_NODE)
+	if level == 0 {
+		btype = BNODE_LEAF
+	}
+	node := BNode{data: make([]byte, b.db.tree.pageSize())}
+	node.setHeader(btype, uint16(len(l.keys)))
+	for i := range l.keys {
+		nodeAppendKV(node, uint16(i), l.ptrs[i], l.keys[i], l.vals[i])
+	}
+
+	ptr := b.next
+	b.next++
+	if _, err := b.db.fp.WriteAt(node.data, int64(ptr)*int64(len(node.data))); err != nil {
+		return 0, err
+	}
+	return ptr, nil
+}
+
+// write the remaining nodes, returns the root
+func (b *bulkBuilder) finish() (uint64, error) {
+	for level := 0; level < len(b.levels); level++ {
+		l := &b.levels[level]
+		if level+1 == len(b.levels) && l.nodes == 0 {
+			// the top level
+			if level > 0 && len(l.keys) == 1 {
+				return l.ptrs[0], nil
+			}
+			return b.write(level)
+		}
+		if len(l.keys) > 0 {
+			if err := b.flush(level); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return 0, nil // empty
+}
+
+// compact the file in place: move the pages at the end of the file into
+// the free pages, then truncate the file. each step is committed by
+// the master page. the readers can start meanwhile, each round waits for
+// the readers of the older versions, whose pages it could overwrite.
+func (db *KV) CompactInPlace() error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	busy := len(db.readers) > 0
+	db.mu.Unlock()
+	if busy {
+		return fmt.Errorf("compact: there are active readers")
+	}
+	if len(db.snaps.items) > 0 {
+		return fmt.Errorf("compact: there are snapshots")
+	}
+	if db.hist.root != 0 {
+		return fmt.Errorf("compact: the history is enabled")
+	}
+	if db.mmap.file == 0 {
+		return nil // empty
+	}
+
+	// drop the free list, all the pages that are not in the tree are free.
+	// this must be committed before the free pages are overwritten.
+	db.free.FreeListData = FreeListData{}
+	if err := compactCommit(db, nil); err != nil {
+		return err
+	}
+
+	var target uint64
+	for {
+		// the readers started meanwhile read the last committed trees,
+		// which are not overwritten by this round. the older ones end first.
+		db.mu.Lock()
+		for len(db.readers) > 0 && db.readers[0].version < db.version {
+			db.readerExit.Wait()
+		}
+		db.mu.Unlock()
+
+		// the live pages and their depths
+		// of the data tree and the TTL tree
+		roots := []*uint64{&db.tree.root, &db.ttl.root}
+		live := map[uint64]int{}
+		for _, root := range roots {
+			if *root != 0 {
+				compactWalk(db, *root, 0, live)
+			}
+		}
+		// the trees will fit in the pages below `target`
+		target = uint64(1 + len(live))
+		moves := compactMoves(db, roots, live, target)
+		if len(moves) == 0 {
+			break
+		}
+
+		// copy the moved pages and their ancestors to the new places.
+		// the old pages are not touched, the master page switches to them.
+		relocated := []uint64{}
+		for _, root := range roots {
+			ptr, err := compactRelocate(db, *root, moves)
+			if err != nil {
+				return err
+			}
+			relocated = append(relocated, ptr)
+		}
+		if err := db.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+		for i, root := range roots {
+			*root = relocated[i]
+		}
+		moved := []uint64{}
+		for _, dst := range moves {
+			moved = append(moved, dst)
+		}
+		if err := compactCommit(db, moved); err != nil {
+			return err
+		}
+	}
+
+	// the pages after the tree are free now
+	db.page.flushed = target
+	if err := compactCommit(db, nil); err != nil {
+		return err
+	}
+	size := int(target) * db.tree.pageSize()
+	if err := db.fp.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	db.mmap.file = size
+	return nil
+}
+
+func compactWalk(db *KV, ptr uint64, depth int, live map[uint64]int) {
+	live[ptr] = depth
+	node := db.tree.get(ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			compactWalk(db, node.getPtr(i), depth+1, live)
+		}
+	}
+}
+
+// assign new places to the pages after `target` and their ancestors.
+// the deepest pages are moved below `target` first, the rest are moved
+// after it and will be moved again in the next round.
+func compactMoves(db *KV, roots []*uint64, live map[uint64]int, target uint64) map[uint64]uint64 {
+	// the pages to be copied
+	copied := map[uint64]bool{}
+	var mark func(ptr uint64) bool
+	mark = func(ptr uint64) bool {
+		node := db.tree.get(ptr)
+		dirty := ptr >= target
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				dirty = mark(node.getPtr(i)) || dirty
+			}
+		}
+		if dirty {
+			copied[ptr] = true
+		}
+		return dirty
+	}
+	dirty := false
+	for _, root := range roots {
+		if *root != 0 && mark(*root) {
+			dirty = true
+		}
+	}
+	if !dirty {
+		return nil
+	}
+	order := []uint64{}
+	for ptr := range copied {
+		order = append(order, ptr)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if live[order[i]] != live[order[j]] {
+			return live[order[i]] > live[order[j]]
+		}
+		return order[i] < order[j]
+	})
+
+	// the free pages below and after `target`, then new pages
+	free := []uint64{}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if _, ok := live[ptr]; !ok {
+			free = append(free, ptr)
+		}
+	}
+	moves := map[uint64]uint64{}
+	for _, ptr := range order {
+		if len(free) > 0 {
+			moves[ptr], free = free[0], free[1:]
+		} else {
+			moves[ptr] = db.page.flushed
+			db.page.flushed++
+		}
+	}
+	return moves
+}
+
+// copy the pages in `moves` to their new places, returns the new pointer
+func compactRelocate(db *KV, ptr uint64, moves map[uint64]uint64) (uint64, error) {
+	dst, ok := moves[ptr]
+	if !ok {
+		return ptr, nil
+	}
+	node := BNode{data: append([]byte(nil), db.tree.get(ptr).data...)}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid, err := compactRelocate(db, node.getPtr(i), moves)
+			if err != nil {
+				return 0, err
+			}
+			node.setPtr(i, kid)
+		}
+	}
+
+	if err := extendFile(db, int(dst)+1); err != nil {
+		return 0, err
+	}
+	if err := extendMmap(db, int(dst)+1); err != nil {
+		return 0, err
+	}
+	copy(pageGetMapped(db, dst).data, node.data)
+	return dst, nil
+}
+
+// write the master page. the caller holds the writer lock.
+// `written` are the pages written since the last commit.
+func compactCommit(db *KV, written []uint64) error {
+	db.mu.Lock()
+	db.version++
+	db.root = db.tree.root
+	db.ttlRoot = db.ttl.root
+	db.mu.Unlock()
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	replPublish(db, written)
+	return nil
+}
@@ -7,12 +7,27 @@ const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
+// the largest page size, the node offsets of a page are 16-bit
+const BTREE_PAGE_SIZE_MAX = 64 << 10
+
+// the default initial mmap size
+const MMAP_INIT_SIZE = 64 << 20
+
+// the number of parsed expressions kept for reuse
+const EXPR_CACHE_MAX = 1024
+
 const TABLE_PREFIX_MIN = 1
 
+// the key prefix of the changelog, it's never allocated to tables
+const CHANGELOG_PREFIX = 0xffffffff
+
 const BNODE_FREE_LIST = 3
 const FREE_LIST_HEADER = 4 + 8 + 8
 const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
+// the page of the snapshot list
+const BNODE_SNAPSHOTS = 4
+
 const (
 	BNODE_NODE = 1 // internal nodes without values
 	BNODE_LEAF = 2 // leaf nodes with values
@@ -22,6 +37,7 @@ const (
 	TYPE_ERROR = 0
 	TYPE_BYTES = 1
 	TYPE_INT64 = 2
+	TYPE_JSON  = 3 // a JSON document, stored as bytes
 )
 
 // modes of the updates
@@ -29,6 +45,7 @@ const (
 	MODE_UPSERT      = 0 // insert or replace
 	MODE_UPDATE_ONLY = 1 // update existing keys
 	MODE_INSERT_ONLY = 2 // only add new keys
+	MODE_UPDATE_IF   = 3 // update existing keys whose value equals `Expect`
 )
 
 const (
@@ -38,7 +55,45 @@ const (
 	CMP_LE = -3 // <=
 )
 
+// durability of the writes
+const (
+	SYNC_ON  = 0 // fsync before and after updating the master page
+	SYNC_OFF = 1 // fsync only before it, atomic but the latest may be lost on a crash
+)
+
+// foreign key actions on parent deletes
+const (
+	FK_RESTRICT = 0 // reject the delete
+	FK_CASCADE  = 1 // delete the child rows
+	FK_SET_NULL = 2 // set the child columns to zero values
+)
+
+// tokenizers of full-text indexes
+const (
+	TOKEN_WORDS = 0 // runs of letters and digits
+	TOKEN_SPACE = 1 // split on white space
+)
+
 const (
 	INDEX_ADD = 1
 	INDEX_DEL = 2
 )
+
+// the operations of change events
+const (
+	CHANGE_INSERT = 1
+	CHANGE_UPDATE = 2
+	CHANGE_DELETE = 3
+)
+
+// formats of table imports and exports
+const (
+	FORMAT_CSV   = 0 // a header of column names, then a line per row
+	FORMAT_JSONL = 1 // a JSON object per line
+)
+
+// handling of bad rows in imports
+const (
+	IMPORT_ABORT = 0 // stop at the first bad row, the committed batches are kept
+	IMPORT_SKIP  = 1 // skip bad rows and continue
+)
@@ -0,0 +1,151 @@
+package relixdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// a simple CHECK constraint on a column.
+// unset fields are not checked.
+type Check struct {
+	Min    *int64  // int64: the inclusive lower bound
+	Max    *int64  // int64: the inclusive upper bound
+	MinLen int     // bytes: the minimal length
+	MaxLen int     // bytes: the maximal length; 0: no limit
+	Enum   []Value // the allowed values
+}
+
+// verify the column constraints of a table definition
+func checkConstraintDefs(tdef *TableDef) error {
+	n := len(tdef.Cols)
+	if len(tdef.Defaults) != 0 && len(tdef.Defaults) != n {
+		return fmt.Errorf("number of defaults does not match number of columns")
+	}
+	if len(tdef.NotNull) != 0 && len(tdef.NotNull) != n {
+		return fmt.Errorf("number of NOT NULL flags does not match number of columns")
+	}
+	if len(tdef.Checks) != 0 && len(tdef.Checks) != n {
+		return fmt.Errorf("number of checks does not match number of columns")
+	}
+
+	for i, col := range tdef.Cols {
+		if chk := colCheck(tdef, i); chk != nil {
+			if err := checkCheckDef(tdef.Types[i], chk); err != nil {
+				return fmt.Errorf("column %s: %w", col, err)
+			}
+		}
+		def := colDefault(tdef, i)
+		if def == nil {
+			continue
+		}
+		if i < tdef.PKeys {
+			return fmt.Errorf("column %s: primary key columns can't have defaults", col)
+		}
+		if def.Type != tdef.Types[i] {
+			return fmt.Errorf("column %s: the default value has the wrong type", col)
+		}
+		if err := checkValue(tdef, i, *def); err != nil {
+			return fmt.Errorf("the default value violates %w", err)
+		}
+	}
+	return nil
+}
+
+func checkCheckDef(typ uint32, chk *Check) error {
+	if typ != TYPE_INT64 && (chk.Min != nil || chk.Max != nil) {
+		return fmt.Errorf("CHECK range requires an int64 column")
+	}
+	if typ != TYPE_BYTES && (chk.MinLen != 0 || chk.MaxLen != 0) {
+		return fmt.Errorf("CHECK length requires a bytes column")
+	}
+	if chk.Min != nil && chk.Max != nil && *chk.Min > *chk.Max {
+		return fmt.Errorf("CHECK range is empty")
+	}
+	if chk.MinLen < 0 || chk.MaxLen < 0 || (chk.MaxLen > 0 && chk.MinLen > chk.MaxLen) {
+		return fmt.Errorf("bad CHECK length")
+	}
+	for _, v := range chk.Enum {
+		if v.Type != typ {
+			return fmt.Errorf("CHECK enum value has the wrong type")
+		}
+	}
+	return nil
+}
+
+func colDefault(tdef *TableDef, i int) *Value {
+	if len(tdef.Defaults) == 0 {
+		return nil
+	}
+	return tdef.Defaults[i]
+}
+
+func colNotNull(tdef *TableDef, i int) bool {
+	return len(tdef.NotNull) != 0 && tdef.NotNull[i]
+}
+
+func colCheck(tdef *TableDef, i int) *Check {
+	if len(tdef.Checks) == 0 {
+		return nil
+	}
+	return tdef.Checks[i]
+}
+
+// fill the omitted columns with their defaults or the zero values,
+// then verify the constraints of every column. the omitted columns of
+// an existing row are filled by mergeStoredRow before.
+func applyConstraints(tdef *TableDef, values []Value) error {
+	for i, col := range tdef.Cols {
+		v := &values[i]
+		if v.Type == TYPE_ERROR {
+			// the column is omitted
+			if def := colDefault(tdef, i); def != nil {
+				*v = *def
+			} else if colNotNull(tdef, i) {
+				return fmt.Errorf("column %s: NOT NULL violated", col)
+			} else {
+				*v = Value{Type: tdef.Types[i]}
+			}
+		}
+		if v.Type != tdef.Types[i] {
+			return fmt.Errorf("column %s: type mismatch", col)
+		}
+		if v.Type == TYPE_JSON && !json.Valid(v.Str) {
+			return fmt.Errorf("column %s: invalid JSON", col)
+		}
+		if err := checkValue(tdef, i, *v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify the CHECK constraint of a column
+func checkValue(tdef *TableDef, i int, v Value) error {
+	chk := colCheck(tdef, i)
+	if chk == nil {
+		return nil
+	}
+	col := tdef.Cols[i]
+	if chk.Min != nil && v.I64 < *chk.Min {
+		return fmt.Errorf("column %s: CHECK >= %d violated", col, *chk.Min)
+	}
+	if chk.Max != nil && v.I64 > *chk.Max {
+		return fmt.Errorf("column %s: CHECK <= %d violated", col, *chk.Max)
+	}
+	if v.Type == TYPE_BYTES && len(v.Str) < chk.MinLen {
+		return fmt.Errorf("column %s: CHECK length >= %d violated", col, chk.MinLen)
+	}
+	if chk.MaxLen > 0 && len(v.Str) > chk.MaxLen {
+		return fmt.Errorf("column %s: CHECK length <= %d violated", col, chk.MaxLen)
+	}
+	if len(chk.Enum) > 0 {
+		for _, e := range chk.Enum {
+			if e.I64 == v.I64 && bytes.Equal(e.Str, v.Str) {
+				return nil
+			}
+		}
+		return fmt.Errorf("column %s: CHECK IN violated", col)
+	}
+	return nil
+}
@@ -9,8 +9,11 @@ import (
 type DB struct {
 	Path string
 	// internals
-	kv     KV
-	tables map[string]*TableDef // cached table defination
+	kv        KV
+	tables    map[string]*TableDef // cached table defination
+	changelog changelogCache       // for recording the changes of transactions
+	endRead   func()               // ends the KV reader of an AS OF view
+	asOf      bool                 // an AS OF view, the rows are copied out of the pages
 }
 
 func (db *DB) NewDB(path string) *DB {
@@ -21,9 +24,9 @@ func (db *DB) NewDB(path string) *DB {
 	}
 }
 
-func (db *DB) Open() error {
-	if err := db.kv.Open(); err != nil {
-		return fmt.Errorf("failed to open db: %v", err)
+func (db *DB) Open(opts ...Options) error {
+	if err := db.kv.Open(opts...); err != nil {
+		return fmt.Errorf("failed to open db: %w", err)
 	}
 	return nil
 }
@@ -40,9 +43,24 @@ type TableDef struct {
 	Cols    []string // column names
 	PKeys   int      // the first `PKeys` columns are the primary key
 	Indexes [][]string
+	// WHERE predicates of partial indexes, either empty or one for each
+	// index; "": all rows are indexed.
+	IndexWhere []string
+	// the int64 primary key is assigned from a counter when omitted
+	AutoIncrement bool
+	// per-column constraints, either empty or one for each column.
+	// omitted columns take the default, or the zero value if not NOT NULL.
+	Defaults []*Value
+	NotNull  []bool
+	Checks   []*Check
+	// references to the primary keys of other tables
+	ForeignKeys []ForeignKey
+	// full-text indexes
+	TextIndexes []TextIndex
 	// auto-assigned B-tree key prefixes for different tables
 	Prefix        uint32
 	IndexPrefixes []uint32
+	TextPrefixes  []uint32
 }
 
 // internal table : metadata
@@ -131,6 +149,16 @@ func getTableDefDB(db *DB, name string) *TableDef {
 
 // Create new table
 func (db *DB) TableNew(tdef *TableDef) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	if err := tx.TableNew(tdef); err != nil {
+		db.Abort(&tx)
+		return err
+	}
+	return db.Commit(&tx)
+}
+
+func dbTableNew(db *DB, tdef *TableDef) error {
 	if err := tableDefCheck(tdef); err != nil {
 		return err
 	}
@@ -141,6 +169,9 @@ func (db *DB) TableNew(tdef *TableDef) error {
 	if ok {
 		return fmt.Errorf("table exists: %s", tdef.Name)
 	}
+	if err := checkForeignKeys(db, tdef); err != nil {
+		return err
+	}
 
 	// allocate a new prefix
 	Assert(tdef.Prefix == 0, "error in tdef prefix")
@@ -159,8 +190,16 @@ func (db *DB) TableNew(tdef *TableDef) error {
 		tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix)
 	}
 
+	for i := range tdef.TextIndexes {
+		prefix := tdef.Prefix + 1 + uint32(len(tdef.Indexes)+i)
+		tdef.TextPrefixes = append(tdef.TextPrefixes, prefix)
+	}
+
 	// update the next prefix
-	ntree := 1 + uint32(len(tdef.Indexes))
+	ntree := 1 + uint32(len(tdef.Indexes)+len(tdef.TextIndexes))
+	if uint64(tdef.Prefix)+uint64(ntree) > CHANGELOG_PREFIX {
+		return fmt.Errorf("out of key prefixes")
+	}
 	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+ntree)
 	_, err = dbUpdate(db, TDEF_META, *meta, 0)
 	if err != nil {
@@ -171,8 +210,10 @@ func (db *DB) TableNew(tdef *TableDef) error {
 	val, err := json.Marshal(tdef)
 	Assert(err == nil, "unable to marshall tdef")
 	table.AddStr("def", val)
-	_, err = dbUpdate(db, TDEF_TABLE, *table, 0)
-	return err
+	if _, err = dbUpdate(db, TDEF_TABLE, *table, 0); err != nil {
+		return err
+	}
+	return fkAddChild(db, tdef)
 }
 
 func tableDefCheck(tdef *TableDef) error {
@@ -195,6 +236,20 @@ func tableDefCheck(tdef *TableDef) error {
 		}
 	}
 
+	if tdef.AutoIncrement && (tdef.PKeys != 1 || tdef.Types[0] != TYPE_INT64) {
+		return fmt.Errorf("auto-increment requires a single int64 primary key")
+	}
+
+	if err := checkConstraintDefs(tdef); err != nil {
+		return err
+	}
+	if err := checkTextIndexes(tdef); err != nil {
+		return err
+	}
+	if err := checkIndexWhere(tdef); err != nil {
+		return err
+	}
+
 	// verify the indexes
 	for i, index := range tdef.Indexes {
 		index, err := checkIndexKeys(tdef, index)
@@ -0,0 +1,80 @@
+package relixdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// a version in the history window: by the version number,
+// or the version that was the latest at a time.
+type AsOf struct {
+	Version uint64
+	Time    time.Time // used if Version is 0
+}
+
+// keep the past versions for AS OF queries, see KV.EnableHistory
+func (db *DB) EnableHistory(opts HistoryOpts) error {
+	return db.kv.EnableHistory(opts)
+}
+
+func (db *DB) DisableHistory() error {
+	return db.kv.DisableHistory()
+}
+
+// the latest committed version
+func (db *DB) Version() uint64 {
+	return db.kv.Version()
+}
+
+// scan a table as of a past version, with the table definition of the version.
+// the version is read by a KV reader, which keeps its pages until the scanner
+// reaches the end or is closed by Scanner.Close. the rows are copied out
+// of the pages, they stay valid after that.
+func (db *DB) ScanAsOf(table string, at AsOf, req *Scanner) error {
+	view, err := dbAsOf(db, at)
+	if err != nil {
+		return err
+	}
+	if err := view.Scan(table, req); err != nil {
+		view.asOfEnd()
+		return err
+	}
+	if !req.Valid() {
+		view.asOfEnd() // empty
+	}
+	return nil
+}
+
+// a read-only view of the database at a version in the history window.
+// it's read by a KV reader, ended by asOfEnd().
+func dbAsOf(db *DB, at AsOf) (*DB, error) {
+	version := at.Version
+	if version == 0 {
+		if at.Time.IsZero() {
+			return nil, fmt.Errorf("AS OF: no version or time")
+		}
+		v, err := db.kv.VersionAt(at.Time)
+		if err != nil {
+			return nil, fmt.Errorf("AS OF: %w", err)
+		}
+		version = v
+	}
+
+	tx := &KVReader{}
+	if err := db.kv.BeginReadAsOf(tx, version); err != nil {
+		return nil, fmt.Errorf("AS OF: %w", err)
+	}
+	view := &DB{Path: db.Path, tables: map[string]*TableDef{}, asOf: true}
+	view.kv.opts.ReadOnly = true
+	view.kv.tree = tx.tree
+	view.endRead = func() { db.kv.EndRead(tx) }
+	return view, nil
+}
+
+// end the reader of an AS OF view, once
+func (db *DB) asOfEnd() {
+	if db.endRead != nil {
+		db.endRead()
+		db.endRead = nil
+	}
+}
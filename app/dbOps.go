@@ -2,7 +2,7 @@ package relixdb
 
 import (
 	"bytes"
-	"fmt"
+	"slices"
 )
 
 type InsertReq struct {
@@ -11,19 +11,24 @@ type InsertReq struct {
 	Added   bool   // added a new key
 	Updated bool   // added a new key or an old key was changed
 	Old     []byte // the value before the update
+	Found   bool   // the key existed before the update
 	// in
-	Key  []byte
-	Val  []byte
-	Mode int
+	Key    []byte
+	Val    []byte
+	Mode   int
+	Expect []byte // the expected old value for MODE_UPDATE_IF
 }
 
 // add a record
 func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	tx := DBTX{}
+	db.Begin(&tx)
+	added, err := tx.Set(table, rec, mode)
+	if err != nil {
+		db.Abort(&tx)
+		return false, err
 	}
-	return dbUpdate(db, tdef, rec, mode)
+	return added, db.Commit(&tx)
 }
 
 func (db *DB) Insert(table string, rec Record) (bool, error) {
@@ -38,85 +43,180 @@ func (db *DB) Upsert(table string, rec Record) (bool, error) {
 	return db.Set(table, rec, MODE_UPSERT)
 }
 
+// insert or update a key according to `req.Mode`.
+// the previous value is returned in `req.Old`.
 func (db *KV) Update(req *InsertReq) (bool, error) {
-	req.tree = &db.tree
-	db.InsertEx(req)
-	return req.Added, nil
+	if err := db.checkWrite(); err != nil {
+		return false, err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	if err := ttlUpdate(db, req); err != nil {
+		return false, err
+	}
+	return req.Added, flushPages(db, saved, db.opts.Sync)
 }
 
 func (db *DB) Delete(table string, rec Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	tx := DBTX{}
+	db.Begin(&tx)
+	deleted, err := tx.Delete(table, rec)
+	if err != nil {
+		db.Abort(&tx)
+		return false, err
 	}
-	return dbDelete(db, tdef, rec)
+	return deleted, db.Commit(&tx)
 }
 
-func (db *KV) InsertEx(req *InsertReq) {
-	// Retrieve the current value associated with the key, if any
-	_, found := db.Get(req.Key)
+// insert or update a key according to the mode of the request.
+// the previous value is returned in `req.Old`.
+func (tree *BTree) InsertEx(req *InsertReq) error {
+	if err := tree.checkKV(req.Key, req.Val); err != nil {
+		return err
+	}
+	req.tree = tree
+	req.Added, req.Updated = false, false
+
+	// the current value, copied since the page will be freed by the update
+	old, found := tree.Get(req.Key)
+	req.Old, req.Found = nil, found
+	if found {
+		req.Old = append([]byte{}, old...)
+	}
 
 	switch req.Mode {
 	case MODE_UPSERT:
-		if found {
-			// Replace the existing value
-			db.Set(req.Key, req.Val)
-			// tree.Set(req.Key, req.Val)return db.Set(table, rec, MODE_INSERT_ONLY)
-			req.Added = false // no new key was added
-			req.Updated = true
-		} else {
-			// Insert the new key-value pair
-			db.Set(req.Key, req.Val)
-			req.Added = true // a new key was added
-			req.Updated = true
-		}
 	case MODE_UPDATE_ONLY:
-		if found {
-			// Update the existing value
-			db.Set(req.Key, req.Val)
-			req.Added = false
-			req.Updated = true
-		} else {
-			req.Added = false // no key was added
-			req.Updated = true
+		if !found {
+			return nil // no key was added
 		}
 	case MODE_INSERT_ONLY:
-		if !found {
-			// Insert the new key-value pair
-			db.Set(req.Key, req.Val)
-			req.Added = true
-			req.Updated = true
-		} else {
-			req.Added = false // no key was added
-			req.Updated = true
+		if found {
+			return nil // no key was added
+		}
+	case MODE_UPDATE_IF:
+		if !found || !bytes.Equal(req.Old, req.Expect) {
+			return nil // the value was changed by someone else
 		}
 	default:
 		panic("unsupported mode")
 	}
+
+	if found && bytes.Equal(req.Old, req.Val) {
+		return nil // nothing to change
+	}
+	tree.Insert(req.Key, req.Val)
+	req.Added = !found
+	req.Updated = true
+	return nil
+}
+
+// set the key to `val` only if it exists and its current value equals
+// `expected`. nil and empty are the same value, see InsertIfAbsent for
+// a key that must not exist.
+func (db *KV) CompareAndSwap(key []byte, expected []byte, val []byte) (bool, error) {
+	req := InsertReq{Key: key, Val: val, Mode: MODE_UPDATE_IF, Expect: expected}
+	if _, err := db.Update(&req); err != nil {
+		return false, err
+	}
+	return req.Found && bytes.Equal(req.Old, expected), nil
+}
+
+// set the key to `val` only if it doesn't exist
+func (db *KV) InsertIfAbsent(key []byte, val []byte) (bool, error) {
+	req := InsertReq{Key: key, Val: val, Mode: MODE_INSERT_ONLY}
+	if _, err := db.Update(&req); err != nil {
+		return false, err
+	}
+	return !req.Found, nil
 }
 
 // add a row to the table
 func dbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
-	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
+	omitted := slices.ContainsFunc(values, func(v Value) bool { return v.Type == TYPE_ERROR })
+	if mode != MODE_INSERT_ONLY && omitted {
+		// the defaults are only for new rows
+		found := mergeStoredRow(db, tdef, values)
+		if !found && mode == MODE_UPDATE_ONLY {
+			return false, nil
+		}
+	}
+	if err := applyConstraints(tdef, values); err != nil {
+		return false, err
+	}
+	if err := fkCheckRow(db, tdef, values); err != nil {
+		return false, err
+	}
+	if err := indexCheck(db, tdef, values); err != nil {
+		return false, err
+	}
+	return dbUpdateValues(db, tdef, values, mode)
+}
+
+// add a row of checked values in the column order, and its index keys
+func dbUpdateValues(db *DB, tdef *TableDef, values []Value, mode int) (bool, error) {
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
 	val := encodeValues(nil, values[tdef.PKeys:])
 	req := InsertReq{Key: key, Val: val, Mode: mode}
-	added, err := db.kv.Update(&req)
-	if err != nil || !req.Updated || len(tdef.Indexes) == 0 {
-		return added, err
+	if err := db.kv.tree.InsertEx(&req); err != nil {
+		return false, err
+	}
+	if !req.Updated {
+		return req.Added, nil
+	}
+	logged := changelogFor(db, tdef) != nil
+	if !hasIndexes(tdef) && !logged {
+		return req.Added, nil
+	}
+	var old []Value
+	if !req.Added {
+		old = decodeRow(tdef, values[:tdef.PKeys], req.Old)
+	}
+	if err := changelogAdd(db, tdef, old, values); err != nil {
+		return false, err
+	}
+	if !hasIndexes(tdef) {
+		return req.Added, nil
 	}
 	// maintain indexes
-	if req.Updated && !req.Added {
-		decodeValues(req.Old, values[tdef.PKeys:]) // get the old row
-		indexOp(db, tdef, Record{tdef.Cols, values}, INDEX_DEL)
+	if req.Added {
+		return true, indexOp(db, tdef, values, INDEX_ADD)
 	}
-	if req.Updated {
-		indexOp(db, tdef, rec, INDEX_ADD)
+	return false, indexUpdate(db, tdef, old, values)
+}
+
+// the full row from the primary key and the encoded value
+func decodeRow(tdef *TableDef, pk []Value, val []byte) []Value {
+	row := make([]Value, len(tdef.Cols))
+	copy(row, pk)
+	for i := tdef.PKeys; i < len(row); i++ {
+		row[i].Type = tdef.Types[i]
 	}
-	return added, nil
+	decodeValues(val, row[tdef.PKeys:])
+	return row
+}
+
+// fill the omitted columns of an update with the stored row, if it exists
+func mergeStoredRow(db *DB, tdef *TableDef, values []Value) bool {
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	val, ok := db.kv.tree.Get(key)
+	if !ok {
+		return false
+	}
+	stored := decodeRow(tdef, values[:tdef.PKeys], val)
+	for i := tdef.PKeys; i < len(values); i++ {
+		if values[i].Type == TYPE_ERROR {
+			values[i] = stored[i]
+			// copied since the page will be freed by the update
+			values[i].Str = append([]byte(nil), stored[i].Str...)
+		}
+	}
+	return true
 }
 
 // delete a record by its primary key
@@ -126,16 +226,38 @@ func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
 		return false, err
 	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+	if err := db.kv.tree.checkKV(key, nil); err != nil {
+		return false, err
+	}
+	if err := fkCheckDelete(db, tdef, values[:tdef.PKeys], map[string]bool{}); err != nil {
+		return false, err
+	}
+
+	// the old row is needed to find its index keys, and for the changelog
+	var old []Value
+	if hasIndexes(tdef) || changelogFor(db, tdef) != nil {
+		val, ok := db.kv.tree.Get(key)
+		if !ok {
+			return false, nil
+		}
+		old = decodeRow(tdef, values[:tdef.PKeys], val)
+	}
 
-	deleted, err := db.kv.Del(key)
-	if err != nil || !deleted || len(tdef.Indexes) == 0 {
-		return deleted, err
+	deleted := db.kv.tree.Delete(key)
+	if !deleted {
+		return false, nil
+	}
+	if err := changelogAdd(db, tdef, old, nil); err != nil {
+		return false, err
 	}
 	// maintain indexes
-	if deleted {
-		indexOp(db, tdef, rec, INDEX_DEL)
+	if hasIndexes(tdef) {
+		if err := indexOp(db, tdef, old, INDEX_DEL); err != nil {
+			return false, err
+		}
 	}
-	return true, nil
+	// the rows referencing the deleted row
+	return true, fkOnDelete(db, tdef, values[:tdef.PKeys])
 }
 
 // find the closest position that is less or equal to the input key
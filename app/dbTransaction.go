@@ -1,5 +1,7 @@
 package relixdb
 
+import "fmt"
+
 type DBTX struct {
 	kv KVTX
 	db *DB
@@ -11,15 +13,23 @@ func (db *DB) Begin(tx *DBTX) {
 }
 
 func (db *DB) Commit(tx *DBTX) error {
-	return db.kv.Commit(&tx.kv)
+	changed := changelogEnd(db, false)
+	err := db.kv.Commit(&tx.kv)
+	if changed && err == nil {
+		changelogNotify(db)
+	}
+	return err
 }
 
 func (db *DB) Abort(tx *DBTX) {
+	// the cached table definitions may come from the aborted updates
+	db.tables = map[string]*TableDef{}
+	changelogEnd(db, true)
 	db.kv.Abort(&tx.kv)
 }
 
 func (tx *DBTX) TableNew(tdef *TableDef) error {
-	return tx.db.TableNew(tdef)
+	return dbTableNew(tx.db, tdef)
 }
 
 func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
@@ -27,11 +37,60 @@ func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
 }
 
 func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
-	return tx.db.Set(table, rec, mode)
+	tdef := getTableDef(tx.db, table)
+	if tdef == nil {
+		return false, fmt.Errorf("table not found: %s", table)
+	}
+	if !tdef.AutoIncrement {
+		return dbUpdate(tx.db, tdef, rec, mode)
+	}
+	rec, id, err := autoIncrement(tx.db, tdef, rec, mode)
+	if err != nil {
+		return false, err
+	}
+	added, err := dbUpdate(tx.db, tdef, rec, mode)
+	if err != nil || !added {
+		return added, err
+	}
+	return true, autoIncrementAdded(tx.db, tdef, id)
+}
+
+func (tx *DBTX) InsertID(table string, rec Record) (int64, error) {
+	tdef := getTableDef(tx.db, table)
+	if tdef == nil {
+		return 0, fmt.Errorf("table not found: %s", table)
+	}
+	if !tdef.AutoIncrement {
+		return 0, fmt.Errorf("table has no auto-increment key: %s", table)
+	}
+	rec, id, err := autoIncrement(tx.db, tdef, rec, MODE_INSERT_ONLY)
+	if err != nil {
+		return 0, err
+	}
+	added, err := dbUpdate(tx.db, tdef, rec, MODE_INSERT_ONLY)
+	if err != nil {
+		return 0, err
+	}
+	if !added {
+		return 0, fmt.Errorf("duplicate primary key %d in table %s", id, table)
+	}
+	return id, autoIncrementAdded(tx.db, tdef, id)
+}
+
+func (tx *DBTX) NextVal(name string) (int64, error) {
+	return dbNextVal(tx.db, name)
+}
+
+func (tx *DBTX) CurrVal(name string) (int64, error) {
+	return dbCurrVal(tx.db, name)
 }
 
 func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
-	return tx.db.Delete(table, rec)
+	tdef := getTableDef(tx.db, table)
+	if tdef == nil {
+		return false, fmt.Errorf("table not found: %s", table)
+	}
+	return dbDelete(tx.db, tdef, rec)
 }
 
 func (tx *DBTX) Scan(table string, req *Scanner) error {
@@ -0,0 +1,840 @@
+package relixdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// logical dumps: the schemas as CREATE TABLE statements followed by the
+// rows as INSERT statements, for moving data between file formats.
+//
+//	CREATE TABLE name (
+//	  col TYPE [NOT NULL] [DEFAULT lit] [CHECK (MIN n, MAX n, MIN_LENGTH n, MAX_LENGTH n, IN (lit, ...))],
+//	  PRIMARY KEY (col, ...) [AUTO_INCREMENT],
+//	  INDEX (col, ...) [WHERE 'expr'],
+//	  FOREIGN KEY (col, ...) REFERENCES table ON DELETE RESTRICT|CASCADE|SET NULL,
+//	  FULLTEXT INDEX name (col, ...) TOKENIZER WORDS|SPACE [KEEP CASE] [STOP WORDS (lit, ...)]
+//	);
+//	INSERT INTO name (col, ...) VALUES (lit, ...);
+//
+// the key prefixes are not dumped, the restore allocates them again from
+// `next_prefix`. the counters in `@meta` are dumped as INSERTs into '@meta'.
+// names that are not identifiers are quoted like strings, strings that are
+// not printable UTF-8 are in hex as X'...'. a statement ends with a ; at the
+// end of a line, lines starting with -- are comments.
+
+const DUMP_HEADER = "-- RelixDB dump"
+
+var dumpTypeNames = map[uint32]string{
+	TYPE_BYTES: "BYTES", TYPE_INT64: "INT64", TYPE_JSON: "JSON",
+}
+
+var dumpFKActions = map[int]string{
+	FK_RESTRICT: "RESTRICT", FK_CASCADE: "CASCADE", FK_SET_NULL: "SET NULL",
+}
+
+// the keywords that start the table constraints, quoted as column names
+var dumpKeywords = []string{"PRIMARY", "INDEX", "FOREIGN", "FULLTEXT"}
+
+// write the tables and the counters as SQL statements.
+// the dump runs in a transaction, so it's consistent.
+func (db *DB) Dump(w io.Writer) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	defer db.Abort(&tx) // nothing is changed
+
+	tables, counters, err := dumpCatalog(db)
+	if err != nil {
+		return fmt.Errorf("dump: %w", err)
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteString(DUMP_HEADER + "\n")
+	for _, tdef := range tables {
+		bw.WriteString("\n" + dumpCreate(tdef))
+	}
+	for _, tdef := range tables {
+		bw.WriteString("\n")
+		if err := dumpRows(db, tdef, bw); err != nil {
+			return fmt.Errorf("dump: %w", err)
+		}
+	}
+	if len(counters) > 0 {
+		bw.WriteString("\n")
+	}
+	for _, rec := range counters {
+		bw.WriteString(dumpInsert(TDEF_META, rec.Vals))
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("dump: %w", err)
+	}
+	return nil
+}
+
+// the user tables, parents before the children of foreign keys,
+// and the counters in `@meta`.
+func dumpCatalog(db *DB) ([]*TableDef, []Record, error) {
+	// `@table` and `@meta` share the key prefix
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	if err := dbScanIndex(db, TDEF_TABLE, &sc, -1); err != nil {
+		return nil, nil, err
+	}
+	byName := map[string]*TableDef{}
+	names := []string{}
+	counters := []Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		key := string(rec.Vals[0].Str)
+		switch {
+		case key == "next_prefix" || strings.HasPrefix(key, META_FK_CHILDREN):
+			// rebuilt by CREATE TABLE
+		case key == META_CHANGELOG:
+			// the changelog is not dumped
+		case strings.HasPrefix(key, META_AUTOINC) || strings.HasPrefix(key, META_SEQUENCE):
+			counters = append(counters, Record{Cols: TDEF_META.Cols, Vals: rec.Vals})
+		case strings.HasPrefix(key, "@"):
+			// internal tables
+		default:
+			tdef := &TableDef{}
+			if err := json.Unmarshal(rec.Vals[1].Str, tdef); err != nil {
+				return nil, nil, fmt.Errorf("bad table definition: %s", key)
+			}
+			byName[key] = tdef
+			names = append(names, key)
+		}
+	}
+
+	tables := []*TableDef{}
+	done := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+		for _, fk := range byName[name].ForeignKeys {
+			if byName[fk.Table] != nil {
+				visit(fk.Table)
+			}
+		}
+		tables = append(tables, byName[name])
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return tables, counters, nil
+}
+
+func dumpCreate(tdef *TableDef) string {
+	items := []string{}
+	for i, col := range tdef.Cols {
+		item := dumpName(col) + " " + dumpTypeNames[tdef.Types[i]]
+		if colNotNull(tdef, i) {
+			item += " NOT NULL"
+		}
+		if def := colDefault(tdef, i); def != nil {
+			item += " DEFAULT " + dumpLit(*def)
+		}
+		if chk := colCheck(tdef, i); chk != nil {
+			if text := dumpCheck(chk); text != "" {
+				item += " CHECK (" + text + ")"
+			}
+		}
+		items = append(items, item)
+	}
+
+	pk := "PRIMARY KEY (" + dumpNames(tdef.Cols[:tdef.PKeys]) + ")"
+	if tdef.AutoIncrement {
+		pk += " AUTO_INCREMENT"
+	}
+	items = append(items, pk)
+	for i, index := range tdef.Indexes {
+		item := "INDEX (" + dumpNames(index) + ")"
+		if where := indexWhere(tdef, i); where != "" {
+			item += " WHERE " + dumpStr(where)
+		}
+		items = append(items, item)
+	}
+	for _, fk := range tdef.ForeignKeys {
+		items = append(items, fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s ON DELETE %s",
+			dumpNames(fk.Cols), dumpName(fk.Table), dumpFKActions[fk.OnDelete]))
+	}
+	for _, ti := range tdef.TextIndexes {
+		item := fmt.Sprintf("FULLTEXT INDEX %s (%s) TOKENIZER ", dumpName(ti.Name), dumpNames(ti.Cols))
+		if ti.Tokenizer == TOKEN_SPACE {
+			item += "SPACE"
+		} else {
+			item += "WORDS"
+		}
+		if ti.KeepCase {
+			item += " KEEP CASE"
+		}
+		if len(ti.StopWords) > 0 {
+			words := make([]string, len(ti.StopWords))
+			for i, word := range ti.StopWords {
+				words[i] = dumpStr(word)
+			}
+			item += " STOP WORDS (" + strings.Join(words, ", ") + ")"
+		}
+		items = append(items, item)
+	}
+	return "CREATE TABLE " + dumpName(tdef.Name) + " (\n  " + strings.Join(items, ",\n  ") + "\n);\n"
+}
+
+func dumpCheck(chk *Check) string {
+	items := []string{}
+	if chk.Min != nil {
+		items = append(items, "MIN "+strconv.FormatInt(*chk.Min, 10))
+	}
+	if chk.Max != nil {
+		items = append(items, "MAX "+strconv.FormatInt(*chk.Max, 10))
+	}
+	if chk.MinLen != 0 {
+		items = append(items, "MIN_LENGTH "+strconv.Itoa(chk.MinLen))
+	}
+	if chk.MaxLen != 0 {
+		items = append(items, "MAX_LENGTH "+strconv.Itoa(chk.MaxLen))
+	}
+	if len(chk.Enum) > 0 {
+		vals := make([]string, len(chk.Enum))
+		for i, v := range chk.Enum {
+			vals[i] = dumpLit(v)
+		}
+		items = append(items, "IN ("+strings.Join(vals, ", ")+")")
+	}
+	return strings.Join(items, ", ")
+}
+
+func dumpRows(db *DB, tdef *TableDef, w *bufio.Writer) error {
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	if err := dbScanIndex(db, tdef, &sc, -1); err != nil {
+		return err
+	}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		if _, err := w.WriteString(dumpInsert(tdef, rec.Vals)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// `vals` are in the column order
+func dumpInsert(tdef *TableDef, vals []Value) string {
+	lits := make([]string, len(vals))
+	for i, v := range vals {
+		lits[i] = dumpLit(v)
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);\n",
+		dumpName(tdef.Name), dumpNames(tdef.Cols), strings.Join(lits, ", "))
+}
+
+// an identifier, or a quoted string if it's not one
+func dumpName(name string) string {
+	ident := name != ""
+	for i := 0; i < len(name); i++ {
+		ident = ident && isIdentChar(name[i], i == 0)
+	}
+	for _, kw := range dumpKeywords {
+		ident = ident && !strings.EqualFold(name, kw)
+	}
+	if ident {
+		return name
+	}
+	return dumpStr(name)
+}
+
+func dumpNames(names []string) string {
+	out := make([]string, len(names))
+	for i, name := range names {
+		out[i] = dumpName(name)
+	}
+	return strings.Join(out, ", ")
+}
+
+func dumpLit(v Value) string {
+	if v.Type == TYPE_INT64 {
+		return strconv.FormatInt(v.I64, 10)
+	}
+	return dumpStr(string(v.Str))
+}
+
+// a quoted string, in hex if it's not printable
+func dumpStr(s string) string {
+	if utf8.ValidString(s) && strings.IndexFunc(s, unicode.IsControl) < 0 {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	return "X'" + hex.EncodeToString([]byte(s)) + "'"
+}
+
+// replay a dump into a database without tables.
+// the statements are committed in batches.
+func (db *DB) RestoreDump(r io.Reader) error {
+	tx := DBTX{}
+	db.Begin(&tx)
+	tables, _, err := dumpCatalog(db)
+	if err == nil && len(tables) > 0 {
+		err = fmt.Errorf("the database is not empty")
+	}
+	if err != nil {
+		db.Abort(&tx)
+		return fmt.Errorf("restore: %w", err)
+	}
+
+	n := 0
+	err = dumpStatements(r, func(stmt string, line int) error {
+		if err := dumpExec(db, stmt); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if n++; n%IMPORT_BATCH_DEFAULT == 0 {
+			if err := db.Commit(&tx); err != nil {
+				return err
+			}
+			db.Begin(&tx)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Abort(&tx)
+		return fmt.Errorf("restore: %w", err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+// call `fn` with each statement without the ; and its first line
+func dumpStatements(r io.Reader, fn func(stmt string, line int) error) error {
+	br := bufio.NewReader(r)
+	stmt := strings.Builder{}
+	start, line, quotes := 0, 0, 0
+	for eof := false; !eof; {
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof = err == io.EOF
+		if text == "" {
+			continue
+		}
+		line++
+		text = strings.TrimRight(text, "\r\n")
+		trimmed := strings.TrimSpace(text)
+		if stmt.Len() == 0 {
+			if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+				continue
+			}
+			start = line
+		}
+		stmt.WriteString(text + "\n")
+		quotes += strings.Count(text, "'") // an escaped quote is 2 quotes
+		if quotes%2 == 0 && strings.HasSuffix(trimmed, ";") {
+			s := strings.TrimSpace(stmt.String())
+			if err := fn(s[:len(s)-1], start); err != nil {
+				return err
+			}
+			stmt.Reset()
+			quotes = 0
+		}
+	}
+	if stmt.Len() > 0 {
+		return fmt.Errorf("line %d: unterminated statement", start)
+	}
+	return nil
+}
+
+func dumpExec(db *DB, stmt string) error {
+	p := dumpParser{}
+	if err := p.tokenize(stmt); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case p.accept("CREATE"):
+		var tdef *TableDef
+		if tdef, err = p.parseCreate(); err == nil {
+			err = p.end()
+		}
+		if err == nil {
+			err = dbTableNew(db, tdef)
+		}
+	case p.accept("INSERT"):
+		var table string
+		var rec Record
+		if table, rec, err = p.parseInsert(db); err == nil {
+			err = p.end()
+		}
+		if err == nil {
+			err = dumpInsertRow(db, table, rec)
+		}
+	default:
+		err = fmt.Errorf("unknown statement")
+	}
+	return err
+}
+
+func dumpInsertRow(db *DB, table string, rec Record) error {
+	tdef := dumpTable(db, table)
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return err
+	}
+	if err := applyConstraints(tdef, values); err != nil {
+		return err
+	}
+	// the foreign keys are not checked, a row can reference a later row
+	// of the same table. the dumped rows were consistent.
+	added, err := dbUpdateValues(db, tdef, values, MODE_INSERT_ONLY)
+	if err == nil && !added {
+		err = fmt.Errorf("duplicate primary key")
+	}
+	return err
+}
+
+// the target of INSERT, `@meta` is an internal table
+func dumpTable(db *DB, name string) *TableDef {
+	if name == TDEF_META.Name {
+		return TDEF_META
+	}
+	return getTableDef(db, name)
+}
+
+// the parser of the dump statements, with the tokens of expressions
+type dumpParser struct {
+	exprParser
+}
+
+func (p *dumpParser) end() error {
+	if tok := p.peek(); tok.kind != 0 {
+		return fmt.Errorf("unexpected %q", tok.text)
+	}
+	return nil
+}
+
+func (p *dumpParser) expect(words ...string) error {
+	for _, w := range words {
+		if !p.accept(w) {
+			return fmt.Errorf("expect %s", w)
+		}
+	}
+	return nil
+}
+
+// an identifier or a quoted name
+func (p *dumpParser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_IDENT && tok.kind != TOK_STR {
+		return "", fmt.Errorf("expect a name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// (name, ...)
+func (p *dumpParser) names() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+		if p.accept(")") {
+			return out, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// an integer or a string, the type is decided by the column
+func (p *dumpParser) lit() (Value, error) {
+	neg := p.accept("-")
+	tok := p.peek()
+	p.pos++
+	switch {
+	case tok.kind == TOK_INT:
+		text := tok.text
+		if neg {
+			text = "-" + text
+		}
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("bad integer %s", text)
+		}
+		return Value{Type: TYPE_INT64, I64: i}, nil
+	case neg:
+	case tok.kind == TOK_STR:
+		return Value{Type: TYPE_BYTES, Str: []byte(tok.text)}, nil
+	case tok.kind == TOK_IDENT && strings.EqualFold(tok.text, "X") && p.peek().kind == TOK_STR:
+		str := p.peek().text
+		p.pos++
+		data, err := hex.DecodeString(str)
+		if err != nil {
+			return Value{}, fmt.Errorf("bad hex string %q", str)
+		}
+		return Value{Type: TYPE_BYTES, Str: data}, nil
+	}
+	return Value{}, fmt.Errorf("expect a value")
+}
+
+// (lit, ...)
+func (p *dumpParser) lits() ([]Value, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	out := []Value{}
+	for {
+		v, err := p.lit()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		if p.accept(")") {
+			return out, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// a literal as a value of the column type
+func dumpValue(v Value, typ uint32) (Value, error) {
+	if (typ == TYPE_INT64) != (v.Type == TYPE_INT64) {
+		return Value{}, fmt.Errorf("type mismatch")
+	}
+	v.Type = typ
+	return v, nil
+}
+
+func (p *dumpParser) int() (int64, error) {
+	v, err := p.lit()
+	if err == nil && v.Type != TYPE_INT64 {
+		err = fmt.Errorf("expect an integer")
+	}
+	return v.I64, err
+}
+
+func (p *dumpParser) parseCreate() (*TableDef, error) {
+	if err := p.expect("TABLE"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	tdef := &TableDef{Name: name}
+	var notNull []bool
+	var defaults []*Value
+	var checks []*Check
+	var pkeys []string
+	var where []string
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("PRIMARY"):
+			if err := p.expect("KEY"); err != nil {
+				return nil, err
+			}
+			if pkeys, err = p.names(); err != nil {
+				return nil, err
+			}
+			tdef.AutoIncrement = p.accept("AUTO_INCREMENT")
+		case p.accept("INDEX"):
+			index, err := p.names()
+			if err != nil {
+				return nil, err
+			}
+			pred := ""
+			if p.accept("WHERE") {
+				v, err := p.lit()
+				if err != nil || v.Type != TYPE_BYTES {
+					return nil, fmt.Errorf("expect a string after WHERE")
+				}
+				pred = string(v.Str)
+			}
+			tdef.Indexes = append(tdef.Indexes, index)
+			where = append(where, pred)
+		case p.accept("FOREIGN"):
+			fk, err := p.parseForeignKey()
+			if err != nil {
+				return nil, err
+			}
+			tdef.ForeignKeys = append(tdef.ForeignKeys, fk)
+		case p.accept("FULLTEXT"):
+			ti, err := p.parseTextIndex()
+			if err != nil {
+				return nil, err
+			}
+			tdef.TextIndexes = append(tdef.TextIndexes, ti)
+		default:
+			col, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			tok := p.peek()
+			typ, ok := exprTypeNames[strings.ToLower(tok.text)]
+			if tok.kind != TOK_IDENT || !ok {
+				return nil, fmt.Errorf("bad type %q of column %s", tok.text, col)
+			}
+			p.pos++
+			nn, def, chk, err := p.parseColumn(typ)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col, err)
+			}
+			tdef.Cols = append(tdef.Cols, col)
+			tdef.Types = append(tdef.Types, typ)
+			notNull = append(notNull, nn)
+			defaults = append(defaults, def)
+			checks = append(checks, chk)
+		}
+		if p.accept(")") {
+			break
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+
+	// the primary key is the first columns
+	tdef.PKeys = len(pkeys)
+	if tdef.PKeys == 0 || tdef.PKeys > len(tdef.Cols) || !slices.Equal(pkeys, tdef.Cols[:tdef.PKeys]) {
+		return nil, fmt.Errorf("the primary key must be the first columns")
+	}
+	// the optional per-column slices are either empty or full
+	if slices.Contains(notNull, true) {
+		tdef.NotNull = notNull
+	}
+	if slices.ContainsFunc(defaults, func(v *Value) bool { return v != nil }) {
+		tdef.Defaults = defaults
+	}
+	if slices.ContainsFunc(checks, func(c *Check) bool { return c != nil }) {
+		tdef.Checks = checks
+	}
+	if slices.ContainsFunc(where, func(s string) bool { return s != "" }) {
+		tdef.IndexWhere = where
+	}
+	return tdef, nil
+}
+
+// the attributes of a column after the type
+func (p *dumpParser) parseColumn(typ uint32) (bool, *Value, *Check, error) {
+	notNull := false
+	var def *Value
+	var chk *Check
+	for {
+		switch {
+		case p.accept("NOT"):
+			if err := p.expect("NULL"); err != nil {
+				return false, nil, nil, err
+			}
+			notNull = true
+		case p.accept("DEFAULT"):
+			v, err := p.lit()
+			if err == nil {
+				v, err = dumpValue(v, typ)
+			}
+			if err != nil {
+				return false, nil, nil, fmt.Errorf("DEFAULT: %w", err)
+			}
+			def = &v
+		case p.accept("CHECK"):
+			var err error
+			if chk, err = p.parseCheck(typ); err != nil {
+				return false, nil, nil, fmt.Errorf("CHECK: %w", err)
+			}
+		default:
+			return notNull, def, chk, nil
+		}
+	}
+}
+
+// (item, ...) after CHECK
+func (p *dumpParser) parseCheck(typ uint32) (*Check, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	chk := &Check{}
+	for {
+		var err error
+		switch {
+		case p.accept("MIN"):
+			var v int64
+			v, err = p.int()
+			chk.Min = &v
+		case p.accept("MAX"):
+			var v int64
+			v, err = p.int()
+			chk.Max = &v
+		case p.accept("MIN_LENGTH"):
+			var v int64
+			v, err = p.int()
+			chk.MinLen = int(v)
+		case p.accept("MAX_LENGTH"):
+			var v int64
+			v, err = p.int()
+			chk.MaxLen = int(v)
+		case p.accept("IN"):
+			var vals []Value
+			if vals, err = p.lits(); err == nil {
+				for i := range vals {
+					if vals[i], err = dumpValue(vals[i], typ); err != nil {
+						break
+					}
+				}
+			}
+			chk.Enum = vals
+		default:
+			err = fmt.Errorf("unknown check %q", p.peek().text)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.accept(")") {
+			return chk, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// after FOREIGN
+func (p *dumpParser) parseForeignKey() (ForeignKey, error) {
+	fk := ForeignKey{}
+	if err := p.expect("KEY"); err != nil {
+		return fk, err
+	}
+	var err error
+	if fk.Cols, err = p.names(); err != nil {
+		return fk, err
+	}
+	if err := p.expect("REFERENCES"); err != nil {
+		return fk, err
+	}
+	if fk.Table, err = p.name(); err != nil {
+		return fk, err
+	}
+	if !p.accept("ON") {
+		return fk, nil // RESTRICT
+	}
+	if err := p.expect("DELETE"); err != nil {
+		return fk, err
+	}
+	switch {
+	case p.accept("RESTRICT"):
+		fk.OnDelete = FK_RESTRICT
+	case p.accept("CASCADE"):
+		fk.OnDelete = FK_CASCADE
+	case p.accept("SET"):
+		fk.OnDelete = FK_SET_NULL
+		err = p.expect("NULL")
+	default:
+		err = fmt.Errorf("bad foreign key action")
+	}
+	return fk, err
+}
+
+// after FULLTEXT
+func (p *dumpParser) parseTextIndex() (TextIndex, error) {
+	ti := TextIndex{}
+	if err := p.expect("INDEX"); err != nil {
+		return ti, err
+	}
+	var err error
+	if ti.Name, err = p.name(); err != nil {
+		return ti, err
+	}
+	if ti.Cols, err = p.names(); err != nil {
+		return ti, err
+	}
+	for {
+		switch {
+		case p.accept("TOKENIZER"):
+			switch {
+			case p.accept("WORDS"):
+				ti.Tokenizer = TOKEN_WORDS
+			case p.accept("SPACE"):
+				ti.Tokenizer = TOKEN_SPACE
+			default:
+				return ti, fmt.Errorf("bad tokenizer")
+			}
+		case p.accept("KEEP"):
+			if err := p.expect("CASE"); err != nil {
+				return ti, err
+			}
+			ti.KeepCase = true
+		case p.accept("STOP"):
+			if err := p.expect("WORDS"); err != nil {
+				return ti, err
+			}
+			words, err := p.lits()
+			if err != nil {
+				return ti, err
+			}
+			for _, w := range words {
+				if w.Type != TYPE_BYTES {
+					return ti, fmt.Errorf("expect strings as stop words")
+				}
+				ti.StopWords = append(ti.StopWords, string(w.Str))
+			}
+		default:
+			return ti, nil
+		}
+	}
+}
+
+// after INSERT
+func (p *dumpParser) parseInsert(db *DB) (string, Record, error) {
+	rec := Record{}
+	if err := p.expect("INTO"); err != nil {
+		return "", rec, err
+	}
+	table, err := p.name()
+	if err != nil {
+		return "", rec, err
+	}
+	tdef := dumpTable(db, table)
+	if tdef == nil {
+		return "", rec, fmt.Errorf("table not found: %s", table)
+	}
+	if rec.Cols, err = p.names(); err != nil {
+		return "", rec, err
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return "", rec, err
+	}
+	if rec.Vals, err = p.lits(); err != nil {
+		return "", rec, err
+	}
+	if len(rec.Vals) != len(rec.Cols) {
+		return "", rec, fmt.Errorf("expected %d values, got %d", len(rec.Cols), len(rec.Vals))
+	}
+	for i, col := range rec.Cols {
+		idx := colIndex(tdef, col)
+		if idx < 0 {
+			return "", rec, fmt.Errorf("unknown column: %s", col)
+		}
+		if rec.Vals[i], err = dumpValue(rec.Vals[i], tdef.Types[idx]); err != nil {
+			return "", rec, fmt.Errorf("column %s: %w", col, err)
+		}
+	}
+	return table, rec, nil
+}
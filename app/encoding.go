@@ -13,7 +13,7 @@ func encodeValues(out []byte, vals []Value) []byte {
 			u := uint64(v.I64) + (1 << 63)
 			binary.BigEndian.PutUint64(buf[:], u)
 			out = append(out, buf[:]...)
-		case TYPE_BYTES:
+		case TYPE_BYTES, TYPE_JSON:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0) // null-terminated
 		default:
@@ -77,7 +77,7 @@ func decodeValues(in []byte, out []Value) []Value {
 			currentValue.I64 = int64(u - (1 << 63)) // Reverse the sign bit flip
 			pos += 8
 
-		case TYPE_BYTES:
+		case TYPE_BYTES, TYPE_JSON:
 			// Find the null terminator and unescape the string
 			start := pos
 			for pos < len(in) && in[pos] != 0 {
@@ -164,8 +164,8 @@ func encodeKeyPartial(
 	max := cmp == CMP_GT || cmp == CMP_LE
 loop:
 	for i := len(values); max && i < len(keys); i++ {
-		switch tdef.Types[colIndex(tdef, keys[i])] {
-		case TYPE_BYTES:
+		switch colType(tdef, keys[i]) {
+		case TYPE_BYTES, TYPE_JSON:
 			out = append(out, 0xff)
 			break loop // stops here since no string encoding starts with 0xff
 		case TYPE_INT64:
@@ -0,0 +1,810 @@
+package relixdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// expression nodes
+const (
+	EXPR_COL      = 1  // a column
+	EXPR_LIT      = 2  // a literal value
+	EXPR_GET      = 3  // json -> key: the JSON value
+	EXPR_GET_TEXT = 4  // json ->> key: the text of the JSON value
+	EXPR_CAST     = 5  // expr::type
+	EXPR_EQ       = 6  // =
+	EXPR_NE       = 7  // !=, <>
+	EXPR_LT       = 8  // <
+	EXPR_LE       = 9  // <=
+	EXPR_GT       = 10 // >
+	EXPR_GE       = 11 // >=
+	EXPR_AND      = 12
+	EXPR_OR       = 13
+	EXPR_NOT      = 14
+	EXPR_ADD      = 15 // +
+	EXPR_SUB      = 16 // -
+	EXPR_MUL      = 17 // *
+	EXPR_DIV      = 18 // /
+	EXPR_MOD      = 19 // %
+	EXPR_CALL     = 20 // a function call
+)
+
+// an expression over the columns of a row.
+// booleans are int64 values of 0 or 1.
+type Expr struct {
+	Op   int
+	Name string // EXPR_COL: the column name; EXPR_CALL: the function name
+	Val  Value  // EXPR_LIT: the value; EXPR_GET*: the object key or array index
+	Type uint32 // EXPR_CAST: the target type
+	Kids []*Expr
+}
+
+var exprOpNames = map[int]string{
+	EXPR_EQ: "=", EXPR_NE: "!=", EXPR_LT: "<", EXPR_LE: "<=", EXPR_GT: ">", EXPR_GE: ">=",
+	EXPR_AND: "AND", EXPR_OR: "OR",
+	EXPR_ADD: "+", EXPR_SUB: "-", EXPR_MUL: "*", EXPR_DIV: "/", EXPR_MOD: "%",
+}
+
+// a built-in function
+type exprFunc struct {
+	args []uint32 // argument types
+	ret  uint32   // result type
+	call func(args []Value) (Value, error)
+}
+
+var exprFuncs = map[string]exprFunc{
+	"lower": {[]uint32{TYPE_BYTES}, TYPE_BYTES, func(args []Value) (Value, error) {
+		return Value{Type: TYPE_BYTES, Str: bytes.ToLower(args[0].Str)}, nil
+	}},
+	"upper": {[]uint32{TYPE_BYTES}, TYPE_BYTES, func(args []Value) (Value, error) {
+		return Value{Type: TYPE_BYTES, Str: bytes.ToUpper(args[0].Str)}, nil
+	}},
+	"length": {[]uint32{TYPE_BYTES}, TYPE_INT64, func(args []Value) (Value, error) {
+		return Value{Type: TYPE_INT64, I64: int64(len(args[0].Str))}, nil
+	}},
+	"abs": {[]uint32{TYPE_INT64}, TYPE_INT64, func(args []Value) (Value, error) {
+		v := args[0].I64
+		if v < 0 {
+			v = -v
+		}
+		return Value{Type: TYPE_INT64, I64: v}, nil
+	}},
+	// substr(s, start, n): n bytes from the 1-based start
+	"substr": {[]uint32{TYPE_BYTES, TYPE_INT64, TYPE_INT64}, TYPE_BYTES, func(args []Value) (Value, error) {
+		s, start, n := args[0].Str, args[1].I64-1, args[2].I64
+		start = min(max(start, 0), int64(len(s)))
+		end := min(start+max(n, 0), int64(len(s)))
+		return Value{Type: TYPE_BYTES, Str: s[start:end]}, nil
+	}},
+}
+
+var exprTypeNames = map[string]uint32{
+	"bytes": TYPE_BYTES, "int64": TYPE_INT64, "json": TYPE_JSON,
+}
+
+// the canonical text of the expression, used to match index columns
+func (e *Expr) String() string {
+	switch e.Op {
+	case EXPR_COL:
+		return e.Name
+	case EXPR_LIT:
+		return exprLitString(e.Val)
+	case EXPR_GET, EXPR_GET_TEXT:
+		arrow := "->"
+		if e.Op == EXPR_GET_TEXT {
+			arrow = "->>"
+		}
+		return e.Kids[0].String() + arrow + exprLitString(e.Val)
+	case EXPR_CAST:
+		for name, typ := range exprTypeNames {
+			if typ == e.Type {
+				return "(" + e.Kids[0].String() + ")::" + name
+			}
+		}
+		panic("what?")
+	case EXPR_NOT:
+		return "(NOT " + e.Kids[0].String() + ")"
+	case EXPR_CALL:
+		args := make([]string, len(e.Kids))
+		for i, kid := range e.Kids {
+			args[i] = kid.String()
+		}
+		return e.Name + "(" + strings.Join(args, ", ") + ")"
+	default:
+		return "(" + e.Kids[0].String() + " " + exprOpNames[e.Op] + " " + e.Kids[1].String() + ")"
+	}
+}
+
+func exprLitString(v Value) string {
+	if v.Type == TYPE_INT64 {
+		return strconv.FormatInt(v.I64, 10)
+	}
+	return "'" + strings.ReplaceAll(string(v.Str), "'", "''") + "'"
+}
+
+// parsed expressions by text, bounded by EXPR_CACHE_MAX since the
+// filters of queries are arbitrary text.
+var exprCache = struct {
+	sync.Mutex
+	m map[string]*Expr
+}{m: map[string]*Expr{}}
+
+func exprCacheGet(text string) (*Expr, bool) {
+	exprCache.Lock()
+	defer exprCache.Unlock()
+	e, ok := exprCache.m[text]
+	return e, ok
+}
+
+func exprCachePut(text string, e *Expr) {
+	exprCache.Lock()
+	defer exprCache.Unlock()
+	if len(exprCache.m) >= EXPR_CACHE_MAX {
+		// evict an arbitrary entry
+		for k := range exprCache.m {
+			delete(exprCache.m, k)
+			break
+		}
+	}
+	exprCache.m[text] = e
+}
+
+// parse an expression, the result is shared and must not be modified
+func ParseExpr(text string) (*Expr, error) {
+	if e, ok := exprCacheGet(text); ok {
+		return e, nil
+	}
+	p := exprParser{}
+	if err := p.tokenize(text); err != nil {
+		return nil, err
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression: %s", p.tokens[p.pos].text, text)
+	}
+	exprCachePut(text, e)
+	return e, nil
+}
+
+// token kinds
+const (
+	TOK_IDENT = 1
+	TOK_INT   = 2
+	TOK_STR   = 3
+	TOK_OP    = 4
+)
+
+type exprToken struct {
+	kind int
+	text string // the unquoted text of strings
+}
+
+type exprParser struct {
+	text   string
+	tokens []exprToken
+	pos    int
+}
+
+// the operators, longer ones first
+var exprOps = []string{
+	"->>", "->", "::", "!=", "<>", "<=", ">=", "=", "<", ">", "(", ")", ",",
+	"+", "-", "*", "/", "%",
+}
+
+func isIdentChar(ch byte, first bool) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') ||
+		(!first && ch >= '0' && ch <= '9')
+}
+
+func (p *exprParser) tokenize(text string) error {
+	p.text = text
+	for pos := 0; pos < len(text); {
+		ch := text[pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			pos++
+		case isIdentChar(ch, true):
+			start := pos
+			for pos < len(text) && isIdentChar(text[pos], false) {
+				pos++
+			}
+			p.tokens = append(p.tokens, exprToken{TOK_IDENT, text[start:pos]})
+		case ch >= '0' && ch <= '9':
+			start := pos
+			for pos < len(text) && text[pos] >= '0' && text[pos] <= '9' {
+				pos++
+			}
+			p.tokens = append(p.tokens, exprToken{TOK_INT, text[start:pos]})
+		case ch == '\'':
+			var sb strings.Builder
+			for pos++; ; pos++ {
+				if pos >= len(text) {
+					return fmt.Errorf("unterminated string in expression: %s", text)
+				}
+				if text[pos] == '\'' {
+					if pos+1 < len(text) && text[pos+1] == '\'' {
+						pos++ // escaped quote
+					} else {
+						break
+					}
+				}
+				sb.WriteByte(text[pos])
+			}
+			pos++
+			p.tokens = append(p.tokens, exprToken{TOK_STR, sb.String()})
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(text[pos:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected %q in expression: %s", ch, text)
+			}
+			pos += len(op)
+			p.tokens = append(p.tokens, exprToken{TOK_OP, op})
+		}
+	}
+	return nil
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return exprToken{}
+}
+
+// consume the operator or keyword if it's the next token
+func (p *exprParser) accept(text string) bool {
+	tok := p.peek()
+	if (tok.kind == TOK_OP && tok.text == text) ||
+		(tok.kind == TOK_IDENT && strings.EqualFold(tok.text, text)) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf(format+" in expression: %s", append(args, p.text)...)
+}
+
+func (p *exprParser) parseOr() (*Expr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("OR") {
+		var right *Expr
+		if right, err = p.parseAnd(); err == nil {
+			left = &Expr{Op: EXPR_OR, Kids: []*Expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (*Expr, error) {
+	left, err := p.parseNot()
+	for err == nil && p.accept("AND") {
+		var right *Expr
+		if right, err = p.parseNot(); err == nil {
+			left = &Expr{Op: EXPR_AND, Kids: []*Expr{left, right}}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseNot() (*Expr, error) {
+	if p.accept("NOT") {
+		kid, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Op: EXPR_NOT, Kids: []*Expr{kid}}, nil
+	}
+	return p.parseCmp()
+}
+
+var exprCmpOps = []struct {
+	text string
+	op   int
+}{
+	{"=", EXPR_EQ}, {"!=", EXPR_NE}, {"<>", EXPR_NE},
+	{"<=", EXPR_LE}, {">=", EXPR_GE}, {"<", EXPR_LT}, {">", EXPR_GT},
+}
+
+func (p *exprParser) parseCmp() (*Expr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range exprCmpOps {
+		if p.accept(c.text) {
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &Expr{Op: c.op, Kids: []*Expr{left, right}}, nil
+		}
+	}
+	return left, nil
+}
+
+// the operand of comparisons
+func (p *exprParser) parseOperand() (*Expr, error) {
+	return p.parseBinary(0)
+}
+
+// arithmetic operators by precedence
+var exprArithOps = [][]struct {
+	text string
+	op   int
+}{
+	{{"+", EXPR_ADD}, {"-", EXPR_SUB}},
+	{{"*", EXPR_MUL}, {"/", EXPR_DIV}, {"%", EXPR_MOD}},
+}
+
+func (p *exprParser) parseBinary(level int) (*Expr, error) {
+	if level == len(exprArithOps) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+loop:
+	for err == nil {
+		for _, o := range exprArithOps[level] {
+			if p.accept(o.text) {
+				var right *Expr
+				if right, err = p.parseBinary(level + 1); err == nil {
+					left = &Expr{Op: o.op, Kids: []*Expr{left, right}}
+				}
+				continue loop
+			}
+		}
+		break
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (*Expr, error) {
+	if !p.accept("-") {
+		return p.parsePostfix()
+	}
+	if tok := p.peek(); tok.kind == TOK_INT {
+		// negative numbers
+		p.pos++
+		i, err := strconv.ParseInt("-"+tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("bad integer -%s", tok.text)
+		}
+		return &Expr{Op: EXPR_LIT, Val: Value{Type: TYPE_INT64, I64: i}}, nil
+	}
+	kid, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	zero := &Expr{Op: EXPR_LIT, Val: Value{Type: TYPE_INT64}}
+	return &Expr{Op: EXPR_SUB, Kids: []*Expr{zero, kid}}, nil
+}
+
+// JSON accessors and casts
+func (p *exprParser) parsePostfix() (*Expr, error) {
+	e, err := p.parsePrimary()
+	for err == nil {
+		switch {
+		case p.accept("->"):
+			e, err = p.parseAccessor(EXPR_GET, e)
+		case p.accept("->>"):
+			e, err = p.parseAccessor(EXPR_GET_TEXT, e)
+		case p.accept("::"):
+			tok := p.peek()
+			typ, ok := exprTypeNames[strings.ToLower(tok.text)]
+			if tok.kind != TOK_IDENT || !ok {
+				return nil, p.errorf("bad type %q", tok.text)
+			}
+			p.pos++
+			e = &Expr{Op: EXPR_CAST, Type: typ, Kids: []*Expr{e}}
+		default:
+			return e, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parseAccessor(op int, e *Expr) (*Expr, error) {
+	tok := p.peek()
+	p.pos++
+	switch tok.kind {
+	case TOK_STR:
+		return &Expr{Op: op, Val: Value{Type: TYPE_BYTES, Str: []byte(tok.text)}, Kids: []*Expr{e}}, nil
+	case TOK_INT:
+		i, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("bad array index %s", tok.text)
+		}
+		return &Expr{Op: op, Val: Value{Type: TYPE_INT64, I64: i}, Kids: []*Expr{e}}, nil
+	default:
+		return nil, p.errorf("expect a key or an index after the arrow")
+	}
+}
+
+func (p *exprParser) parsePrimary() (*Expr, error) {
+	tok := p.peek()
+	switch {
+	case p.accept("("):
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expect )")
+		}
+		return e, nil
+	case tok.kind == TOK_INT:
+		p.pos++
+		i, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("bad integer %s", tok.text)
+		}
+		return &Expr{Op: EXPR_LIT, Val: Value{Type: TYPE_INT64, I64: i}}, nil
+	case tok.kind == TOK_STR:
+		p.pos++
+		return &Expr{Op: EXPR_LIT, Val: Value{Type: TYPE_BYTES, Str: []byte(tok.text)}}, nil
+	case tok.kind == TOK_IDENT:
+		p.pos++
+		if p.accept("(") {
+			return p.parseCall(strings.ToLower(tok.text))
+		}
+		return &Expr{Op: EXPR_COL, Name: tok.text}, nil
+	case tok.kind == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected %q", tok.text)
+	}
+}
+
+// the arguments of a function call after the (
+func (p *exprParser) parseCall(name string) (*Expr, error) {
+	e := &Expr{Op: EXPR_CALL, Name: name}
+	if p.accept(")") {
+		return e, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		e.Kids = append(e.Kids, arg)
+		if p.accept(")") {
+			return e, nil
+		}
+		if !p.accept(",") {
+			return nil, p.errorf("expect , or )")
+		}
+	}
+}
+
+// the type of the expression result
+func exprType(tdef *TableDef, e *Expr) (uint32, error) {
+	kids := make([]uint32, len(e.Kids))
+	for i, kid := range e.Kids {
+		t, err := exprType(tdef, kid)
+		if err != nil {
+			return 0, err
+		}
+		kids[i] = t
+	}
+
+	switch e.Op {
+	case EXPR_COL:
+		idx := colIndex(tdef, e.Name)
+		if idx < 0 {
+			return 0, fmt.Errorf("unknown column: %s", e.Name)
+		}
+		return tdef.Types[idx], nil
+	case EXPR_LIT:
+		return e.Val.Type, nil
+	case EXPR_GET, EXPR_GET_TEXT:
+		if kids[0] != TYPE_JSON {
+			return 0, fmt.Errorf("JSON accessor on a non-JSON value: %s", e)
+		}
+		if e.Op == EXPR_GET {
+			return TYPE_JSON, nil
+		}
+		return TYPE_BYTES, nil
+	case EXPR_CAST:
+		return e.Type, nil
+	case EXPR_EQ, EXPR_NE, EXPR_LT, EXPR_LE, EXPR_GT, EXPR_GE:
+		if kids[0] != kids[1] {
+			return 0, fmt.Errorf("comparison of different types: %s", e)
+		}
+		return TYPE_INT64, nil
+	case EXPR_AND, EXPR_OR, EXPR_NOT:
+		for _, t := range kids {
+			if t != TYPE_INT64 {
+				return 0, fmt.Errorf("boolean operator on a non-int64 value: %s", e)
+			}
+		}
+		return TYPE_INT64, nil
+	case EXPR_ADD, EXPR_SUB, EXPR_MUL, EXPR_DIV, EXPR_MOD:
+		if kids[0] != TYPE_INT64 || kids[1] != TYPE_INT64 {
+			return 0, fmt.Errorf("arithmetic on a non-int64 value: %s", e)
+		}
+		return TYPE_INT64, nil
+	case EXPR_CALL:
+		fn, ok := exprFuncs[e.Name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function: %s", e.Name)
+		}
+		if len(kids) != len(fn.args) {
+			return 0, fmt.Errorf("%s() takes %d arguments", e.Name, len(fn.args))
+		}
+		for i, t := range kids {
+			if t != fn.args[i] {
+				return 0, fmt.Errorf("argument %d of %s() has the wrong type", i+1, e.Name)
+			}
+		}
+		return fn.ret, nil
+	default:
+		panic("what?")
+	}
+}
+
+// evaluate the expression on a row
+func evalExpr(e *Expr, rec Record) (Value, error) {
+	switch e.Op {
+	case EXPR_COL:
+		v := rec.Get(e.Name)
+		if v == nil {
+			return Value{}, fmt.Errorf("unknown column: %s", e.Name)
+		}
+		return *v, nil
+	case EXPR_LIT:
+		return e.Val, nil
+	case EXPR_AND, EXPR_OR:
+		left, err := evalExpr(e.Kids[0], rec)
+		if err != nil {
+			return Value{}, err
+		}
+		// short circuit
+		if (left.I64 != 0) == (e.Op == EXPR_OR) {
+			return exprBool(left.I64 != 0), nil
+		}
+		right, err := evalExpr(e.Kids[1], rec)
+		if err != nil {
+			return Value{}, err
+		}
+		return exprBool(right.I64 != 0), nil
+	}
+
+	kids := make([]Value, len(e.Kids))
+	for i, kid := range e.Kids {
+		v, err := evalExpr(kid, rec)
+		if err != nil {
+			return Value{}, err
+		}
+		kids[i] = v
+	}
+	switch e.Op {
+	case EXPR_GET, EXPR_GET_TEXT:
+		raw, err := jsonGet(kids[0].Str, e.Val)
+		if err != nil {
+			return Value{}, err
+		}
+		if e.Op == EXPR_GET {
+			return Value{Type: TYPE_JSON, Str: raw}, nil
+		}
+		return Value{Type: TYPE_BYTES, Str: jsonText(raw)}, nil
+	case EXPR_CAST:
+		return castValue(kids[0], e.Type)
+	case EXPR_NOT:
+		return exprBool(kids[0].I64 == 0), nil
+	case EXPR_ADD, EXPR_SUB, EXPR_MUL, EXPR_DIV, EXPR_MOD:
+		return evalArith(e.Op, kids[0], kids[1])
+	case EXPR_CALL:
+		fn, ok := exprFuncs[e.Name]
+		if !ok {
+			return Value{}, fmt.Errorf("unknown function: %s", e.Name)
+		}
+		return fn.call(kids)
+	case EXPR_EQ, EXPR_NE, EXPR_LT, EXPR_LE, EXPR_GT, EXPR_GE:
+		if kids[0].Type != kids[1].Type {
+			return Value{}, fmt.Errorf("comparison of different types: %s", e)
+		}
+		r := compareValues(kids[0], kids[1])
+		ok := map[int]bool{
+			EXPR_EQ: r == 0, EXPR_NE: r != 0, EXPR_LT: r < 0,
+			EXPR_LE: r <= 0, EXPR_GT: r > 0, EXPR_GE: r >= 0,
+		}[e.Op]
+		return exprBool(ok), nil
+	default:
+		panic("what?")
+	}
+}
+
+func evalArith(op int, a Value, b Value) (Value, error) {
+	if a.Type != TYPE_INT64 || b.Type != TYPE_INT64 {
+		return Value{}, fmt.Errorf("arithmetic on a non-int64 value")
+	}
+	x, y := a.I64, b.I64
+	out := Value{Type: TYPE_INT64}
+	switch op {
+	case EXPR_ADD:
+		out.I64 = x + y
+	case EXPR_SUB:
+		out.I64 = x - y
+	case EXPR_MUL:
+		out.I64 = x * y
+	case EXPR_DIV, EXPR_MOD:
+		if y == 0 {
+			return Value{}, fmt.Errorf("division by zero")
+		}
+		if op == EXPR_DIV {
+			out.I64 = x / y
+		} else {
+			out.I64 = x % y
+		}
+	default:
+		panic("what?")
+	}
+	return out, nil
+}
+
+func exprBool(b bool) Value {
+	v := Value{Type: TYPE_INT64}
+	if b {
+		v.I64 = 1
+	}
+	return v
+}
+
+// compare values of the same type in the order of their encodings
+func compareValues(a Value, b Value) int {
+	return bytes.Compare(encodeValues(nil, []Value{a}), encodeValues(nil, []Value{b}))
+}
+
+// the compact JSON value of an object key or an array index.
+// missing values are JSON null.
+func jsonGet(doc []byte, key Value) ([]byte, error) {
+	var raw json.RawMessage
+	if key.Type == TYPE_BYTES {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(doc, &obj) == nil {
+			raw = obj[string(key.Str)]
+		}
+	} else {
+		var arr []json.RawMessage
+		if json.Unmarshal(doc, &arr) == nil && key.I64 >= 0 && key.I64 < int64(len(arr)) {
+			raw = arr[key.I64]
+		}
+	}
+	if raw == nil {
+		return []byte("null"), nil
+	}
+	out := bytes.Buffer{}
+	if err := json.Compact(&out, raw); err != nil {
+		return nil, fmt.Errorf("bad JSON: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// the text of a JSON value: strings are unquoted, null is empty
+func jsonText(raw []byte) []byte {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return []byte(s)
+	}
+	if string(raw) == "null" {
+		return []byte{}
+	}
+	return raw
+}
+
+func castValue(v Value, typ uint32) (Value, error) {
+	if v.Type == typ {
+		return v, nil
+	}
+	text := v.Str
+	if v.Type == TYPE_INT64 {
+		text = []byte(strconv.FormatInt(v.I64, 10))
+	} else if v.Type == TYPE_JSON {
+		text = jsonText(v.Str)
+	}
+
+	switch typ {
+	case TYPE_BYTES:
+		return Value{Type: TYPE_BYTES, Str: text}, nil
+	case TYPE_INT64:
+		if len(text) == 0 {
+			return Value{Type: TYPE_INT64}, nil
+		}
+		i, err := strconv.ParseInt(string(text), 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("can't cast %q to int64", text)
+		}
+		return Value{Type: TYPE_INT64, I64: i}, nil
+	case TYPE_JSON:
+		// the text is parsed as JSON
+		out := bytes.Buffer{}
+		if err := json.Compact(&out, text); err != nil {
+			return Value{}, fmt.Errorf("can't cast %q to JSON", text)
+		}
+		return Value{Type: TYPE_JSON, Str: out.Bytes()}, nil
+	default:
+		panic("what?")
+	}
+}
+
+// parse and type-check an expression on the table
+func tableExpr(tdef *TableDef, text string) (*Expr, uint32, error) {
+	e, err := ParseExpr(text)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ, err := exprType(tdef, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e, typ, nil
+}
+
+// the type of a column or an expression
+func colType(tdef *TableDef, col string) uint32 {
+	if idx := colIndex(tdef, col); idx >= 0 {
+		return tdef.Types[idx]
+	}
+	_, typ, err := tableExpr(tdef, col)
+	Assert(err == nil, "bad expression column")
+	return typ
+}
+
+// the value of a column or an expression.
+// `vals` are in the order of `tdef.Cols`.
+func colValue(tdef *TableDef, col string, vals []Value) (Value, error) {
+	if idx := colIndex(tdef, col); idx >= 0 {
+		return vals[idx], nil
+	}
+	e, _, err := tableExpr(tdef, col)
+	if err != nil {
+		return Value{}, err
+	}
+	return evalExpr(e, Record{Cols: tdef.Cols, Vals: vals})
+}
+
+// expression columns are matched by their canonical text
+func canonicalCol(tdef *TableDef, col string) (string, error) {
+	if colIndex(tdef, col) >= 0 {
+		return col, nil
+	}
+	e, _, err := tableExpr(tdef, col)
+	if err != nil {
+		return "", err
+	}
+	return e.String(), nil
+}
+
+// the terms of a chain of ANDs
+func exprConjuncts(e *Expr, out []*Expr) []*Expr {
+	if e.Op == EXPR_AND {
+		out = exprConjuncts(e.Kids[0], out)
+		return exprConjuncts(e.Kids[1], out)
+	}
+	return append(out, e)
+}
+
+// the canonical text of the terms of a chain of ANDs
+func exprCondSet(e *Expr) map[string]bool {
+	conds := map[string]bool{}
+	if e != nil {
+		for _, c := range exprConjuncts(e, nil) {
+			conds[c.String()] = true
+		}
+	}
+	return conds
+}
@@ -0,0 +1,278 @@
+package relixdb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// + parent table name: the JSON list of the tables referencing it
+const META_FK_CHILDREN = "fkref:"
+
+// a foreign key references the primary key of the parent table.
+// a child row whose foreign key columns are all zero values is NULL
+// and doesn't reference anything.
+type ForeignKey struct {
+	Cols     []string // the child columns, in the order of the parent key
+	Table    string   // the parent table
+	OnDelete int      // FK_RESTRICT, FK_CASCADE or FK_SET_NULL
+}
+
+// verify the foreign keys of a new table, and add an index on the child
+// columns if there is none, so that parent deletes don't scan the table.
+func checkForeignKeys(db *DB, tdef *TableDef) error {
+	for _, fk := range tdef.ForeignKeys {
+		parent := tdef
+		if fk.Table != tdef.Name {
+			parent = getTableDef(db, fk.Table)
+		}
+		if parent == nil {
+			return fmt.Errorf("foreign key references unknown table: %s", fk.Table)
+		}
+		if len(fk.Cols) != parent.PKeys {
+			return fmt.Errorf("foreign key %v must match the primary key of %s", fk.Cols, fk.Table)
+		}
+		for i, c := range fk.Cols {
+			idx := colIndex(tdef, c)
+			if idx < 0 {
+				return fmt.Errorf("unknown column in foreign key: %s", c)
+			}
+			if tdef.Types[idx] != parent.Types[i] {
+				return fmt.Errorf("foreign key column %s has a different type than %s.%s",
+					c, fk.Table, parent.Cols[i])
+			}
+			if fk.OnDelete == FK_SET_NULL && (idx < tdef.PKeys || colNotNull(tdef, idx)) {
+				return fmt.Errorf("foreign key column %s can't be set to NULL", c)
+			}
+		}
+		switch fk.OnDelete {
+		case FK_RESTRICT, FK_CASCADE, FK_SET_NULL:
+		default:
+			return fmt.Errorf("bad foreign key action: %d", fk.OnDelete)
+		}
+
+		if !fkIndexed(tdef, fk) {
+			index, err := checkIndexKeys(tdef, append([]string{}, fk.Cols...))
+			if err != nil {
+				return err
+			}
+			tdef.Indexes = append(tdef.Indexes, index)
+			if len(tdef.IndexWhere) > 0 {
+				tdef.IndexWhere = append(tdef.IndexWhere, "")
+			}
+		}
+	}
+	return nil
+}
+
+// can the child rows be found without a full scan?
+func fkIndexed(tdef *TableDef, fk ForeignKey) bool {
+	if isPrefix(tdef.Cols[:tdef.PKeys], fk.Cols) {
+		return true
+	}
+	for _, index := range tdef.Indexes {
+		if isPrefix(index, fk.Cols) {
+			return true
+		}
+	}
+	return false
+}
+
+// the foreign key columns of a row; nil for NULL.
+// `vals` are in the order of `tdef.Cols`.
+func fkValues(tdef *TableDef, fk ForeignKey, vals []Value) []Value {
+	out := make([]Value, len(fk.Cols))
+	for i, c := range fk.Cols {
+		out[i] = vals[colIndex(tdef, c)]
+	}
+	if fkNull(out) {
+		return nil
+	}
+	return out
+}
+
+// all zero values are NULL for foreign keys
+func fkNull(vals []Value) bool {
+	for _, v := range vals {
+		if v.I64 != 0 || len(v.Str) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the referenced parent rows must exist
+func fkCheckRow(db *DB, tdef *TableDef, vals []Value) error {
+	for _, fk := range tdef.ForeignKeys {
+		key := fkValues(tdef, fk, vals)
+		if key == nil {
+			continue
+		}
+		parent := getTableDef(db, fk.Table)
+		if parent == nil {
+			return fmt.Errorf("table not found: %s", fk.Table)
+		}
+		rec := Record{Cols: parent.Cols[:parent.PKeys], Vals: key}
+		ok, err := dbGet(db, parent, &rec)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("foreign key %v violated: no row in %s", fk.Cols, fk.Table)
+		}
+	}
+	return nil
+}
+
+// the names of the tables with foreign keys referencing `name`,
+// kept in `@meta` since internal keys share the prefix of `@table`.
+func fkChildren(db *DB, name string) ([]string, error) {
+	meta := (&Record{}).AddStr("key", []byte(META_FK_CHILDREN+name))
+	ok, err := dbGet(db, TDEF_META, meta)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var names []string
+	if err := json.Unmarshal(meta.Get("val").Str, &names); err != nil {
+		return nil, fmt.Errorf("bad foreign key references of %s: %w", name, err)
+	}
+	return names, nil
+}
+
+// record a new table in the references of its parent tables
+func fkAddChild(db *DB, tdef *TableDef) error {
+	added := map[string]bool{}
+	for _, fk := range tdef.ForeignKeys {
+		if added[fk.Table] {
+			continue
+		}
+		added[fk.Table] = true
+		names, err := fkChildren(db, fk.Table)
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(append(names, tdef.Name))
+		Assert(err == nil, "unable to marshal references")
+		meta := (&Record{}).AddStr("key", []byte(META_FK_CHILDREN+fk.Table)).AddStr("val", val)
+		if _, err := dbUpdate(db, TDEF_META, *meta, MODE_UPSERT); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject the delete of a parent row referenced by RESTRICT, through the
+// CASCADE deletes too. it's checked before the tree is changed, since a
+// failed statement can't be rolled back inside a transaction.
+func fkCheckDelete(db *DB, parent *TableDef, pk []Value, seen map[string]bool) error {
+	if fkNull(pk) {
+		return nil
+	}
+	key := string(encodeKey(nil, parent.Prefix, pk))
+	if seen[key] {
+		return nil // a cycle of cascades
+	}
+	seen[key] = true
+	children, err := fkChildren(db, parent.Name)
+	if err != nil {
+		return err
+	}
+	for _, name := range children {
+		child := getTableDef(db, name)
+		if child == nil {
+			return fmt.Errorf("table not found: %s", name)
+		}
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != parent.Name || fk.OnDelete == FK_SET_NULL {
+				continue
+			}
+			rows, err := fkFindRows(db, child, fk, pk)
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 && fk.OnDelete == FK_RESTRICT {
+				return fkRestricted(child, fk)
+			}
+			for _, row := range rows {
+				if err := fkCheckDelete(db, child, row.Vals[:child.PKeys], seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply the ON DELETE actions after a parent row is deleted
+func fkOnDelete(db *DB, parent *TableDef, pk []Value) error {
+	if fkNull(pk) {
+		// the key is NULL as a foreign key, it can't be referenced
+		return nil
+	}
+	children, err := fkChildren(db, parent.Name)
+	if err != nil {
+		return err
+	}
+	for _, name := range children {
+		child := getTableDef(db, name)
+		if child == nil {
+			return fmt.Errorf("table not found: %s", name)
+		}
+		for _, fk := range child.ForeignKeys {
+			if fk.Table != parent.Name {
+				continue
+			}
+			rows, err := fkFindRows(db, child, fk, pk)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if err := fkAction(db, child, fk, row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// the child rows referencing the parent key
+func fkFindRows(db *DB, child *TableDef, fk ForeignKey, pk []Value) ([]Record, error) {
+	key := Record{Cols: fk.Cols, Vals: pk}
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key}
+	if err := dbScan(db, child, &sc); err != nil {
+		return nil, err
+	}
+	// collect the rows before modifying the tree
+	var rows []Record
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.deref(&rec); err != nil {
+			return nil, err
+		}
+		rows = append(rows, rec)
+	}
+	return rows, nil
+}
+
+func fkAction(db *DB, child *TableDef, fk ForeignKey, row Record) error {
+	switch fk.OnDelete {
+	case FK_RESTRICT:
+		return fkRestricted(child, fk)
+	case FK_CASCADE:
+		_, err := dbDelete(db, child, row)
+		return err
+	case FK_SET_NULL:
+		for _, c := range fk.Cols {
+			v := row.Get(c)
+			*v = Value{Type: v.Type}
+		}
+		_, err := dbUpdate(db, child, row, MODE_UPDATE_ONLY)
+		return err
+	default:
+		panic("what?")
+	}
+}
+
+func fkRestricted(child *TableDef, fk ForeignKey) error {
+	return fmt.Errorf("foreign key %v violated: the row is referenced by %s", fk.Cols, child.Name)
+}
@@ -12,6 +12,8 @@ type FreeList struct {
 	get func(uint64) BNode  // dereference a pointer
 	new func(BNode) uint64  // append a new page
 	use func(uint64, BNode) // reuse a page
+	// the page size, 0: BTREE_PAGE_SIZE
+	psize int
 }
 
 // the in-memory data structure that is updated and committed by transactions
@@ -23,6 +25,28 @@ type FreeListData struct {
 	total int
 	// cached number of discarded items in the tail node.
 	offset int
+	// pages freed by recent versions, they are added to the list
+	// once all readers are at or after the version.
+	pending []pendingPage
+	// the tree of the pending pages on disk, see pendingCommit()
+	pendingRoot uint64
+}
+
+type pendingPage struct {
+	ptr     uint64
+	version uint64 // the first version that can't reach the page
+}
+
+func (fl *FreeList) pageSize() int {
+	if fl.psize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return fl.psize
+}
+
+// the number of pointers in a list node, FREE_LIST_CAP for the default page size
+func (fl *FreeList) cap() int {
+	return (fl.pageSize() - FREE_LIST_HEADER) / 8
 }
 
 // Functions for accessing the list node:
@@ -69,10 +93,11 @@ func (fl *FreeList) Total() int {
 		return 0
 	}
 
+	// the total is stored in the head node
 	firstNode := fl.get(fl.head)
-	total := flnSize(firstNode)
+	total := binary.LittleEndian.Uint64(firstNode.data[4:12])
 
-	return total
+	return int(total)
 }
 
 // get the nth pointer
@@ -98,7 +123,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 	// prepare to construct the new list
 	total := fl.Total()
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	for fl.head != 0 && (popn > 0 || len(reuse)*fl.cap() < len(freed)) {
 		node := fl.get(fl.head)
 		freed = append(freed, fl.head) // recycle the node itself
 		if popn >= flnSize(node) {
@@ -111,7 +136,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 			remain := flnSize(node) - popn
 			popn = 0
 			// resuse pointers from the list itself
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
+			for remain > 0 && len(reuse)*fl.cap() < len(freed)+remain {
 				remain--
 				reuse = append(reuse, flnPtr(node, remain))
 			}
@@ -126,12 +151,14 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 		fl.head = flnNext(node)
 	}
 
-	Assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0, "error in update free list")
+	Assert(len(reuse)*fl.cap() >= len(freed) || fl.head == 0, "error in update free list")
 
 	// phase 3 : prepend new nodes
 	flPush(fl, freed, reuse)
 	// done
-	flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+	if fl.head != 0 {
+		flnSetTotal(fl.get(fl.head), uint64(total+len(freed)))
+	}
 }
 
 // func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
@@ -208,7 +235,7 @@ func (fl *FreeList) Add(freed []uint64) {
 
 	// Prepare to construct new nodes
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	for fl.head != 0 && len(reuse)*fl.cap() < len(freed) {
 		node := fl.get(fl.head)
 		freed = append(freed, fl.head) // Recycle the node itself
 
@@ -229,12 +256,12 @@ func (fl *FreeList) Add(freed []uint64) {
 // Helper to push nodes into the free list
 func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
 	for len(freed) > 0 {
-		newNode := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		newNode := BNode{make([]byte, fl.pageSize())}
 
 		// Create a new node
 		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+		if size > fl.cap() {
+			size = fl.cap()
 		}
 
 		flnSetHeader(newNode, uint16(size), fl.head)
@@ -0,0 +1,323 @@
+package relixdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// time travel: the roots of the recent versions are kept in a log, and the
+// pages freed by later versions are not reused until the versions that can
+// reach them leave the retention window. both are stored in a B-tree
+// referenced by the master page, so the window survives restarts.
+// compacting into a new file drops the history, compacting in place is
+// refused while it's enabled.
+//
+// the keys of the history tree:
+// "o":                 | max_versions 8B | max_age 8B |
+// "p" version8 seq4:   the pages freed by the version, 8B pointers
+// "r" version8:        | root 8B | time 8B |
+// the version numbers of the keys are big-endian for the key order.
+
+const (
+	HISTORY_OPTS  = 'o'
+	HISTORY_PAGES = 'p'
+	HISTORY_ROOT  = 'r'
+)
+
+// the retention window of the history, the latest version is always kept
+type HistoryOpts struct {
+	MaxVersions uint64        // 0: no limit
+	MaxAge      time.Duration // 0: no limit
+}
+
+// the history of a version, saved and rolled back with the tree
+type historyState struct {
+	root uint64 // the history tree, 0: disabled
+	opts HistoryOpts
+	log  []historyRoot // the versions in the window, never modified in place
+}
+
+type historyRoot struct {
+	version uint64
+	root    uint64
+	time    time.Time
+}
+
+// keep the versions from now on within the window of `opts`.
+// the window starts at the latest version if the history is disabled.
+func (db *KV) EnableHistory(opts HistoryOpts) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	if db.hist.root == 0 {
+		// the pending pages are only in memory until now
+		db.hist.log = []historyRoot{{db.version, db.tree.root, time.Now()}}
+		historyUpdate(db, func(tree *BTree) {
+			tree.Insert(historyKey(HISTORY_ROOT, db.version), historyRootVal(db.hist.log[0]))
+			historyAddPages(tree, db.free.pending)
+		})
+		// the history tree keeps them from now on
+		pendingUpdate(db, func(tree *BTree) {
+			tree.DeleteRange(nil, nil)
+		})
+	}
+	db.hist.opts = opts
+	historyUpdate(db, func(tree *BTree) {
+		var val [16]byte
+		binary.LittleEndian.PutUint64(val[0:], opts.MaxVersions)
+		binary.LittleEndian.PutUint64(val[8:], uint64(opts.MaxAge))
+		tree.Insert([]byte{HISTORY_OPTS}, val[:])
+	})
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// drop the history, the pages kept for it are reused once the readers are gone
+func (db *KV) DisableHistory() error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.hist.root == 0 {
+		return nil
+	}
+	saved := db.saveState()
+	var drop func(ptr uint64)
+	drop = func(ptr uint64) {
+		node := db.pageGet(ptr)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				drop(node.getPtr(i))
+			}
+		}
+		db.page.released = append(db.page.released, ptr)
+	}
+	drop(db.hist.root)
+	db.hist = historyState{}
+	// the pending pages are kept by the pending tree from now on
+	pendingUpdate(db, func(tree *BTree) {
+		historyAddPages(tree, db.free.pending)
+	})
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// the latest committed version
+func (db *KV) Version() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.version
+}
+
+// the oldest and the latest versions in the history window
+func (db *KV) HistoryRange() (uint64, uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	log, err := historyLog(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	return log[0].version, log[len(log)-1].version, nil
+}
+
+// the version that was the latest at time `t`
+func (db *KV) VersionAt(t time.Time) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	log, err := historyLog(db)
+	if err != nil {
+		return 0, err
+	}
+	i, _ := slices.BinarySearchFunc(log, t, func(h historyRoot, t time.Time) int {
+		return h.time.Compare(t)
+	})
+	for i < len(log) && !log[i].time.After(t) {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("no version at %s in the history", t.Format(time.RFC3339Nano))
+	}
+	return log[i-1].version, nil
+}
+
+// begin a read-only transaction on a version in the history window.
+// the pages of the version are kept until EndRead, even if the window moves on.
+func (db *KV) BeginReadAsOf(tx *KVReader, version uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	root, err := historyFind(db, version)
+	if err != nil {
+		return err
+	}
+	db.beginRead(tx, root, version)
+	return nil
+}
+
+// the committed log, the caller holds `mu`
+func historyLog(db *KV) ([]historyRoot, error) {
+	if !db.historyLoaded {
+		// a follower reloads it after applying the primary's updates
+		if err := historyLoad(db); err != nil {
+			return nil, err
+		}
+	}
+	if len(db.history) == 0 {
+		return nil, fmt.Errorf("the history is disabled")
+	}
+	return db.history, nil
+}
+
+// the root of a version in the committed log, the caller holds `mu`
+func historyFind(db *KV, version uint64) (uint64, error) {
+	log, err := historyLog(db)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := slices.BinarySearchFunc(log, version, func(h historyRoot, v uint64) int {
+		return cmpUint64(h.version, v)
+	})
+	if !ok {
+		return 0, fmt.Errorf("version %d is not in the history", version)
+	}
+	return log[i].root, nil
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+// read the history tree of the master page
+func historyLoad(db *KV) error {
+	db.historyLoaded = true
+	db.history = nil
+	if db.hist.root == 0 {
+		return nil
+	}
+	tree := BTree{root: db.hist.root, psize: db.tree.psize}
+	tree.get = func(ptr uint64) BNode { return pageGetMapped(db, ptr) }
+	log := []historyRoot{}
+	pending := []pendingPage{}
+	for key, val := range tree.scanSeq(nil, nil, ScanOpts{}) {
+		switch {
+		case key[0] == HISTORY_OPTS && len(val) == 16:
+			db.hist.opts.MaxVersions = binary.LittleEndian.Uint64(val[0:])
+			db.hist.opts.MaxAge = time.Duration(binary.LittleEndian.Uint64(val[8:]))
+		case key[0] == HISTORY_PAGES && len(key) == 13 && len(val)%8 == 0:
+			version := binary.BigEndian.Uint64(key[1:])
+			for i := 0; i < len(val); i += 8 {
+				pending = append(pending, pendingPage{binary.LittleEndian.Uint64(val[i:]), version})
+			}
+		case key[0] == HISTORY_ROOT && len(key) == 9 && len(val) == 16:
+			log = append(log, historyRoot{
+				version: binary.BigEndian.Uint64(key[1:]),
+				root:    binary.LittleEndian.Uint64(val[0:]),
+				time:    time.Unix(0, int64(binary.LittleEndian.Uint64(val[8:]))),
+			})
+		default:
+			return fmt.Errorf("bad history key: %q", key)
+		}
+	}
+	if len(log) == 0 {
+		return fmt.Errorf("empty history")
+	}
+	db.hist.log = log
+	db.history = log
+	db.free.pending = pending
+	return nil
+}
+
+// record the version being committed, and move the window.
+// returns the oldest version that can still be read, the pages freed after
+// it are kept. the caller holds the writer lock.
+func historyCommit(db *KV, freed []pendingPage, minReader uint64) uint64 {
+	now := time.Now()
+	h := historyRoot{db.version + 1, db.tree.root, now}
+	log := append(db.hist.log, h)
+	opts := db.hist.opts
+	for len(log) > 1 {
+		tooMany := opts.MaxVersions > 0 && uint64(len(log)) > opts.MaxVersions
+		tooOld := opts.MaxAge > 0 && now.Sub(log[0].time) > opts.MaxAge
+		if !tooMany && !tooOld {
+			break
+		}
+		log = log[1:]
+	}
+	db.hist.log = log
+
+	oldest := log[0].version
+	if versionBefore(minReader, oldest) {
+		oldest = minReader
+	}
+	historyUpdate(db, func(tree *BTree) {
+		tree.Insert(historyKey(HISTORY_ROOT, h.version), historyRootVal(h))
+		historyAddPages(tree, freed)
+		// the versions before the window, and the pages to be reused
+		tree.DeleteRange(historyKey(HISTORY_ROOT, 0), historyKey(HISTORY_ROOT, log[0].version))
+		tree.DeleteRange(historyKey(HISTORY_PAGES, 0), historyKey(HISTORY_PAGES, oldest+1))
+	})
+	return oldest
+}
+
+// update the history tree. its old pages are reused right after the commit,
+// since only the writer reads it.
+func historyUpdate(db *KV, fn func(tree *BTree)) {
+	tree := BTree{root: db.hist.root, get: db.pageGet, new: db.pageNew, psize: db.tree.psize}
+	tree.del = func(ptr uint64) {
+		delete(db.page.updates, ptr) // a new page of this transaction
+		db.page.released = append(db.page.released, ptr)
+	}
+	fn(&tree)
+	db.hist.root = tree.root
+}
+
+func historyKey(kind byte, version uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = kind
+	binary.BigEndian.PutUint64(key[1:], version)
+	return key
+}
+
+func historyRootVal(h historyRoot) []byte {
+	val := make([]byte, 16)
+	binary.LittleEndian.PutUint64(val[0:], h.root)
+	binary.LittleEndian.PutUint64(val[8:], uint64(h.time.UnixNano()))
+	return val
+}
+
+// add the freed pages, grouped by the version
+func historyAddPages(tree *BTree, pages []pendingPage) {
+	pages = slices.Clone(pages)
+	slices.SortFunc(pages, func(a, b pendingPage) int {
+		return cmpUint64(a.version, b.version)
+	})
+	limit := tree.maxValSize() / 8
+	for i := 0; i < len(pages); {
+		version := pages[i].version
+		val := []byte{}
+		seq := uint32(0)
+		flush := func() {
+			key := binary.BigEndian.AppendUint32(historyKey(HISTORY_PAGES, version), seq)
+			tree.Insert(key, val)
+			val, seq = []byte{}, seq+1
+		}
+		for ; i < len(pages) && pages[i].version == version; i++ {
+			val = binary.LittleEndian.AppendUint64(val, pages[i].ptr)
+			if len(val)/8 == limit {
+				flush()
+			}
+		}
+		if len(val) > 0 {
+			flush()
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package relixdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+)
+
+// importing and exporting tables as CSV or JSON Lines.
+// CSV headers and JSON object keys are column names. an empty CSV cell,
+// a JSON null or a missing key is an omitted column.
+
+// the default number of rows per transaction of an import
+const IMPORT_BATCH_DEFAULT = 1000
+
+// the number of skipped row errors kept in ImportStats
+const IMPORT_MAX_ERRORS = 100
+
+// options for importing rows
+type ImportOpts struct {
+	Format    int // FORMAT_CSV or FORMAT_JSONL
+	Mode      int // MODE_UPSERT or MODE_INSERT_ONLY, an existing row is an error
+	OnError   int // IMPORT_ABORT or IMPORT_SKIP
+	BatchSize int // rows per transaction, 0: IMPORT_BATCH_DEFAULT
+}
+
+// the result of an import
+type ImportStats struct {
+	Rows    int     // the imported rows
+	Skipped int     // the bad rows skipped by IMPORT_SKIP
+	Errors  []error // the errors of the first IMPORT_MAX_ERRORS skipped rows
+}
+
+// options for exporting rows
+type ExportOpts struct {
+	Format int // FORMAT_CSV or FORMAT_JSONL
+	// the range of the primary key, same as the Scanner.
+	// leave both Cmp1 and Cmp2 unset to export the whole table.
+	Cmp1 int
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+}
+
+// a bad row of the input, can be skipped
+type importRowError struct {
+	line int
+	err  error
+}
+
+func (e *importRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+func (e *importRowError) Unwrap() error {
+	return e.err
+}
+
+// read rows from `r` and add them to the table in batches of transactions.
+// on an error, the rows of the previous batches are kept.
+func (db *DB) Import(table string, r io.Reader, opts ImportOpts) (ImportStats, error) {
+	stats := ImportStats{}
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return stats, fmt.Errorf("table not found: %s", table)
+	}
+	if opts.Mode != MODE_UPSERT && opts.Mode != MODE_INSERT_ONLY {
+		return stats, fmt.Errorf("bad import mode: %d", opts.Mode)
+	}
+	if opts.OnError != IMPORT_ABORT && opts.OnError != IMPORT_SKIP {
+		return stats, fmt.Errorf("bad import error handling: %d", opts.OnError)
+	}
+	if opts.BatchSize < 0 {
+		return stats, fmt.Errorf("bad batch size: %d", opts.BatchSize)
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = IMPORT_BATCH_DEFAULT
+	}
+
+	var next func() (Record, int, error)
+	switch opts.Format {
+	case FORMAT_CSV:
+		var err error
+		if next, err = csvRows(tdef, r); err != nil {
+			return stats, err
+		}
+	case FORMAT_JSONL:
+		next = jsonlRows(tdef, r)
+	default:
+		return stats, fmt.Errorf("bad format: %d", opts.Format)
+	}
+
+	tx := DBTX{}
+	pending := -1 // the rows in the transaction, -1: no transaction
+	for {
+		rec, line, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if pending < 0 {
+				db.Begin(&tx)
+				pending = 0
+			}
+			if err = importRow(&tx, tdef, rec, opts.Mode); err != nil {
+				err = &importRowError{line, err}
+			}
+		}
+		var rowErr *importRowError
+		if err != nil && opts.OnError == IMPORT_SKIP && errors.As(err, &rowErr) {
+			stats.Skipped++
+			if len(stats.Errors) < IMPORT_MAX_ERRORS {
+				stats.Errors = append(stats.Errors, err)
+			}
+			continue
+		}
+		if err != nil {
+			if pending >= 0 {
+				db.Abort(&tx)
+			}
+			return stats, err
+		}
+
+		pending++
+		if pending == opts.BatchSize {
+			if err := db.Commit(&tx); err != nil {
+				return stats, err
+			}
+			stats.Rows += pending
+			pending = -1
+		}
+	}
+	if pending >= 0 {
+		if err := db.Commit(&tx); err != nil {
+			return stats, err
+		}
+		stats.Rows += pending
+	}
+	return stats, nil
+}
+
+func importRow(tx *DBTX, tdef *TableDef, rec Record, mode int) error {
+	added, err := tx.Set(tdef.Name, rec, mode)
+	if err != nil {
+		return err
+	}
+	if mode == MODE_INSERT_ONLY && !added {
+		return fmt.Errorf("duplicate primary key")
+	}
+	return nil
+}
+
+// rows from CSV with a header line
+func csvRows(tdef *TableDef, r io.Reader) (func() (Record, int, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // checked by us
+	header, err := cr.Read()
+	if err == io.EOF {
+		return func() (Record, int, error) { return Record{}, 0, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CSV header: %w", err)
+	}
+	cols := make([]int, len(header))
+	for i, name := range header {
+		cols[i] = colIndex(tdef, name)
+		if cols[i] < 0 {
+			return nil, fmt.Errorf("CSV header: unknown column: %s", name)
+		}
+		if slices.Contains(cols[:i], cols[i]) {
+			return nil, fmt.Errorf("CSV header: duplicate column: %s", name)
+		}
+	}
+
+	return func() (Record, int, error) {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return Record{}, 0, io.EOF
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return Record{}, 0, &importRowError{perr.StartLine, perr.Err}
+		}
+		if err != nil {
+			return Record{}, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(fields) != len(cols) {
+			err := fmt.Errorf("expected %d fields, got %d", len(cols), len(fields))
+			return Record{}, 0, &importRowError{line, err}
+		}
+		rec := Record{}
+		for i, s := range fields {
+			if s == "" {
+				continue // omitted
+			}
+			v, err := parseTextValue(tdef.Types[cols[i]], s)
+			if err != nil {
+				err = fmt.Errorf("column %s: %w", tdef.Cols[cols[i]], err)
+				return Record{}, 0, &importRowError{line, err}
+			}
+			rec.Cols = append(rec.Cols, tdef.Cols[cols[i]])
+			rec.Vals = append(rec.Vals, v)
+		}
+		return rec, line, nil
+	}, nil
+}
+
+// a value from its text in CSV
+func parseTextValue(typ uint32, s string) (Value, error) {
+	switch typ {
+	case TYPE_INT64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("bad int64: %q", s)
+		}
+		return Value{Type: TYPE_INT64, I64: i}, nil
+	case TYPE_BYTES:
+		return Value{Type: TYPE_BYTES, Str: []byte(s)}, nil
+	case TYPE_JSON:
+		if !json.Valid([]byte(s)) {
+			return Value{}, fmt.Errorf("invalid JSON")
+		}
+		return Value{Type: TYPE_JSON, Str: []byte(s)}, nil
+	default:
+		return Value{}, fmt.Errorf("unsupported type: %d", typ)
+	}
+}
+
+// rows from JSON objects, one per line. blank lines are ignored.
+func jsonlRows(tdef *TableDef, r io.Reader) func() (Record, int, error) {
+	br := bufio.NewReader(r)
+	line := 0
+	return func() (Record, int, error) {
+		for {
+			data, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return Record{}, 0, err
+			}
+			if err == io.EOF && len(data) == 0 {
+				return Record{}, 0, io.EOF
+			}
+			line++
+			if len(bytes.TrimSpace(data)) == 0 {
+				continue
+			}
+			rec, err := parseJSONRow(tdef, data)
+			if err != nil {
+				return Record{}, 0, &importRowError{line, err}
+			}
+			return rec, line, nil
+		}
+	}
+}
+
+func parseJSONRow(tdef *TableDef, data []byte) (Record, error) {
+	obj := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return Record{}, fmt.Errorf("bad JSON object: %w", err)
+	}
+	rec := Record{}
+	for _, name := range slices.Sorted(maps.Keys(obj)) {
+		idx := colIndex(tdef, name)
+		if idx < 0 {
+			return Record{}, fmt.Errorf("unknown column: %s", name)
+		}
+		raw := obj[name]
+		if string(raw) == "null" {
+			continue // omitted
+		}
+		v, err := parseJSONValue(tdef.Types[idx], raw)
+		if err != nil {
+			return Record{}, fmt.Errorf("column %s: %w", name, err)
+		}
+		rec.Cols = append(rec.Cols, name)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// a value from its JSON representation
+func parseJSONValue(typ uint32, raw json.RawMessage) (Value, error) {
+	switch typ {
+	case TYPE_INT64:
+		i, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("bad int64: %s", raw)
+		}
+		return Value{Type: TYPE_INT64, I64: i}, nil
+	case TYPE_BYTES:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return Value{}, fmt.Errorf("expected a string: %s", raw)
+		}
+		return Value{Type: TYPE_BYTES, Str: []byte(s)}, nil
+	case TYPE_JSON:
+		buf := bytes.Buffer{}
+		if err := json.Compact(&buf, raw); err != nil {
+			return Value{}, fmt.Errorf("invalid JSON")
+		}
+		return Value{Type: TYPE_JSON, Str: buf.Bytes()}, nil
+	default:
+		return Value{}, fmt.Errorf("unsupported type: %d", typ)
+	}
+}
+
+// write the rows of a primary key range to `w` in the primary key order.
+// returns the number of rows.
+func (db *DB) Export(table string, w io.Writer, opts ExportOpts) (int, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return 0, fmt.Errorf("table not found: %s", table)
+	}
+	sc := &Scanner{Cmp1: opts.Cmp1, Cmp2: opts.Cmp2, Key1: opts.Key1, Key2: opts.Key2}
+	if sc.Cmp1 == 0 && sc.Cmp2 == 0 {
+		if len(sc.Key1.Cols) > 0 || len(sc.Key2.Cols) > 0 {
+			return 0, fmt.Errorf("bad range")
+		}
+		sc.Cmp1, sc.Cmp2 = CMP_GE, CMP_LE // the whole table
+	}
+	if err := canonicalKeys(tdef, sc); err != nil {
+		return 0, err
+	}
+	if err := dbScanIndex(db, tdef, sc, -1); err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	var write func(rec Record) error
+	switch opts.Format {
+	case FORMAT_CSV:
+		cw := csv.NewWriter(bw)
+		if err := cw.Write(tdef.Cols); err != nil {
+			return 0, err
+		}
+		fields := make([]string, len(tdef.Cols))
+		write = func(rec Record) error {
+			for i, v := range rec.Vals {
+				fields[i] = formatTextValue(v)
+			}
+			if err := cw.Write(fields); err != nil {
+				return err
+			}
+			cw.Flush() // into `bw`
+			return cw.Error()
+		}
+	case FORMAT_JSONL:
+		write = func(rec Record) error {
+			_, err := bw.Write(append(formatJSONRow(rec), '\n'))
+			return err
+		}
+	default:
+		return 0, fmt.Errorf("bad format: %d", opts.Format)
+	}
+
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.deref(&rec); err != nil {
+			return n, fmt.Errorf("export: %w", err)
+		}
+		if err := write(rec); err != nil {
+			return n, fmt.Errorf("export: %w", err)
+		}
+		n++
+	}
+	if err := bw.Flush(); err != nil {
+		return n, fmt.Errorf("export: %w", err)
+	}
+	return n, nil
+}
+
+// a prefix of the primary key from the text of its columns, as in CSV
+func (db *DB) ParseKey(table string, texts ...string) (Record, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return Record{}, fmt.Errorf("table not found: %s", table)
+	}
+	if len(texts) > tdef.PKeys {
+		return Record{}, fmt.Errorf("too many primary key columns")
+	}
+	rec := Record{}
+	for i, s := range texts {
+		v, err := parseTextValue(tdef.Types[i], s)
+		if err != nil {
+			return Record{}, fmt.Errorf("column %s: %w", tdef.Cols[i], err)
+		}
+		rec.Cols = append(rec.Cols, tdef.Cols[i])
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// the text of a value in CSV
+func formatTextValue(v Value) string {
+	switch v.Type {
+	case TYPE_INT64:
+		return strconv.FormatInt(v.I64, 10)
+	case TYPE_BYTES, TYPE_JSON:
+		return string(v.Str)
+	default:
+		panic("what?")
+	}
+}
+
+// a row as a JSON object with the keys in the column order
+func formatJSONRow(rec Record) []byte {
+	out := []byte{'{'}
+	for i, col := range rec.Cols {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		name, _ := json.Marshal(col)
+		out = append(out, name...)
+		out = append(out, ':')
+		switch v := rec.Vals[i]; v.Type {
+		case TYPE_INT64:
+			out = strconv.AppendInt(out, v.I64, 10)
+		case TYPE_BYTES:
+			str, _ := json.Marshal(string(v.Str))
+			out = append(out, str...)
+		case TYPE_JSON:
+			out = append(out, v.Str...)
+		default:
+			panic("what?")
+		}
+	}
+	return append(out, '}')
+}
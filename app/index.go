@@ -1,12 +1,19 @@
 package relixdb
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
 func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 	icols := map[string]bool{}
-	for _, c := range index {
-		// check the index columns
-		// omitted...
+	for i, c := range index {
+		// check the index columns, expressions are stored in canonical form
+		c, err := canonicalCol(tdef, c)
+		if err != nil {
+			return nil, err
+		}
+		index[i] = c
 		icols[c] = true
 	}
 	// add the primary key to the index
@@ -15,7 +22,7 @@ func checkIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 			index = append(index, c)
 		}
 	}
-	Assert(len(index) < len(tdef.Cols), "index length is larger than columns length")
+	Assert(len(index) <= len(tdef.Cols), "index length is larger than columns length")
 	return index, nil
 }
 
@@ -28,34 +35,150 @@ func colIndex(tdef *TableDef, col string) int {
 	return -1
 }
 
+// the key of an index entry. `vals` are in the order of `tdef.Cols`.
+// nil if the row is excluded from a partial index.
+func indexKey(out []byte, tdef *TableDef, indexNo int, vals []Value) ([]byte, error) {
+	index := tdef.Indexes[indexNo]
+	if where := indexWhere(tdef, indexNo); where != "" {
+		e, _, err := tableExpr(tdef, where)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := rowMatch(e, Record{Cols: tdef.Cols, Vals: vals})
+		if err != nil {
+			return nil, fmt.Errorf("index %v of table %s: %w", index, tdef.Name, err)
+		}
+		if !ok {
+			return nil, nil
+		}
+	}
+	irec := make([]Value, len(index))
+	for j, c := range index {
+		v, err := colValue(tdef, c, vals)
+		if err != nil {
+			return nil, fmt.Errorf("index %v of table %s: %w", index, tdef.Name, err)
+		}
+		irec[j] = v
+	}
+	return encodeKey(out, tdef.IndexPrefixes[indexNo], irec), nil
+}
+
 // maintain indexes after a record is added or removed
-func indexOp(db *DB, tdef *TableDef, rec Record, op int) {
-	key := make([]byte, 0, 256)
-	irec := make([]Value, len(tdef.Cols))
+func indexOp(db *DB, tdef *TableDef, vals []Value, op int) error {
+	for i := range tdef.Indexes {
+		key, err := indexKey(nil, tdef, i, vals)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue // not in the partial index
+		}
+		if err := indexKeyOp(db, tdef, i, key, op); err != nil {
+			return err
+		}
+	}
+	for i := range tdef.TextIndexes {
+		if err := textIndexOp(db, tdef, i, vals, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	for i, index := range tdef.Indexes {
-		// the indexed key
-		for j, c := range index {
-			irec[j] = *rec.Get(c)
+// check the index keys of a row before it's written,
+// so that a failed update leaves nothing behind.
+func indexCheck(db *DB, tdef *TableDef, vals []Value) error {
+	for i := range tdef.Indexes {
+		key, err := indexKey(nil, tdef, i, vals)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			continue // not in the partial index
+		}
+		if err := db.kv.tree.checkKV(key, nil); err != nil {
+			return fmt.Errorf("index %v of table %s: %w", tdef.Indexes[i], tdef.Name, err)
+		}
+	}
+	for i := range tdef.TextIndexes {
+		keys, postings, _ := textPostings(tdef, i, vals)
+		if err := textCheck(db, tdef, i, keys, postings); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// update the key value store
-		key = encodeKey(key[:0], tdef.IndexPrefixes[i], irec[:len(index)])
-		done, err := false, error(nil)
-		switch op {
-		case INDEX_ADD:
-			done, err = db.kv.Update(&InsertReq{Key: key})
-		case INDEX_DEL:
-			done, err = db.kv.Del(key)
-		default:
-			panic("what?")
-		}
-		Assert(err == nil, "error encountered in indexOP") // XXX: will fix this in later chapters
-		Assert(done, "error encountered in doing update or del in indexOp")
+// does the table have any secondary or full-text index?
+func hasIndexes(tdef *TableDef) bool {
+	return len(tdef.Indexes) > 0 || len(tdef.TextIndexes) > 0
+}
+
+// maintain indexes after a record is changed from `old` to `vals`.
+// only the index keys that changed are touched.
+func indexUpdate(db *DB, tdef *TableDef, old []Value, vals []Value) error {
+	for i := range tdef.Indexes {
+		oldKey, err := indexKey(nil, tdef, i, old)
+		if err != nil {
+			return err
+		}
+		newKey, err := indexKey(nil, tdef, i, vals)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		// a nil key is a row outside of the partial index
+		if oldKey != nil {
+			if err := indexKeyOp(db, tdef, i, oldKey, INDEX_DEL); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			if err := indexKeyOp(db, tdef, i, newKey, INDEX_ADD); err != nil {
+				return err
+			}
+		}
 	}
+	for i := range tdef.TextIndexes {
+		if !textChanged(tdef, &tdef.TextIndexes[i], old, vals) {
+			continue
+		}
+		if err := textIndexOp(db, tdef, i, old, INDEX_DEL); err != nil {
+			return err
+		}
+		if err := textIndexOp(db, tdef, i, vals, INDEX_ADD); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func findIndex(tdef *TableDef, keys []string) (int, error) {
+// add or remove a single index key
+func indexKeyOp(db *DB, tdef *TableDef, indexNo int, key []byte, op int) error {
+	done := false
+	switch op {
+	case INDEX_ADD:
+		req := InsertReq{Key: key, Mode: MODE_INSERT_ONLY}
+		if err := db.kv.tree.InsertEx(&req); err != nil {
+			return err
+		}
+		done = req.Added
+	case INDEX_DEL:
+		done = db.kv.tree.Delete(key)
+	default:
+		panic("what?")
+	}
+	if !done {
+		return fmt.Errorf("inconsistent index %v of table %s", tdef.Indexes[indexNo], tdef.Name)
+	}
+	return nil
+}
+
+// select an index for the key columns. a partial index is only
+// usable if its predicate is one of the conditions `conds` of the query.
+func findIndex(tdef *TableDef, keys []string, conds map[string]bool) (int, error) {
 	pk := tdef.Cols[:tdef.PKeys]
 	if isPrefix(pk, keys) {
 		// use the primary key.
@@ -66,7 +189,7 @@ func findIndex(tdef *TableDef, keys []string) (int, error) {
 	// find a suitable index
 	winner := -2
 	for i, index := range tdef.Indexes {
-		if !isPrefix(index, keys) {
+		if !isPrefix(index, keys) || !indexUsable(tdef, i, conds) {
 			continue
 		}
 		if winner == -2 || len(index) < len(tdef.Indexes[winner]) {
@@ -89,4 +212,52 @@ func isPrefix(long []string, short []string) bool {
 		}
 	}
 	return true
-}
\ No newline at end of file
+}
+
+// the WHERE predicate of a partial index, "" for a full index
+func indexWhere(tdef *TableDef, indexNo int) string {
+	if len(tdef.IndexWhere) == 0 {
+		return ""
+	}
+	return tdef.IndexWhere[indexNo]
+}
+
+// does the index contain all the rows matching the conditions?
+func indexUsable(tdef *TableDef, indexNo int, conds map[string]bool) bool {
+	where := indexWhere(tdef, indexNo)
+	if where == "" {
+		return true
+	}
+	e, _, err := tableExpr(tdef, where)
+	Assert(err == nil, "bad index predicate")
+	for _, c := range exprConjuncts(e, nil) {
+		if !conds[c.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// verify the partial index predicates and store them in canonical form
+func checkIndexWhere(tdef *TableDef) error {
+	if len(tdef.IndexWhere) == 0 {
+		return nil
+	}
+	if len(tdef.IndexWhere) != len(tdef.Indexes) {
+		return fmt.Errorf("number of index predicates does not match number of indexes")
+	}
+	for i, where := range tdef.IndexWhere {
+		if where == "" {
+			continue
+		}
+		e, typ, err := tableExpr(tdef, where)
+		if err != nil {
+			return err
+		}
+		if typ != TYPE_INT64 {
+			return fmt.Errorf("the index predicate is not a boolean: %s", where)
+		}
+		tdef.IndexWhere[i] = e.String()
+	}
+	return nil
+}
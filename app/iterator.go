@@ -80,31 +80,28 @@ func iterNext(iter *BIter, level int) bool {
 	if iter.pos[level] < node.nkeys()-1 {
 		iter.pos[level]++
 		return true
-	} else if level > 0 {
-		if iterNext(iter, level-1) {
-			node := iter.path[level]
-			kid := iter.tree.get(node.getPtr(iter.pos[level]))
-			iter.path[level+1] = kid
-			iter.pos[level+1] = 0
-			return true
-		}
+	} else if level > 0 && iterNext(iter, level-1) {
+		// the parent moved to the next kid
+		parent := iter.path[level-1]
+		kid := iter.tree.get(parent.getPtr(iter.pos[level-1]))
+		iter.path[level] = kid
+		iter.pos[level] = 0
+		return true
 	}
 	return false // No more keys
 }
 
 func iterPrev(iter *BIter, level int) bool {
-	// node := iter.path[level]
 	if iter.pos[level] > 0 {
 		iter.pos[level]--
 		return true
-	} else if level > 0 {
-		if iterPrev(iter, level-1) {
-			node := iter.path[level]
-			kid := iter.tree.get(node.getPtr(iter.pos[level]))
-			iter.path[level+1] = kid
-			iter.pos[level+1] = kid.nkeys() - 1
-			return true
-		}
+	} else if level > 0 && iterPrev(iter, level-1) {
+		// the parent moved to the previous kid
+		parent := iter.path[level-1]
+		kid := iter.tree.get(parent.getPtr(iter.pos[level-1]))
+		iter.path[level] = kid
+		iter.pos[level] = kid.nkeys() - 1
+		return true
 	}
 	return false // No more keys
 }
@@ -5,11 +5,13 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type KV struct {
 	Path string
 	// internals
+	opts Options // the options of Open(), with the defaults filled in
 	fp   *os.File
 	tree BTree
 	mmap struct {
@@ -24,13 +26,31 @@ type KV struct {
 		// newly allocated or deallocated pages keyed by the pointer.
 		// nil value denotes a deallocated page
 		updates map[uint64][]byte
+		// pages that can be reused after the commit, not kept for readers
+		released []uint64
 	}
 	free FreeList
 	mu     sync.Mutex
 	writer sync.Mutex
 	// version number and reader list
 	version uint64
+	root    uint64     // the committed root of the version, for readers
 	readers ReaderList // heap, for tracking the minimum reader version
+	// replication
+	repl       *ReplLog   // the commits are logged for followers, if not nil
+	replica    bool       // a follower, only updated by the replication
+	readerExit *sync.Cond // with `mu`, signaled when a reader ends
+	// named snapshots
+	snaps     snapshotList    // the working list, saved and rolled back with the tree
+	snapshots []Snapshot      // the committed list, for readers
+	pinned    map[uint64]bool // the pages of the snapshots, built on demand
+	// time travel
+	hist          historyState  // the working state, saved and rolled back with the tree
+	history       []historyRoot // the committed log, for readers
+	historyLoaded bool          // the history of the master page is loaded
+	// expiring keys
+	ttl     BTree  // the working TTL tree, saved and rolled back with the tree
+	ttlRoot uint64 // the committed TTL tree, for readers
 }
 
 // implements heap.Interface
@@ -49,11 +69,15 @@ func (r *ReaderList) Less(i, j int) bool {
 // Swap swaps two elements in the reader list.
 func (r *ReaderList) Swap(i, j int) {
     (*r)[i], (*r)[j] = (*r)[j], (*r)[i]
+    (*r)[i].index = i
+    (*r)[j].index = j
 }
 
 // Push adds a new reader to the heap.
 func (r *ReaderList) Push(x any) {
-    *r = append(*r, x.(*KVReader))
+    tx := x.(*KVReader)
+    tx.index = len(*r)
+    *r = append(*r, tx)
 }
 
 // Pop removes the minimum reader (lowest version).
@@ -65,16 +89,59 @@ func (r *ReaderList) Pop() any {
     return x
 }
 
-func (db *KV) Open() (err error) {
+// open or create the DB file, with at most one set of options
+func (db *KV) Open(opts ...Options) (err error) {
+	if len(opts) > 1 {
+		return fmt.Errorf("more than one set of options")
+	}
+	if len(opts) == 1 {
+		db.opts = opts[0]
+	}
+	if err := checkOptions(&db.opts); err != nil {
+		return err
+	}
+
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	flags := os.O_RDWR | os.O_CREATE
+	if db.opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(db.Path, flags, 0644)
 	if err != nil {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
 	db.fp = fp
 
+	// one writer or many readers
+	how := syscall.LOCK_EX
+	if db.opts.ReadOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB); err != nil {
+		db.Close()
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+		return fmt.Errorf("flock: %w", err)
+	}
+
+	// the page size of an existing file is fixed
+	psize, err := masterPageSize(fp)
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("master load error: %w", err)
+	}
+	switch {
+	case psize == 0: // a new file
+		psize = max(db.opts.PageSize, BTREE_PAGE_SIZE)
+	case db.opts.PageSize != 0 && db.opts.PageSize != psize:
+		db.Close()
+		return fmt.Errorf("page size mismatch: %d, the file uses %d", db.opts.PageSize, psize)
+	}
+	db.opts.PageSize = psize
+
 	// create the initial mmap
-	sz, chunk, err := mmapInit(db.fp)
+	sz, chunk, err := mmapInit(db.fp, db.opts)
 	if err != nil {
 		db.Close() // Ensure resources are released
 		return fmt.Errorf("mmap init error: %w", err)
@@ -85,19 +152,32 @@ func (db *KV) Open() (err error) {
 	db.mmap.chunks = [][]byte{chunk}
 
 	db.page.updates = make(map[uint64][]byte)
+	db.readerExit = sync.NewCond(&db.mu)
 
 	// BTree callbacks
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
 	db.tree.del = db.pageDel
+	db.tree.psize = db.opts.PageSize
+	db.ttl.get = db.pageGet
+	db.ttl.new = db.pageNew
+	db.ttl.del = db.pageDel
+	db.ttl.psize = db.opts.PageSize
 
 	// FreeList callbacks
 	db.free.get = db.pageGet
 	db.free.new = db.pageAppend
 	db.free.use = db.pageUse
+	db.free.psize = db.opts.PageSize
 
 	// read the master page
 	err = masterLoad(db)
+	if err == nil {
+		err = historyLoad(db)
+	}
+	if err == nil {
+		err = pendingLoad(db)
+	}
 	if err != nil {
 		db.Close() // Ensure resources are released
 		return fmt.Errorf("master load error: %w", err)
@@ -109,6 +189,9 @@ func (db *KV) Open() (err error) {
 
 // cleanups
 func (db *KV) Close() {
+	if len(db.free.pending) > 0 && !db.opts.ReadOnly {
+		_ = flushPending(db) // or they are freed by the next update after a restart
+	}
 	for _, chunk := range db.mmap.chunks {
 		err := syscall.Munmap(chunk)
 		Assert(err == nil, "unable to unmap")
@@ -116,18 +199,76 @@ func (db *KV) Close() {
 	_ = db.fp.Close()
 }
 
-// read the db
+// read the db, an expired key is absent
 func (db *KV) Get(key []byte) ([]byte, bool) {
+	if ttlExpired(&db.ttl, key, time.Now()) {
+		return nil, false
+	}
 	return db.tree.Get(key)
 }
 
 // update the db
 func (db *KV) Set(key []byte, val []byte) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	if err := db.tree.checkKV(key, val); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
 	db.tree.Insert(key, val)
-	return flushPages(db)
+	ttlClear(db, key)
+	return flushPages(db, saved, db.opts.Sync)
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
+	if err := db.checkWrite(); err != nil {
+		return false, err
+	}
+	if err := db.tree.checkKV(key, nil); err != nil {
+		return false, err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
 	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	ttlClear(db, key)
+	return deleted, flushPages(db, saved, db.opts.Sync)
+}
+
+// delete all keys in [start, end). a nil `end` is unbounded.
+func (db *KV) DeleteRange(start []byte, end []byte) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	db.tree.DeleteRange(start, end)
+	ttlClearRange(db, start, end)
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// updates are rejected before touching the tree
+func (db *KV) checkWrite() error {
+	if db.opts.ReadOnly || db.replica {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// the size limits of the B-tree
+func (tree *BTree) checkKV(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("key too large: %d > %d", len(key), BTREE_MAX_KEY_SIZE)
+	}
+	if len(val) > tree.maxValSize() {
+		return fmt.Errorf("value too large: %d > %d", len(val), tree.maxValSize())
+	}
+	return nil
 }
@@ -9,11 +9,11 @@ import (
 func (tree *BTree) Insert(key []byte, val []byte) {
 	Assert(len(key) != 0, "key is not provided")
 	Assert(len(key) <= BTREE_MAX_KEY_SIZE, "key provided exccedes the max size")
-	Assert(len(val) <= BTREE_MAX_VAL_SIZE, "val provided exccedes the max size")
+	Assert(len(val) <= tree.maxValSize(), "val provided exccedes the max size")
 
 	if tree.root == 0 {
 		// create the first node
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{data: make([]byte, tree.pageSize())}
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containg node..
@@ -27,10 +27,10 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	tree.del(tree.root)
 
 	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := nodeSplit3(node)
+	nsplit, splitted := nodeSplit3(node, tree.pageSize())
 	if nsplit > 1 {
 		// the root was split, add a new level.
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{data: make([]byte, tree.pageSize())}
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range splitted[:nsplit] {
 			ptr, key := tree.new(knode), knode.getKey(0)
@@ -120,7 +120,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	// the result node
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := BNode{data: make([]byte, 2*tree.pageSize())}
 
 	// where to insert the key?
 	idx := nodeLookupLE(node, key)
@@ -156,9 +156,9 @@ func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 // update a key
 func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
-	nodeAppendRange(new, old, 0, 0, idx-1)
+	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
-	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
 }
 
 // part of the treeInsert(): KV insertion to an internal node
@@ -170,7 +170,7 @@ func nodeInsert(tree *BTree, new BNode, node BNode, idx uint16, key []byte, val
 	// recursive insertion to the kid node
 	knode = treeInsert(tree, knode, key, val)
 	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	nsplit, splited := nodeSplit3(knode, tree.pageSize())
 	// // update the kid links
 	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
 }
@@ -211,53 +211,78 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 	binary.LittleEndian.PutUint16(new.data[pos+0:], uint16(len(key)))
 	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val)))
 	copy(new.data[pos+4:], key)
-	copy(new.data[pos+4+uint16(len(key)):], val)
+	copy(new.data[pos+4+uint32(len(key)):], val)
 	// the offset of the next key
-	new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
+	new.setOffset(idx+1, new.getOffset(idx)+4+uint32((len(key)+len(val))))
 }
 
 // Split a node into two. The first node 'left' can still be bigger than one page,
 // but the second node 'right' must fit within one page.
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// First, set up the left node to handle part of the data
-	left.setHeader(old.btype(), 0)  // Start with an empty left node
-	right.setHeader(old.btype(), 0) // Start with an empty right node
-
-	nkeys := old.nkeys() // Total number of keys in the old node
-	mid := nkeys / 2     // Split the keys roughly in half
-
-	// Add the first half (or slightly more) to the left node
-	nodeAppendRange(left, old, 0, 0, mid)
-
-	// Add the remaining half to the right node
-	nodeAppendRange(right, old, 0, mid, nkeys-mid)
-
-	// Set the new number of keys for both nodes
-	left.setHeader(old.btype(), mid)
-	right.setHeader(old.btype(), nkeys-mid)
+func nodeSplit2(left BNode, right BNode, old BNode, psize int) {
+	Assert(old.nkeys() >= 2, "not enough keys to split")
+
+	// the initial guess: split the keys roughly in half
+	nleft := old.nkeys() / 2
+	// the sizes with 16-bit offsets, as in the pages
+	leftBytes := func() uint32 {
+		return HEADER + 10*uint32(nleft) + old.getOffset(nleft)
+	}
+	// try to fit the left half
+	for int(leftBytes()) > psize {
+		nleft--
+	}
+	Assert(nleft >= 1, "unable to split the node")
+	// try to fit the right half
+	rightBytes := func() uint32 {
+		nright := uint32(old.nkeys() - nleft)
+		return HEADER + 10*nright + old.getOffset(old.nkeys()) - old.getOffset(nleft)
+	}
+	for int(rightBytes()) > psize {
+		nleft++
+	}
+	Assert(nleft < old.nkeys(), "unable to split the node")
+	nright := old.nkeys() - nleft
+
+	// the header must be set before appending the keys
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	Assert(int(right.nbytes()) <= psize, "right node exceeds the page size")
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old.data = old.data[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old}
-	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, 2*BTREE_PAGE_SIZE)}
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right}
+func nodeSplit3(old BNode, psize int) (uint16, [3]BNode) {
+	if int(old.pageBytes()) <= psize {
+		return 1, [3]BNode{nodeToPage(old, psize)}
+	}
+	left := BNode{make([]byte, 2*psize)} // might be split later
+	right := BNode{make([]byte, psize)}
+	nodeSplit2(left, right, old, psize)
+	if int(left.pageBytes()) <= psize {
+		return 2, [3]BNode{nodeToPage(left, psize), right}
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE, "Left page size is greater than desired")
+	leftleft := BNode{make([]byte, psize)}
+	middle := BNode{make([]byte, psize)}
+	nodeSplit2(leftleft, middle, left, psize)
+	Assert(int(leftleft.nbytes()) <= psize, "Left page size is greater than desired")
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
+// a node that fits in a page, in a buffer of the page size
+func nodeToPage(node BNode, psize int) BNode {
+	if node.offsetSize() == 2 {
+		node.data = node.data[:psize]
+		return node
+	}
+	// re-encode the 32-bit offsets
+	page := BNode{make([]byte, psize)}
+	page.setHeader(node.btype(), node.nkeys())
+	nodeAppendRange(page, node, 0, 0, node.nkeys())
+	return page
+}
+
 // replace a link with multiple links
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
 	inc := uint16(len(kids))
@@ -281,7 +306,7 @@ func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 		}
 
 		// delete the key in leaf node
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		new := BNode{data: make([]byte, tree.pageSize())}
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
@@ -308,17 +333,17 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.del(kptr)
 
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	new := BNode{data: make([]byte, tree.pageSize())}
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		merged := BNode{data: make([]byte, tree.pageSize())}
 		nodeMerge(merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: // right
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		merged := BNode{data: make([]byte, tree.pageSize())}
 		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
@@ -353,23 +378,142 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 
 // should the updated node be merged with a sibling?
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if int(updated.nbytes()) > tree.pageSize()/4 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if int(merged) <= tree.pageSize() {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if int(merged) <= tree.pageSize() {
 			return +1, sibling
 		}
 	}
 	return 0, BNode{}
 }
+
+// interface for deleting all keys in [start, end). a nil `end` is unbounded.
+// subtrees that are entirely inside the range are freed without visiting leaves.
+// NOTE: nodes are not merged, the tree may be left with underfull nodes.
+func (tree *BTree) DeleteRange(start []byte, end []byte) bool {
+	if tree.root == 0 {
+		return false
+	}
+
+	// the height of the tree, for freeing subtrees without reading leaves
+	height := 1
+	for node := tree.get(tree.root); node.btype() == BNODE_NODE; height++ {
+		node = tree.get(node.getPtr(0))
+	}
+
+	updated, changed := treeDeleteRange(tree, tree.get(tree.root), height, start, end, nil)
+	if !changed {
+		return false
+	}
+	tree.del(tree.root)
+	// remove levels with a single kid
+	for updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		ptr := updated.getPtr(0)
+		updated = BNode{data: append([]byte(nil), tree.get(ptr).data...)}
+		tree.del(ptr)
+	}
+	tree.root = tree.new(updated)
+	return true
+}
+
+// is the key inside [start, end)?
+// the dummy empty key is never deleted.
+func inDeleteRange(key []byte, start []byte, end []byte) bool {
+	return len(key) > 0 && bytes.Compare(key, start) >= 0 &&
+		(end == nil || bytes.Compare(key, end) < 0)
+}
+
+// part of the DeleteRange(). `hi` is the upper bound of the keys in the node,
+// nil if unbounded. returns the updated node if anything was deleted,
+// the result can be an empty node.
+func treeDeleteRange(
+	tree *BTree, node BNode, height int, start []byte, end []byte, hi []byte,
+) (BNode, bool) {
+	new := BNode{data: make([]byte, tree.pageSize())}
+	if node.btype() == BNODE_LEAF {
+		keep := []uint16{}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !inDeleteRange(node.getKey(i), start, end) {
+				keep = append(keep, i)
+			}
+		}
+		if len(keep) == int(node.nkeys()) {
+			return BNode{}, false
+		}
+		new.setHeader(BNODE_LEAF, uint16(len(keep)))
+		for i, idx := range keep {
+			nodeAppendKV(new, uint16(i), 0, node.getKey(idx), node.getVal(idx))
+		}
+		return new, true
+	}
+
+	type kid struct {
+		ptr uint64
+		key []byte
+	}
+	kids := []kid{}
+	changed := false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kptr, lo := node.getPtr(i), node.getKey(i)
+		khi := hi
+		if i+1 < node.nkeys() {
+			khi = node.getKey(i + 1)
+		}
+
+		disjoint := (khi != nil && bytes.Compare(khi, start) <= 0) ||
+			(end != nil && bytes.Compare(lo, end) >= 0)
+		covered := len(lo) > 0 && bytes.Compare(lo, start) >= 0 &&
+			(end == nil || (khi != nil && bytes.Compare(khi, end) <= 0))
+		switch {
+		case disjoint:
+			kids = append(kids, kid{kptr, lo})
+		case covered:
+			// the whole subtree is in the range
+			treeFree(tree, kptr, height-1)
+			changed = true
+		default:
+			updated, ok := treeDeleteRange(tree, tree.get(kptr), height-1, start, end, khi)
+			if !ok {
+				kids = append(kids, kid{kptr, lo})
+				continue
+			}
+			changed = true
+			tree.del(kptr)
+			if updated.nkeys() > 0 {
+				kids = append(kids, kid{tree.new(updated), updated.getKey(0)})
+			}
+		}
+	}
+	if !changed {
+		return BNode{}, false
+	}
+
+	new.setHeader(BNODE_NODE, uint16(len(kids)))
+	for i, k := range kids {
+		nodeAppendKV(new, uint16(i), k.ptr, k.key, nil)
+	}
+	return new, true
+}
+
+// deallocate a subtree of the given height
+func treeFree(tree *BTree, ptr uint64, height int) {
+	if height > 1 {
+		node := tree.get(ptr)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeFree(tree, node.getPtr(i), height-1)
+		}
+	}
+	tree.del(ptr)
+}
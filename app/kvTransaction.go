@@ -3,122 +3,82 @@ package relixdb
 import (
 	"bytes"
 	"container/heap"
-	"fmt"
+	"time"
 )
 
 // KV transaction
 type KVTX struct {
 	KVReader
-	db   *KV
-	free FreeList
-	page struct {
-		nappend int // number of pages to be appended
-		// newly allocated or deallocated pages keyed by the pointer.
-		// nil value denotes a deallocated page.
-		updates map[uint64][]byte
-	}
+	db *KV
+	// the state before the transaction, for rolling back
+	saved kvState
 }
 
-// begin a transaction
+// begin a transaction.
+// updates are applied to the tree in place and persisted on commit,
+// only one transaction can be active at a time.
 func (kv *KV) Begin(tx *KVTX) {
-	tx.db = kv
-	tx.page.updates = map[uint64][]byte{}
-	tx.mmap.chunks = kv.mmap.chunks
 	kv.writer.Lock()
+	tx.db = kv
+	tx.saved = kv.saveState()
 	tx.version = kv.version
-	// btree
-	tx.tree.root = kv.tree.root
-	tx.tree.get = tx.pageGet
-	tx.tree.new = tx.pageNew
-	tx.tree.del = tx.pageDel
-	// freelist
-	tx.free.FreeListData = kv.free.FreeListData
-	tx.free.version = kv.version
-	tx.free.get = tx.pageGet
-	tx.free.new = tx.pageAppend
-	tx.free.use = tx.pageUse
-	tx.free.minReader = kv.version
-	kv.mu.Lock()
-	if len(kv.readers) > 0 {
-		tx.free.minReader = kv.readers[0].version
-	}
-	kv.mu.Unlock()
-}
-
-// roolback the tree and other in-memory data structures.
-func roolbackTX(tx *KVTX) {
-	kv := tx.db
-	kv.tree.root = tx.tree.root
-	kv.free.head = tx.free.head
-	kv.page.nfree = 0
-	kv.page.nappend = 0
-	kv.page.updates = make(map[uint64][]byte)
 }
 
 // end a transaction: roolback
 func (kv *KV) Abort(tx *KVTX) {
+	kv.rollback(tx.saved)
 	kv.writer.Unlock()
 }
 
 // end a transaction: commit updates
 func (kv *KV) Commit(tx *KVTX) error {
 	defer kv.writer.Unlock()
-	if kv.tree.root == tx.tree.root {
-		return nil // no updates?
-	}
-
-	// phase 1: persist the page data to disk.
-	if err := writePages(kv); err != nil {
-		roolbackTX(tx)
-		return err
-	}
-
-	// the page data must reach disk before the master page.
-	// the `fsync` serves as a barrier here.
-	if err := kv.fp.Sync(); err != nil {
-		roolbackTX(tx)
-		return fmt.Errorf("fsync: %w", err)
-	}
-
-	// the transaction is visible at this point.
-	// save the new version of in-memory data structures.
-	kv.page.flushed += uint64(tx.page.nappend)
-	kv.free = tx.free
-	kv.mu.Lock()
-	kv.tree.root = tx.tree.root
-	kv.version++
-	kv.mu.Unlock()
-
-	// phase 2: update the master page to point to the new tree.
-	// NOTE: Cannot rollback the tree to the old version if phase 2 fails.
-	//		 Because there is no way to know the state of the master page.
-	//		 Updating from an old root can cause corruption.
-
-	if err := masterStore(kv); err != nil {
-		return err
-	}
-	if err := kv.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
-	}
-	return nil
+	return flushPages(kv, tx.saved, kv.opts.Sync)
 }
 
 // KV operations
 func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	if ttlExpired(&tx.db.ttl, key, time.Now()) {
+		return nil, false
+	}
 	return tx.db.tree.Get(key)
 }
 
+// the expired keys are not skipped
 func (tx *KVTX) Seek(key []byte, cmp int) *BIter {
 	return tx.db.tree.Seek(key, cmp)
 }
 
-func (tx *KVTX) Update(req *InsertReq) bool {
-	tx.db.InsertEx(req)
-	return req.Added
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	if err := tx.db.checkWrite(); err != nil {
+		return err
+	}
+	if err := tx.db.tree.checkKV(key, val); err != nil {
+		return err
+	}
+	tx.db.tree.Insert(key, val)
+	ttlClear(tx.db, key)
+	return nil
+}
+
+func (tx *KVTX) Update(req *InsertReq) (bool, error) {
+	if err := tx.db.checkWrite(); err != nil {
+		return false, err
+	}
+	err := ttlUpdate(tx.db, req)
+	return req.Added, err
 }
 
 func (tx *KVTX) Del(key []byte) (bool, error) {
-	return tx.db.Del(key)
+	if err := tx.db.checkWrite(); err != nil {
+		return false, err
+	}
+	if err := tx.db.tree.checkKV(key, nil); err != nil {
+		return false, err
+	}
+	deleted := tx.db.tree.Delete(key)
+	ttlClear(tx.db, key)
+	return deleted, nil
 }
 
 // read-only KV transactions
@@ -126,6 +86,7 @@ type KVReader struct {
 	// the snapshot
 	version uint64
 	tree    BTree
+	ttl     BTree // the expiries, empty for the snapshots and the past versions
 	mmap    struct {
 		chunks [][]byte // copied from struct KV. read-only.
 	}
@@ -135,27 +96,42 @@ type KVReader struct {
 
 func (kv *KV) BeginRead(tx *KVReader) {
 	kv.mu.Lock()
+	kv.beginRead(tx, kv.root, kv.version)
+	tx.ttl.root = kv.ttlRoot
+	kv.mu.Unlock()
+}
+
+// read the tree at `root`, the caller holds `mu`.
+// the pages freed after `version` are kept for the reader.
+func (kv *KV) beginRead(tx *KVReader, root uint64, version uint64) {
 	tx.mmap.chunks = kv.mmap.chunks
-	tx.tree.root = kv.tree.root
+	tx.tree.root = root
+	tx.tree.psize = kv.tree.psize
 	tx.tree.get = tx.pageGetMapped
-	tx.version = kv.version
+	tx.ttl = BTree{get: tx.pageGetMapped, psize: kv.tree.psize}
+	tx.version = version
 	heap.Push(&kv.readers, tx)
-	kv.mu.Unlock()
 }
 
 func (kv *KV) EndRead(tx *KVReader) {
 	kv.mu.Lock()
 	heap.Remove(&kv.readers, tx.index)
+	if kv.readerExit != nil {
+		kv.readerExit.Broadcast()
+	}
 	kv.mu.Unlock()
 }
 
 // callback for BTree & FreeList, dereference a pointer.
 func (tx *KVReader) pageGetMapped(ptr uint64) BNode {
-	return BNode{}
+	return chunksPage(tx.mmap.chunks, tx.tree.pageSize(), ptr)
 }
 
 // Get retrieves the value associated with the key from the read-only transaction.
 func (tx *KVReader) Get(key []byte) ([]byte, bool) {
+	if ttlExpired(&tx.ttl, key, time.Now()) {
+		return nil, false
+	}
 	// We use the `Seek` method for KVReader which returns the iterator to find the key
 	iter := tx.Seek(key, CMP_LE)
 	if iter.Valid() {
@@ -168,27 +144,7 @@ func (tx *KVReader) Get(key []byte) ([]byte, bool) {
 }
 
 // Seek returns an iterator to the closest position based on the comparison.
+// the expired keys are not skipped.
 func (tx *KVReader) Seek(key []byte, cmp int) *BIter {
 	return tx.tree.Seek(key, cmp)
 }
-
-// btree utility functions
-func (tx *KVTX) pageGet(ptr uint64) BNode {
-	return tx.db.pageGet(ptr)
-}
-
-func (tx *KVTX) pageNew(node BNode) uint64 {
-	return tx.db.pageNew(node)
-}
-
-func (tx *KVTX) pageDel(ptr uint64) {
-	tx.db.pageDel(ptr)
-}
-
-func (tx *KVTX) pageAppend(node BNode) uint64 {
-	return tx.db.pageAppend(node)
-}
-
-func (tx *KVTX) pageUse(ptr uint64, node BNode) {
-	tx.db.pageUse(ptr, node)
-}
@@ -2,9 +2,15 @@ package relixdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 // Helper function to create a temporary file for testing
@@ -268,6 +274,191 @@ func TestFreeListUsage(t *testing.T) {
 	}
 }
 
+// overwriting keys at the ends and in the middle of a leaf
+func TestKV_UpdateInLeaf(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	expect := map[string]string{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		expect[key] = fmt.Sprintf("value%d", i)
+		if err := kv.Set([]byte(key), []byte(expect[key])); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for _, i := range []int{0, 5, 9} {
+		key := fmt.Sprintf("key%d", i)
+		expect[key] = fmt.Sprintf("new%d", i)
+		if err := kv.Set([]byte(key), []byte(expect[key])); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for key, val := range expect {
+		got, ok := kv.Get([]byte(key))
+		if !ok || string(got) != val {
+			t.Fatalf("key %s: expected %s, got %s", key, val, got)
+		}
+	}
+}
+
+// a split by the key count leaves the large KVs in an oversized right node
+func TestKV_SplitUneven(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	expect := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		expect[fmt.Sprintf("a%02d", i)] = []byte("v")
+	}
+	for i := 0; i < 4; i++ {
+		expect[fmt.Sprintf("z%02d", i)] = bytes.Repeat([]byte{'x'}, 1000)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("a%02d", i)
+		if err := kv.Set([]byte(key), expect[key]); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("z%02d", i)
+		if err := kv.Set([]byte(key), expect[key]); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for key, val := range expect {
+		got, ok := kv.Get([]byte(key))
+		if !ok || !bytes.Equal(got, val) {
+			t.Fatalf("key %s: unexpected value", key)
+		}
+	}
+}
+
+// iterating across the leaves of a multi-level tree
+func TestKV_IterAcrossLeaves(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := kv.Set([]byte(key), bytes.Repeat([]byte{'v'}, 50)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	i := 0
+	for iter := kv.tree.Seek([]byte("key"), CMP_GE); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if expect := fmt.Sprintf("key%05d", i); string(key) != expect {
+			t.Fatalf("expected %s, got %s", expect, key)
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d keys forward, got %d", n, i)
+	}
+	for iter := kv.tree.Seek([]byte("key99999"), CMP_LE); iter.Valid(); iter.Prev() {
+		key, _ := iter.Deref()
+		if len(key) == 0 {
+			break // the dummy key
+		}
+		i--
+		if expect := fmt.Sprintf("key%05d", i); string(key) != expect {
+			t.Fatalf("expected %s, got %s", expect, key)
+		}
+	}
+	if i != 0 {
+		t.Fatalf("expected %d keys backward, got %d", n, n-i)
+	}
+}
+
+// the total of the free list and popping without new pointers
+func TestFreeList_Update(t *testing.T) {
+	pages := map[uint64][]byte{}
+	next := uint64(1 << 20)
+	fl := FreeList{}
+	fl.get = func(ptr uint64) BNode {
+		return BNode{pages[ptr]}
+	}
+	fl.new = func(node BNode) uint64 {
+		next++
+		pages[next] = node.data
+		return next
+	}
+	fl.use = func(ptr uint64, node BNode) {
+		pages[ptr] = node.data
+	}
+
+	freed := []uint64{}
+	for i := uint64(1); i <= 1000; i++ {
+		freed = append(freed, i)
+	}
+	fl.Update(0, freed)
+	if fl.Total() != 1000 {
+		t.Fatalf("expected 1000 items, got %d", fl.Total())
+	}
+	// the popped items are taken by the caller, the rest are kept
+	pop := func(n int) {
+		t.Helper()
+		total := fl.Total()
+		popped := map[uint64]bool{}
+		for i := 0; i < n; i++ {
+			popped[fl.Get(i)] = true
+		}
+		fl.Update(n, nil)
+		if n < total && fl.Total() != total-n {
+			t.Fatalf("expected %d items, got %d", total-n, fl.Total())
+		}
+		for i := 0; i < fl.Total(); i++ {
+			if popped[fl.Get(i)] {
+				t.Fatalf("a popped item is left: %d", fl.Get(i))
+			}
+		}
+	}
+	pop(10)
+	pop(100)
+	// the list nodes are recycled as items
+	pop(fl.Total())
+}
+
+// the pages of a commit are not written again by the next ones
+func TestKV_CommitResetsPages(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := kv.Set([]byte("key"), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		if len(kv.page.updates) != 0 || kv.page.nfree != 0 {
+			t.Fatalf("pages of a commit are left: %d %d", len(kv.page.updates), kv.page.nfree)
+		}
+	}
+	if kv.page.flushed > 20 {
+		t.Fatalf("the freed pages are not reused: %d pages", kv.page.flushed)
+	}
+}
+
 // TestPersistence tests whether the database persists data correctly across reopenings.
 func TestPersistence(t *testing.T) {
 	path := createTempFile(t)
@@ -348,3 +539,1765 @@ func TestOverwriteKey(t *testing.T) {
 		t.Fatalf("Expected %s, got %s", newValue, retrieved)
 	}
 }
+
+func TestKV_RangeIterators(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if err := kv.Set(key, []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	if err := kv.Set([]byte("other"), []byte("x")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+
+	collect := func(seq func(func([]byte, []byte) bool)) []string {
+		keys := []string{}
+		for k := range seq {
+			keys = append(keys, string(k))
+		}
+		return keys
+	}
+
+	keys := collect(kv.Range([]byte("key010"), []byte("key013")))
+	if fmt.Sprint(keys) != "[key010 key011 key012]" {
+		t.Fatalf("Range() returned %v", keys)
+	}
+	keys = collect(kv.RangeReverse([]byte("key010"), []byte("key013")))
+	if fmt.Sprint(keys) != "[key012 key011 key010]" {
+		t.Fatalf("RangeReverse() returned %v", keys)
+	}
+	if keys = collect(kv.Range(nil, nil)); len(keys) != 301 || keys[300] != "other" {
+		t.Fatalf("Range(nil, nil) returned %d keys", len(keys))
+	}
+	if keys = collect(kv.RangeReverse(nil, nil)); len(keys) != 301 || keys[0] != "other" {
+		t.Fatalf("RangeReverse(nil, nil) returned %d keys", len(keys))
+	}
+	if keys = collect(kv.Prefix([]byte("key2"))); len(keys) != 100 || keys[0] != "key200" {
+		t.Fatalf("Prefix() returned %d keys", len(keys))
+	}
+	if keys = collect(kv.PrefixReverse([]byte("key2"))); len(keys) != 100 || keys[0] != "key299" {
+		t.Fatalf("PrefixReverse() returned %d keys", len(keys))
+	}
+
+	// early termination
+	n := 0
+	for k, v := range kv.Prefix([]byte("key1")) {
+		if !bytes.HasPrefix(v, []byte("value")) || !bytes.HasPrefix(k, []byte("key1")) {
+			t.Fatalf("unexpected pair %s=%s", k, v)
+		}
+		if n++; n == 5 {
+			break
+		}
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 iterations, got %d", n)
+	}
+}
+
+func TestKV_ScanBounds(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+
+	scan := func(start, end string, opts ScanOpts) string {
+		keys := []string{}
+		for k := range kv.Scan([]byte(start), []byte(end), opts) {
+			keys = append(keys, string(k))
+		}
+		return fmt.Sprint(keys)
+	}
+
+	testCases := []struct {
+		opts     ScanOpts
+		expected string
+	}{
+		{ScanOpts{}, "[k2 k3 k4]"},
+		{ScanOpts{Cmp1: CMP_GT, Cmp2: CMP_LE}, "[k3 k4 k5]"},
+		{ScanOpts{Cmp2: CMP_LE, Reverse: true}, "[k5 k4 k3 k2]"},
+		{ScanOpts{Cmp1: CMP_GT, Reverse: true}, "[k4 k3]"},
+		{ScanOpts{Cmp2: CMP_LE, Limit: 2}, "[k2 k3]"},
+	}
+	for _, tc := range testCases {
+		if got := scan("k2", "k5", tc.opts); got != tc.expected {
+			t.Errorf("KV.Scan(%+v) = %s, expected %s", tc.opts, got, tc.expected)
+		}
+	}
+
+	keys := []string{}
+	for k := range kv.ScanPrefix([]byte("k"), ScanOpts{Reverse: true, Limit: 3}) {
+		keys = append(keys, string(k))
+	}
+	if fmt.Sprint(keys) != "[k9 k8 k7]" {
+		t.Errorf("KV.ScanPrefix() = %v", keys)
+	}
+}
+
+func TestKV_DeleteRange(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := kv.Set(key, bytes.Repeat([]byte{'v'}, 100)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+
+	if err := kv.DeleteRange([]byte("key0100"), []byte("key1900")); err != nil {
+		t.Fatalf("KV.DeleteRange() failed: %v", err)
+	}
+	if kv.free.Total() == 0 {
+		t.Fatalf("expected the deleted pages in the free list")
+	}
+
+	check := func() {
+		n := 0
+		for k := range kv.Range(nil, nil) {
+			if string(k) >= "key0100" && string(k) < "key1900" {
+				t.Fatalf("key %s was not deleted", k)
+			}
+			n++
+		}
+		if n != 200 {
+			t.Fatalf("expected 200 keys, got %d", n)
+		}
+		for _, key := range []string{"key0000", "key0099", "key1900", "key1999"} {
+			if _, ok := kv.Get([]byte(key)); !ok {
+				t.Fatalf("key %s is missing", key)
+			}
+		}
+	}
+	check()
+
+	// the tree is still usable
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i*19))
+		if _, err := kv.Del(key); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+		if err := kv.Set(key, []byte("again")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	if err := kv.DeleteRange([]byte("key0100"), []byte("key1900")); err != nil {
+		t.Fatalf("KV.DeleteRange() failed: %v", err)
+	}
+	check()
+
+	kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	check()
+
+	if err := kv.DeleteRange([]byte("key"), nil); err != nil {
+		t.Fatalf("KV.DeleteRange() failed: %v", err)
+	}
+	for k := range kv.Range(nil, nil) {
+		t.Fatalf("unexpected key %s", k)
+	}
+}
+
+func TestKV_WriteBatch(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	if err := kv.Set([]byte("old"), []byte("v")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+
+	b := WriteBatch{}
+	for i := 0; i < 5000; i++ {
+		b.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	b.Delete([]byte("old"))
+	b.Delete([]byte("key00007"))
+	version := kv.version
+	if err := kv.Write(&b, SYNC_ON); err != nil {
+		t.Fatalf("KV.Write() failed: %v", err)
+	}
+	if kv.version != version+1 {
+		t.Fatalf("expected a single commit, got %d", kv.version-version)
+	}
+
+	// an invalid update rejects the whole batch
+	b.Reset()
+	b.Put([]byte("key00001"), []byte("changed"))
+	b.Put(nil, []byte("bad"))
+	if err := kv.Write(&b, SYNC_ON); err == nil {
+		t.Fatalf("KV.Write() with an empty key should fail")
+	}
+
+	b.Reset()
+	b.Put([]byte("async"), []byte("v"))
+	if err := kv.Write(&b, SYNC_OFF); err != nil {
+		t.Fatalf("KV.Write() failed: %v", err)
+	}
+
+	kv.Close()
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	for i := 0; i < 5000; i++ {
+		val, ok := kv.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if i == 7 {
+			if ok {
+				t.Fatalf("key00007 should be deleted")
+			}
+			continue
+		}
+		if !ok || string(val) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("unexpected value for key%05d: %s", i, val)
+		}
+	}
+	if _, ok := kv.Get([]byte("old")); ok {
+		t.Fatalf("old should be deleted")
+	}
+	if _, ok := kv.Get([]byte("async")); !ok {
+		t.Fatalf("async is missing")
+	}
+}
+
+func TestKV_CompareAndSwap(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	key := []byte("counter")
+	if ok, err := kv.InsertIfAbsent(key, []byte("0")); err != nil || !ok {
+		t.Fatalf("InsertIfAbsent() on a new key: %v %v", ok, err)
+	}
+	if ok, _ := kv.InsertIfAbsent(key, []byte("x")); ok {
+		t.Fatalf("InsertIfAbsent() should fail on an existing key")
+	}
+
+	// a counter with optimistic retries
+	for i := 0; i < 100; i++ {
+		for {
+			old, _ := kv.Get(key)
+			old = append([]byte(nil), old...)
+			n, _ := strconv.Atoi(string(old))
+			ok, err := kv.CompareAndSwap(key, old, []byte(strconv.Itoa(n+1)))
+			if err != nil {
+				t.Fatalf("CompareAndSwap() failed: %v", err)
+			}
+			if ok {
+				break
+			}
+		}
+	}
+	if val, _ := kv.Get(key); string(val) != "100" {
+		t.Fatalf("unexpected counter: %s", val)
+	}
+
+	// a stale value is rejected
+	if ok, _ := kv.CompareAndSwap(key, []byte("99"), []byte("0")); ok {
+		t.Fatalf("CompareAndSwap() should fail on a stale value")
+	}
+	if ok, _ := kv.CompareAndSwap([]byte("missing"), []byte("1"), []byte("2")); ok {
+		t.Fatalf("CompareAndSwap() should fail on a missing key")
+	}
+	// nil is the empty value, not a missing key
+	if ok, _ := kv.CompareAndSwap([]byte("missing"), nil, []byte("2")); ok {
+		t.Fatalf("CompareAndSwap() should fail on a missing key")
+	}
+	if err := kv.Set([]byte("empty"), nil); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+	if ok, err := kv.CompareAndSwap([]byte("empty"), nil, []byte("1")); !ok || err != nil {
+		t.Fatalf("CompareAndSwap() on an empty value: %v %v", ok, err)
+	}
+	if ok, err := kv.CompareAndSwap([]byte("empty"), []byte("1"), []byte{}); !ok || err != nil {
+		t.Fatalf("CompareAndSwap() failed: %v %v", ok, err)
+	}
+	if ok, err := kv.CompareAndSwap([]byte("empty"), nil, []byte("2")); !ok || err != nil {
+		t.Fatalf("CompareAndSwap() on an empty value: %v %v", ok, err)
+	}
+
+	// the previous value is returned
+	req := InsertReq{Key: key, Val: []byte("reset")}
+	if _, err := kv.Update(&req); err != nil {
+		t.Fatalf("KV.Update() failed: %v", err)
+	}
+	if !req.Updated || req.Added || string(req.Old) != "100" {
+		t.Fatalf("unexpected update result: %+v", req)
+	}
+	req = InsertReq{Key: key, Val: []byte("reset")}
+	kv.Update(&req)
+	if req.Updated || string(req.Old) != "reset" {
+		t.Fatalf("an unchanged value should not be updated")
+	}
+	req = InsertReq{Key: []byte("missing"), Val: []byte("v"), Mode: MODE_UPDATE_ONLY}
+	kv.Update(&req)
+	if req.Updated || req.Found {
+		t.Fatalf("MODE_UPDATE_ONLY should not add keys")
+	}
+	if _, ok := kv.Get([]byte("missing")); ok {
+		t.Fatalf("missing should not exist")
+	}
+}
+
+func TestKV_Options(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	opts := Options{PageSize: 16 << 10, MmapSize: 1 << 20, FileGrowth: 0.5, Sync: SYNC_OFF}
+	if err := kv.Open(opts); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	// values larger than the default limit fit in larger pages
+	big := bytes.Repeat([]byte("v"), 10000)
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if err := kv.Set(key, big[:i*20]); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for i := 0; i < 500; i += 2 {
+		if _, err := kv.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+	}
+	if err := kv.Set([]byte("huge"), bytes.Repeat([]byte("v"), 20000)); err == nil {
+		t.Fatalf("expected an error for a value larger than the page")
+	}
+	kv.Close()
+
+	// the page size is stored in the file
+	for _, psize := range []int{4096, 32 << 10} {
+		kv = KV{Path: path}
+		if err := kv.Open(Options{PageSize: psize}); err == nil {
+			kv.Close()
+			t.Fatalf("expected a page size mismatch for %d", psize)
+		}
+	}
+	kv = KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		val, ok := kv.Get([]byte(fmt.Sprintf("key%04d", i)))
+		if ok != (i%2 == 1) || (ok && !bytes.Equal(val, big[:i*20])) {
+			t.Fatalf("unexpected value for key%04d after reopening", i)
+		}
+	}
+	kv.Close()
+
+	// read-only
+	kv = KV{Path: path}
+	if err := kv.Open(Options{ReadOnly: true}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	if _, ok := kv.Get([]byte("key0001")); !ok {
+		t.Fatalf("KV.Get() failed on a read-only database")
+	}
+	if err := kv.Set([]byte("key0001"), []byte("x")); err == nil {
+		t.Fatalf("expected an error for updating a read-only database")
+	}
+	if val, _ := kv.Get([]byte("key0001")); !bytes.Equal(val, big[:20]) {
+		t.Fatalf("the failed update is visible")
+	}
+	kv.Close()
+
+	for _, opts := range []Options{{PageSize: 128 << 10}, {PageSize: 5000}, {Sync: 7}, {FileGrowth: -1}} {
+		kv = KV{Path: path}
+		if err := kv.Open(opts); err == nil {
+			kv.Close()
+			t.Fatalf("expected an error for the options %+v", opts)
+		}
+	}
+}
+
+func TestKV_LargePages(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	psize := BTREE_PAGE_SIZE_MAX
+	if err := kv.Open(Options{PageSize: psize}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	// values of the maximum size split the nodes in 3,
+	// the temporary nodes are larger than 64K.
+	maxVal := kv.tree.maxValSize()
+	val := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i%26)}, maxVal-i%3)
+	}
+	for i := 0; i < 40; i++ {
+		key := bytes.Repeat([]byte{byte('0' + i%10)}, BTREE_MAX_KEY_SIZE-2)
+		key = append(key, byte(i/10), byte(i))
+		if err := kv.Set(key, val(i)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		if i%2 == 0 {
+			if err := kv.Set([]byte(fmt.Sprintf("small%02d", i)), []byte("v")); err != nil {
+				t.Fatalf("KV.Set() failed: %v", err)
+			}
+		}
+	}
+	if err := kv.Set([]byte("huge"), make([]byte, maxVal+1)); err == nil {
+		t.Fatalf("expected an error for a value larger than the page")
+	}
+	kv.Close()
+
+	kv = KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+	if kv.tree.pageSize() != psize {
+		t.Fatalf("expected the page size %d, got %d", psize, kv.tree.pageSize())
+	}
+	for i := 0; i < 40; i++ {
+		key := bytes.Repeat([]byte{byte('0' + i%10)}, BTREE_MAX_KEY_SIZE-2)
+		key = append(key, byte(i/10), byte(i))
+		if got, ok := kv.Get(key); !ok || !bytes.Equal(got, val(i)) {
+			t.Fatalf("unexpected value for key %d", i)
+		}
+		if _, err := kv.Del(key); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+	}
+	for i := 0; i < 40; i += 2 {
+		if got, ok := kv.Get([]byte(fmt.Sprintf("small%02d", i))); !ok || string(got) != "v" {
+			t.Fatalf("unexpected value for small%02d", i)
+		}
+	}
+}
+
+func TestKV_Locking(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	writer := KV{Path: path}
+	if err := writer.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	if err := writer.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+	// only one writer, and no readers while writing
+	for _, opts := range []Options{{}, {ReadOnly: true}} {
+		other := KV{Path: path}
+		if err := other.Open(opts); !errors.Is(err, ErrLocked) {
+			t.Fatalf("expected ErrLocked, got %v", err)
+		}
+	}
+	writer.Close()
+
+	// many readers
+	readers := []*KV{{Path: path}, {Path: path}}
+	for _, r := range readers {
+		if err := r.Open(Options{ReadOnly: true}); err != nil {
+			t.Fatalf("KV.Open() failed: %v", err)
+		}
+		if val, ok := r.Get([]byte("k")); !ok || string(val) != "v" {
+			t.Fatalf("KV.Get() failed on a read-only database")
+		}
+	}
+	r := readers[0]
+	if err := r.Set([]byte("k"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := r.Del([]byte("k")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := r.DeleteRange(nil, nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := r.CompareAndSwap([]byte("k"), []byte("v"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	b := WriteBatch{}
+	b.Put([]byte("k"), []byte("x"))
+	if err := r.Write(&b, SYNC_ON); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	tx := KVTX{}
+	r.Begin(&tx)
+	if err := tx.Set([]byte("k"), []byte("x")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	r.Abort(&tx)
+
+	// the writer waits for the readers
+	writer = KV{Path: path}
+	if err := writer.Open(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+	writer = KV{Path: path}
+	if err := writer.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	writer.Close()
+}
+
+func TestKV_BackupRestore(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	expect := map[string]string{}
+	set := func(i int, val string) {
+		key := fmt.Sprintf("key%05d", i)
+		if err := kv.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		expect[key] = val
+	}
+	for i := 0; i < 2000; i++ {
+		set(i, fmt.Sprintf("v1-%d", i))
+	}
+	snapshot := func() map[string]string {
+		m := map[string]string{}
+		for k, v := range expect {
+			m[k] = v
+		}
+		return m
+	}
+	check := func(path string, want map[string]string) {
+		t.Helper()
+		db := KV{Path: path}
+		if err := db.Open(); err != nil {
+			t.Fatalf("KV.Open() failed: %v", err)
+		}
+		defer db.Close()
+		n := 0
+		for k, v := range db.Range(nil, nil) {
+			if want[string(k)] != string(v) {
+				t.Fatalf("unexpected value for %s: %s", k, v)
+			}
+			n++
+		}
+		if n != len(want) {
+			t.Fatalf("expected %d keys, got %d", len(want), n)
+		}
+		// the restored file is usable
+		if err := db.Set([]byte("new"), []byte("key")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+
+	// a snapshot is stable while being updated
+	full := bytes.Buffer{}
+	tx := KVReader{}
+	kv.BeginRead(&tx)
+	for i := 0; i < 100; i++ {
+		set(i, "changed")
+	}
+	if val, ok := tx.Get([]byte("key00001")); !ok || string(val) != "v1-1" {
+		t.Fatalf("the snapshot has changed: %s", val)
+	}
+	kv.EndRead(&tx)
+
+	want1 := snapshot()
+	info1, err := kv.Backup(&full)
+	if err != nil {
+		t.Fatalf("KV.Backup() failed: %v", err)
+	}
+
+	for i := 1000; i < 1010; i++ {
+		set(i, "v2")
+	}
+	kv.Del([]byte("key00500"))
+	delete(expect, "key00500")
+	want2 := snapshot()
+	incr := bytes.Buffer{}
+	info2, err := kv.BackupIncremental(&incr, info1)
+	if err != nil {
+		t.Fatalf("KV.BackupIncremental() failed: %v", err)
+	}
+	if incr.Len()*4 > full.Len() {
+		t.Fatalf("the incremental backup is too large: %d vs %d", incr.Len(), full.Len())
+	}
+	read, err := ReadBackupInfo(bytes.NewReader(incr.Bytes()))
+	if err != nil || read.Version != info2.Version || read.Base != info1.Version || len(read.Pages) != len(info2.Pages) {
+		t.Fatalf("ReadBackupInfo() failed: %+v %v", read, err)
+	}
+
+	path1 := createTempFile(t)
+	defer os.Remove(path1)
+	if err := Restore(path1, bytes.NewReader(full.Bytes())); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	check(path1, want1)
+
+	path2 := createTempFile(t)
+	defer os.Remove(path2)
+	if err := Restore(path2, bytes.NewReader(full.Bytes()), bytes.NewReader(incr.Bytes())); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	check(path2, want2)
+
+	// broken chains
+	path3 := createTempFile(t)
+	defer os.Remove(path3)
+	if err := Restore(path3, bytes.NewReader(incr.Bytes())); err == nil {
+		t.Fatalf("expected an error for restoring an incremental backup alone")
+	}
+	os.Remove(path3)
+	if err := Restore(path3, bytes.NewReader(full.Bytes()), bytes.NewReader(full.Bytes())); err == nil {
+		t.Fatalf("expected an error for a broken chain")
+	}
+	if err := Restore(path1, bytes.NewReader(full.Bytes())); err == nil {
+		t.Fatalf("expected an error for restoring into a non-empty file")
+	}
+}
+
+func TestKV_Compact(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	expect := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		val := fmt.Sprintf("value%d-%s", i, bytes.Repeat([]byte("x"), i%100))
+		if err := kv.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		expect[key] = val
+	}
+	for i := 0; i < 5000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := fmt.Sprintf("key%05d", i)
+		if _, err := kv.Del([]byte(key)); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+		delete(expect, key)
+	}
+	fileSize := func(path string) int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat failed: %v", err)
+		}
+		return fi.Size()
+	}
+	check := func(db *KV) {
+		t.Helper()
+		n := 0
+		for k, v := range db.Range(nil, nil) {
+			if expect[string(k)] != string(v) {
+				t.Fatalf("unexpected value for %s: %s", k, v)
+			}
+			n++
+		}
+		if n != len(expect) {
+			t.Fatalf("expected %d keys, got %d", len(expect), n)
+		}
+	}
+	before := fileSize(path)
+
+	// into a new file
+	dst := createTempFile(t)
+	defer os.Remove(dst)
+	if err := kv.Compact(dst); err != nil {
+		t.Fatalf("KV.Compact() failed: %v", err)
+	}
+	if size := fileSize(dst); size*4 > before {
+		t.Fatalf("the compacted file is too large: %d vs %d", size, before)
+	}
+	compacted := KV{Path: dst}
+	if err := compacted.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	check(&compacted)
+	if err := compacted.Set([]byte("key00001"), []byte("new")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+	compacted.Close()
+	if err := kv.Compact(dst); err == nil {
+		t.Fatalf("expected an error for compacting into a non-empty file")
+	}
+
+	// in place, the readers are not blocked meanwhile
+	read := func() {
+		tx := KVReader{}
+		kv.BeginRead(&tx)
+		defer kv.EndRead(&tx)
+		time.Sleep(time.Millisecond) // while the next rounds run
+		n := 0
+		for k, v := range tx.tree.scanSeq(nil, nil, ScanOpts{}) {
+			if expect[string(k)] != string(v) {
+				t.Fatalf("unexpected value for %s: %s", k, v)
+			}
+			n++
+		}
+		if n != len(expect) {
+			t.Fatalf("expected %d keys, got %d", len(expect), n)
+		}
+	}
+	version := kv.version
+	done := make(chan error)
+	go func() { done <- kv.CompactInPlace() }()
+	for running := true; running; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("KV.CompactInPlace() failed: %v", err)
+			}
+			running = false
+		default:
+			// after the check for the active readers
+			kv.mu.Lock()
+			started := kv.version != version
+			kv.mu.Unlock()
+			if started {
+				read()
+			}
+		}
+	}
+	if size := fileSize(path); size*2 > before {
+		t.Fatalf("the file is not truncated: %d vs %d", size, before)
+	}
+	check(&kv)
+	for i := 0; i < 5000; i += 7 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := kv.Set([]byte(key), []byte("after")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		expect[key] = "after"
+	}
+	check(&kv)
+	kv.Close()
+
+	kv = KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	check(&kv)
+}
+
+func TestKV_BulkLoad(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+
+	expect := map[string]string{}
+	sorted := func(from, to, step int, val string) func(func([]byte, []byte) bool) {
+		return func(yield func([]byte, []byte) bool) {
+			for i := from; i < to; i += step {
+				key := fmt.Sprintf("key%06d", i)
+				expect[key] = fmt.Sprintf("%s%d-%s", val, i, bytes.Repeat([]byte("x"), i%50))
+				if !yield([]byte(key), []byte(expect[key])) {
+					return
+				}
+			}
+		}
+	}
+	// all leaves are at the same depth and the keys are in order
+	checkTree := func(db *KV) {
+		t.Helper()
+		depth := -1
+		var prev []byte
+		var walk func(ptr uint64, d int)
+		walk = func(ptr uint64, d int) {
+			node := db.tree.get(ptr)
+			for i := uint16(0); i < node.nkeys(); i++ {
+				if node.btype() == BNODE_NODE {
+					walk(node.getPtr(i), d+1)
+					continue
+				}
+				if depth != -1 && depth != d {
+					t.Fatalf("leaves at different depths: %d and %d", depth, d)
+				}
+				depth = d
+				if prev != nil && bytes.Compare(prev, node.getKey(i)) >= 0 {
+					t.Fatalf("keys out of order: %q, %q", prev, node.getKey(i))
+				}
+				prev = append([]byte{}, node.getKey(i)...)
+			}
+		}
+		walk(db.tree.root, 0)
+		n := 0
+		for k, v := range db.Range(nil, nil) {
+			if expect[string(k)] != string(v) {
+				t.Fatalf("unexpected value for %s: %s", k, v)
+			}
+			n++
+		}
+		if n != len(expect) {
+			t.Fatalf("expected %d keys, got %d", len(expect), n)
+		}
+	}
+
+	// into an empty tree
+	if err := kv.BulkLoad(sorted(0, 20000, 2, "a")); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	checkTree(&kv)
+	full := kv.page.flushed
+
+	// merged with the existing keys, some of them are replaced
+	if err := kv.BulkLoad(sorted(9001, 12000, 3, "b"), BulkOpts{Fill: 0.5}); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	checkTree(&kv)
+	if err := kv.BulkLoad(sorted(30000, 31000, 1, "c")); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	checkTree(&kv)
+
+	// normal updates after the bulk loads
+	for i := 1; i < 20000; i += 97 {
+		key := fmt.Sprintf("key%06d", i)
+		if err := kv.Set([]byte(key), []byte("set")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		expect[key] = "set"
+	}
+	for i := 0; i < 20000; i += 10 {
+		key := fmt.Sprintf("key%06d", i)
+		if _, err := kv.Del([]byte(key)); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+		delete(expect, key)
+	}
+	checkTree(&kv)
+
+	// unsorted input fails without changes
+	bad := func(yield func([]byte, []byte) bool) {
+		_ = yield([]byte("zzz2"), []byte("v")) && yield([]byte("zzz1"), []byte("v"))
+	}
+	if err := kv.BulkLoad(bad); err == nil {
+		t.Fatalf("expected an error for unsorted keys")
+	}
+	if err := kv.BulkLoad(sorted(0, 1, 1, "d"), BulkOpts{Fill: 2}); err == nil {
+		t.Fatalf("expected an error for a bad fill factor")
+	}
+	checkTree(&kv)
+
+	// a lower fill factor takes more pages
+	path2 := createTempFile(t)
+	defer os.Remove(path2)
+	half := KV{Path: path2}
+	if err := half.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	saved := expect
+	expect = map[string]string{}
+	if err := half.BulkLoad(sorted(0, 20000, 2, "a"), BulkOpts{Fill: 0.5}); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	checkTree(&half)
+	if half.page.flushed < full*3/2 {
+		t.Fatalf("expected more pages with a lower fill factor: %d vs %d", half.page.flushed, full)
+	}
+	half.Close()
+	expect = saved
+
+	kv.Close()
+	kv = KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	checkTree(&kv)
+}
+
+// a primary and a follower on localhost, over TCP or a directory
+func TestKV_Replication(t *testing.T) {
+	for _, transport := range []string{"tcp", "dir"} {
+		t.Run(transport, func(t *testing.T) {
+			testReplication(t, transport)
+		})
+	}
+}
+
+func testReplication(t *testing.T, transport string) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	primary := KV{Path: path}
+	if err := primary.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer primary.Close()
+
+	expect := map[string]string{}
+	set := func(i int, val string) {
+		t.Helper()
+		key := fmt.Sprintf("key%05d", i)
+		if err := primary.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		expect[key] = val
+	}
+	// before the replication, the follower is seeded by a full record
+	for i := 0; i < 300; i++ {
+		set(i, "before")
+	}
+	log := primary.StartReplication(20)
+	defer log.Close()
+
+	// the transport
+	var newSource func() ReplSource
+	switch transport {
+	case "tcp":
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen failed: %v", err)
+		}
+		defer ln.Close()
+		go log.Serve(ln)
+		newSource = func() ReplSource { return &ReplTCPSource{Addr: ln.Addr().String()} }
+	case "dir":
+		dir := t.TempDir()
+		shipped := make(chan error, 1)
+		go func() { shipped <- log.ShipToDir(dir) }()
+		defer func() {
+			log.Close()
+			if err := <-shipped; err != nil {
+				t.Errorf("ShipToDir() failed: %v", err)
+			}
+		}()
+		newSource = func() ReplSource { return &ReplDirSource{Dir: dir, Poll: time.Millisecond} }
+	}
+
+	fpath := createTempFile(t)
+	defer os.Remove(fpath)
+	follower, err := OpenFollower(fpath, newSource())
+	if err != nil {
+		t.Fatalf("OpenFollower() failed: %v", err)
+	}
+	defer func() { follower.Close() }()
+
+	snapshot := func(f *Follower) map[string]string {
+		t.Helper()
+		tx := KVReader{}
+		f.KV().BeginRead(&tx)
+		defer f.KV().EndRead(&tx)
+		return readerData(&tx)
+	}
+	sync := func() {
+		t.Helper()
+		if err := follower.Wait(primary.version, 5*time.Second); err != nil {
+			t.Fatalf("Follower.Wait() failed: %v", err)
+		}
+		if got := snapshot(follower); !maps.Equal(got, expect) {
+			t.Fatalf("the follower differs: %d keys, expected %d", len(got), len(expect))
+		}
+	}
+	sync()
+
+	// incremental records
+	for i := 0; i < 500; i++ {
+		set(i*7%600, fmt.Sprintf("v%d", i))
+		if i%3 == 0 {
+			key := fmt.Sprintf("key%05d", i*5%600)
+			if _, err := primary.Del([]byte(key)); err != nil {
+				t.Fatalf("KV.Del() failed: %v", err)
+			}
+			delete(expect, key)
+		}
+	}
+	sync()
+	if err := follower.KV().Set([]byte("k"), []byte("v")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	// a snapshot on the follower is not changed by the later records
+	old := maps.Clone(expect)
+	tx := KVReader{}
+	follower.KV().BeginRead(&tx)
+	for i := 0; i < 10; i++ {
+		set(i, "during")
+	}
+	// the follower can apply the next record only
+	time.Sleep(50 * time.Millisecond)
+	if got := readerData(&tx); !maps.Equal(got, old) {
+		t.Fatalf("the snapshot is changed")
+	}
+	follower.KV().EndRead(&tx)
+	sync()
+
+	// bulk loads and compaction are replicated too
+	kvs := func(yield func([]byte, []byte) bool) {
+		for i := 1000; i < 3000; i++ {
+			key, val := fmt.Sprintf("key%05d", i), "bulk"
+			expect[key] = val
+			if !yield([]byte(key), []byte(val)) {
+				return
+			}
+		}
+	}
+	if err := primary.BulkLoad(kvs); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	for i := 1000; i < 3000; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		if _, err := primary.Del([]byte(key)); err != nil {
+			t.Fatalf("KV.Del() failed: %v", err)
+		}
+		delete(expect, key)
+	}
+	if err := primary.CompactInPlace(); err != nil {
+		t.Fatalf("KV.CompactInPlace() failed: %v", err)
+	}
+	sync()
+
+	// resume after a disconnect, from the log or from a full record
+	for _, n := range []int{5, 100} {
+		if err := follower.Close(); err != nil {
+			t.Fatalf("Follower.Close() failed: %v", err)
+		}
+		for i := 0; i < n; i++ {
+			set(i, fmt.Sprintf("offline%d", n))
+		}
+		if follower, err = OpenFollower(fpath, newSource()); err != nil {
+			t.Fatalf("OpenFollower() failed: %v", err)
+		}
+		sync()
+	}
+
+	// the follower takes over
+	kv, err := follower.Promote()
+	if err != nil {
+		t.Fatalf("Follower.Promote() failed: %v", err)
+	}
+	if err := kv.Set([]byte("key00000"), []byte("promoted")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+	expect["key00000"] = "promoted"
+	if got := snapshot(follower); !maps.Equal(got, expect) {
+		t.Fatalf("the promoted follower differs")
+	}
+}
+
+func readerData(tx *KVReader) map[string]string {
+	data := map[string]string{}
+	for k, v := range tx.tree.scanSeq(nil, nil, ScanOpts{}) {
+		if len(k) > 0 {
+			data[string(k)] = string(v)
+		}
+	}
+	return data
+}
+
+func TestKV_ReplRecord(t *testing.T) {
+	rec := &ReplRecord{
+		Version: 7,
+		Master:  make([]byte, MASTER_SIZE),
+		Pages:   map[uint64][]byte{3: bytes.Repeat([]byte{3}, BTREE_PAGE_SIZE)},
+	}
+	binary.LittleEndian.PutUint32(rec.Master[32:], BTREE_PAGE_SIZE)
+	buf := bytes.Buffer{}
+	if err := writeReplRecord(&buf, rec); err != nil {
+		t.Fatalf("writeReplRecord() failed: %v", err)
+	}
+	data := buf.Bytes()
+	got, err := readReplRecord(bytes.NewReader(data))
+	if err != nil || got.Version != 7 || got.Full || !bytes.Equal(got.Pages[3], rec.Pages[3]) {
+		t.Fatalf("bad record: %v", err)
+	}
+	data[100]++
+	if _, err := readReplRecord(bytes.NewReader(data)); err == nil {
+		t.Fatalf("expected a hash mismatch")
+	}
+	if _, err := readReplRecord(bytes.NewReader(data[:50])); err == nil {
+		t.Fatalf("expected an error on a truncated record")
+	}
+}
+
+func TestKV_PendingPages(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+
+	kv := KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	update := func(kv *KV, round int) {
+		for i := 0; i < 200; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			if err := kv.Set(key, []byte(fmt.Sprintf("val%d", round))); err != nil {
+				t.Fatalf("KV.Set() failed: %v", err)
+			}
+		}
+	}
+	update(&kv, 0)
+
+	// the pages freed while a reader is open are pending
+	tx := KVReader{}
+	kv.BeginRead(&tx)
+	update(&kv, 1)
+	npending := len(kv.free.pending)
+	if npending == 0 || kv.free.pendingRoot == 0 {
+		t.Fatalf("expected pending pages")
+	}
+
+	// they are found after a crash
+	crash := path + ".crash"
+	defer os.Remove(crash)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if err := os.WriteFile(crash, data, 0o644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	// and after closing with the reader open
+	kv.Close()
+	for _, p := range []string{crash, path} {
+		other := KV{Path: p}
+		if err := other.Open(); err != nil {
+			t.Fatalf("KV.Open() failed: %v", err)
+		}
+		if len(other.free.pending) != npending {
+			t.Fatalf("expected %d pending pages, got %d", npending, len(other.free.pending))
+		}
+		// and reused by the next update without readers
+		loaded := other.free.pending
+		if err := other.Set([]byte("key0000"), []byte("next")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+		free := map[uint64]bool{}
+		for i := 0; i < other.free.Total(); i++ {
+			free[other.free.Get(i)] = true
+		}
+		for _, p := range loaded {
+			if !free[p.ptr] {
+				t.Fatalf("the pending page %d is not freed", p.ptr)
+			}
+		}
+		update(&other, 2)
+		if val, ok := other.Get([]byte("key0007")); !ok || string(val) != "val2" {
+			t.Fatalf("unexpected value: %q", val)
+		}
+		other.Close()
+	}
+
+	// the history keeps them while it's enabled
+	kv = KV{Path: path}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer kv.Close()
+	kv.BeginRead(&tx)
+	update(&kv, 3)
+	if err := kv.EnableHistory(HistoryOpts{MaxVersions: 2}); err != nil {
+		t.Fatalf("KV.EnableHistory() failed: %v", err)
+	}
+	if kv.free.pendingRoot != 0 {
+		t.Fatalf("expected the history to keep the pending pages")
+	}
+	update(&kv, 4)
+	if err := kv.DisableHistory(); err != nil {
+		t.Fatalf("KV.DisableHistory() failed: %v", err)
+	}
+	if kv.free.pendingRoot == 0 {
+		t.Fatalf("expected the pending pages on disk")
+	}
+	kv.EndRead(&tx)
+	update(&kv, 5)
+	// only the pages freed by the last update are kept
+	for _, p := range kv.free.pending {
+		if p.version != kv.version {
+			t.Fatalf("unexpected pending page of the version %d", p.version)
+		}
+	}
+}
+
+func TestKV_Snapshots(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer func() { kv.Close() }()
+
+	expect := map[string]string{}
+	update := func(round int) {
+		t.Helper()
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			val := fmt.Sprintf("value%d-%d", round, i)
+			if i%7 == round%7 {
+				if _, err := kv.Del([]byte(key)); err != nil {
+					t.Fatalf("KV.Del() failed: %v", err)
+				}
+				delete(expect, key)
+				continue
+			}
+			if err := kv.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatalf("KV.Set() failed: %v", err)
+			}
+			expect[key] = val
+		}
+	}
+	check := func(name string, want map[string]string) {
+		t.Helper()
+		tx, err := kv.OpenSnapshot(name)
+		if err != nil {
+			t.Fatalf("KV.OpenSnapshot() failed: %v", err)
+		}
+		defer kv.EndRead(tx)
+		if got := readerData(tx); !maps.Equal(got, want) {
+			t.Fatalf("snapshot %s: expected %d keys, got %d", name, len(want), len(got))
+		}
+	}
+
+	update(0)
+	if err := kv.CreateSnapshot("a"); err != nil {
+		t.Fatalf("KV.CreateSnapshot() failed: %v", err)
+	}
+	if err := kv.CreateSnapshot("a"); err == nil {
+		t.Fatalf("expected an error for a duplicate snapshot")
+	}
+	snapA := maps.Clone(expect)
+	versionA := kv.version - 1
+	update(1)
+	update(2)
+	check("a", snapA)
+	if err := kv.CompactInPlace(); err == nil {
+		t.Fatalf("expected an error for compacting with snapshots")
+	}
+
+	// the snapshots survive restarts
+	kv.Close()
+	kv = KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	snaps := kv.Snapshots()
+	if len(snaps) != 1 || snaps[0].Name != "a" || snaps[0].Version != versionA {
+		t.Fatalf("unexpected snapshots: %+v", snaps)
+	}
+	update(3)
+	check("a", snapA)
+	if err := kv.CreateSnapshot("b"); err != nil {
+		t.Fatalf("KV.CreateSnapshot() failed: %v", err)
+	}
+	snapB := maps.Clone(expect)
+	update(4)
+
+	// the pages of "a" are freed, "b" is intact
+	nfree := kv.free.Total()
+	if err := kv.DeleteSnapshot("a"); err != nil {
+		t.Fatalf("KV.DeleteSnapshot() failed: %v", err)
+	}
+	if err := kv.DeleteSnapshot("a"); err == nil {
+		t.Fatalf("expected an error for a deleted snapshot")
+	}
+	if _, err := kv.OpenSnapshot("a"); err == nil {
+		t.Fatalf("expected an error for a deleted snapshot")
+	}
+	update(5)
+	if kv.free.Total() <= nfree {
+		t.Fatalf("the pages are not freed: %d -> %d", nfree, kv.free.Total())
+	}
+	check("b", snapB)
+
+	// a reader keeps the pages of a deleted snapshot
+	tx, err := kv.OpenSnapshot("b")
+	if err != nil {
+		t.Fatalf("KV.OpenSnapshot() failed: %v", err)
+	}
+	if err := kv.DeleteSnapshot("b"); err != nil {
+		t.Fatalf("KV.DeleteSnapshot() failed: %v", err)
+	}
+	update(6)
+	if got := readerData(tx); !maps.Equal(got, snapB) {
+		t.Fatalf("the reader of a deleted snapshot is changed")
+	}
+	kv.EndRead(tx)
+
+	if len(kv.Snapshots()) != 0 || kv.snaps.head != 0 {
+		t.Fatalf("the snapshot list is not empty")
+	}
+	if err := kv.CompactInPlace(); err != nil {
+		t.Fatalf("KV.CompactInPlace() failed: %v", err)
+	}
+	for k, v := range kv.Range(nil, nil) {
+		if expect[string(k)] != string(v) {
+			t.Fatalf("unexpected value for %s: %s", k, v)
+		}
+	}
+}
+
+func TestKV_History(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer func() { kv.Close() }()
+
+	if _, err := kv.VersionAt(time.Now()); err == nil {
+		t.Fatalf("expected an error without the history")
+	}
+	update := func(round int) {
+		t.Helper()
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%04d", (i*7+round)%1000)
+			if err := kv.Set([]byte(key), []byte(fmt.Sprintf("value%d", round))); err != nil {
+				t.Fatalf("KV.Set() failed: %v", err)
+			}
+		}
+	}
+	data := func() map[string]string {
+		tx := KVReader{}
+		kv.BeginRead(&tx)
+		defer kv.EndRead(&tx)
+		return readerData(&tx)
+	}
+	asOf := func(version uint64) (map[string]string, error) {
+		tx := KVReader{}
+		if err := kv.BeginReadAsOf(&tx, version); err != nil {
+			return nil, err
+		}
+		defer kv.EndRead(&tx)
+		return readerData(&tx), nil
+	}
+
+	update(0)
+	if err := kv.EnableHistory(HistoryOpts{MaxVersions: 5000}); err != nil {
+		t.Fatalf("KV.EnableHistory() failed: %v", err)
+	}
+	// the data of some versions, and a time between them
+	expect := map[uint64]map[string]string{}
+	var mid time.Time
+	var midVersion uint64
+	for round := 1; round <= 5; round++ {
+		expect[kv.version] = data()
+		if round == 3 {
+			time.Sleep(time.Millisecond)
+			mid, midVersion = time.Now(), kv.version
+			time.Sleep(time.Millisecond)
+		}
+		update(round)
+	}
+	check := func() {
+		t.Helper()
+		for version, want := range expect {
+			got, err := asOf(version)
+			if err != nil {
+				t.Fatalf("KV.BeginReadAsOf(%d) failed: %v", version, err)
+			}
+			if !maps.Equal(got, want) {
+				t.Fatalf("version %d: unexpected data", version)
+			}
+		}
+		if v, err := kv.VersionAt(mid); err != nil || v != midVersion {
+			t.Fatalf("KV.VersionAt() = %d, %v, expected %d", v, err, midVersion)
+		}
+	}
+	check()
+	if err := kv.CompactInPlace(); err == nil {
+		t.Fatalf("expected an error for compacting with the history")
+	}
+	if _, err := asOf(kv.version + 1); err == nil {
+		t.Fatalf("expected an error for a future version")
+	}
+
+	// the window survives restarts
+	kv.Close()
+	kv = KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	check()
+	update(6)
+	check()
+
+	// a reader keeps its version after the window moves on
+	oldest, latest, err := kv.HistoryRange()
+	if err != nil || latest != kv.version {
+		t.Fatalf("KV.HistoryRange() = %d, %d, %v", oldest, latest, err)
+	}
+	want := expect[oldest+1] // enabling the history is a version without changes
+	tx := KVReader{}
+	if err := kv.BeginReadAsOf(&tx, oldest); err != nil {
+		t.Fatalf("KV.BeginReadAsOf() failed: %v", err)
+	}
+	if err := kv.EnableHistory(HistoryOpts{MaxVersions: 10}); err != nil {
+		t.Fatalf("KV.EnableHistory() failed: %v", err)
+	}
+	update(7)
+	if got := readerData(&tx); !maps.Equal(got, want) {
+		t.Fatalf("the reader of version %d is changed", oldest)
+	}
+	kv.EndRead(&tx)
+	if _, err := asOf(oldest); err == nil {
+		t.Fatalf("expected an error for a version before the window")
+	}
+	if first, last, _ := kv.HistoryRange(); last-first != 9 {
+		t.Fatalf("unexpected window: %d-%d", first, last)
+	}
+
+	// the pages before the window are reused
+	for round := 8; round < 30; round++ {
+		update(round)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	size := fi.Size()
+	for round := 30; round < 60; round++ {
+		update(round)
+	}
+	if fi, _ := os.Stat(path); fi.Size() > size*2 {
+		t.Fatalf("the file keeps growing: %d -> %d", size, fi.Size())
+	}
+
+	// the history is dropped
+	if err := kv.DisableHistory(); err != nil {
+		t.Fatalf("KV.DisableHistory() failed: %v", err)
+	}
+	if _, _, err := kv.HistoryRange(); err == nil {
+		t.Fatalf("expected an error without the history")
+	}
+	if err := kv.CompactInPlace(); err != nil {
+		t.Fatalf("KV.CompactInPlace() failed: %v", err)
+	}
+	kv.Close()
+	kv = KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	if got := data(); len(got) != 1000 {
+		t.Fatalf("expected 1000 keys, got %d", len(got))
+	}
+}
+
+func TestKV_TTL(t *testing.T) {
+	path := createTempFile(t)
+	defer os.Remove(path)
+	kv := KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	defer func() { kv.Close() }()
+
+	for i := 0; i < 100; i++ {
+		if err := kv.Set([]byte(fmt.Sprintf("p%04d", i)), []byte("v")); err != nil {
+			t.Fatalf("KV.Set() failed: %v", err)
+		}
+	}
+	for i := 0; i < 3000; i++ {
+		if err := kv.SetWithTTL([]byte(fmt.Sprintf("e%04d", i)), []byte("v"), 50*time.Millisecond); err != nil {
+			t.Fatalf("KV.SetWithTTL() failed: %v", err)
+		}
+	}
+	if err := kv.SetWithTTL([]byte("long"), []byte("v"), time.Hour); err != nil {
+		t.Fatalf("KV.SetWithTTL() failed: %v", err)
+	}
+	if err := kv.SetWithTTL([]byte("long"), []byte("v"), 0); err == nil {
+		t.Fatalf("expected an error for a zero TTL")
+	}
+	// the updates without a TTL make the keys permanent
+	for _, key := range []string{"set", "batch", "cas"} {
+		if err := kv.SetWithTTL([]byte(key), []byte("old"), 50*time.Millisecond); err != nil {
+			t.Fatalf("KV.SetWithTTL() failed: %v", err)
+		}
+	}
+	if err := kv.Set([]byte("set"), []byte("new")); err != nil {
+		t.Fatalf("KV.Set() failed: %v", err)
+	}
+	b := WriteBatch{}
+	b.Put([]byte("batch"), []byte("new"))
+	if err := kv.Write(&b, SYNC_OFF); err != nil {
+		t.Fatalf("KV.Write() failed: %v", err)
+	}
+	if ok, err := kv.CompareAndSwap([]byte("cas"), []byte("old"), []byte("new")); !ok || err != nil {
+		t.Fatalf("KV.CompareAndSwap() failed: %v %v", ok, err)
+	}
+	if d, ok := kv.TTL([]byte("long")); !ok || d <= 59*time.Minute {
+		t.Fatalf("unexpected TTL: %v %v", d, ok)
+	}
+	for _, key := range []string{"p0000", "set", "batch", "cas"} {
+		if _, ok := kv.TTL([]byte(key)); ok {
+			t.Fatalf("unexpected TTL of %s", key)
+		}
+	}
+
+	// the expired keys are absent before they are deleted
+	old := KVReader{}
+	kv.BeginRead(&old)
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := kv.Get([]byte("e0000")); ok {
+		t.Fatalf("expected an expired key to be absent")
+	}
+	if _, ok := old.Get([]byte("e0000")); ok {
+		t.Fatalf("expected an expired key to be absent for readers")
+	}
+	tx := KVTX{}
+	kv.Begin(&tx)
+	_, ok := tx.Get([]byte("e2999"))
+	kv.Abort(&tx)
+	if ok {
+		t.Fatalf("expected an expired key to be absent in transactions")
+	}
+	count := 0
+	for range kv.Range(nil, nil) {
+		count++
+	}
+	if count != 104 {
+		t.Fatalf("expected 104 keys, got %d", count)
+	}
+	for key := range kv.ScanPrefix([]byte("e"), ScanOpts{Limit: 5}) {
+		t.Fatalf("unexpected expired key: %q", key)
+	}
+	if _, ok := kv.tree.Get([]byte("e0000")); !ok {
+		t.Fatalf("expected the expired key to be in the tree")
+	}
+
+	// in batches, ordered by the expiry
+	n, err := kv.ReapExpired(1000)
+	if err != nil || n != 1000 {
+		t.Fatalf("KV.ReapExpired() = %d %v", n, err)
+	}
+	if _, ok := kv.tree.Get([]byte("e0999")); ok {
+		t.Fatalf("expected the reaped key to be deleted")
+	}
+	if _, ok := kv.tree.Get([]byte("e1000")); !ok {
+		t.Fatalf("expected the later key to be kept")
+	}
+	// the reader of the old version still sees the pages
+	if _, ok := old.tree.Get([]byte("e0000")); !ok {
+		t.Fatalf("expected the old version to be kept for the reader")
+	}
+	kv.EndRead(&old)
+	if err := kv.CompactInPlace(); err != nil {
+		t.Fatalf("KV.CompactInPlace() failed: %v", err)
+	}
+	if _, ok := kv.TTL([]byte("e1000")); !ok {
+		t.Fatalf("expected the TTLs to be compacted")
+	}
+
+	// the background reaper
+	r := kv.StartReaper(5*time.Millisecond, 300)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tx := KVReader{}
+		kv.BeginRead(&tx)
+		_, ok := tx.tree.Get([]byte("e2999"))
+		kv.EndRead(&tx)
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the reaper didn't delete the expired keys")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Reaper.Close() failed: %v", err)
+	}
+	if n, err := kv.ReapExpired(0); n != 0 || err != nil {
+		t.Fatalf("KV.ReapExpired() = %d %v", n, err)
+	}
+	for _, key := range []string{"p0099", "long", "set", "batch", "cas"} {
+		if _, ok := kv.Get([]byte(key)); !ok {
+			t.Fatalf("expected %s to be kept", key)
+		}
+	}
+
+	// the expired keys are absent for the conditional updates
+	for _, key := range []string{"x1", "x2", "x3"} {
+		if err := kv.SetWithTTL([]byte(key), []byte("v"), time.Millisecond); err != nil {
+			t.Fatalf("KV.SetWithTTL() failed: %v", err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	kv.Begin(&tx)
+	added, err := tx.Update(&InsertReq{Key: []byte("x1"), Val: []byte("new"), Mode: MODE_INSERT_ONLY})
+	if err != nil || !added {
+		kv.Abort(&tx)
+		t.Fatalf("KVTX.Update() = %v %v", added, err)
+	}
+	if err := kv.Commit(&tx); err != nil {
+		t.Fatalf("KV.Commit() failed: %v", err)
+	}
+	if ok, err := kv.InsertIfAbsent([]byte("x2"), []byte("new")); !ok || err != nil {
+		t.Fatalf("KV.InsertIfAbsent() failed: %v %v", ok, err)
+	}
+	if ok, err := kv.CompareAndSwap([]byte("x3"), []byte("v"), []byte("new")); ok || err != nil {
+		t.Fatalf("expected no swap of an expired key: %v %v", ok, err)
+	}
+	for _, key := range []string{"x1", "x2"} {
+		if val, ok := kv.Get([]byte(key)); !ok || string(val) != "new" {
+			t.Fatalf("unexpected value of %s: %q %v", key, val, ok)
+		}
+		if _, ok := kv.TTL([]byte(key)); ok {
+			t.Fatalf("unexpected TTL of %s", key)
+		}
+	}
+	if _, ok := kv.tree.Get([]byte("x3")); ok {
+		t.Fatalf("expected the expired key to be deleted")
+	}
+
+	// bulk loads replace the keys with a TTL
+	if err := kv.SetWithTTL([]byte("bulk"), []byte("old"), time.Hour); err != nil {
+		t.Fatalf("KV.SetWithTTL() failed: %v", err)
+	}
+	bulk := func(yield func([]byte, []byte) bool) {
+		yield([]byte("bulk"), []byte("new"))
+	}
+	if err := kv.BulkLoad(bulk); err != nil {
+		t.Fatalf("KV.BulkLoad() failed: %v", err)
+	}
+	if _, ok := kv.TTL([]byte("bulk")); ok {
+		t.Fatalf("expected the TTL to be dropped by the bulk load")
+	}
+
+	// the TTLs are copied by the compaction
+	dst := path + ".compact"
+	defer os.Remove(dst)
+	if err := kv.Compact(dst); err != nil {
+		t.Fatalf("KV.Compact() failed: %v", err)
+	}
+	out := KV{Path: dst}
+	if err := out.Open(Options{ReadOnly: true}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	_, ok = out.TTL([]byte("long"))
+	out.Close()
+	if !ok {
+		t.Fatalf("expected the TTL in the compacted file")
+	}
+
+	// and by the backups
+	full, incr := bytes.Buffer{}, bytes.Buffer{}
+	info, err := kv.Backup(&full)
+	if err != nil || info.TTLRoot == 0 {
+		t.Fatalf("KV.Backup() failed: %+v %v", info, err)
+	}
+	if err := kv.SetWithTTL([]byte("incr"), []byte("v"), time.Hour); err != nil {
+		t.Fatalf("KV.SetWithTTL() failed: %v", err)
+	}
+	if _, err := kv.BackupIncremental(&incr, info); err != nil {
+		t.Fatalf("KV.BackupIncremental() failed: %v", err)
+	}
+	if _, err := kv.Del([]byte("incr")); err != nil {
+		t.Fatalf("KV.Del() failed: %v", err)
+	}
+	restored := path + ".restore"
+	defer os.Remove(restored)
+	if err := Restore(restored, bytes.NewReader(full.Bytes()), bytes.NewReader(incr.Bytes())); err != nil {
+		t.Fatalf("Restore() failed: %v", err)
+	}
+	out = KV{Path: restored}
+	if err := out.Open(Options{ReadOnly: true}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	_, ok1 := out.TTL([]byte("long"))
+	_, ok2 := out.TTL([]byte("incr"))
+	out.Close()
+	if !ok1 || !ok2 {
+		t.Fatalf("expected the TTLs in the restored file")
+	}
+
+	// the TTLs survive restarts
+	if err := kv.SetWithTTL([]byte("short"), []byte("v"), time.Millisecond); err != nil {
+		t.Fatalf("KV.SetWithTTL() failed: %v", err)
+	}
+	kv.Close()
+	time.Sleep(2 * time.Millisecond)
+	kv = KV{Path: path}
+	if err := kv.Open(Options{Sync: SYNC_OFF}); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	if _, ok := kv.Get([]byte("short")); ok {
+		t.Fatalf("expected an expired key to be absent after a restart")
+	}
+	if _, ok := kv.TTL([]byte("long")); !ok {
+		t.Fatalf("expected the TTL to be kept after a restart")
+	}
+
+	// the tree is dropped with the last TTL
+	if _, err := kv.Del([]byte("short")); err != nil {
+		t.Fatalf("KV.Del() failed: %v", err)
+	}
+	if err := kv.DeleteRange([]byte("l"), []byte("m")); err != nil {
+		t.Fatalf("KV.DeleteRange() failed: %v", err)
+	}
+	if kv.ttl.root != 0 {
+		t.Fatalf("expected an empty TTL tree")
+	}
+	if _, ok := kv.Get([]byte("p0099")); !ok {
+		t.Fatalf("expected p0099 to be kept")
+	}
+}
+
+func TestExprCache(t *testing.T) {
+	first, err := ParseExpr("a + 1")
+	if err != nil {
+		t.Fatalf("ParseExpr() failed: %v", err)
+	}
+	if again, _ := ParseExpr("a + 1"); again != first {
+		t.Fatalf("expected the cached expression")
+	}
+	// distinct filters don't grow the cache without bound
+	for i := 0; i < 2*EXPR_CACHE_MAX; i++ {
+		if _, err := ParseExpr(fmt.Sprintf("a = %d", i)); err != nil {
+			t.Fatalf("ParseExpr() failed: %v", err)
+		}
+	}
+	exprCache.Lock()
+	n := len(exprCache.m)
+	exprCache.Unlock()
+	if n > EXPR_CACHE_MAX {
+		t.Fatalf("expected at most %d cached expressions, got %d", EXPR_CACHE_MAX, n)
+	}
+}
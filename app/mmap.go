@@ -9,27 +9,31 @@ import (
 	"syscall"
 )
 
-func mmapInit(fp *os.File) (int, []byte, error) {
+func mmapInit(fp *os.File, opts Options) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
 
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+	psize := opts.PageSize
+	if fi.Size()%int64(psize) != 0 {
 		return 0, nil, errors.New("file size is not a multiple of page size")
 	}
 
-	mmapSize := 64 << 20
-	Assert(mmapSize%BTREE_PAGE_SIZE == 0, "mmap size is not a multiple of page size.")
+	mmapSize := opts.MmapSize
+	if mmapSize%psize != 0 {
+		return 0, nil, errors.New("mmap size is not a multiple of page size")
+	}
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
 	// mmap size can be larger than the file
 
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	if opts.ReadOnly {
+		prot = syscall.PROT_READ
+	}
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, prot, syscall.MAP_SHARED)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -39,26 +43,25 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 
 // extend the mmap by adding new mappings
 func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
-		return nil
-	}
-
-	// double the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	for db.mmap.total < npages*db.tree.pageSize() {
+		// double the address space
+		chunk, err := syscall.Mmap(
+			int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.total += db.mmap.total
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
 	}
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
 	return nil
 }
 
 // extend the file to atleadt `npages`.
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	psize := db.tree.pageSize()
+	filePages := db.mmap.file / psize
 	if filePages >= npages {
 		return nil
 	}
@@ -66,14 +69,14 @@ func extendFile(db *KV, npages int) error {
 	for filePages < npages {
 		// the file size is increased exponentially
 		// so that we don't have to extend the size for every update.
-		inc := filePages / 8
+		inc := int(float64(filePages) * db.opts.FileGrowth)
 		if inc < 1 {
 			inc = 1
 		}
 		filePages += inc
 	}
 
-	fileSize := filePages * BTREE_PAGE_SIZE
+	fileSize := filePages * psize
 	err := syscall.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
@@ -85,8 +88,13 @@ func extendFile(db *KV, npages int) error {
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B |    8B      |    8B     |
+// | sig | btree_root | page_used | page_size | version | free_list | snapshots | history | ttl | pending |
+// | 16B |    8B      |    8B     |    4B     |   8B    |    8B     |    8B     |   8B    | 8B  |   8B    |
+// a zero page size is BTREE_PAGE_SIZE, for files created before it was stored.
+// the snapshot list, the history tree, the TTL tree and the pending pages
+// are 0 for none, which is also true for older files.
+
+const MASTER_SIZE = 84
 
 func masterLoad(db *KV) error {
 	// If the file is empty, initialize the master page
@@ -95,7 +103,11 @@ func masterLoad(db *KV) error {
 		db.page.flushed = 1 // reserved for the master page
 		return nil
 	}
-	data := db.mmap.chunks[0]
+	return masterParse(db, db.mmap.chunks[0])
+}
+
+// verify the master page and take its state
+func masterParse(db *KV, data []byte) error {
 	root := binary.LittleEndian.Uint64(data[16:])
 	used := binary.LittleEndian.Uint64(data[24:])
 
@@ -103,25 +115,91 @@ func masterLoad(db *KV) error {
 	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
 		return errors.New("bad signature")
 	}
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(root < used)
+	bad := !(1 <= used && used <= uint64(db.mmap.file/db.tree.pageSize()))
+	free := binary.LittleEndian.Uint64(data[44:])
+	snaps := binary.LittleEndian.Uint64(data[52:])
+	hist := binary.LittleEndian.Uint64(data[60:])
+	ttl := binary.LittleEndian.Uint64(data[68:])
+	pending := binary.LittleEndian.Uint64(data[76:])
+	bad = bad || !(root < used) || !(free < used) || !(snaps < used) || !(hist < used) || !(ttl < used)
+	bad = bad || !(pending < used)
 	if bad {
 		return errors.New("bad master page")
 	}
+	items, err := snapshotParse(db, snaps)
+	if err != nil {
+		return err
+	}
 	db.tree.root = root
+	db.root = root
+	db.ttl.root = ttl
+	db.ttlRoot = ttl
 	db.page.flushed = used
+	db.version = binary.LittleEndian.Uint64(data[36:])
+	db.free.head = free
+	db.free.pendingRoot = pending
+	db.snaps = snapshotList{head: snaps, items: items}
+	db.snapshots = items
+	db.pinned = nil
+	// loaded by the caller, or on demand for followers
+	db.hist = historyState{root: hist}
+	db.history = nil
+	db.historyLoaded = false
 	return nil
 }
 
+// read the page size from the master page before the file is mapped.
+// 0 for an empty file.
+func masterPageSize(fp *os.File) (int, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size() == 0 {
+		return 0, nil
+	}
+
+	var data [36]byte
+	if _, err := fp.ReadAt(data[:], 0); err != nil {
+		return 0, fmt.Errorf("read master page: %w", err)
+	}
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		return 0, errors.New("bad signature")
+	}
+	psize := int(binary.LittleEndian.Uint32(data[32:]))
+	if psize == 0 {
+		return BTREE_PAGE_SIZE, nil
+	}
+	if err := checkPageSize(psize); err != nil {
+		return 0, errors.New("bad master page")
+	}
+	return psize, nil
+}
+
 // update the master page. it must be atomic.
 func masterStore(db *KV) error {
-	var data [32]byte
+	return masterWrite(db, masterData(db))
+}
+
+func masterData(db *KV) []byte {
+	data := make([]byte, MASTER_SIZE)
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint32(data[32:], uint32(db.tree.pageSize()))
+	binary.LittleEndian.PutUint64(data[36:], db.version)
+	binary.LittleEndian.PutUint64(data[44:], db.free.head)
+	binary.LittleEndian.PutUint64(data[52:], db.snaps.head)
+	binary.LittleEndian.PutUint64(data[60:], db.hist.root)
+	binary.LittleEndian.PutUint64(data[68:], db.ttl.root)
+	binary.LittleEndian.PutUint64(data[76:], db.free.pendingRoot)
+	return data
+}
+
+func masterWrite(db *KV, data []byte) error {
 	// NOTE: Updating the page via mmap is not atomic.
 	// Use the `pwrite()` syscall instead.
-	_, err := syscall.Pwrite(int(db.fp.Fd()), data[:], 0)
+	_, err := syscall.Pwrite(int(db.fp.Fd()), data, 0)
 	// _, err := db.fp.WriteAt(data[:], 0)
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
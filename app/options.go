@@ -0,0 +1,64 @@
+package relixdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// an update on a database opened with Options.ReadOnly
+	ErrReadOnly = errors.New("the database is read-only")
+	// the file is opened by another KV, a writer excludes all others
+	ErrLocked = errors.New("the database is locked")
+)
+
+// options for opening a KV or a DB
+type Options struct {
+	// a power of two from BTREE_PAGE_SIZE to BTREE_PAGE_SIZE_MAX, stored in
+	// the master page. 0: the page size of the file, or BTREE_PAGE_SIZE.
+	PageSize int
+	// the initial mmap size, a multiple of the page size. 0: MMAP_INIT_SIZE.
+	MmapSize int
+	// the file is extended by at least this fraction of its size. 0: 1/8.
+	FileGrowth float64
+	// the durability of single updates and commits: SYNC_ON or SYNC_OFF
+	Sync int
+	// open the file for reading with a shared lock, updates fail with ErrReadOnly.
+	// otherwise the file is locked exclusively. the read-only opens share the
+	// file with each other but not with a writer, whose commits could reuse
+	// the pages they read: they fail with ErrLocked until the writer is closed.
+	ReadOnly bool
+}
+
+// check the options and fill in the defaults
+func checkOptions(opts *Options) error {
+	if opts.PageSize != 0 {
+		if err := checkPageSize(opts.PageSize); err != nil {
+			return err
+		}
+	}
+	if opts.MmapSize < 0 {
+		return fmt.Errorf("bad mmap size: %d", opts.MmapSize)
+	}
+	if opts.MmapSize == 0 {
+		opts.MmapSize = MMAP_INIT_SIZE
+	}
+	if opts.FileGrowth < 0 {
+		return fmt.Errorf("bad file growth: %v", opts.FileGrowth)
+	}
+	if opts.FileGrowth == 0 {
+		opts.FileGrowth = 1.0 / 8
+	}
+	if opts.Sync != SYNC_ON && opts.Sync != SYNC_OFF {
+		return fmt.Errorf("bad sync mode: %d", opts.Sync)
+	}
+	return nil
+}
+
+func checkPageSize(psize int) error {
+	ok := psize >= BTREE_PAGE_SIZE && psize <= BTREE_PAGE_SIZE_MAX
+	if !ok || psize&(psize-1) != 0 {
+		return fmt.Errorf("bad page size: %d", psize)
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package relixdb
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+)
 
 // callback for BTree & FreeList, dereference a pointer.
 func (db *KV) pageGet(ptr uint64) BNode {
@@ -12,12 +15,18 @@ func (db *KV) pageGet(ptr uint64) BNode {
 }
 
 func pageGetMapped(db *KV, ptr uint64) BNode {
+    return chunksPage(db.mmap.chunks, db.tree.pageSize(), ptr)
+}
+
+// find a page in the mmap chunks
+func chunksPage(chunks [][]byte, pageSize int, ptr uint64) BNode {
+    psize := uint64(pageSize)
     start := uint64(0)
-    for _, chunk := range db.mmap.chunks {
-        end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+    for _, chunk := range chunks {
+        end := start + uint64(len(chunk))/psize
         if ptr < end {
-            offset := BTREE_PAGE_SIZE * (ptr - start)
-            return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
+            offset := psize * (ptr - start)
+            return BNode{chunk[offset : offset+psize]}
         }
         start = end
     }
@@ -26,7 +35,7 @@ func pageGetMapped(db *KV, ptr uint64) BNode {
 
 // callback for BTree, allocate a new page.
 func (db *KV) pageNew(node BNode) uint64 {
-	Assert(len(node.data) <= BTREE_PAGE_SIZE, "node data excceds page size")
+	Assert(len(node.data) <= db.tree.pageSize(), "node data excceds page size")
 	ptr := uint64(0)
 	if db.page.nfree < db.free.Total() {
 		// reuse a deallocated page
@@ -48,7 +57,7 @@ func (db *KV) pageDel(ptr uint64) {
 
 // callback for FreeList, allocate a new page.
 func (db *KV) pageAppend(node BNode) uint64 {
-	Assert(len(node.data) <= BTREE_PAGE_SIZE, "node data excceds page size")
+	Assert(len(node.data) <= db.tree.pageSize(), "node data excceds page size")
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
 	db.page.updates[ptr] = node.data
@@ -60,27 +69,131 @@ func (db *KV) pageUse(ptr uint64, node BNode) {
 	db.page.updates[ptr] = node.data
 }
 
-// persist the newly allocated pages after updates
-func flushPages(db *KV) error {
+// the in-memory state before an update, for rolling back
+type kvState struct {
+	root  uint64
+	free  FreeListData
+	snaps snapshotList
+	hist  historyState
+	ttl   uint64
+}
+
+func (db *KV) saveState() kvState {
+	return kvState{root: db.tree.root, free: db.free.FreeListData, snaps: db.snaps, hist: db.hist, ttl: db.ttl.root}
+}
+
+// discard the pending updates
+func (db *KV) rollback(saved kvState) {
+	db.tree.root = saved.root
+	db.free.FreeListData = saved.free
+	if db.snaps.head != saved.snaps.head {
+		db.snaps = saved.snaps
+		db.pinned = nil
+	}
+	db.hist = saved.hist
+	db.ttl.root = saved.ttl
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.page.released = nil
+}
+
+// persist the newly allocated pages after updates.
+// the in-memory state is rolled back to `saved` if nothing has reached the master page.
+func flushPages(db *KV, saved kvState, sync int) error {
+	if len(db.page.updates) == 0 && len(db.page.released) == 0 && db.tree.root == saved.root {
+		return nil // no updates
+	}
+	if db.opts.ReadOnly {
+		db.rollback(saved)
+		return ErrReadOnly
+	}
 	if err := writePages(db); err != nil {
+		db.rollback(saved)
 		return err
 	}
 
-	return syncPages(db)
+	return syncPages(db, saved, sync)
 }
 
-func writePages(db *KV) error {
-	// update the free list
+// take over the pages written directly to the file: the tree at `root`
+// uses the pages below `used`, the `unused` ones are added to the free list.
+func adoptPages(db *KV, root uint64, used uint64, version uint64, unused []uint64) error {
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	db.mmap.file = int(fi.Size())
+	if err := extendMmap(db, int(used)); err != nil {
+		return err
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	db.tree.root = root
+	db.page.flushed = used
+	db.version = version
+	db.free.Update(0, unused)
+	return flushPages(db, saved, SYNC_ON)
+}
+
+// add all pending free pages to the free list if there are no readers
+func flushPending(db *KV) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	busy := len(db.readers) > 0
+	db.mu.Unlock()
+	if busy || db.hist.root != 0 {
+		return nil // the history keeps them on disk
+	}
+
+	saved := db.saveState()
 	freed := []uint64{}
+	for _, p := range db.free.pending {
+		freed = append(freed, p.ptr)
+	}
+	db.free.pending = nil
+	db.free.Update(0, freed)
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+func writePages(db *KV) error {
+	// update the free list. the freed pages can still be read by snapshots,
+	// they are reused only after the readers of older versions are gone.
+	// the pages of the named snapshots are kept until they are deleted.
+	pending := []pendingPage{}
 	for ptr, page := range db.page.updates {
-		if page == nil {
-			freed = append(freed, ptr)
+		if page == nil && !snapshotPinned(db, ptr) {
+			pending = append(pending, pendingPage{ptr, db.version + 1})
 		}
 	}
+	db.mu.Lock()
+	minReader := db.version
+	if len(db.readers) > 0 {
+		minReader = db.readers[0].version
+	}
+	db.mu.Unlock()
+	if db.hist.root != 0 {
+		// the window of the history is also read
+		minReader = historyCommit(db, pending, minReader)
+	} else {
+		pendingCommit(db, pending, minReader)
+	}
+	freed := slices.Clone(db.page.released)
+	for _, p := range db.free.pending {
+		if versionBefore(minReader, p.version) {
+			pending = append(pending, p)
+		} else {
+			freed = append(freed, p.ptr)
+		}
+	}
+	db.free.pending = pending
 	db.free.Update(db.page.nfree, freed)
 
 	// extend the file and mmap if needed
-	npages := int(db.page.flushed) + len(db.page.updates)
+	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
 		return err
 	}
@@ -98,26 +211,46 @@ func writePages(db *KV) error {
 	return nil
 }
 
-func syncPages(db *KV) error {
-	// flush data to the disk. must be done before updating the master page.
+func syncPages(db *KV, saved kvState, sync int) error {
+	// flush data to the disk. must be done before updating the master page,
+	// or it can point to pages that are lost on a crash.
 	if err := db.fp.Sync(); err != nil {
+		db.rollback(saved)
 		return fmt.Errorf("fscync: %w", err)
 	}
 
+	// the pending pages are in the file now
+	var written []uint64
+	if db.repl != nil {
+		written = replWritten(db)
+	}
 	db.page.flushed += uint64(db.page.nappend)
 	db.page.nappend = 0
-	// db.page.flushed += uint64(len(db.page.updates))
-	// think this
-	// db.page.updates = db.page.updates[0]
+	db.page.nfree = 0
+	db.page.updates = make(map[uint64][]byte)
+	db.page.released = nil
+	db.mu.Lock()
+	db.version++
+	db.root = db.tree.root
+	db.ttlRoot = db.ttl.root
+	db.snapshots = db.snaps.items
+	db.history = db.hist.log
+	db.mu.Unlock()
 
 	// update and flush the master page
+	// NOTE: Cannot rollback the tree to the old version if this fails.
+	//		 Because there is no way to know the state of the master page.
+	//		 Updating from an old root can cause corruption.
 	if err := masterStore(db); err != nil {
 		return err
 	}
 
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fscync: %w", err)
+	// the master page itself can be left to the OS
+	if sync == SYNC_ON {
+		if err := db.fp.Sync(); err != nil {
+			return fmt.Errorf("fscync: %w", err)
+		}
 	}
-
+	replPublish(db, written)
 	return nil
 }
@@ -0,0 +1,66 @@
+package relixdb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the pages freed while readers are open are pending until the readers are
+// gone. they are kept in a B-tree referenced by the master page, or they are
+// lost on a crash. there are no readers after a restart, so they are added
+// to the free list by the next update. the history tree keeps them instead
+// while the history is enabled.
+//
+// the keys are the same as the pages of the history tree:
+// "p" version8 seq4:   the pages freed by the version, 8B pointers
+
+// record the pages freed by the version being committed, and drop the
+// pages that can be reused. the caller holds the writer lock.
+func pendingCommit(db *KV, freed []pendingPage, minReader uint64) {
+	if db.free.pendingRoot == 0 && len(freed) == 0 {
+		return
+	}
+	pendingUpdate(db, func(tree *BTree) {
+		historyAddPages(tree, freed)
+		tree.DeleteRange(historyKey(HISTORY_PAGES, 0), historyKey(HISTORY_PAGES, minReader+1))
+	})
+}
+
+// update the pending tree. like the history tree, only the writer reads it.
+func pendingUpdate(db *KV, fn func(tree *BTree)) {
+	tree := BTree{root: db.free.pendingRoot, get: db.pageGet, new: db.pageNew, psize: db.tree.psize}
+	tree.del = func(ptr uint64) {
+		delete(db.page.updates, ptr) // a new page of this transaction
+		db.page.released = append(db.page.released, ptr)
+	}
+	fn(&tree)
+	if tree.root != 0 {
+		// free the tree when only the dummy key is left
+		node := tree.get(tree.root)
+		if node.btype() == BNODE_LEAF && node.nkeys() == 1 {
+			tree.del(tree.root)
+			tree.root = 0
+		}
+	}
+	db.free.pendingRoot = tree.root
+}
+
+// read the pending tree of the master page
+func pendingLoad(db *KV) error {
+	if db.free.pendingRoot == 0 {
+		return nil
+	}
+	tree := BTree{root: db.free.pendingRoot, psize: db.tree.psize}
+	tree.get = func(ptr uint64) BNode { return pageGetMapped(db, ptr) }
+	for key, val := range tree.scanSeq(nil, nil, ScanOpts{}) {
+		if key[0] != HISTORY_PAGES || len(key) != 13 || len(val)%8 != 0 {
+			return fmt.Errorf("bad pending key: %q", key)
+		}
+		version := binary.BigEndian.Uint64(key[1:])
+		for i := 0; i < len(val); i += 8 {
+			p := pendingPage{binary.LittleEndian.Uint64(val[i:]), version}
+			db.free.pending = append(db.free.pending, p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package relixdb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ORDER BY a column
+type OrderBy struct {
+	Col  string
+	Desc bool
+}
+
+// a range query with ordering and pagination
+type Query struct {
+	// the range, same as the Scanner.
+	// leave both Cmp1 and Cmp2 unset to scan the whole table.
+	Cmp1 int
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+	// or a disjunction of ranges, same as the Scanner
+	Ranges []ScanRange
+	// WHERE: a boolean expression on the rows in the range
+	Filter string
+	// ORDER BY, LIMIT, OFFSET
+	OrderBy []OrderBy
+	Limit   int // 0: no limit
+	Offset  int
+	// memory budget in bytes for sorting non-indexed orders,
+	// larger results are spilled to temporary files.
+	SortMem int
+	// AS OF: query a past version in the history window, see DB.ScanAsOf
+	AsOf *AsOf
+}
+
+// the result of a query, iterated like a Scanner
+type Rows struct {
+	tdef *TableDef
+	// the rows either come straight from an index in the right order,
+	// or from a sort.
+	scan   *Scanner
+	sorted sortedIter
+	filter *Expr // nil: no filter
+	offset int   // rows still to skip
+	limit  int   // rows still to return; -1: no limit
+	// the current row
+	rec   Record
+	valid bool
+	err   error
+	// the view of an AS OF query
+	view *DB
+}
+
+func (db *DB) Query(table string, q *Query) (*Rows, error) {
+	if q.AsOf == nil {
+		tdef := getTableDef(db, table)
+		if tdef == nil {
+			return nil, fmt.Errorf("table not found: %s", table)
+		}
+		return dbQuery(db, tdef, q)
+	}
+
+	// the reader of the version is ended at the end of the rows, or by Close
+	view, err := dbAsOf(db, *q.AsOf)
+	if err != nil {
+		return nil, err
+	}
+	tdef := getTableDef(view, table)
+	if tdef == nil {
+		view.asOfEnd()
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	rows, err := dbQuery(view, tdef, q)
+	if err != nil {
+		view.asOfEnd()
+		return nil, err
+	}
+	rows.view = view
+	if rows.scan == nil || !rows.scan.Valid() {
+		view.asOfEnd() // sorted, or no more rows to read
+	}
+	return rows, nil
+}
+
+func dbQuery(db *DB, tdef *TableDef, q *Query) (*Rows, error) {
+	if q.Limit < 0 || q.Offset < 0 {
+		return nil, fmt.Errorf("bad limit or offset")
+	}
+	for _, ob := range q.OrderBy {
+		if colIndex(tdef, ob.Col) < 0 {
+			return nil, fmt.Errorf("unknown column in ORDER BY: %s", ob.Col)
+		}
+	}
+
+	sc := &Scanner{Cmp1: q.Cmp1, Cmp2: q.Cmp2, Key1: q.Key1, Key2: q.Key2, Ranges: q.Ranges}
+	if sc.Cmp1 == 0 && sc.Cmp2 == 0 && len(sc.Ranges) == 0 {
+		if len(sc.Key1.Cols) > 0 || len(sc.Key2.Cols) > 0 {
+			return nil, fmt.Errorf("bad range")
+		}
+		sc.Cmp1, sc.Cmp2 = CMP_GE, CMP_LE // the whole table
+	}
+
+	rows := &Rows{tdef: tdef, offset: q.Offset, limit: -1}
+	if q.Limit > 0 {
+		rows.limit = q.Limit
+	}
+	if q.Filter != "" {
+		filter, typ, err := tableExpr(tdef, q.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if typ != TYPE_INT64 {
+			return nil, fmt.Errorf("the filter is not a boolean: %s", q.Filter)
+		}
+		rows.filter = filter
+	}
+
+	conds := exprCondSet(rows.filter)
+	if err := canonicalKeys(tdef, sc); err != nil {
+		return nil, err
+	}
+	if len(q.OrderBy) == 0 {
+		if err := dbScanWhere(db, tdef, sc, conds); err != nil {
+			return nil, err
+		}
+		rows.scan = sc
+	} else if indexNo, desc, ok := orderByIndex(tdef, sc, q.OrderBy, conds); ok {
+		// the index order is the requested order, no sorting needed.
+		if ranges := sc.scanRanges(); desc != (ranges[0].Cmp1 < 0) {
+			sc = reverseScanner(sc)
+		}
+		if err := dbScanIndex(db, tdef, sc, indexNo); err != nil {
+			return nil, err
+		}
+		rows.scan = sc
+	} else {
+		if err := dbScanWhere(db, tdef, sc, conds); err != nil {
+			return nil, err
+		}
+		sorted, err := sortRows(tdef, sc, q, rows.filter)
+		if err != nil {
+			return nil, err
+		}
+		rows.sorted = sorted
+	}
+
+	rows.fetch()
+	for rows.valid && rows.offset > 0 {
+		rows.offset--
+		rows.fetch()
+	}
+	return rows, nil
+}
+
+// can the ORDER BY be satisfied by the order of an index?
+// returns the index number and the scan direction.
+func orderByIndex(tdef *TableDef, sc *Scanner, orderBy []OrderBy, conds map[string]bool) (int, bool, bool) {
+	desc := orderBy[0].Desc
+	cols := make([]string, len(orderBy))
+	for i, ob := range orderBy {
+		if ob.Desc != desc {
+			return 0, false, false // mixed directions
+		}
+		cols[i] = ob.Col
+	}
+
+	// candidates: the primary key and the indexes usable for the range
+	candidates := []int{-1}
+	for i := range tdef.Indexes {
+		if indexUsable(tdef, i, conds) {
+			candidates = append(candidates, i)
+		}
+	}
+	for _, indexNo := range candidates {
+		index := tdef.Cols[:tdef.PKeys]
+		if indexNo >= 0 {
+			index = tdef.Indexes[indexNo]
+		}
+		ranges, usable := sc.scanRanges(), true
+		for _, r := range ranges {
+			usable = usable && isPrefix(index, r.Key1.Cols) && isPrefix(index, r.Key2.Cols)
+		}
+		if !usable {
+			continue
+		}
+		// columns fixed by equalities with the same value in all ranges
+		// don't affect the order
+		fixed := rangeFixedCols(ranges)
+		for skip := 0; skip <= fixed; skip++ {
+			if isPrefix(index[skip:], cols) {
+				return indexNo, desc, true
+			}
+		}
+	}
+	return 0, false, false
+}
+
+// the number of leading columns fixed to a single value by the ranges
+func rangeFixedCols(ranges []ScanRange) int {
+	first := ranges[0]
+	fixed := 0
+	for ; ; fixed++ {
+		for _, r := range ranges {
+			if fixed >= len(r.Key1.Cols) || fixed >= len(r.Key2.Cols) ||
+				!valueEqual(r.Key1.Vals[fixed], r.Key2.Vals[fixed]) ||
+				!valueEqual(r.Key1.Vals[fixed], first.Key1.Vals[fixed]) {
+				return fixed
+			}
+		}
+	}
+}
+
+// the same ranges scanned in the opposite direction
+func reverseScanner(sc *Scanner) *Scanner {
+	if len(sc.Ranges) == 0 {
+		return &Scanner{Cmp1: sc.Cmp2, Cmp2: sc.Cmp1, Key1: sc.Key2, Key2: sc.Key1}
+	}
+	out := &Scanner{}
+	for _, r := range sc.Ranges {
+		out.Ranges = append(out.Ranges, ScanRange{Cmp1: r.Cmp2, Cmp2: r.Cmp1, Key1: r.Key2, Key2: r.Key1})
+	}
+	return out
+}
+
+func valueEqual(a Value, b Value) bool {
+	return a.Type == b.Type && a.I64 == b.I64 && bytes.Equal(a.Str, b.Str)
+}
+
+// the order-preserving sort key for the ORDER BY columns.
+// descending columns are encoded with inverted bits.
+func encodeSortKey(out []byte, rec Record, orderBy []OrderBy) []byte {
+	for _, ob := range orderBy {
+		start := len(out)
+		out = encodeValues(out, []Value{*rec.Get(ob.Col)})
+		if ob.Desc {
+			for i := start; i < len(out); i++ {
+				out[i] = ^out[i]
+			}
+		}
+	}
+	return out
+}
+
+// sort the rows of the scanner with the ORDER BY columns
+func sortRows(tdef *TableDef, sc *Scanner, q *Query, filter *Expr) (sortedIter, error) {
+	// only the first OFFSET+LIMIT rows are needed with a LIMIT
+	var top *topN
+	sorter := &extSorter{mem: q.SortMem}
+	if q.Limit > 0 {
+		top = &topN{n: q.Offset + q.Limit}
+	}
+
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		if err := sc.deref(&rec); err != nil {
+			sorter.discard()
+			return nil, err
+		}
+		if ok, err := rowMatch(filter, rec); err != nil {
+			sorter.discard()
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		item := sortItem(
+			encodeSortKey(nil, rec, q.OrderBy),
+			encodeValues(nil, rec.Vals),
+		)
+		if top != nil {
+			top.add(item)
+		} else if err := sorter.add(item); err != nil {
+			sorter.discard()
+			return nil, err
+		}
+	}
+
+	if top != nil {
+		return top.finish(), nil
+	}
+	return sorter.finish()
+}
+
+// load the next row
+func (rows *Rows) fetch() {
+	rows.valid = false
+	if rows.err != nil || rows.limit == 0 {
+		return
+	}
+
+	tdef := rows.tdef
+	if rows.scan != nil {
+		for {
+			if !rows.scan.Valid() {
+				return
+			}
+			rows.rec = Record{}
+			if err := rows.scan.deref(&rows.rec); err != nil {
+				rows.err = err
+				return
+			}
+			rows.scan.Next()
+			ok, err := rowMatch(rows.filter, rows.rec)
+			if err != nil {
+				rows.err = err
+				return
+			}
+			if ok {
+				break
+			}
+		}
+	} else {
+		item, ok, err := rows.sorted.next()
+		if err != nil {
+			rows.err = err
+		}
+		if !ok {
+			return
+		}
+		vals := make([]Value, len(tdef.Cols))
+		for i := range vals {
+			vals[i].Type = tdef.Types[i]
+		}
+		decodeValues(sortItemPayload(item), vals)
+		rows.rec = Record{Cols: tdef.Cols, Vals: vals}
+	}
+
+	rows.valid = true
+	if rows.limit > 0 && rows.offset == 0 {
+		rows.limit--
+	}
+}
+
+// is there a current row?
+func (rows *Rows) Valid() bool {
+	return rows.valid
+}
+
+// fetch the current row
+func (rows *Rows) Deref(rec *Record) {
+	Assert(rows.valid, "rows is not valid")
+	rec.Cols = append([]string(nil), rows.rec.Cols...)
+	rec.Vals = append([]Value(nil), rows.rec.Vals...)
+}
+
+// move to the next row
+func (rows *Rows) Next() {
+	Assert(rows.valid, "rows is not valid")
+	rows.fetch()
+}
+
+// the error encountered while iterating, if any
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// release the temporary files used for sorting,
+// and the reader of an AS OF query
+func (rows *Rows) Close() error {
+	rows.valid = false
+	if rows.view != nil {
+		rows.view.asOfEnd()
+	}
+	if rows.sorted != nil {
+		return rows.sorted.close()
+	}
+	return nil
+}
+
+// does the row pass the filter?
+func rowMatch(filter *Expr, rec Record) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	v, err := evalExpr(filter, rec)
+	return v.I64 != 0, err
+}
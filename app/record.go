@@ -43,6 +43,21 @@ func (rec *Record) AddInt64(key string, val int64) *Record {
 	return rec
 }
 
+func (rec *Record) AddJSON(key string, val []byte) *Record {
+	// Find index of the column if it already exists
+	for i, col := range rec.Cols {
+		if col == key {
+			// Update existing column's value
+			rec.Vals[i] = Value{Type: TYPE_JSON, Str: val}
+			return rec
+		}
+	}
+	// If column does not exist, add new column
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_JSON, Str: val})
+	return rec
+}
+
 func (rec *Record) Get(key string) *Value {
 	// Find the value for the corresponding column
 	for i, col := range rec.Cols {
@@ -0,0 +1,698 @@
+package relixdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// asynchronous replication by shipping pages: each commit of the primary
+// is a log record of the written pages and the new master page, followers
+// apply the records in the version order to their own files.
+// the record format:
+// | sig | version | flags | page_size | npages | master | pages... | hash |
+// | 16B |   8B    |  4B   |    4B     |   8B   |  52B   |          |  8B  |
+// followed by the pages and a hash of everything before it:
+// | ptr | data |
+// | 8B  |  page_size |
+// a full record has all the pages of the file, it seeds a follower
+// that is too far behind the log.
+
+const REPL_SIG = "RelxDBReplica001"
+
+const REPL_FULL = 1 // the flag of full records
+
+const (
+	REPL_KEEP_DEFAULT = 1000                   // records kept by the primary
+	REPL_RETRY_DELAY  = 100 * time.Millisecond // before reconnecting a follower
+	REPL_POLL_DEFAULT = 50 * time.Millisecond  // of the directory transport
+)
+
+// the replication is stopped
+var ErrReplClosed = errors.New("the replication is closed")
+
+// a commit of the primary
+type ReplRecord struct {
+	Version uint64
+	Full    bool              // all the pages of the file
+	Master  []byte            // the master page
+	Pages   map[uint64][]byte // the written pages by the pointer
+}
+
+func (rec *ReplRecord) pageSize() int {
+	return int(binary.LittleEndian.Uint32(rec.Master[32:]))
+}
+
+func writeReplRecord(w io.Writer, rec *ReplRecord) error {
+	h := fnv.New64a()
+	bw := bufio.NewWriter(w)
+	mw := io.MultiWriter(bw, h)
+
+	var hdr [40]byte
+	copy(hdr[:16], REPL_SIG)
+	binary.LittleEndian.PutUint64(hdr[16:], rec.Version)
+	if rec.Full {
+		binary.LittleEndian.PutUint32(hdr[24:], REPL_FULL)
+	}
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(rec.pageSize()))
+	binary.LittleEndian.PutUint64(hdr[32:], uint64(len(rec.Pages)))
+	mw.Write(hdr[:])
+	mw.Write(rec.Master)
+
+	ptrs := make([]uint64, 0, len(rec.Pages))
+	for ptr := range rec.Pages {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	for _, ptr := range ptrs {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], ptr)
+		mw.Write(buf[:])
+		mw.Write(rec.Pages[ptr])
+	}
+
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], h.Sum64())
+	bw.Write(sum[:])
+	return bw.Flush()
+}
+
+func readReplRecord(r io.Reader) (*ReplRecord, error) {
+	h := fnv.New64a()
+	tr := io.TeeReader(r, h)
+
+	var hdr [40 + MASTER_SIZE]byte
+	if _, err := io.ReadFull(tr, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:16], []byte(REPL_SIG)) {
+		return nil, fmt.Errorf("bad replication record signature")
+	}
+	rec := &ReplRecord{
+		Version: binary.LittleEndian.Uint64(hdr[16:]),
+		Full:    binary.LittleEndian.Uint32(hdr[24:])&REPL_FULL != 0,
+		Master:  append([]byte(nil), hdr[40:]...),
+		Pages:   map[uint64][]byte{},
+	}
+	psize := int(binary.LittleEndian.Uint32(hdr[28:]))
+	if err := checkPageSize(psize); err != nil || psize != rec.pageSize() {
+		return nil, fmt.Errorf("bad replication record: page size")
+	}
+	npages := binary.LittleEndian.Uint64(hdr[32:])
+	for i := uint64(0); i < npages; i++ {
+		var buf [8]byte
+		if _, err := io.ReadFull(tr, buf[:]); err != nil {
+			return nil, err
+		}
+		ptr := binary.LittleEndian.Uint64(buf[:])
+		data := make([]byte, psize)
+		if _, err := io.ReadFull(tr, data); err != nil {
+			return nil, err
+		}
+		if ptr == 0 {
+			return nil, fmt.Errorf("bad replication record: page 0")
+		}
+		rec.Pages[ptr] = data
+	}
+
+	sum := h.Sum64()
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(buf[:]) != sum {
+		return nil, fmt.Errorf("bad replication record: hash mismatch")
+	}
+	return rec, nil
+}
+
+// the commits of a primary, the recent ones are kept in memory
+// so that followers can resume from their versions.
+type ReplLog struct {
+	db      *KV
+	keep    int
+	mu      sync.Mutex
+	cond    *sync.Cond
+	recs    []*ReplRecord // consecutive versions
+	version uint64        // the latest version
+	closed  bool
+}
+
+// start logging the commits, the last `keep` records are kept.
+// 0: REPL_KEEP_DEFAULT.
+func (db *KV) StartReplication(keep int) *ReplLog {
+	if keep <= 0 {
+		keep = REPL_KEEP_DEFAULT
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	Assert(db.repl == nil, "the replication is already started")
+	l := &ReplLog{db: db, keep: keep, version: db.version}
+	l.cond = sync.NewCond(&l.mu)
+	db.repl = l
+	return l
+}
+
+// stop logging, the transports return
+func (l *ReplLog) Close() {
+	l.db.writer.Lock()
+	l.db.repl = nil
+	l.db.writer.Unlock()
+
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *ReplLog) append(rec *ReplRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs = append(l.recs, rec)
+	if len(l.recs) > l.keep {
+		l.recs = append([]*ReplRecord(nil), l.recs[len(l.recs)-l.keep:]...)
+	}
+	l.version = rec.Version
+	l.cond.Broadcast()
+}
+
+// the record after `version`, blocks until there is one.
+// a full record is made if the log doesn't have it.
+func (l *ReplLog) Next(version uint64) (*ReplRecord, error) {
+	l.mu.Lock()
+	for {
+		if l.closed {
+			l.mu.Unlock()
+			return nil, ErrReplClosed
+		}
+		if version > l.version {
+			l.mu.Unlock()
+			return nil, fmt.Errorf("the follower is ahead of the primary: %d > %d", version, l.version)
+		}
+		if version < l.version {
+			break
+		}
+		l.cond.Wait()
+	}
+	if len(l.recs) > 0 && l.recs[0].Version <= version+1 {
+		rec := l.recs[version+1-l.recs[0].Version]
+		l.mu.Unlock()
+		return rec, nil
+	}
+	l.mu.Unlock()
+	return replSnapshot(l.db), nil
+}
+
+// the pages written by the commit, before the pending ones are cleared
+func replWritten(db *KV) []uint64 {
+	written := []uint64{}
+	for ptr, page := range db.page.updates {
+		if page != nil && ptr < db.page.flushed {
+			written = append(written, ptr)
+		}
+	}
+	// including the ones written directly to the file
+	for i := 0; i < db.page.nappend; i++ {
+		written = append(written, db.page.flushed+uint64(i))
+	}
+	return written
+}
+
+// log a commit after the master page is written. the caller holds the writer lock.
+func replPublish(db *KV, written []uint64) {
+	if db.repl == nil {
+		return
+	}
+	rec := &ReplRecord{
+		Version: db.version,
+		Master:  masterData(db),
+		Pages:   map[uint64][]byte{},
+	}
+	for _, ptr := range written {
+		rec.Pages[ptr] = append([]byte(nil), pageGetMapped(db, ptr).data...)
+	}
+	db.repl.append(rec)
+}
+
+// a full record of the current version, writers are blocked while copying
+func replSnapshot(db *KV) *ReplRecord {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	rec := &ReplRecord{
+		Version: db.version,
+		Full:    true,
+		Master:  masterData(db),
+		Pages:   map[uint64][]byte{},
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		rec.Pages[ptr] = append([]byte(nil), pageGetMapped(db, ptr).data...)
+	}
+	return rec
+}
+
+// serve the log to followers over TCP until the listener is closed.
+// a follower sends the signature and its version, then receives the
+// records after it.
+func (l *ReplLog) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go l.serveConn(conn)
+	}
+}
+
+func (l *ReplLog) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var req [24]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	if !bytes.Equal(req[:16], []byte(REPL_SIG)) {
+		return
+	}
+	version := binary.LittleEndian.Uint64(req[16:])
+	for {
+		rec, err := l.Next(version)
+		if err != nil {
+			return
+		}
+		if err := writeReplRecord(conn, rec); err != nil {
+			return
+		}
+		version = rec.Version
+	}
+}
+
+// write the records to a directory, one file per version, until the log is
+// closed. it resumes after the latest file in the directory.
+func (l *ReplLog) ShipToDir(dir string) error {
+	names, err := replDirFiles(dir)
+	if err != nil {
+		return err
+	}
+	version := uint64(0)
+	if len(names) > 0 {
+		version = replFileVersion(names[len(names)-1])
+	}
+	for {
+		rec, err := l.Next(version)
+		if err == ErrReplClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := replWriteFile(dir, rec); err != nil {
+			return err
+		}
+		version = rec.Version
+	}
+}
+
+func replFileName(version uint64) string {
+	return fmt.Sprintf("%016x.repl", version)
+}
+
+func replFileVersion(name string) uint64 {
+	v, _ := strconv.ParseUint(strings.TrimSuffix(name, ".repl"), 16, 64)
+	return v
+}
+
+// the record files in the version order
+func replDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if len(e.Name()) == len(replFileName(0)) && strings.HasSuffix(e.Name(), ".repl") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil // sorted by ReadDir
+}
+
+// write a file atomically, a follower never sees a partial record
+func replWriteFile(dir string, rec *ReplRecord) error {
+	fp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	err = writeReplRecord(fp, rec)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), filepath.Join(dir, replFileName(rec.Version)))
+}
+
+// where a follower gets the records from
+type ReplSource interface {
+	// the next record after `version`, blocks until there is one.
+	// it's called again with the follower's version after errors.
+	Next(version uint64) (*ReplRecord, error)
+	// unblock Next and release the resources
+	Close() error
+}
+
+// a source connected to ReplLog.Serve, reconnects after errors
+type ReplTCPSource struct {
+	Addr string
+	// internals
+	mu      sync.Mutex
+	conn    net.Conn
+	rd      *bufio.Reader
+	version uint64 // of the last record on the connection
+	closed  bool
+}
+
+func (src *ReplTCPSource) Next(version uint64) (*ReplRecord, error) {
+	conn, rd, err := src.connect(version)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := readReplRecord(rd)
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if err != nil {
+		if src.conn == conn {
+			src.conn.Close()
+			src.conn = nil
+		}
+		return nil, err
+	}
+	src.version = rec.Version
+	return rec, nil
+}
+
+// the connection positioned at `version`
+func (src *ReplTCPSource) connect(version uint64) (net.Conn, *bufio.Reader, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.closed {
+		return nil, nil, ErrReplClosed
+	}
+	if src.conn != nil && src.version == version {
+		return src.conn, src.rd, nil
+	}
+	if src.conn != nil {
+		src.conn.Close()
+		src.conn = nil
+	}
+
+	conn, err := net.Dial("tcp", src.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var req [24]byte
+	copy(req[:16], REPL_SIG)
+	binary.LittleEndian.PutUint64(req[16:], version)
+	if _, err := conn.Write(req[:]); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	src.conn, src.rd, src.version = conn, bufio.NewReader(conn), version
+	return src.conn, src.rd, nil
+}
+
+func (src *ReplTCPSource) Close() error {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.closed = true
+	if src.conn != nil {
+		src.conn.Close()
+		src.conn = nil
+	}
+	return nil
+}
+
+// a source reading the files of ReplLog.ShipToDir
+type ReplDirSource struct {
+	Dir  string
+	Poll time.Duration // the interval of checking for new files, 0: REPL_POLL_DEFAULT
+	// internals
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (src *ReplDirSource) init() {
+	src.once.Do(func() { src.closed = make(chan struct{}) })
+}
+
+func (src *ReplDirSource) Next(version uint64) (*ReplRecord, error) {
+	src.init()
+	poll := src.Poll
+	if poll == 0 {
+		poll = REPL_POLL_DEFAULT
+	}
+	for {
+		names, err := replDirFiles(src.Dir)
+		if err != nil {
+			return nil, err
+		}
+		// the first file after the version
+		i := sort.SearchStrings(names, replFileName(version+1))
+		if i < len(names) {
+			fp, err := os.Open(filepath.Join(src.Dir, names[i]))
+			if err != nil {
+				return nil, err
+			}
+			defer fp.Close()
+			return readReplRecord(bufio.NewReader(fp))
+		}
+		select {
+		case <-src.closed:
+			return nil, ErrReplClosed
+		case <-time.After(poll):
+		}
+	}
+}
+
+func (src *ReplDirSource) Close() error {
+	src.init()
+	select {
+	case <-src.closed:
+	default:
+		close(src.closed)
+	}
+	return nil
+}
+
+// a read-only copy of a primary, kept up to date in the background.
+// snapshots are read with KV().BeginRead().
+type Follower struct {
+	kv  *KV
+	src ReplSource
+	// the state of the apply loop
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced when the version changes
+	err     error         // the loop stopped on it
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// open the follower file and start applying the records from `src`.
+// the file is empty or was written by a follower of the same primary.
+func OpenFollower(path string, src ReplSource, opts ...Options) (*Follower, error) {
+	kv := &KV{Path: path}
+	if err := kv.Open(opts...); err != nil {
+		return nil, err
+	}
+	if kv.opts.ReadOnly {
+		kv.Close()
+		return nil, fmt.Errorf("a follower can't be read-only")
+	}
+	kv.replica = true
+
+	f := &Follower{
+		kv:      kv,
+		src:     src,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *Follower) KV() *KV {
+	return f.kv
+}
+
+// the applied version
+func (f *Follower) Version() uint64 {
+	f.kv.mu.Lock()
+	defer f.kv.mu.Unlock()
+	return f.kv.version
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+		rec, err := f.src.Next(f.Version())
+		if err != nil {
+			// reconnect, unless it's stopped
+			select {
+			case <-f.stop:
+				return
+			case <-time.After(REPL_RETRY_DELAY):
+			}
+			continue
+		}
+		if err := replApply(f.kv, rec); err != nil {
+			f.mu.Lock()
+			f.err = fmt.Errorf("replication: version %d: %w", rec.Version, err)
+			close(f.changed)
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Lock()
+		close(f.changed)
+		f.changed = make(chan struct{})
+		f.mu.Unlock()
+	}
+}
+
+// wait until the follower reaches `version`
+func (f *Follower) Wait(version uint64, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		f.mu.Lock()
+		changed, err := f.changed, f.err
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if f.Version() >= version {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("replication: timeout at version %d", f.Version())
+		}
+	}
+}
+
+// stop the apply loop, returns its error
+func (f *Follower) halt() error {
+	select {
+	case <-f.stop:
+	default:
+		close(f.stop)
+	}
+	f.src.Close()
+	<-f.done
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// stop replicating and take over the file as a writable KV
+func (f *Follower) Promote() (*KV, error) {
+	if err := f.halt(); err != nil {
+		return nil, err
+	}
+	f.kv.writer.Lock()
+	defer f.kv.writer.Unlock()
+	f.kv.mu.Lock()
+	defer f.kv.mu.Unlock()
+	// the pages kept for the history are only tracked by the writer
+	if !f.kv.historyLoaded {
+		if err := historyLoad(f.kv); err != nil {
+			return nil, err
+		}
+	}
+	if err := pendingLoad(f.kv); err != nil {
+		return nil, err
+	}
+	f.kv.replica = false
+	return f.kv, nil
+}
+
+func (f *Follower) Close() error {
+	err := f.halt()
+	f.kv.Close()
+	return err
+}
+
+// apply a record of the primary: write the pages, then the master page
+func replApply(db *KV, rec *ReplRecord) error {
+	if rec.pageSize() != db.tree.pageSize() {
+		return fmt.Errorf("page size mismatch: %d, the file uses %d", rec.pageSize(), db.tree.pageSize())
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !rec.Full && rec.Version != db.version+1 {
+		return fmt.Errorf("not the next version of %d", db.version)
+	}
+	if rec.Full && rec.Version < db.version {
+		return fmt.Errorf("older than the version %d", db.version)
+	}
+
+	// the primary only reuses pages that can't be reached from the
+	// previous version, older snapshots must end first. a full record
+	// can overwrite any page.
+	for len(db.readers) > 0 && (rec.Full || db.readers[0].version+1 < rec.Version) {
+		db.readerExit.Wait()
+	}
+
+	npages := int(binary.LittleEndian.Uint64(rec.Master[24:]))
+	for ptr := range rec.Pages {
+		npages = max(npages, int(ptr)+1)
+	}
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	if err := extendMmap(db, npages); err != nil {
+		return err
+	}
+	for ptr, data := range rec.Pages {
+		copy(pageGetMapped(db, ptr).data, data)
+	}
+
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := masterWrite(db, rec.Master); err != nil {
+		return err
+	}
+	if db.opts.Sync == SYNC_ON {
+		if err := db.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	db.free.FreeListData = FreeListData{}
+	return masterParse(db, rec.Master)
+}
@@ -1,9 +1,19 @@
 package relixdb
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 )
 
+// a range from Key1 to Key2
+type ScanRange struct {
+	Cmp1 int // CMP_??
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+}
+
 // the iterator for range queries
 type Scanner struct {
 	// the range, from Key1 to Key2
@@ -11,16 +21,27 @@ type Scanner struct {
 	Cmp2 int
 	Key1 Record
 	Key2 Record
+	// or a disjunction of ranges in the same direction on the same index,
+	// the rows are returned in the index order without duplicates.
+	Ranges []ScanRange
 	// internal
 	db      *DB
 	tdef    *TableDef
-	indexNo int    // -1: use the primary key; >= 0: use an index
-	iter    *BIter // the underlying B-tree iterator
-	keyEnd  []byte // the encoded Key2
+	indexNo int        // -1: use the primary key; >= 0: use an index
+	iter    *BIter     // the underlying B-tree iterator
+	ranges  []keyRange // the encoded ranges, sorted and disjoint
+	cur     int        // the current range
+	desc    bool       // scanning in descending order
 }
 
 // fetch the current row
 func (sc *Scanner) Deref(rec *Record) {
+	err := sc.deref(rec)
+	Assert(err == nil, "error encoutered while dereferencing the current row by secondary index")
+}
+
+// fetch the current row, the row of an index entry can fail to be found
+func (sc *Scanner) deref(rec *Record) error {
 	Assert(sc.Valid(), "scanner is not valid")
 
 	tdef := sc.tdef
@@ -61,7 +82,7 @@ func (sc *Scanner) Deref(rec *Record) {
 		index := tdef.Indexes[sc.indexNo]
 		ival := make([]Value, len(index))
 		for i, c := range index {
-			ival[i].Type = tdef.Types[colIndex(tdef, c)]
+			ival[i].Type = colType(tdef, c)
 		}
 		decodeValues(key[4:], ival)
 		icol := Record{index, ival}
@@ -72,8 +93,20 @@ func (sc *Scanner) Deref(rec *Record) {
 		}
 		// TODO: skip this if the index contains all the columns
 		ok, err := dbGet(sc.db, tdef, rec)
-		Assert(ok && err == nil, "error encoutered while dereferencing the current row by secondary index")
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("row not found for the index entry of %s", tdef.Name)
+		}
 	}
+	if sc.db.asOf {
+		// the pages can be reused after the reader ends, at the end of the scan
+		for i := range rec.Vals {
+			rec.Vals[i].Str = bytes.Clone(rec.Vals[i].Str)
+		}
+	}
+	return nil
 }
 
 func (db *DB) Scan(table string, req *Scanner) error {
@@ -85,54 +118,229 @@ func (db *DB) Scan(table string, req *Scanner) error {
 }
 
 func dbScan(db *DB, tdef *TableDef, req *Scanner) error {
-	// sanity checks
-	switch {
-	case req.Cmp1 > 0 && req.Cmp2 < 0:
-	case req.Cmp2 > 0 && req.Cmp1 < 0:
-	default:
-		return fmt.Errorf("bad range")
-	}
+	return dbScanWhere(db, tdef, req, nil)
+}
 
-	//  select an index
-	indexNo, err := findIndex(tdef, req.Key1.Cols)
+// a range scan for rows that also satisfy the conditions `conds`,
+// which allows using partial indexes.
+func dbScanWhere(db *DB, tdef *TableDef, req *Scanner, conds map[string]bool) error {
+	if err := canonicalKeys(tdef, req); err != nil {
+		return err
+	}
+	//  select an index for the longest key of the ranges
+	var keys []string
+	for _, r := range req.scanRanges() {
+		for _, key := range []Record{r.Key1, r.Key2} {
+			if len(key.Cols) > len(keys) {
+				keys = key.Cols
+			}
+		}
+	}
+	indexNo, err := findIndex(tdef, keys, conds)
 	if err != nil {
 		return err
 	}
+	return dbScanIndex(db, tdef, req, indexNo)
+}
+
+// the ranges of the scanner
+func (sc *Scanner) scanRanges() []ScanRange {
+	if len(sc.Ranges) > 0 {
+		return sc.Ranges
+	}
+	return []ScanRange{{Cmp1: sc.Cmp1, Cmp2: sc.Cmp2, Key1: sc.Key1, Key2: sc.Key2}}
+}
+
+// expression columns are matched by their canonical text
+func canonicalKeys(tdef *TableDef, req *Scanner) error {
+	canonical := func(key *Record) error {
+		cols := make([]string, len(key.Cols))
+		for i, c := range key.Cols {
+			var err error
+			if cols[i], err = canonicalCol(tdef, c); err != nil {
+				return err
+			}
+		}
+		key.Cols = cols
+		return nil
+	}
+	if err := canonical(&req.Key1); err != nil {
+		return err
+	}
+	if err := canonical(&req.Key2); err != nil {
+		return err
+	}
+	// don't modify the caller's ranges
+	req.Ranges = append([]ScanRange(nil), req.Ranges...)
+	for i := range req.Ranges {
+		if err := canonical(&req.Ranges[i].Key1); err != nil {
+			return err
+		}
+		if err := canonical(&req.Ranges[i].Key2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start a range scan on a specific index.
+// the columns of Key1 and Key2 must be a prefix of the index.
+func dbScanIndex(db *DB, tdef *TableDef, req *Scanner, indexNo int) error {
+	if len(req.Ranges) > 0 && (req.Cmp1 != 0 || req.Cmp2 != 0) {
+		return fmt.Errorf("bad range: both a range and a list of ranges")
+	}
+
 	index, prefix := tdef.Cols[:tdef.PKeys], tdef.Prefix
 	if indexNo >= 0 {
 		index, prefix = tdef.Indexes[indexNo], tdef.IndexPrefixes[indexNo]
 	}
+
+	ranges := req.scanRanges()
+	req.ranges = req.ranges[:0]
+	for _, r := range ranges {
+		// sanity checks
+		switch {
+		case r.Cmp1 > 0 && r.Cmp2 < 0:
+		case r.Cmp2 > 0 && r.Cmp1 < 0:
+		default:
+			return fmt.Errorf("bad range")
+		}
+		if (r.Cmp1 > 0) != (ranges[0].Cmp1 > 0) {
+			return fmt.Errorf("bad range: ranges in different directions")
+		}
+		if !isPrefix(index, r.Key1.Cols) || !isPrefix(index, r.Key2.Cols) {
+			return fmt.Errorf("bad range: the keys are not a prefix of the index")
+		}
+		req.ranges = append(req.ranges, keyRange{
+			start: encodeKeyPartial(nil, prefix, r.Key1.Vals, tdef, index, r.Cmp1),
+			end:   encodeKeyPartial(nil, prefix, r.Key2.Vals, tdef, index, r.Cmp2),
+			cmp1:  r.Cmp1,
+			cmp2:  r.Cmp2,
+		})
+	}
+	req.ranges = mergeKeyRanges(req.ranges)
+
 	req.db = db
 	req.tdef = tdef
 	req.indexNo = indexNo
+	req.desc = ranges[0].Cmp1 < 0
 
 	// seek to the start key
-	keyStart := encodeKeyPartial(
-		nil, prefix, req.Key1.Vals, tdef, index, req.Cmp1)
-	req.keyEnd = encodeKeyPartial(
-		nil, prefix, req.Key2.Vals, tdef, index, req.Cmp2)
-	req.iter = db.kv.tree.Seek(keyStart, req.Cmp1)
-
+	req.cur = 0
+	first := req.ranges[0]
+	req.iter = db.kv.tree.Seek(first.start, first.cmp1)
+	req.settle()
 	return nil
 }
 
-// within the range or not?
-func (sc *Scanner) Valid() bool {
+// an encoded range
+type keyRange struct {
+	start []byte
+	end   []byte
+	cmp1  int
+	cmp2  int
+}
+
+// sort the ranges in the scan direction and merge the overlapping ones,
+// so that the scan never goes back and never returns a row twice.
+func mergeKeyRanges(ranges []keyRange) []keyRange {
+	dir := 1
+	if ranges[0].cmp1 < 0 {
+		dir = -1
+	}
+	inclusive := func(cmp int) bool { return cmp == CMP_GE || cmp == CMP_LE }
+	sort.SliceStable(ranges, func(i, j int) bool {
+		c := bytes.Compare(ranges[i].start, ranges[j].start) * dir
+		return c < 0 || (c == 0 && inclusive(ranges[i].cmp1) && !inclusive(ranges[j].cmp1))
+	})
+
+	out := ranges[:1]
+	for _, r := range ranges[1:] {
+		cur := &out[len(out)-1]
+		c := bytes.Compare(r.start, cur.end) * dir
+		if c > 0 || (c == 0 && !inclusive(r.cmp1) && !inclusive(cur.cmp2)) {
+			out = append(out, r) // disjoint
+			continue
+		}
+		// overlapping, extend the end
+		switch c := bytes.Compare(r.end, cur.end) * dir; {
+		case c > 0:
+			cur.end, cur.cmp2 = r.end, r.cmp2
+		case c == 0 && inclusive(r.cmp2):
+			cur.cmp2 = r.cmp2
+		}
+	}
+	return out
+}
+
+// is the iterator within the current range?
+func (sc *Scanner) inRange() bool {
 	if !sc.iter.Valid() {
 		return false
 	}
 	key, _ := sc.iter.Deref()
-	return cmpOK(key, sc.Cmp2, sc.keyEnd)
+	r := sc.ranges[sc.cur]
+	return cmpOK(key, r.cmp2, r.end)
+}
+
+// skip to the next range once the current one is exhausted
+func (sc *Scanner) settle() {
+	for !sc.inRange() && sc.cur+1 < len(sc.ranges) {
+		sc.cur++
+		r := sc.ranges[sc.cur]
+		sc.iter = sc.db.kv.tree.Seek(r.start, r.cmp1)
+	}
+}
+
+// within the range or not?
+func (sc *Scanner) Valid() bool {
+	return sc.inRange()
 }
 
 // move the underlying B-tree iterator
 func (sc *Scanner) Next() {
 	Assert(sc.Valid(), "scanner is not valid")
-	if sc.Cmp1 > 0 {
+	if !sc.desc {
 		sc.iter.Next()
 	} else {
 		sc.iter.Prev()
 	}
+	sc.settle()
+	if !sc.Valid() {
+		sc.db.asOfEnd()
+	}
+}
+
+// stop the scan before the end. only needed by AS OF scans,
+// which hold a reader until the end, see DB.ScanAsOf.
+func (sc *Scanner) Close() {
+	if sc.db != nil {
+		sc.db.asOfEnd()
+	}
+}
+
+// the ranges of `col IN (vals)` after the equality columns of `eq`,
+// e.g. `a = 1 AND b IN (3, 5, 9)`.
+func ScanIn(eq Record, col string, vals []Value) []ScanRange {
+	ranges := make([]ScanRange, 0, len(vals))
+	for _, v := range vals {
+		key := Record{
+			Cols: append(append([]string(nil), eq.Cols...), col),
+			Vals: append(append([]Value(nil), eq.Vals...), v),
+		}
+		ranges = append(ranges, ScanRange{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key})
+	}
+	return ranges
+}
+
+// the ranges of `key1 OR key2 OR ...` where each key is a conjunction
+// of equalities on a prefix of the same index.
+func ScanEq(keys ...Record) []ScanRange {
+	ranges := make([]ScanRange, 0, len(keys))
+	for _, key := range keys {
+		ranges = append(ranges, ScanRange{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: key, Key2: key})
+	}
+	return ranges
 }
 
 // get a single row by the primary key
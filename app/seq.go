@@ -0,0 +1,178 @@
+package relixdb
+
+import (
+	"iter"
+)
+
+// range-over-func iterators. keys and values are slices into the pages,
+// they are only valid until the next update. the expired keys are skipped.
+
+// KV pairs in [start, end) in ascending order. a nil `end` is unbounded.
+func (db *KV) Range(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return db.Scan(start, end, ScanOpts{})
+}
+
+// KV pairs in [start, end) in descending order. a nil `end` is unbounded.
+func (db *KV) RangeReverse(start []byte, end []byte) iter.Seq2[[]byte, []byte] {
+	return db.Scan(start, end, ScanOpts{Reverse: true})
+}
+
+// KV pairs whose keys start with `prefix` in ascending order
+func (db *KV) Prefix(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return db.ScanPrefix(prefix, ScanOpts{})
+}
+
+// KV pairs whose keys start with `prefix` in descending order
+func (db *KV) PrefixReverse(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return db.ScanPrefix(prefix, ScanOpts{Reverse: true})
+}
+
+// options for KV range scans
+type ScanOpts struct {
+	Cmp1    int  // the bound of `start`: CMP_GE (default) or CMP_GT
+	Cmp2    int  // the bound of `end`: CMP_LT (default) or CMP_LE
+	Reverse bool // iterate from `end` to `start`
+	Limit   int  // 0: no limit
+}
+
+// KV pairs between `start` and `end` with the bounds of `opts`.
+// a nil `start` or `end` is unbounded.
+func (db *KV) Scan(start []byte, end []byte, opts ScanOpts) iter.Seq2[[]byte, []byte] {
+	return ttlScan(db, start, end, opts)
+}
+
+// KV pairs whose keys start with `prefix`. the bounds of `opts` are ignored.
+func (db *KV) ScanPrefix(prefix []byte, opts ScanOpts) iter.Seq2[[]byte, []byte] {
+	opts.Cmp1, opts.Cmp2 = CMP_GE, CMP_LT
+	return ttlScan(db, prefix, prefixEnd(prefix), opts)
+}
+
+// the smallest key that is larger than all keys with the prefix.
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
+
+func (tree *BTree) scanSeq(start []byte, end []byte, opts ScanOpts) iter.Seq2[[]byte, []byte] {
+	if opts.Cmp1 == 0 {
+		opts.Cmp1 = CMP_GE
+	}
+	if opts.Cmp2 == 0 {
+		opts.Cmp2 = CMP_LT
+	}
+	Assert(opts.Cmp1 == CMP_GE || opts.Cmp1 == CMP_GT, "bad start bound")
+	Assert(opts.Cmp2 == CMP_LT || opts.Cmp2 == CMP_LE, "bad end bound")
+
+	return func(yield func([]byte, []byte) bool) {
+		var it *BIter
+		switch {
+		case !opts.Reverse && start != nil:
+			it = tree.Seek(start, opts.Cmp1)
+		case !opts.Reverse:
+			it = tree.Seek(nil, CMP_GE)
+		case end != nil:
+			it = tree.Seek(end, opts.Cmp2)
+		default:
+			it = tree.SeekLast()
+		}
+
+		count := 0
+		for ; it.Valid(); moveIter(it, opts.Reverse) {
+			key, val := it.Deref()
+			if end != nil && !cmpOK(key, opts.Cmp2, end) {
+				if opts.Reverse {
+					continue
+				}
+				return
+			}
+			if start != nil && !cmpOK(key, opts.Cmp1, start) {
+				if opts.Reverse {
+					return
+				}
+				continue
+			}
+			if len(key) == 0 {
+				continue // the dummy key of the first leaf
+			}
+			if !yield(key, val) {
+				return
+			}
+			if count++; opts.Limit > 0 && count >= opts.Limit {
+				return
+			}
+		}
+	}
+}
+
+func moveIter(it *BIter, reverse bool) {
+	if reverse {
+		it.Prev()
+	} else {
+		it.Next()
+	}
+}
+
+// the position of the last key
+func (tree *BTree) SeekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// rows of a range scan. errors are yielded with an empty record,
+// the iteration stops after an error.
+func (db *DB) ScanSeq(table string, req *Scanner) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		if err := db.Scan(table, req); err != nil {
+			yield(Record{}, err)
+			return
+		}
+		for req.Valid() {
+			rec := Record{}
+			if err := req.deref(&rec); err != nil {
+				yield(Record{}, err)
+				return
+			}
+			if !yield(rec, nil) {
+				return
+			}
+			req.Next()
+		}
+	}
+}
+
+// the remaining rows of a query, closed at the end of the iteration
+func (rows *Rows) All() iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		defer rows.Close()
+		for rows.Valid() {
+			rec := Record{}
+			rows.Deref(&rec)
+			if !yield(rec, nil) {
+				return
+			}
+			rows.Next()
+		}
+		if err := rows.Err(); err != nil {
+			yield(Record{}, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package relixdb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// counters are int64 values stored in the `@meta` table,
+// they are updated in the same transaction as the rows using them.
+const (
+	META_AUTOINC  = "autoinc:" // + table name: the last assigned primary key
+	META_SEQUENCE = "seq:"     // + sequence name: the last value
+)
+
+// read a counter from `@meta`
+func metaGetInt(db *DB, key string) (int64, bool, error) {
+	meta := (&Record{}).AddStr("key", []byte(key))
+	ok, err := dbGet(db, TDEF_META, meta)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	val := meta.Get("val").Str
+	if len(val) != 8 {
+		return 0, false, fmt.Errorf("bad counter in @meta: %s", key)
+	}
+	return int64(binary.LittleEndian.Uint64(val)), true, nil
+}
+
+// write a counter to `@meta`
+func metaSetInt(db *DB, key string, v int64) error {
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, uint64(v))
+	meta := (&Record{}).AddStr("key", []byte(key)).AddStr("val", val)
+	_, err := dbUpdate(db, TDEF_META, *meta, MODE_UPSERT)
+	return err
+}
+
+// assign the primary key of an auto-increment table if it's omitted by
+// an insert. returns the record with the primary key and the key.
+// the counter is moved by autoIncrementAdded() once the row is added.
+func autoIncrement(db *DB, tdef *TableDef, rec Record, mode int) (Record, int64, error) {
+	col := tdef.Cols[0]
+	if v := rec.Get(col); v != nil {
+		if v.Type != TYPE_INT64 {
+			return rec, 0, fmt.Errorf("auto-increment column %s must be int64", col)
+		}
+		return rec, v.I64, nil
+	}
+	if mode != MODE_UPSERT && mode != MODE_INSERT_ONLY {
+		return rec, 0, nil // the missing key is reported by the update
+	}
+
+	last, _, err := metaGetInt(db, META_AUTOINC+tdef.Name)
+	if err != nil {
+		return rec, 0, err
+	}
+	if last == 1<<63-1 {
+		return rec, 0, fmt.Errorf("auto-increment overflow: %s", tdef.Name)
+	}
+	id := last + 1
+	// don't modify the caller's record
+	out := Record{
+		Cols: append([]string{col}, rec.Cols...),
+		Vals: append([]Value{{Type: TYPE_INT64, I64: id}}, rec.Vals...),
+	}
+	return out, id, nil
+}
+
+// an added row with a key larger than the counter moves the counter forward
+func autoIncrementAdded(db *DB, tdef *TableDef, id int64) error {
+	key := META_AUTOINC + tdef.Name
+	last, _, err := metaGetInt(db, key)
+	if err != nil || id <= last {
+		return err
+	}
+	return metaSetInt(db, key, id)
+}
+
+// the next value of a named sequence, starting from 1.
+// the sequence is created on its first use.
+func dbNextVal(db *DB, name string) (int64, error) {
+	key := META_SEQUENCE + name
+	last, _, err := metaGetInt(db, key)
+	if err != nil {
+		return 0, err
+	}
+	if last == 1<<63-1 {
+		return 0, fmt.Errorf("sequence overflow: %s", name)
+	}
+	return last + 1, metaSetInt(db, key, last+1)
+}
+
+// the last value of a named sequence
+func dbCurrVal(db *DB, name string) (int64, error) {
+	last, ok, err := metaGetInt(db, META_SEQUENCE+name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("sequence not used yet: %s", name)
+	}
+	return last, nil
+}
+
+func (db *DB) NextVal(name string) (int64, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	v, err := tx.NextVal(name)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	return v, db.Commit(&tx)
+}
+
+func (db *DB) CurrVal(name string) (int64, error) {
+	return dbCurrVal(db, name)
+}
+
+// insert a new row and return its primary key.
+// the table must use an auto-increment primary key.
+func (db *DB) InsertID(table string, rec Record) (int64, error) {
+	tx := DBTX{}
+	db.Begin(&tx)
+	id, err := tx.InsertID(table, rec)
+	if err != nil {
+		db.Abort(&tx)
+		return 0, err
+	}
+	return id, db.Commit(&tx)
+}
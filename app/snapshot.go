@@ -0,0 +1,234 @@
+package relixdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// named snapshots: a snapshot records the root of a committed version, its
+// pages are not reused until it's deleted. unlike the readers, they are
+// stored in the file and survive restarts. compacting into a new file
+// drops them, compacting in place is refused while there are any.
+//
+// the list is stored in a page referenced by the master page:
+// | type | nsnaps | snapshots... |
+// |  2B  |   2B   |
+// each snapshot:
+// | version | root | time | nlen | name |
+// |   8B    |  8B  |  8B  |  2B  | ...  |
+
+// a named snapshot
+type Snapshot struct {
+	Name    string
+	Version uint64    // the version of the snapshot
+	Created time.Time // the time of creating the snapshot
+	root    uint64
+}
+
+// the snapshots of a version, the items are sorted by name and never
+// modified in place.
+type snapshotList struct {
+	head  uint64 // the page of the list, 0 for no snapshots
+	items []Snapshot
+}
+
+// record the latest committed version as a named snapshot
+func (db *KV) CreateSnapshot(name string) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("empty snapshot name")
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	i, ok := snapshotFind(db.snaps.items, name)
+	if ok {
+		return fmt.Errorf("snapshot exists: %s", name)
+	}
+
+	// no transaction is active, the tree is the latest version
+	snap := Snapshot{Name: name, Version: db.version, Created: time.Now(), root: db.tree.root}
+	saved := db.saveState()
+	if err := snapshotStore(db, slices.Insert(slices.Clone(db.snaps.items), i, snap)); err != nil {
+		return err
+	}
+	if db.pinned != nil {
+		snapshotPin(db, db.pinned, snap.root)
+	}
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// delete a snapshot, the pages that are only reachable from it are freed
+func (db *KV) DeleteSnapshot(name string) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	i, ok := snapshotFind(db.snaps.items, name)
+	if !ok {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+	root := db.snaps.items[i].root
+	items := slices.Delete(slices.Clone(db.snaps.items), i, i+1)
+
+	// the pages of the other snapshots and the latest version are kept
+	pinned := map[uint64]bool{}
+	for _, snap := range items {
+		snapshotPin(db, pinned, snap.root)
+	}
+	keep := maps.Clone(pinned)
+	snapshotPin(db, keep, db.tree.root)
+	freed := []uint64{}
+	var sweep func(ptr uint64)
+	sweep = func(ptr uint64) {
+		if ptr == 0 || keep[ptr] {
+			return
+		}
+		keep[ptr] = true
+		freed = append(freed, ptr)
+		node := pageGetMapped(db, ptr)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				sweep(node.getPtr(i))
+			}
+		}
+	}
+	sweep(root)
+
+	saved := db.saveState()
+	if err := snapshotStore(db, items); err != nil {
+		return err
+	}
+	// the readers of the snapshot keep the pages until they end
+	for _, ptr := range freed {
+		db.pageDel(ptr)
+	}
+	db.pinned = pinned
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+// the committed snapshots, sorted by name
+func (db *KV) Snapshots() []Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return slices.Clone(db.snapshots)
+}
+
+// begin a read-only transaction on a snapshot, it's ended by EndRead
+func (db *KV) OpenSnapshot(name string) (*KVReader, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	i, ok := snapshotFind(db.snapshots, name)
+	if !ok {
+		return nil, fmt.Errorf("snapshot not found: %s", name)
+	}
+	// the pages of the snapshot are kept by itself, and by the version
+	// once it's deleted.
+	tx := &KVReader{}
+	db.beginRead(tx, db.snapshots[i].root, db.version)
+	return tx, nil
+}
+
+func snapshotFind(items []Snapshot, name string) (int, bool) {
+	return slices.BinarySearchFunc(items, name, func(snap Snapshot, name string) int {
+		return strings.Compare(snap.Name, name)
+	})
+}
+
+// replace the list page, the caller holds the writer lock
+func snapshotStore(db *KV, items []Snapshot) error {
+	size := 4
+	for _, snap := range items {
+		size += 26 + len(snap.Name)
+	}
+	if size > db.tree.pageSize() {
+		return fmt.Errorf("too many snapshots")
+	}
+
+	if db.snaps.head != 0 {
+		db.pageDel(db.snaps.head)
+	}
+	head := uint64(0)
+	if len(items) > 0 {
+		data := make([]byte, db.tree.pageSize())
+		binary.LittleEndian.PutUint16(data[0:], BNODE_SNAPSHOTS)
+		binary.LittleEndian.PutUint16(data[2:], uint16(len(items)))
+		pos := 4
+		for _, snap := range items {
+			binary.LittleEndian.PutUint64(data[pos:], snap.Version)
+			binary.LittleEndian.PutUint64(data[pos+8:], snap.root)
+			binary.LittleEndian.PutUint64(data[pos+16:], uint64(snap.Created.UnixNano()))
+			binary.LittleEndian.PutUint16(data[pos+24:], uint16(len(snap.Name)))
+			pos += 26 + copy(data[pos+26:], snap.Name)
+		}
+		head = db.pageNew(BNode{data})
+	}
+	db.snaps = snapshotList{head: head, items: items}
+	return nil
+}
+
+// read the list page of the master page
+func snapshotParse(db *KV, head uint64) ([]Snapshot, error) {
+	if head == 0 {
+		return nil, nil
+	}
+	data := pageGetMapped(db, head).data
+	if binary.LittleEndian.Uint16(data[0:]) != BNODE_SNAPSHOTS {
+		return nil, fmt.Errorf("bad snapshot list")
+	}
+	n := int(binary.LittleEndian.Uint16(data[2:]))
+	items := make([]Snapshot, 0, n)
+	pos := 4
+	for i := 0; i < n; i++ {
+		if pos+26 > len(data) {
+			return nil, fmt.Errorf("bad snapshot list")
+		}
+		nlen := int(binary.LittleEndian.Uint16(data[pos+24:]))
+		if pos+26+nlen > len(data) {
+			return nil, fmt.Errorf("bad snapshot list")
+		}
+		items = append(items, Snapshot{
+			Name:    string(data[pos+26 : pos+26+nlen]),
+			Version: binary.LittleEndian.Uint64(data[pos:]),
+			Created: time.Unix(0, int64(binary.LittleEndian.Uint64(data[pos+16:]))),
+			root:    binary.LittleEndian.Uint64(data[pos+8:]),
+		})
+		pos += 26 + nlen
+	}
+	return items, nil
+}
+
+// the page is reachable from a snapshot, the caller holds the writer lock
+func snapshotPinned(db *KV, ptr uint64) bool {
+	if len(db.snaps.items) == 0 {
+		return false
+	}
+	if db.pinned == nil {
+		db.pinned = map[uint64]bool{}
+		for _, snap := range db.snaps.items {
+			snapshotPin(db, db.pinned, snap.root)
+		}
+	}
+	return db.pinned[ptr]
+}
+
+// add the pages of a tree to the set. a page in the set is skipped with
+// its subtree, which is shared by the copy-on-write.
+func snapshotPin(db *KV, pages map[uint64]bool, ptr uint64) {
+	if ptr == 0 || pages[ptr] {
+		return
+	}
+	pages[ptr] = true
+	node := pageGetMapped(db, ptr)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			snapshotPin(db, pages, node.getPtr(i))
+		}
+	}
+}
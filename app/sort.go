@@ -0,0 +1,269 @@
+package relixdb
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// default memory budget of the external sort before spilling to disk
+const SORT_MEM_DEFAULT = 32 << 20
+
+// a sort item is a sort key followed by an opaque payload.
+// | klen | key | payload |
+// |  4B  | ... |   ...   |
+func sortItem(key []byte, payload []byte) []byte {
+	item := make([]byte, 4, 4+len(key)+len(payload))
+	binary.LittleEndian.PutUint32(item, uint32(len(key)))
+	item = append(item, key...)
+	return append(item, payload...)
+}
+
+func sortItemKey(item []byte) []byte {
+	klen := binary.LittleEndian.Uint32(item)
+	return item[4 : 4+klen]
+}
+
+func sortItemPayload(item []byte) []byte {
+	klen := binary.LittleEndian.Uint32(item)
+	return item[4+klen:]
+}
+
+// the output of a sort, in ascending order of the sort keys
+type sortedIter interface {
+	next() ([]byte, bool, error)
+	close() error
+}
+
+// external merge sort. items are buffered in memory and spilled to
+// temporary files as sorted runs once the buffer exceeds `mem` bytes.
+type extSorter struct {
+	mem  int // memory budget in bytes
+	buf  [][]byte
+	size int
+	runs []*os.File
+}
+
+func (s *extSorter) add(item []byte) error {
+	s.buf = append(s.buf, item)
+	s.size += len(item)
+	if s.size >= s.memLimit() {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *extSorter) memLimit() int {
+	if s.mem <= 0 {
+		return SORT_MEM_DEFAULT
+	}
+	return s.mem
+}
+
+func (s *extSorter) sortBuf() {
+	sort.Slice(s.buf, func(i, j int) bool {
+		return bytes.Compare(sortItemKey(s.buf[i]), sortItemKey(s.buf[j])) < 0
+	})
+}
+
+// write the buffer as a sorted run
+func (s *extSorter) spill() error {
+	s.sortBuf()
+	fp, err := os.CreateTemp("", "relixdb-sort-*")
+	if err != nil {
+		return fmt.Errorf("sort spill: %w", err)
+	}
+	// the file is only referenced by the descriptor from now on
+	_ = os.Remove(fp.Name())
+	s.runs = append(s.runs, fp)
+
+	w := bufio.NewWriter(fp)
+	var hdr [4]byte
+	for _, item := range s.buf {
+		binary.LittleEndian.PutUint32(hdr[:], uint32(len(item)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return fmt.Errorf("sort spill: %w", err)
+		}
+		if _, err := w.Write(item); err != nil {
+			return fmt.Errorf("sort spill: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("sort spill: %w", err)
+	}
+	s.buf, s.size = nil, 0
+	return nil
+}
+
+// finish adding items and merge everything
+func (s *extSorter) finish() (sortedIter, error) {
+	if len(s.runs) == 0 {
+		s.sortBuf()
+		return &memIter{items: s.buf}, nil
+	}
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			s.discard()
+			return nil, err
+		}
+	}
+	m := &mergeIter{files: s.runs}
+	for _, fp := range s.runs {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			m.close()
+			return nil, fmt.Errorf("sort merge: %w", err)
+		}
+		run := &sortRun{r: bufio.NewReader(fp)}
+		if err := run.advance(); err != nil {
+			m.close()
+			return nil, err
+		}
+		if run.item != nil {
+			m.heap = append(m.heap, run)
+		}
+	}
+	heap.Init(&m.heap)
+	s.runs = nil
+	return m, nil
+}
+
+// release temporary files without producing the output
+func (s *extSorter) discard() {
+	for _, fp := range s.runs {
+		_ = fp.Close()
+	}
+	s.runs, s.buf, s.size = nil, nil, 0
+}
+
+// in-memory sorted items
+type memIter struct {
+	items [][]byte
+}
+
+func (it *memIter) next() ([]byte, bool, error) {
+	if len(it.items) == 0 {
+		return nil, false, nil
+	}
+	item := it.items[0]
+	it.items = it.items[1:]
+	return item, true, nil
+}
+
+func (it *memIter) close() error {
+	it.items = nil
+	return nil
+}
+
+// a sorted run read back from a temporary file
+type sortRun struct {
+	r    *bufio.Reader
+	item []byte // nil at the end of the run
+}
+
+func (run *sortRun) advance() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(run.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			run.item = nil
+			return nil
+		}
+		return fmt.Errorf("sort merge: %w", err)
+	}
+	run.item = make([]byte, binary.LittleEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(run.r, run.item); err != nil {
+		return fmt.Errorf("sort merge: %w", err)
+	}
+	return nil
+}
+
+// implements heap.Interface, ordered by the current item of each run
+type runHeap []*sortRun
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	return bytes.Compare(sortItemKey(h[i].item), sortItemKey(h[j].item)) < 0
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*sortRun)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// k-way merge of sorted runs
+type mergeIter struct {
+	heap  runHeap
+	files []*os.File
+}
+
+func (m *mergeIter) next() ([]byte, bool, error) {
+	if len(m.heap) == 0 {
+		return nil, false, nil
+	}
+	run := m.heap[0]
+	item := run.item
+	if err := run.advance(); err != nil {
+		return nil, false, err
+	}
+	if run.item == nil {
+		heap.Pop(&m.heap)
+	} else {
+		heap.Fix(&m.heap, 0)
+	}
+	return item, true, nil
+}
+
+func (m *mergeIter) close() error {
+	var err error
+	for _, fp := range m.files {
+		if cerr := fp.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	m.files, m.heap = nil, nil
+	return err
+}
+
+// keeps the smallest `n` items seen so far (top-N for LIMIT).
+// implements heap.Interface as a max-heap so the worst item is on top.
+type topN struct {
+	n     int
+	items [][]byte
+}
+
+func (t *topN) Len() int { return len(t.items) }
+func (t *topN) Less(i, j int) bool {
+	return bytes.Compare(sortItemKey(t.items[i]), sortItemKey(t.items[j])) > 0
+}
+func (t *topN) Swap(i, j int) { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topN) Push(x any)    { t.items = append(t.items, x.([]byte)) }
+func (t *topN) Pop() any {
+	x := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return x
+}
+
+func (t *topN) add(item []byte) {
+	if len(t.items) < t.n {
+		heap.Push(t, item)
+		return
+	}
+	if bytes.Compare(sortItemKey(item), sortItemKey(t.items[0])) < 0 {
+		t.items[0] = item
+		heap.Fix(t, 0)
+	}
+}
+
+func (t *topN) finish() sortedIter {
+	sort.Slice(t.items, func(i, j int) bool {
+		return bytes.Compare(sortItemKey(t.items[i]), sortItemKey(t.items[j])) < 0
+	})
+	return &memIter{items: t.items}
+}
@@ -0,0 +1,499 @@
+package relixdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// a full-text index on bytes columns.
+//
+// the KV pairs under the prefix of the index:
+// | "p" | term | primary key | => positions of the term in the row
+// | "d" | primary key |        => the number of tokens of the row
+// | "s" |                      => the number of rows | the total tokens
+type TextIndex struct {
+	Name      string
+	Cols      []string // TYPE_BYTES columns
+	Tokenizer int      // TOKEN_WORDS or TOKEN_SPACE
+	KeepCase  bool     // don't lowercase the tokens
+	StopWords []string // tokens that are not indexed
+}
+
+// BM25 parameters
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+// a row matched by a full-text search
+type SearchHit struct {
+	Rec   Record
+	Score float64
+}
+
+func checkTextIndexes(tdef *TableDef) error {
+	names := map[string]bool{}
+	for _, ti := range tdef.TextIndexes {
+		if ti.Name == "" || names[ti.Name] {
+			return fmt.Errorf("full-text indexes must have unique names")
+		}
+		names[ti.Name] = true
+		if len(ti.Cols) == 0 {
+			return fmt.Errorf("full-text index %s has no columns", ti.Name)
+		}
+		for _, c := range ti.Cols {
+			idx := colIndex(tdef, c)
+			if idx < 0 {
+				return fmt.Errorf("unknown column in full-text index %s: %s", ti.Name, c)
+			}
+			if tdef.Types[idx] != TYPE_BYTES {
+				return fmt.Errorf("full-text index %s: column %s is not bytes", ti.Name, c)
+			}
+		}
+		if ti.Tokenizer != TOKEN_WORDS && ti.Tokenizer != TOKEN_SPACE {
+			return fmt.Errorf("full-text index %s: bad tokenizer %d", ti.Name, ti.Tokenizer)
+		}
+	}
+	return nil
+}
+
+// split the text into tokens. stop words are returned as empty strings
+// so that they still count in the positions of the other tokens.
+func textTokens(ti *TextIndex, text string) []string {
+	var tokens []string
+	switch ti.Tokenizer {
+	case TOKEN_WORDS:
+		tokens = strings.FieldsFunc(text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+	case TOKEN_SPACE:
+		tokens = strings.Fields(text)
+	default:
+		panic("what?")
+	}
+	for i, tok := range tokens {
+		if !ti.KeepCase {
+			tok = strings.ToLower(tok)
+		}
+		for _, stop := range ti.StopWords {
+			if tok == stop {
+				tok = ""
+				break
+			}
+		}
+		tokens[i] = tok
+	}
+	return tokens
+}
+
+// the positions of each term of the indexed columns, and the number of tokens.
+// `vals` are in the order of `tdef.Cols`.
+func textTerms(tdef *TableDef, ti *TextIndex, vals []Value) (map[string][]uint32, int) {
+	terms := map[string][]uint32{}
+	pos := uint32(0)
+	for _, c := range ti.Cols {
+		for _, tok := range textTokens(ti, string(vals[colIndex(tdef, c)].Str)) {
+			if tok != "" {
+				terms[tok] = append(terms[tok], pos)
+			}
+			pos++
+		}
+		pos++ // phrases don't span columns
+	}
+	length := int(pos) - len(ti.Cols)
+	return terms, length
+}
+
+func textPostingPrefix(prefix uint32, term string) []byte {
+	return encodeKey(nil, prefix, []Value{
+		{Type: TYPE_BYTES, Str: []byte("p")}, {Type: TYPE_BYTES, Str: []byte(term)},
+	})
+}
+
+func textDocPrefix(prefix uint32) []byte {
+	return encodeKey(nil, prefix, []Value{{Type: TYPE_BYTES, Str: []byte("d")}})
+}
+
+func textStatsKey(prefix uint32) []byte {
+	return encodeKey(nil, prefix, []Value{{Type: TYPE_BYTES, Str: []byte("s")}})
+}
+
+// the number of rows and the total number of tokens
+func textStats(tree *BTree, prefix uint32) (int64, int64) {
+	val, ok := tree.Get(textStatsKey(prefix))
+	if !ok {
+		return 0, 0
+	}
+	return int64(binary.LittleEndian.Uint64(val[0:])), int64(binary.LittleEndian.Uint64(val[8:]))
+}
+
+// the KVs of a row: the document length, then the postings with the
+// positions of the terms. also returns the number of tokens.
+func textPostings(tdef *TableDef, i int, vals []Value) ([][]byte, [][]byte, int) {
+	ti := &tdef.TextIndexes[i]
+	prefix := tdef.TextPrefixes[i]
+	pk := encodeValues(nil, vals[:tdef.PKeys])
+	terms, length := textTerms(tdef, ti, vals)
+
+	keys := [][]byte{append(textDocPrefix(prefix), pk...)}
+	postings := [][]byte{binary.AppendUvarint(nil, uint64(length))}
+	for term, pos := range terms {
+		var val []byte
+		for j, p := range pos {
+			if j > 0 {
+				p -= pos[j-1]
+			}
+			val = binary.AppendUvarint(val, uint64(p))
+		}
+		keys = append(keys, append(textPostingPrefix(prefix, term), pk...))
+		postings = append(postings, val)
+	}
+	return keys, postings, length
+}
+
+// can the postings of a row be added?
+func textCheck(db *DB, tdef *TableDef, i int, keys [][]byte, postings [][]byte) error {
+	for j := range keys {
+		if err := db.kv.tree.checkKV(keys[j], postings[j]); err != nil {
+			return fmt.Errorf("full-text index %s of table %s: %w",
+				tdef.TextIndexes[i].Name, tdef.Name, err)
+		}
+	}
+	return nil
+}
+
+// add or remove the postings of a row
+func textIndexOp(db *DB, tdef *TableDef, i int, vals []Value, op int) error {
+	ti := &tdef.TextIndexes[i]
+	prefix := tdef.TextPrefixes[i]
+	keys, postings, length := textPostings(tdef, i, vals)
+	tree := &db.kv.tree
+
+	docs, total := textStats(tree, prefix)
+	switch op {
+	case INDEX_ADD:
+		// check the terms before touching the tree
+		if err := textCheck(db, tdef, i, keys, postings); err != nil {
+			return err
+		}
+		for j := range keys {
+			tree.Insert(keys[j], postings[j])
+		}
+		docs, total = docs+1, total+int64(length)
+	case INDEX_DEL:
+		for _, key := range keys {
+			if !tree.Delete(key) {
+				return fmt.Errorf("inconsistent full-text index %s of table %s", ti.Name, tdef.Name)
+			}
+		}
+		docs, total = docs-1, total-int64(length)
+	default:
+		panic("what?")
+	}
+
+	stats := make([]byte, 16)
+	binary.LittleEndian.PutUint64(stats[0:], uint64(docs))
+	binary.LittleEndian.PutUint64(stats[8:], uint64(total))
+	tree.Insert(textStatsKey(prefix), stats)
+	return nil
+}
+
+// does the row change the text of the index?
+func textChanged(tdef *TableDef, ti *TextIndex, old []Value, vals []Value) bool {
+	for _, c := range ti.Cols {
+		idx := colIndex(tdef, c)
+		if !bytes.Equal(old[idx].Str, vals[idx].Str) {
+			return true
+		}
+	}
+	return false
+}
+
+// a term, or a phrase of terms at relative positions
+type textItem struct {
+	terms []string
+	offs  []int
+}
+
+// the conjunction of the `must` items without the `not` items
+type textClause struct {
+	must []textItem
+	not  []textItem
+}
+
+// parse a boolean query into a disjunction of clauses.
+// terms are ANDed, `OR` separates clauses, `-term` or `NOT term` excludes,
+// and "quoted words" are phrases.
+func parseTextQuery(ti *TextIndex, query string) ([]textClause, error) {
+	clauses := []textClause{{}}
+	negate := false
+	for pos := 0; pos < len(query); {
+		ch := query[pos]
+		if ch == ' ' || ch == '\t' || ch == '\n' {
+			pos++
+			continue
+		}
+		if ch == '-' {
+			negate = true
+			pos++
+			continue
+		}
+
+		var text string
+		if ch == '"' {
+			end := strings.IndexByte(query[pos+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated phrase in query: %s", query)
+			}
+			text = query[pos+1 : pos+1+end]
+			pos += end + 2
+		} else {
+			end := strings.IndexAny(query[pos:], " \t\n\"")
+			if end < 0 {
+				end = len(query) - pos
+			}
+			text = query[pos : pos+end]
+			pos += end
+			switch text {
+			case "OR":
+				if negate || len(clauses[len(clauses)-1].must)+len(clauses[len(clauses)-1].not) == 0 {
+					return nil, fmt.Errorf("misplaced OR in query: %s", query)
+				}
+				clauses = append(clauses, textClause{})
+				continue
+			case "AND":
+				continue
+			case "NOT":
+				negate = true
+				continue
+			}
+		}
+
+		item := textItem{}
+		for i, tok := range textTokens(ti, text) {
+			if tok != "" {
+				item.terms = append(item.terms, tok)
+				item.offs = append(item.offs, i)
+			}
+		}
+		cl := &clauses[len(clauses)-1]
+		if len(item.terms) == 0 {
+			// only stop words
+		} else if negate {
+			cl.not = append(cl.not, item)
+		} else {
+			cl.must = append(cl.must, item)
+		}
+		negate = false
+	}
+
+	for _, cl := range clauses {
+		if len(cl.must)+len(cl.not) == 0 {
+			return nil, fmt.Errorf("empty query")
+		}
+	}
+	return clauses, nil
+}
+
+// evaluates a query against a full-text index
+type textSearcher struct {
+	tree     *BTree
+	prefix   uint32
+	postings map[string]map[string][]uint32 // term -> encoded pk -> positions
+}
+
+// the rows containing the term
+func (s *textSearcher) term(term string) map[string][]uint32 {
+	if docs, ok := s.postings[term]; ok {
+		return docs
+	}
+	docs := map[string][]uint32{}
+	start := textPostingPrefix(s.prefix, term)
+	for key, val := range s.tree.scanSeq(start, prefixEnd(start), ScanOpts{}) {
+		var pos []uint32
+		for p := uint64(0); len(val) > 0; {
+			delta, n := binary.Uvarint(val)
+			p += delta
+			val = val[n:]
+			pos = append(pos, uint32(p))
+		}
+		docs[string(key[len(start):])] = pos
+	}
+	s.postings[term] = docs
+	return docs
+}
+
+// all indexed rows
+func (s *textSearcher) all() map[string]bool {
+	docs := map[string]bool{}
+	start := textDocPrefix(s.prefix)
+	for key := range s.tree.scanSeq(start, prefixEnd(start), ScanOpts{}) {
+		docs[string(key[len(start):])] = true
+	}
+	return docs
+}
+
+// the rows matching a term or a phrase
+func (s *textSearcher) item(item textItem) map[string]bool {
+	docs := map[string]bool{}
+	first := s.term(item.terms[0])
+	for pk, pos := range first {
+		for _, p := range pos {
+			if s.phraseAt(item, pk, int(p)) {
+				docs[pk] = true
+				break
+			}
+		}
+	}
+	return docs
+}
+
+// does the phrase start at the position of the row?
+func (s *textSearcher) phraseAt(item textItem, pk string, start int) bool {
+	for i := 1; i < len(item.terms); i++ {
+		want := uint32(start + item.offs[i] - item.offs[0])
+		pos := s.term(item.terms[i])[pk]
+		j := sort.Search(len(pos), func(j int) bool { return pos[j] >= want })
+		if j == len(pos) || pos[j] != want {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *textSearcher) clause(cl textClause) map[string]bool {
+	var docs map[string]bool
+	if len(cl.must) == 0 {
+		docs = s.all()
+	}
+	for _, item := range cl.must {
+		matched := s.item(item)
+		if docs == nil {
+			docs = matched
+			continue
+		}
+		for pk := range docs {
+			if !matched[pk] {
+				delete(docs, pk)
+			}
+		}
+	}
+	for _, item := range cl.not {
+		for pk := range s.item(item) {
+			delete(docs, pk)
+		}
+	}
+	return docs
+}
+
+// the BM25 score of a row for the query terms
+func (s *textSearcher) score(terms map[string]bool, pk string) float64 {
+	docs, total := textStats(s.tree, s.prefix)
+	if docs <= 0 {
+		return 0
+	}
+	avgdl := float64(total) / float64(docs)
+	dl := 0.0
+	if val, ok := s.tree.Get(append(textDocPrefix(s.prefix), pk...)); ok {
+		n, _ := binary.Uvarint(val)
+		dl = float64(n)
+	}
+
+	score := 0.0
+	for term := range terms {
+		postings := s.term(term)
+		tf := float64(len(postings[pk]))
+		if tf == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (float64(docs)-df+0.5)/(df+0.5))
+		norm := 1 - BM25_B
+		if avgdl > 0 {
+			norm += BM25_B * dl / avgdl
+		}
+		score += idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*norm)
+	}
+	return score
+}
+
+// full-text search, the rows are ranked by BM25. limit 0: no limit.
+func (db *DB) Search(table string, index string, query string, limit int) ([]SearchHit, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return dbSearch(db, tdef, index, query, limit)
+}
+
+func dbSearch(db *DB, tdef *TableDef, index string, query string, limit int) ([]SearchHit, error) {
+	i := 0
+	for i < len(tdef.TextIndexes) && tdef.TextIndexes[i].Name != index {
+		i++
+	}
+	if i == len(tdef.TextIndexes) {
+		return nil, fmt.Errorf("full-text index not found: %s", index)
+	}
+	clauses, err := parseTextQuery(&tdef.TextIndexes[i], query)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &textSearcher{
+		tree:     &db.kv.tree,
+		prefix:   tdef.TextPrefixes[i],
+		postings: map[string]map[string][]uint32{},
+	}
+	matched := map[string]bool{}
+	terms := map[string]bool{} // the terms that contribute to the score
+	for _, cl := range clauses {
+		for pk := range s.clause(cl) {
+			matched[pk] = true
+		}
+		for _, item := range cl.must {
+			for _, term := range item.terms {
+				terms[term] = true
+			}
+		}
+	}
+
+	type hit struct {
+		pk    string
+		score float64
+	}
+	hits := make([]hit, 0, len(matched))
+	for pk := range matched {
+		hits = append(hits, hit{pk, s.score(terms, pk)})
+	}
+	sort.Slice(hits, func(a, b int) bool {
+		if hits[a].score != hits[b].score {
+			return hits[a].score > hits[b].score
+		}
+		return hits[a].pk < hits[b].pk
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	out := make([]SearchHit, 0, len(hits))
+	for _, h := range hits {
+		pk := make([]Value, tdef.PKeys)
+		for j := range pk {
+			pk[j].Type = tdef.Types[j]
+		}
+		decodeValues([]byte(h.pk), pk)
+		rec := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: pk}
+		ok, err := dbGet(db, tdef, &rec)
+		if err != nil {
+			return nil, err
+		}
+		Assert(ok, "full-text index references a missing row")
+		out = append(out, SearchHit{Rec: rec, Score: h.score})
+	}
+	return out, nil
+}
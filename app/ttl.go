@@ -0,0 +1,315 @@
+package relixdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+)
+
+// expiring keys: the expiry of a key is kept in a second B-tree referenced
+// by the master page, indexed both by the key and by the time, so the
+// reaper finds the expired keys without scanning the data. an expired key
+// is absent for reads and conditional updates before it's deleted. a key
+// loses its TTL when it's overwritten or deleted. the snapshots and the
+// AS OF readers don't apply the expiry. the backups and the compaction
+// keep the TTL tree.
+//
+// the keys of the TTL tree:
+// "k" key:             | expiry 8B |
+// "e" expiry8 key:     empty
+// the expiry is the unix time in nanoseconds, big-endian in the key.
+
+const (
+	TTL_KEY    = 'k'
+	TTL_EXPIRY = 'e'
+)
+
+const (
+	TTL_REAP_INTERVAL_DEFAULT = time.Second // between the rounds of the reaper
+	TTL_REAP_BATCH_DEFAULT    = 1000        // keys deleted per update
+)
+
+// set a key that expires after `ttl`
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if err := db.checkWrite(); err != nil {
+		return err
+	}
+	if err := ttlCheck(&db.tree, key, val, ttl); err != nil {
+		return err
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	db.tree.Insert(key, val)
+	ttlSet(db, key, time.Now().Add(ttl))
+	return flushPages(db, saved, db.opts.Sync)
+}
+
+func (tx *KVTX) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if err := tx.db.checkWrite(); err != nil {
+		return err
+	}
+	if err := ttlCheck(&tx.db.tree, key, val, ttl); err != nil {
+		return err
+	}
+	tx.db.tree.Insert(key, val)
+	ttlSet(tx.db, key, time.Now().Add(ttl))
+	return nil
+}
+
+// the time left before a key expires, false if it has no TTL
+func (db *KV) TTL(key []byte) (time.Duration, bool) {
+	expiry, ok := ttlGet(&db.ttl, key)
+	if !ok {
+		return 0, false
+	}
+	return time.Until(expiry), true
+}
+
+// delete up to `batch` expired keys in a single update.
+// returns the number of keys deleted.
+func (db *KV) ReapExpired(batch int) (int, error) {
+	if err := db.checkWrite(); err != nil {
+		return 0, err
+	}
+	if batch <= 0 {
+		batch = TTL_REAP_BATCH_DEFAULT
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := db.saveState()
+	n := ttlReap(db, time.Now(), batch)
+	return n, flushPages(db, saved, db.opts.Sync)
+}
+
+// deletes the expired keys in the background.
+// it's a writer, so the KV is read with BeginRead or transactions meanwhile.
+type Reaper struct {
+	db       *KV
+	interval time.Duration
+	batch    int
+	mu       sync.Mutex
+	err      error // of the last round
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// start reaping every `interval`, `batch` keys per update.
+// 0: TTL_REAP_INTERVAL_DEFAULT and TTL_REAP_BATCH_DEFAULT.
+func (db *KV) StartReaper(interval time.Duration, batch int) *Reaper {
+	if interval <= 0 {
+		interval = TTL_REAP_INTERVAL_DEFAULT
+	}
+	if batch <= 0 {
+		batch = TTL_REAP_BATCH_DEFAULT
+	}
+	r := &Reaper{
+		db:       db,
+		interval: interval,
+		batch:    batch,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *Reaper) run() {
+	defer close(r.done)
+	for {
+		n, err := r.db.ReapExpired(r.batch)
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+		if err == nil && n == r.batch {
+			// there can be more, without waiting
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// the error of the last round, nil if it succeeded
+func (r *Reaper) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// stop the reaper, returns the error of the last round
+func (r *Reaper) Close() error {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+	return r.Err()
+}
+
+func ttlCheck(tree *BTree, key []byte, val []byte, ttl time.Duration) error {
+	if err := tree.checkKV(key, val); err != nil {
+		return err
+	}
+	if len(key)+9 > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("key too large for a TTL: %d > %d", len(key), BTREE_MAX_KEY_SIZE-9)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("bad TTL: %v", ttl)
+	}
+	return nil
+}
+
+func ttlKey(key []byte) []byte {
+	return append([]byte{TTL_KEY}, key...)
+}
+
+func ttlExpiryKey(expiry uint64, key []byte) []byte {
+	out := make([]byte, 9, 9+len(key))
+	out[0] = TTL_EXPIRY
+	binary.BigEndian.PutUint64(out[1:], expiry)
+	return append(out, key...)
+}
+
+// the expiry of a key
+func ttlGet(tree *BTree, key []byte) (time.Time, bool) {
+	if tree.root == 0 || len(key) == 0 || len(key)+9 > BTREE_MAX_KEY_SIZE {
+		return time.Time{}, false
+	}
+	val, ok := tree.Get(ttlKey(key))
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(val))), true
+}
+
+func ttlExpired(tree *BTree, key []byte, now time.Time) bool {
+	expiry, ok := ttlGet(tree, key)
+	return ok && !expiry.After(now)
+}
+
+// replace the expiry of a key, the caller holds the writer lock
+func ttlSet(db *KV, key []byte, expiry time.Time) {
+	ttlClear(db, key)
+	t := uint64(expiry.UnixNano())
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], t)
+	db.ttl.Insert(ttlKey(key), val[:])
+	db.ttl.Insert(ttlExpiryKey(t, key), nil)
+}
+
+// InsertEx with an expired key absent, which is deleted first.
+// the updated key loses its TTL. the caller holds the writer lock.
+func ttlUpdate(db *KV, req *InsertReq) error {
+	if err := db.tree.checkKV(req.Key, req.Val); err != nil {
+		return err
+	}
+	if ttlExpired(&db.ttl, req.Key, time.Now()) {
+		db.tree.Delete(req.Key)
+		ttlClear(db, req.Key)
+	}
+	err := db.tree.InsertEx(req)
+	if req.Updated {
+		ttlClear(db, req.Key)
+	}
+	return err
+}
+
+// drop the expiry of an updated key
+func ttlClear(db *KV, key []byte) {
+	expiry, ok := ttlGet(&db.ttl, key)
+	if !ok {
+		return
+	}
+	db.ttl.Delete(ttlExpiryKey(uint64(expiry.UnixNano()), key))
+	db.ttl.Delete(ttlKey(key))
+	ttlTrim(db)
+}
+
+// drop the expiries of the keys in [start, end), a nil `end` is unbounded
+func ttlClearRange(db *KV, start []byte, end []byte) {
+	if db.ttl.root == 0 {
+		return
+	}
+	tend := prefixEnd([]byte{TTL_KEY})
+	if end != nil {
+		tend = ttlKey(end)
+	}
+	keys := [][]byte{}
+	for key, val := range db.ttl.scanSeq(ttlKey(start), tend, ScanOpts{}) {
+		keys = append(keys, ttlExpiryKey(binary.LittleEndian.Uint64(val), key[1:]))
+	}
+	for _, key := range keys {
+		db.ttl.Delete(key)
+		db.ttl.Delete(ttlKey(key[9:]))
+	}
+	ttlTrim(db)
+}
+
+// delete up to `batch` keys expired at `now`
+func ttlReap(db *KV, now time.Time, batch int) int {
+	if db.ttl.root == 0 {
+		return 0
+	}
+	// the expiries up to `now`, inclusive
+	end := ttlExpiryKey(uint64(now.UnixNano())+1, nil)
+	keys := [][]byte{}
+	for key := range db.ttl.scanSeq([]byte{TTL_EXPIRY}, end, ScanOpts{Limit: batch}) {
+		keys = append(keys, append([]byte(nil), key...))
+	}
+	for _, key := range keys {
+		db.ttl.Delete(key)
+		db.ttl.Delete(ttlKey(key[9:]))
+		db.tree.Delete(key[9:])
+	}
+	ttlTrim(db)
+	return len(keys)
+}
+
+// free the tree when only the dummy key is left
+func ttlTrim(db *KV) {
+	if db.ttl.root == 0 {
+		return
+	}
+	node := db.ttl.get(db.ttl.root)
+	if node.btype() == BNODE_LEAF && node.nkeys() == 1 {
+		db.ttl.del(db.ttl.root)
+		db.ttl.root = 0
+	}
+}
+
+// skip the expired keys of a scan, the limit counts the remaining keys
+func ttlScan(db *KV, start []byte, end []byte, opts ScanOpts) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		if db.ttl.root == 0 {
+			db.tree.scanSeq(start, end, opts)(yield)
+			return
+		}
+		limit := opts.Limit
+		opts.Limit = 0
+		now := time.Now()
+		count := 0
+		for key, val := range db.tree.scanSeq(start, end, opts) {
+			if ttlExpired(&db.ttl, key, now) {
+				continue
+			}
+			if !yield(key, val) {
+				return
+			}
+			if count++; limit > 0 && count >= limit {
+				return
+			}
+		}
+	}
+}
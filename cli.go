@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	app "github.com/yash7xm/RelixDB/app"
+)
+
+// the subcommands of the relix command
+var commands = map[string]func(args []string) error{
+	"import":  cmdImport,
+	"export":  cmdExport,
+	"dump":    cmdDump,
+	"restore": cmdRestore,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  relix import -db FILE -table NAME [-format csv|jsonl] [-batch N] [-insert-only] [-skip-errors] [INPUT]
+  relix export -db FILE -table NAME [-format csv|jsonl] [-from KEY] [-to KEY] [OUTPUT]
+  relix dump -db FILE [OUTPUT]
+  relix restore -db FILE [INPUT]
+the input and output default to stdin and stdout.`)
+}
+
+// csv or jsonl, from the flag or the file extension
+func parseFormat(format string, path string) (int, error) {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		default:
+			format = "csv"
+		}
+	}
+	switch format {
+	case "csv":
+		return app.FORMAT_CSV, nil
+	case "jsonl":
+		return app.FORMAT_JSONL, nil
+	default:
+		return 0, fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+func openDB(path string, readOnly bool) (*app.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-db is required")
+	}
+	db := (&app.DB{}).NewDB(path)
+	if err := db.Open(app.Options{ReadOnly: readOnly}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func cmdImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "the database file")
+	table := fs.String("table", "", "the table to import into")
+	format := fs.String("format", "", "csv or jsonl, by the file extension if omitted")
+	batch := fs.Int("batch", app.IMPORT_BATCH_DEFAULT, "rows per transaction")
+	insertOnly := fs.Bool("insert-only", false, "fail on existing rows instead of replacing them")
+	skip := fs.Bool("skip-errors", false, "skip bad rows instead of stopping")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	opts := app.ImportOpts{BatchSize: *batch}
+	var err error
+	if opts.Format, err = parseFormat(*format, fs.Arg(0)); err != nil {
+		return err
+	}
+	if *insertOnly {
+		opts.Mode = app.MODE_INSERT_ONLY
+	}
+	if *skip {
+		opts.OnError = app.IMPORT_SKIP
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 1 {
+		fp, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+	}
+	db, err := openDB(*dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.Import(*table, in, opts)
+	for _, e := range stats.Errors {
+		fmt.Fprintln(os.Stderr, "skipped:", e)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d rows, skipped %d\n", stats.Rows, stats.Skipped)
+	return err
+}
+
+func cmdExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "the database file")
+	table := fs.String("table", "", "the table to export")
+	format := fs.String("format", "", "csv or jsonl, by the file extension if omitted")
+	from := fs.String("from", "", "the first value of the first primary key column")
+	to := fs.String("to", "", "the last value of the first primary key column")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	opts := app.ExportOpts{}
+	var err error
+	if opts.Format, err = parseFormat(*format, fs.Arg(0)); err != nil {
+		return err
+	}
+	db, err := openDB(*dbPath, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// the range on the first primary key column
+	if *from != "" || *to != "" {
+		if *from != "" {
+			if opts.Key1, err = db.ParseKey(*table, *from); err != nil {
+				return err
+			}
+		}
+		if *to != "" {
+			if opts.Key2, err = db.ParseKey(*table, *to); err != nil {
+				return err
+			}
+		}
+		opts.Cmp1, opts.Cmp2 = app.CMP_GE, app.CMP_LE
+	}
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 1 {
+		fp, err := os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		out = fp
+	}
+	n, err := db.Export(*table, out, opts)
+	fmt.Fprintf(os.Stderr, "exported %d rows\n", n)
+	return err
+}
+
+func cmdDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "the database file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+	db, err := openDB(*dbPath, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	if fs.NArg() == 1 {
+		fp, err := os.Create(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		out = fp
+	}
+	return db.Dump(out)
+}
+
+func cmdRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dbPath := fs.String("db", "", "the new database file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("too many arguments")
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() == 1 {
+		fp, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		in = fp
+	}
+	db, err := openDB(*dbPath, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.RestoreDump(in)
+}
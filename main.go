@@ -3,11 +3,25 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	app "github.com/yash7xm/RelixDB/app"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		if err := cmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Println("Initializing RelixDB...")
 
 	// Create and initialize the database instance
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func TestBulkInsert(t *testing.T) {
+	db := newTestDB(t)
+	users := setupQueryTable(t, db)
+
+	table := &Table.TableDef{
+		Name:          "items",
+		Types:         []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64},
+		Cols:          []string{"id", "name", "price"},
+		PKeys:         1,
+		Indexes:       [][]string{{"price"}},
+		AutoIncrement: true,
+		TextIndexes:   []Table.TextIndex{{Name: "body", Cols: []string{"name"}}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	const N = 3000
+	rows := func(yield func(Table.Record) bool) {
+		for i := 1; i <= N; i++ {
+			name := fmt.Sprintf("item%d color%d", i, i%7)
+			rec := (&Table.Record{}).AddStr("name", []byte(name)).AddInt64("price", int64(i%100))
+			if !yield(*rec) {
+				return
+			}
+		}
+	}
+	n, err := db.BulkInsert("items", rows, Table.BulkOpts{Fill: 0.8})
+	if err != nil {
+		t.Fatalf("BulkInsert failed: %v", err)
+	}
+	if n != N {
+		t.Fatalf("expected %d rows, got %d", N, n)
+	}
+
+	// the primary key
+	rec := (&Table.Record{}).AddInt64("id", 1234)
+	if ok, err := db.Get("items", rec); err != nil || !ok {
+		t.Fatalf("Get failed: %v %v", ok, err)
+	}
+	if got := string(rec.Get("name").Str); got != "item1234 color2" {
+		t.Fatalf("unexpected name: %s", got)
+	}
+
+	// the secondary index
+	q := &Table.Query{
+		Cmp1: Table.CMP_GE, Key1: *(&Table.Record{}).AddInt64("price", 42),
+		Cmp2: Table.CMP_LE, Key2: *(&Table.Record{}).AddInt64("price", 42),
+	}
+	res, err := db.Query("items", q)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	ids := collectIDs(t, res)
+	if len(ids) != N/100 {
+		t.Fatalf("expected %d rows by the index, got %d", N/100, len(ids))
+	}
+	for _, id := range ids {
+		if id%100 != 42 {
+			t.Fatalf("unexpected row by the index: %d", id)
+		}
+	}
+
+	// the full-text index
+	hits, err := db.Search("items", "body", "item77 color0", 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(hits) != 1 || hits[0].Rec.Get("id").I64 != 77 {
+		t.Fatalf("unexpected search result: %v", hits)
+	}
+	hits, err = db.Search("items", "body", "color3", 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(hits) != (N+3)/7 {
+		t.Fatalf("expected %d hits, got %d", (N+3)/7, len(hits))
+	}
+
+	// the auto-increment counter continues after the bulk insert
+	id, err := db.InsertID("items", *(&Table.Record{}).AddStr("name", []byte("last")).AddInt64("price", 1))
+	if err != nil {
+		t.Fatalf("InsertID failed: %v", err)
+	}
+	if id != N+1 {
+		t.Fatalf("expected id %d, got %d", N+1, id)
+	}
+	if _, err := db.Delete("items", *(&Table.Record{}).AddInt64("id", 5)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// the other table is untouched
+	res, err = db.Query("users", &Table.Query{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if ids := collectIDs(t, res); len(ids) != len(users) {
+		t.Fatalf("expected %d users, got %d", len(users), len(ids))
+	}
+
+	// only into empty tables
+	if _, err := db.BulkInsert("items", rows); err == nil {
+		t.Fatalf("expected an error for a non-empty table")
+	}
+}
+
+func TestBulkInsertErrors(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:    "kv",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_INT64},
+		Cols:    []string{"k", "v"},
+		PKeys:   1,
+		Indexes: [][]string{{"v"}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	bulk := func(keys ...int64) error {
+		_, err := db.BulkInsert("kv", func(yield func(Table.Record) bool) {
+			for _, k := range keys {
+				if !yield(*(&Table.Record{}).AddInt64("k", k).AddInt64("v", k*10)) {
+					return
+				}
+			}
+		})
+		return err
+	}
+	if err := bulk(1, 3, 2); err == nil {
+		t.Fatalf("expected an error for unsorted rows")
+	}
+	if err := bulk(1, 1); err == nil {
+		t.Fatalf("expected an error for duplicated rows")
+	}
+	res, err := db.Query("kv", &Table.Query{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if ids := collectIDs(t, res); len(ids) != 0 {
+		t.Fatalf("expected no rows after the failed inserts, got %v", ids)
+	}
+	if err := bulk(1, 2, 3); err != nil {
+		t.Fatalf("BulkInsert failed: %v", err)
+	}
+}
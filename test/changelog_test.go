@@ -0,0 +1,245 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func setupChangelogTables(t *testing.T, db *Table.DB) {
+	t.Helper()
+	for _, tdef := range []*Table.TableDef{
+		{
+			Name:    "users",
+			Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+			Cols:    []string{"id", "name"},
+			PKeys:   1,
+			Indexes: [][]string{{"name"}},
+		},
+		{
+			Name:  "posts",
+			Types: []uint32{Table.TYPE_BYTES, Table.TYPE_INT64},
+			Cols:  []string{"slug", "author"},
+			PKeys: 1,
+			ForeignKeys: []Table.ForeignKey{
+				{Cols: []string{"author"}, Table: "users", OnDelete: Table.FK_CASCADE},
+			},
+		},
+	} {
+		if err := db.TableNew(tdef); err != nil {
+			t.Fatalf("Failed to create table: %v", err)
+		}
+	}
+}
+
+// all the events available now
+func pollChanges(t *testing.T, sub *Table.Subscription) []Table.ChangeEvent {
+	t.Helper()
+	events := []Table.ChangeEvent{}
+	for {
+		ev, ok, err := sub.Poll()
+		if err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+		if !ok {
+			return events
+		}
+		events = append(events, ev)
+	}
+}
+
+// a short form of an event: op table key old new
+func changeString(ev Table.ChangeEvent) string {
+	row := func(rec *Table.Record) string {
+		if rec == nil {
+			return "-"
+		}
+		s := ""
+		for i, v := range rec.Vals {
+			if i > 0 {
+				s += ","
+			}
+			if v.Type == Table.TYPE_INT64 {
+				s += fmt.Sprint(v.I64)
+			} else {
+				s += string(v.Str)
+			}
+		}
+		return s
+	}
+	op := map[int]string{Table.CHANGE_INSERT: "ins", Table.CHANGE_UPDATE: "upd", Table.CHANGE_DELETE: "del"}[ev.Op]
+	return fmt.Sprintf("%s %s %s %s %s", op, ev.Table, row(&ev.Key), row(ev.Old), row(ev.New))
+}
+
+func TestChangelog(t *testing.T) {
+	fp, err := os.CreateTemp("", "relixdb_test.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	fp.Close()
+	defer os.Remove(fp.Name())
+	db := (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	setupChangelogTables(t, db)
+	user := func(id int64, name string) Table.Record {
+		return *(&Table.Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+	}
+	// not recorded yet
+	if _, err := db.Insert("users", user(1, "alice")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.EnableChangelog(Table.ChangelogOpts{}); err != nil {
+		t.Fatalf("EnableChangelog failed: %v", err)
+	}
+	sub := db.Subscribe(0)
+	if got := pollChanges(t, sub); len(got) != 0 {
+		t.Fatalf("unexpected events: %v", got)
+	}
+
+	// a transaction with several changes
+	tx := Table.DBTX{}
+	db.Begin(&tx)
+	for _, op := range []func() error{
+		func() error { _, err := tx.Set("users", user(2, "bob"), Table.MODE_INSERT_ONLY); return err },
+		func() error { _, err := tx.Set("users", user(1, "alice2"), Table.MODE_UPSERT); return err },
+		func() error { _, err := tx.Set("users", user(1, "alice2"), Table.MODE_UPSERT); return err }, // unchanged
+		func() error {
+			post := (&Table.Record{}).AddStr("slug", []byte("hello")).AddInt64("author", 2)
+			_, err := tx.Set("posts", *post, Table.MODE_INSERT_ONLY)
+			return err
+		},
+	} {
+		if err := op(); err != nil {
+			t.Fatalf("update failed: %v", err)
+		}
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// aborted changes are not recorded
+	db.Begin(&tx)
+	if _, err := tx.Set("users", user(3, "carol"), Table.MODE_INSERT_ONLY); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	db.Abort(&tx)
+	// a cascade
+	if _, err := db.Delete("users", *(&Table.Record{}).AddInt64("id", 2)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	got := pollChanges(t, sub)
+	expect := []string{
+		"ins users 2 - 2,bob",
+		"upd users 1 1,alice 1,alice2",
+		"ins posts hello - hello,2",
+		"del users 2 2,bob -",
+		"del posts hello hello,2 -",
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d events, got %d", len(expect), len(got))
+	}
+	for i := range expect {
+		if s := changeString(got[i]); s != expect[i] {
+			t.Fatalf("event %d: expected %q, got %q", i, expect[i], s)
+		}
+	}
+	if got[0].Version != got[2].Version || got[3].Version != got[0].Version+1 || got[4].Version != got[3].Version {
+		t.Fatalf("unexpected versions: %d %d %d %d", got[0].Version, got[2].Version, got[3].Version, got[4].Version)
+	}
+	if time.Since(got[0].Time) > time.Minute {
+		t.Fatalf("unexpected time: %v", got[0].Time)
+	}
+	last := got[4].Version
+
+	// tailing
+	done := make(chan Table.ChangeEvent)
+	go func() {
+		ev, err := sub.Next()
+		if err != nil {
+			t.Errorf("Next failed: %v", err)
+		}
+		done <- ev
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := db.Insert("users", user(4, "dave")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	select {
+	case ev := <-done:
+		if s := changeString(ev); s != "ins users 4 - 4,dave" {
+			t.Fatalf("unexpected event: %s", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Next is not woken up")
+	}
+	sub.Close()
+	if _, err := sub.Next(); err != Table.ErrSubscriptionClosed {
+		t.Fatalf("expected ErrSubscriptionClosed, got %v", err)
+	}
+
+	// resume after a restart
+	db.Close()
+	db = (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	got = pollChanges(t, db.Subscribe(last+1))
+	if len(got) != 1 || changeString(got[0]) != "ins users 4 - 4,dave" {
+		t.Fatalf("unexpected events after restart: %v", got)
+	}
+
+	// bulk inserts are recorded too
+	if err := db.TableNew(&Table.TableDef{
+		Name: "items", Types: []uint32{Table.TYPE_INT64}, Cols: []string{"id"}, PKeys: 1,
+	}); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	rows := func(yield func(Table.Record) bool) {
+		for i := int64(0); i < 500; i++ {
+			if !yield(*(&Table.Record{}).AddInt64("id", i)) {
+				return
+			}
+		}
+	}
+	if _, err := db.BulkInsert("items", rows); err != nil {
+		t.Fatalf("BulkInsert failed: %v", err)
+	}
+	got = pollChanges(t, db.Subscribe(last+2))
+	if len(got) != 500 || changeString(got[499]) != "ins items 499 - 499" {
+		t.Fatalf("unexpected bulk events: %d", len(got))
+	}
+
+	// retention
+	if err := db.EnableChangelog(Table.ChangelogOpts{MaxVersions: 3}); err != nil {
+		t.Fatalf("EnableChangelog failed: %v", err)
+	}
+	for i := int64(10); i < 20; i++ {
+		if _, err := db.Insert("users", user(i, "x")); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if _, _, err := db.Subscribe(last + 1).Poll(); err != Table.ErrChangesTrimmed {
+		t.Fatalf("expected ErrChangesTrimmed, got %v", err)
+	}
+	got = pollChanges(t, db.Subscribe(0))
+	if len(got) != 3 || changeString(got[0]) != "ins users 17 - 17,x" {
+		t.Fatalf("unexpected events after trimming: %d", len(got))
+	}
+
+	if err := db.DisableChangelog(); err != nil {
+		t.Fatalf("DisableChangelog failed: %v", err)
+	}
+	if _, err := db.Insert("users", user(30, "y")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if got := pollChanges(t, db.Subscribe(0)); len(got) != 0 {
+		t.Fatalf("unexpected events after disabling: %d", len(got))
+	}
+}
@@ -0,0 +1,204 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func dumpString(t *testing.T, db *Table.DB) string {
+	t.Helper()
+	out := bytes.Buffer{}
+	if err := db.Dump(&out); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	return out.String()
+}
+
+func setupDumpTables(t *testing.T, db *Table.DB) {
+	t.Helper()
+	minAge, maxAge := int64(0), int64(150)
+	users := &Table.TableDef{
+		Name:          "users",
+		Types:         []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_JSON},
+		Cols:          []string{"id", "name", "age", "bio", "doc"},
+		PKeys:         1,
+		AutoIncrement: true,
+		Indexes:       [][]string{{"age"}, {"lower(name)"}, {"name"}},
+		IndexWhere:    []string{"", "", "age >= 18"},
+		NotNull:       []bool{false, true, false, false, false},
+		Defaults:      []*Table.Value{nil, nil, nil, nil, {Type: Table.TYPE_JSON, Str: []byte("{}")}},
+		Checks:        []*Table.Check{nil, {MinLen: 1, MaxLen: 20}, {Min: &minAge, Max: &maxAge}, nil, nil},
+		TextIndexes: []Table.TextIndex{
+			{Name: "bio", Cols: []string{"bio"}, StopWords: []string{"the", "it's"}},
+		},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	// a self-referencing table, and an odd name
+	nodes := &Table.TableDef{
+		Name:  "tree nodes",
+		Types: []uint32{Table.TYPE_BYTES, Table.TYPE_BYTES, Table.TYPE_INT64},
+		Cols:  []string{"key", "parent", "owner"},
+		PKeys: 1,
+		ForeignKeys: []Table.ForeignKey{
+			{Cols: []string{"parent"}, Table: "tree nodes", OnDelete: Table.FK_CASCADE},
+			{Cols: []string{"owner"}, Table: "users", OnDelete: Table.FK_SET_NULL},
+		},
+	}
+	if err := db.TableNew(nodes); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	for _, u := range []struct {
+		name string
+		age  int64
+		bio  string
+	}{
+		{"Alice", 30, "it's the quick brown fox"},
+		{"bob", 12, "lazy dog, 'quoted'"},
+		{"Carol", 45, "brown bear"},
+	} {
+		rec := (&Table.Record{}).AddStr("name", []byte(u.name)).AddInt64("age", u.age).AddStr("bio", []byte(u.bio))
+		if _, err := db.InsertID("users", *rec); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	// children before the parents in the key order, binary keys
+	for _, n := range []struct {
+		key, parent string
+		owner       int64
+	}{
+		{"z", "", 2},
+		{"a", "z", 1},
+		{"b\x00\xff", "a", 0},
+	} {
+		rec := (&Table.Record{}).AddStr("key", []byte(n.key)).AddStr("parent", []byte(n.parent)).AddInt64("owner", n.owner)
+		if _, err := db.Insert("tree nodes", *rec); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.NextVal("orders"); err != nil {
+			t.Fatalf("NextVal failed: %v", err)
+		}
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	src := newTestDB(t)
+	setupDumpTables(t, src)
+	dump := dumpString(t, src)
+	if !strings.HasPrefix(dump, Table.DUMP_HEADER+"\n") {
+		t.Fatalf("missing header:\n%s", dump)
+	}
+	if strings.Contains(dump, "Prefix") || strings.Contains(dump, "next_prefix") {
+		t.Fatalf("the prefixes are dumped:\n%s", dump)
+	}
+	// the parents first
+	if strings.Index(dump, "CREATE TABLE users") > strings.Index(dump, "CREATE TABLE 'tree nodes'") {
+		t.Fatalf("bad table order:\n%s", dump)
+	}
+
+	dst := newTestDB(t)
+	if err := dst.RestoreDump(strings.NewReader(dump)); err != nil {
+		t.Fatalf("RestoreDump failed: %v\n%s", err, dump)
+	}
+	if again := dumpString(t, dst); again != dump {
+		t.Fatalf("the dumps differ:\n%s\n%s", dump, again)
+	}
+
+	// the indexes are rebuilt
+	rows, err := dst.Query("users", &Table.Query{Filter: "lower(name) = 'carol'"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if got := collectIDs(t, rows); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+	hits, err := dst.Search("users", "bio", "brown", 0)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("expected 2 hits, got %d", len(hits))
+	}
+	if hits, _ := dst.Search("users", "bio", "the", 0); len(hits) != 0 {
+		t.Fatalf("the stop words are lost")
+	}
+	rec := (&Table.Record{}).AddStr("key", []byte("b\x00\xff"))
+	if ok, err := dst.Get("tree nodes", rec); err != nil || !ok || string(rec.Get("parent").Str) != "a" {
+		t.Fatalf("binary key not restored: %v %v", ok, err)
+	}
+
+	// the counters continue
+	id, err := dst.InsertID("users", *(&Table.Record{}).AddStr("name", []byte("dave")))
+	if err != nil || id != 4 {
+		t.Fatalf("unexpected auto-increment: %d %v", id, err)
+	}
+	if v, err := dst.NextVal("orders"); err != nil || v != 4 {
+		t.Fatalf("unexpected sequence value: %d %v", v, err)
+	}
+	// the constraints are kept
+	bad := (&Table.Record{}).AddStr("name", []byte("eve")).AddInt64("age", 200)
+	if _, err := dst.InsertID("users", *bad); err == nil {
+		t.Fatalf("expected a CHECK violation")
+	}
+	// and the foreign keys
+	if _, err := dst.Delete("tree nodes", *(&Table.Record{}).AddStr("key", []byte("z"))); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for _, key := range []string{"a", "b\x00\xff"} {
+		rec := (&Table.Record{}).AddStr("key", []byte(key))
+		if ok, err := dst.Get("tree nodes", rec); err != nil || ok {
+			t.Fatalf("the cascade is lost: %q", key)
+		}
+	}
+
+	// a new table gets a fresh prefix
+	extra := &Table.TableDef{
+		Name:  "extra",
+		Types: []uint32{Table.TYPE_INT64},
+		Cols:  []string{"id"},
+		PKeys: 1,
+	}
+	if err := dst.TableNew(extra); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := dst.Insert("extra", *(&Table.Record{}).AddInt64("id", 1)); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if again := dumpString(t, dst); !strings.Contains(again, "INSERT INTO extra (id) VALUES (1);") {
+		t.Fatalf("unexpected dump:\n%s", again)
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	db := newTestDB(t)
+	cases := []struct {
+		dump string
+		err  string
+	}{
+		{"CREATE TABLE t (id INT64, PRIMARY KEY (id));\nINSERT INTO t (id) VALUES ('x');\n", "line 2"},
+		{"CREATE TABLE t (id INT64, PRIMARY KEY (id));\n\nINSERT INTO t (id) VALUES (1);\nINSERT INTO t (id) VALUES (1);\n", "line 4: duplicate"},
+		{"CREATE TABLE t (a BYTES, id INT64, PRIMARY KEY (id));\n", "primary key"},
+		{"DROP TABLE t;\n", "unknown statement"},
+		{"CREATE TABLE t (id INT64,\n  PRIMARY KEY (id))\n", "unterminated"},
+	}
+	for _, c := range cases {
+		err := db.RestoreDump(strings.NewReader(c.dump))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("expected %q, got %v", c.err, err)
+		}
+	}
+
+	if err := db.RestoreDump(strings.NewReader("CREATE TABLE t (id INT64, PRIMARY KEY (id));\n")); err != nil {
+		t.Fatalf("RestoreDump failed: %v", err)
+	}
+	if err := db.RestoreDump(strings.NewReader("")); err == nil {
+		t.Fatalf("expected an error on a non-empty database")
+	}
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func TestExpressionAndPartialIndexes(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:       "accounts",
+		Types:      []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64, Table.TYPE_INT64},
+		Cols:       []string{"id", "email", "created", "active"},
+		PKeys:      1,
+		Indexes:    [][]string{{"lower(email)"}, {"created / 86400"}, {"email"}},
+		IndexWhere: []string{"", "", "active = 1"},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	set := func(id int64, email string, created int64, active int64) {
+		t.Helper()
+		rec := (&Table.Record{}).AddInt64("id", id).AddStr("email", []byte(email)).
+			AddInt64("created", created).AddInt64("active", active)
+		if _, err := db.Upsert("accounts", *rec); err != nil {
+			t.Fatalf("Upsert failed: %v", err)
+		}
+	}
+	query := func(q *Table.Query) []int64 {
+		t.Helper()
+		rows, err := db.Query("accounts", q)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		return collectIDs(t, rows)
+	}
+	const day = 86400
+	set(1, "Alice@Example.com", 0*day+5, 1)
+	set(2, "bob@example.com", 1*day+7, 0)
+	set(3, "BOB@example.com", 1*day+100, 1)
+	set(4, "carol@example.com", 3*day, 1)
+
+	key := (&Table.Record{}).AddStr("LOWER(email)", []byte("bob@example.com"))
+	got := query(&Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *key, Key2: *key})
+	if !compareIntSlices(sortedIDs(got), []int64{2, 3}) {
+		t.Errorf("expected [2 3], got %v", got)
+	}
+
+	lo := (&Table.Record{}).AddInt64("created/86400", 1)
+	hi := (&Table.Record{}).AddInt64("created/86400", 3)
+	got = query(&Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LT, Key1: *lo, Key2: *hi})
+	if !compareIntSlices(sortedIDs(got), []int64{2, 3}) {
+		t.Errorf("expected [2 3], got %v", got)
+	}
+
+	// the partial index is only used when the query implies its predicate
+	email := (&Table.Record{}).AddStr("email", []byte("bob@example.com"))
+	if _, err := db.Query("accounts", &Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *email, Key2: *email}); err == nil {
+		t.Errorf("the partial index should not be used without its predicate")
+	}
+	active := func(addr string) []int64 {
+		key := (&Table.Record{}).AddStr("email", []byte(addr))
+		return query(&Table.Query{
+			Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *key, Key2: *key,
+			Filter: "length(email) > 0 AND active = 1",
+		})
+	}
+	if got := active("BOB@example.com"); !compareIntSlices(got, []int64{3}) {
+		t.Errorf("expected [3], got %v", got)
+	}
+	if got := active("bob@example.com"); len(got) != 0 {
+		t.Errorf("inactive rows should not be in the partial index: %v", got)
+	}
+
+	// rows move in and out of the partial index
+	set(2, "bob@example.com", 1*day+7, 1)
+	set(3, "BOB@example.com", 1*day+100, 0)
+	set(3, "BOB@example.com", 1*day+100, 1)
+	set(3, "BOB@example.com", 1*day+100, 0)
+	if got := active("bob@example.com"); !compareIntSlices(got, []int64{2}) {
+		t.Errorf("expected [2], got %v", got)
+	}
+	if _, err := db.Delete("accounts", *(&Table.Record{}).AddInt64("id", 3)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// functions and arithmetic in filters
+	got = query(&Table.Query{Filter: "substr(upper(email), 1, 3) = 'ALI' OR (created + 1) % 2 = 0"})
+	if !compareIntSlices(got, []int64{1, 2}) {
+		t.Errorf("expected [1 2], got %v", got)
+	}
+	got = query(&Table.Query{Filter: "abs(-created) = 3 * 86400 AND -active < 0"})
+	if !compareIntSlices(got, []int64{4}) {
+		t.Errorf("expected [4], got %v", got)
+	}
+	for _, f := range []string{"abs(email) = 1", "nope(1) = 1", "lower(email, 1) = 'x'", "email + 1 = 2"} {
+		if _, err := db.Query("accounts", &Table.Query{Filter: f}); err == nil {
+			t.Errorf("filter %q should be rejected", f)
+		}
+	}
+	rows, err := db.Query("accounts", &Table.Query{Filter: "created / (active - 1) = 0"})
+	if err == nil {
+		for rows.Valid() {
+			rows.Next()
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	if err == nil {
+		t.Errorf("division by zero should fail")
+	}
+}
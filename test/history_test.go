@@ -0,0 +1,204 @@
+package test
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func TestScanAsOf(t *testing.T) {
+	db := newTestDB(t)
+	users := &Table.TableDef{
+		Name:    "users",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:    []string{"id", "name"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	whole := func() *Table.Scanner {
+		return &Table.Scanner{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE}
+	}
+	user := func(id int64, name string) Table.Record {
+		return *(&Table.Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+	}
+	if _, err := db.Insert("users", user(1, "alice")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := db.EnableHistory(Table.HistoryOpts{MaxAge: time.Hour}); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+	if _, err := db.Insert("users", user(2, "bob")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	past := db.Version()
+	time.Sleep(time.Millisecond)
+	mid := time.Now()
+	time.Sleep(time.Millisecond)
+
+	// the changes after the version, including the schema
+	if _, err := db.Update("users", user(1, "alice2")); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := db.Delete("users", *(&Table.Record{}).AddInt64("id", 2)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := db.Insert("users", user(3, "carol")); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	extra := &Table.TableDef{Name: "extra", Types: []uint32{Table.TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}
+	if err := db.TableNew(extra); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	for _, at := range []Table.AsOf{{Version: past}, {Time: mid}} {
+		sc := whole()
+		if err := db.ScanAsOf("users", at, sc); err != nil {
+			t.Fatalf("ScanAsOf failed: %v", err)
+		}
+		names := []string{}
+		for ; sc.Valid(); sc.Next() {
+			rec := Table.Record{}
+			sc.Deref(&rec)
+			names = append(names, string(rec.Get("name").Str))
+		}
+		if !slices.Equal(names, []string{"alice", "bob"}) {
+			t.Fatalf("unexpected rows as of %+v: %v", at, names)
+		}
+
+		// through the index
+		rows, err := db.Query("users", &Table.Query{Filter: "name = 'bob'", AsOf: &at})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if got := collectIDs(t, rows); !slices.Equal(got, []int64{2}) {
+			t.Fatalf("unexpected rows: %v", got)
+		}
+		if _, err := db.Query("extra", &Table.Query{AsOf: &at}); err == nil {
+			t.Fatalf("expected an error for a table created later")
+		}
+	}
+
+	// the latest version
+	rows, err := db.Query("users", &Table.Query{Filter: "name = 'bob'"})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if got := collectIDs(t, rows); len(got) != 0 {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+	latest := Table.AsOf{Version: db.Version()}
+	rows, err = db.Query("users", &Table.Query{AsOf: &latest})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if got := collectIDs(t, rows); !slices.Equal(got, []int64{1, 3}) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// outside of the window
+	for _, at := range []Table.AsOf{
+		{Version: db.Version() + 1},
+		{Time: mid.Add(-time.Hour)},
+		{},
+	} {
+		if err := db.ScanAsOf("users", at, whole()); err == nil {
+			t.Fatalf("expected an error as of %+v", at)
+		}
+	}
+	if err := db.DisableHistory(); err != nil {
+		t.Fatalf("DisableHistory failed: %v", err)
+	}
+	if err := db.ScanAsOf("users", Table.AsOf{Version: past}, whole()); err == nil {
+		t.Fatalf("expected an error without the history")
+	}
+}
+
+func TestScanAsOfReader(t *testing.T) {
+	db := newTestDB(t)
+	users := &Table.TableDef{
+		Name:  "users",
+		Types: []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	update := func(round int) {
+		for id := int64(0); id < 200; id++ {
+			name := fmt.Sprintf("round%d-%s", round, strings.Repeat("x", 100))
+			rec := (&Table.Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+			if _, err := db.Upsert("users", *rec); err != nil {
+				t.Fatalf("Upsert failed: %v", err)
+			}
+		}
+	}
+	update(0)
+	if err := db.EnableHistory(Table.HistoryOpts{MaxVersions: 1}); err != nil {
+		t.Fatalf("EnableHistory failed: %v", err)
+	}
+	at := Table.AsOf{Version: db.Version()}
+	check := func(rec Table.Record) {
+		if name := string(rec.Get("name").Str); !strings.HasPrefix(name, "round0-") {
+			t.Fatalf("unexpected row: %s", name)
+		}
+	}
+
+	// lazy scans keep the pages of the version after the window moves on
+	sc := &Table.Scanner{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE}
+	if err := db.ScanAsOf("users", at, sc); err != nil {
+		t.Fatalf("ScanAsOf failed: %v", err)
+	}
+	rows, err := db.Query("users", &Table.Query{AsOf: &at})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	closed := &Table.Scanner{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE}
+	if err := db.ScanAsOf("users", at, closed); err != nil {
+		t.Fatalf("ScanAsOf failed: %v", err)
+	}
+	closed.Close()
+	closed.Close()
+
+	update(1)
+	update(2)
+	n := 0
+	for ; sc.Valid(); sc.Next() {
+		rec := Table.Record{}
+		sc.Deref(&rec)
+		check(rec)
+		n++
+	}
+	sc.Close()
+	if n != 200 {
+		t.Fatalf("expected 200 rows, got %d", n)
+	}
+	kept := []Table.Record{}
+	for rec, err := range rows.All() {
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		check(rec)
+		kept = append(kept, rec)
+	}
+	if len(kept) != 200 {
+		t.Fatalf("expected 200 rows, got %d", len(kept))
+	}
+	// the version is out of the window once the readers are gone
+	update(3)
+	if err := db.ScanAsOf("users", at, sc); err == nil {
+		t.Fatalf("expected an error out of the window")
+	}
+	// the rows don't share the pages reused by the updates
+	update(4)
+	for _, rec := range kept {
+		check(rec)
+	}
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func newImportTable(t *testing.T, db *Table.DB, name string) {
+	t.Helper()
+	table := &Table.TableDef{
+		Name:  name,
+		Types: []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_JSON},
+		Cols:  []string{"id", "name", "doc"},
+		PKeys: 1,
+		Defaults: []*Table.Value{
+			nil, nil, {Type: Table.TYPE_JSON, Str: []byte("{}")},
+		},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+}
+
+func exportString(t *testing.T, db *Table.DB, table string, opts Table.ExportOpts) string {
+	t.Helper()
+	out := bytes.Buffer{}
+	if _, err := db.Export(table, &out, opts); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	return out.String()
+}
+
+func TestImportExportCSV(t *testing.T) {
+	db := newTestDB(t)
+	newImportTable(t, db, "t")
+
+	input := "name,id,doc\n" +
+		"alice,3,\"{\"\"a\"\": 1}\"\n" +
+		"bob,1,\n" +
+		"\"carol, jr\",2,\"[1,2]\"\n"
+	stats, err := db.Import("t", strings.NewReader(input), Table.ImportOpts{})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Rows != 3 || stats.Skipped != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	expect := "id,name,doc\n" +
+		"1,bob,{}\n" +
+		"2,\"carol, jr\",\"[1,2]\"\n" +
+		"3,alice,\"{\"\"a\"\": 1}\"\n"
+	if got := exportString(t, db, "t", Table.ExportOpts{}); got != expect {
+		t.Fatalf("unexpected export:\n%s", got)
+	}
+
+	// a primary key range
+	opts := Table.ExportOpts{
+		Format: Table.FORMAT_JSONL,
+		Cmp1:   Table.CMP_GE, Key1: *(&Table.Record{}).AddInt64("id", 2),
+		Cmp2: Table.CMP_LE, Key2: *(&Table.Record{}).AddInt64("id", 3),
+	}
+	expect = `{"id":2,"name":"carol, jr","doc":[1,2]}` + "\n" +
+		`{"id":3,"name":"alice","doc":{"a": 1}}` + "\n"
+	if got := exportString(t, db, "t", opts); got != expect {
+		t.Fatalf("unexpected export:\n%s", got)
+	}
+	opts.Key1 = *(&Table.Record{}).AddStr("name", []byte("x"))
+	if _, err := db.Export("t", &bytes.Buffer{}, opts); err == nil {
+		t.Fatalf("expected an error for a range not on the primary key")
+	}
+
+	// the header must match the columns
+	for _, bad := range []string{"id,nope\n", "id,id\n"} {
+		if _, err := db.Import("t", strings.NewReader(bad), Table.ImportOpts{}); err == nil {
+			t.Fatalf("expected an error for the header %q", bad)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	db := newTestDB(t)
+	newImportTable(t, db, "t")
+
+	input := "id,name\n" +
+		"1,a\n" +
+		"2,b\n" +
+		"x,c\n" + // bad int64
+		"4\n" + // missing field
+		"1,dup\n" + // existing row
+		"6,f\n"
+	opts := Table.ImportOpts{Mode: Table.MODE_INSERT_ONLY, OnError: Table.IMPORT_SKIP}
+	stats, err := db.Import("t", strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Rows != 3 || stats.Skipped != 3 || len(stats.Errors) != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if msg := stats.Errors[0].Error(); !strings.HasPrefix(msg, "line 4:") {
+		t.Fatalf("unexpected error: %s", msg)
+	}
+
+	// stop at the first bad row, the committed batches are kept
+	db2 := newTestDB(t)
+	newImportTable(t, db2, "t")
+	opts = Table.ImportOpts{Mode: Table.MODE_INSERT_ONLY, BatchSize: 2}
+	stats, err = db2.Import("t", strings.NewReader(input), opts)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 4:") {
+		t.Fatalf("expected an error at line 4, got %v", err)
+	}
+	if stats.Rows != 2 {
+		t.Fatalf("expected 2 committed rows, got %d", stats.Rows)
+	}
+	if got := exportString(t, db2, "t", Table.ExportOpts{}); got != "id,name,doc\n1,a,{}\n2,b,{}\n" {
+		t.Fatalf("unexpected export:\n%s", got)
+	}
+
+	// a row that fails on its index key leaves nothing behind
+	db3 := newTestDB(t)
+	table := &Table.TableDef{
+		Name:    "ix",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:    []string{"id", "name"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}},
+	}
+	if err := db3.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if err := db3.EnableChangelog(Table.ChangelogOpts{}); err != nil {
+		t.Fatalf("EnableChangelog failed: %v", err)
+	}
+	input = "id,name\n1,a\n2," + strings.Repeat("x", 1500) + "\n3,c\n"
+	opts = Table.ImportOpts{OnError: Table.IMPORT_SKIP}
+	stats, err = db3.Import("ix", strings.NewReader(input), opts)
+	if err != nil || stats.Rows != 2 || stats.Skipped != 1 {
+		t.Fatalf("unexpected import: %+v %v", stats, err)
+	}
+	if got := exportString(t, db3, "ix", Table.ExportOpts{}); got != "id,name\n1,a\n3,c\n" {
+		t.Fatalf("unexpected export:\n%s", got)
+	}
+	keys := []int64{}
+	for _, ev := range pollChanges(t, db3.Subscribe(0)) {
+		keys = append(keys, ev.Key.Get("id").I64)
+	}
+	if !compareIntSlices(keys, []int64{1, 3}) {
+		t.Fatalf("unexpected change events: %v", keys)
+	}
+}
+
+func TestImportExportJSONL(t *testing.T) {
+	db := newTestDB(t)
+	newImportTable(t, db, "t")
+
+	input := `{"id": 1, "name": "a", "doc": {"x": [1, 2]}}` + "\n" +
+		"\n" +
+		`{"id": 2, "name": null}` + "\n" +
+		`{"id": 3, "name": 5}` + "\n" + // not a string
+		`{"id": 4, "other": "x"}` + "\n" + // unknown column
+		`{"id": 5.5}` + "\n" + // not an int64
+		`not json` + "\n" +
+		`{"id": 6, "name": "fé"}`
+	stats, err := db.Import("t", strings.NewReader(input), Table.ImportOpts{
+		Format: Table.FORMAT_JSONL, OnError: Table.IMPORT_SKIP,
+	})
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if stats.Rows != 3 || stats.Skipped != 4 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	expect := `{"id":1,"name":"a","doc":{"x":[1,2]}}` + "\n" +
+		`{"id":2,"name":"","doc":{}}` + "\n" +
+		`{"id":6,"name":"fé","doc":{}}` + "\n"
+	jsonl := exportString(t, db, "t", Table.ExportOpts{Format: Table.FORMAT_JSONL})
+	if jsonl != expect {
+		t.Fatalf("unexpected export:\n%s", jsonl)
+	}
+
+	// round trip into another table
+	newImportTable(t, db, "copy")
+	if _, err := db.Import("copy", strings.NewReader(jsonl), Table.ImportOpts{Format: Table.FORMAT_JSONL}); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if got := exportString(t, db, "copy", Table.ExportOpts{Format: Table.FORMAT_JSONL}); got != expect {
+		t.Fatalf("unexpected export:\n%s", got)
+	}
+}
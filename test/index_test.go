@@ -2,6 +2,7 @@ package test
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	Table "github.com/yash7xm/RelixDB/app"
@@ -254,3 +255,89 @@ func TestRangeQueriesWithSecondaryIndexes(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateIndexedColumns(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:    "users",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64},
+		Cols:    []string{"id", "name", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}, {"age"}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	set := func(id int64, name string, age int64) {
+		t.Helper()
+		rec := (&Table.Record{}).AddInt64("id", id).AddStr("name", []byte(name)).AddInt64("age", age)
+		if _, err := db.Set("users", *rec, Table.MODE_UPSERT); err != nil {
+			t.Fatalf("Failed to set record %d: %v", id, err)
+		}
+	}
+	// the ids of the rows found with an index lookup
+	lookup := func(key *Table.Record) []int64 {
+		t.Helper()
+		rows, err := db.Query("users", &Table.Query{
+			Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *key, Key2: *key,
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		ids := collectIDs(t, rows)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	byName := func(name string) []int64 {
+		return lookup((&Table.Record{}).AddStr("name", []byte(name)))
+	}
+	byAge := func(age int64) []int64 {
+		return lookup((&Table.Record{}).AddInt64("age", age))
+	}
+
+	set(1, "alice", 25)
+	set(2, "bob", 30)
+	set(3, "carol", 30)
+
+	set(1, "alicia", 25) // changes only the name index
+	set(2, "bob", 31)    // changes only the age index
+	set(3, "carol", 30)  // changes nothing
+	set(3, "carol", 30)
+
+	cases := []struct {
+		got    []int64
+		expect []int64
+	}{
+		{byName("alice"), []int64{}},
+		{byName("alicia"), []int64{1}},
+		{byAge(25), []int64{1}},
+		{byName("bob"), []int64{2}},
+		{byAge(30), []int64{3}},
+		{byAge(31), []int64{2}},
+		{byName("carol"), []int64{3}},
+	}
+	for i, c := range cases {
+		if !compareIntSlices(c.got, c.expect) {
+			t.Errorf("case %d: expected %v, got %v", i, c.expect, c.got)
+		}
+	}
+
+	// deleting by the primary key alone removes the index entries
+	deleted, err := db.Delete("users", *(&Table.Record{}).AddInt64("id", 2))
+	if err != nil || !deleted {
+		t.Fatalf("Failed to delete record: %v", err)
+	}
+	if ids := byName("bob"); len(ids) != 0 {
+		t.Errorf("stale name index entries: %v", ids)
+	}
+	if ids := byAge(31); len(ids) != 0 {
+		t.Errorf("stale age index entries: %v", ids)
+	}
+
+	// the index entry of a new row is added again
+	set(2, "bob", 30)
+	if ids := byAge(30); !compareIntSlices(ids, []int64{2, 3}) {
+		t.Errorf("expected [2 3], got %v", ids)
+	}
+}
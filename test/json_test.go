@@ -0,0 +1,103 @@
+package test
+
+import (
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func TestJSONColumns(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:    "events",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_JSON},
+		Cols:    []string{"id", "doc"},
+		PKeys:   1,
+		Indexes: [][]string{{"doc->'user'->>'name'"}, {"(doc ->> 'score')::int64"}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	bad := &Table.TableDef{
+		Name:    "bad",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:    []string{"id", "doc"},
+		PKeys:   1,
+		Indexes: [][]string{{"doc->>'name'"}},
+	}
+	if err := db.TableNew(bad); err == nil {
+		t.Fatalf("JSON accessors on a bytes column should be rejected")
+	}
+
+	docs := []string{
+		`{"user": {"name": "alice"}, "score": 30, "tags": ["a", "b"]}`,
+		`{"user": {"name": "bob"}, "score": 10, "tags": ["b"]}`,
+		`{"user": {"name": "carol"}, "score": 20}`,
+		`{"user": {"name": "alice"}, "score": 5, "tags": ["c"]}`,
+	}
+	for i, doc := range docs {
+		rec := (&Table.Record{}).AddInt64("id", int64(i+1)).AddJSON("doc", []byte(doc))
+		if _, err := db.Insert("events", *rec); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	rec := (&Table.Record{}).AddInt64("id", 9).AddJSON("doc", []byte(`{"user": `))
+	if _, err := db.Insert("events", *rec); err == nil {
+		t.Fatalf("invalid JSON should be rejected")
+	}
+
+	query := func(q *Table.Query) []int64 {
+		t.Helper()
+		rows, err := db.Query("events", q)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		return collectIDs(t, rows)
+	}
+
+	// lookups and ranges on the expression indexes,
+	// matched regardless of the spacing of the expression
+	name := (&Table.Record{}).AddStr("doc -> 'user' ->> 'name'", []byte("alice"))
+	got := query(&Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *name, Key2: *name})
+	if !compareIntSlices(got, []int64{1, 4}) {
+		t.Errorf("expected [1 4], got %v", got)
+	}
+	lo := (&Table.Record{}).AddInt64("(doc->>'score')::int64", 10)
+	hi := (&Table.Record{}).AddInt64("(doc->>'score')::int64", 30)
+	got = query(&Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LT, Key1: *lo, Key2: *hi})
+	if !compareIntSlices(got, []int64{2, 3}) {
+		t.Errorf("expected [2 3], got %v", got)
+	}
+
+	// filters
+	got = query(&Table.Query{Filter: "doc->'tags'->>0 = 'b' OR doc->>'score' = '20'"})
+	if !compareIntSlices(got, []int64{2, 3}) {
+		t.Errorf("expected [2 3], got %v", got)
+	}
+	got = query(&Table.Query{Filter: "doc->'user'->>'name' = 'alice' AND NOT doc->'tags' = '[\"c\"]'::json"})
+	if !compareIntSlices(got, []int64{1}) {
+		t.Errorf("expected [1], got %v", got)
+	}
+	for _, f := range []string{"doc->>'score' > 3", "missing = 1", "doc->>'name' = 'x", "doc->"} {
+		if _, err := db.Query("events", &Table.Query{Filter: f}); err == nil {
+			t.Errorf("filter %q should be rejected", f)
+		}
+	}
+
+	// the indexes follow updates
+	rec = (&Table.Record{}).AddInt64("id", 4).AddJSON("doc", []byte(`{"user": {"name": "dave"}, "score": 40}`))
+	if _, err := db.Update("events", *rec); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	got = query(&Table.Query{Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *name, Key2: *name})
+	if !compareIntSlices(got, []int64{1}) {
+		t.Errorf("expected [1], got %v", got)
+	}
+	got = query(&Table.Query{
+		Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE, Key1: *lo, Key2: *hi,
+		OrderBy: []Table.OrderBy{{Col: "id", Desc: true}},
+	})
+	if !compareIntSlices(got, []int64{3, 2, 1}) {
+		t.Errorf("expected [3 2 1], got %v", got)
+	}
+}
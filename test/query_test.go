@@ -0,0 +1,165 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+// open a fresh database in a temporary file
+func newTestDB(t *testing.T) *Table.DB {
+	t.Helper()
+	fp, err := os.CreateTemp("", "relixdb_test.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	fp.Close()
+	t.Cleanup(func() { os.Remove(fp.Name()) })
+
+	db := (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+type queryUser struct {
+	id   int64
+	name string
+	age  int64
+}
+
+func setupQueryTable(t *testing.T, db *Table.DB) []queryUser {
+	t.Helper()
+	table := &Table.TableDef{
+		Name:    "users",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64},
+		Cols:    []string{"id", "name", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	users := []queryUser{}
+	for i := int64(1); i <= 20; i++ {
+		u := queryUser{i, fmt.Sprintf("user%02d", (i*7)%20), 20 + (i*13)%17}
+		users = append(users, u)
+		rec := (&Table.Record{}).
+			AddInt64("id", u.id).
+			AddStr("name", []byte(u.name)).
+			AddInt64("age", u.age)
+		if _, err := db.Insert("users", *rec); err != nil {
+			t.Fatalf("Failed to insert record with id %d: %v", u.id, err)
+		}
+	}
+	return users
+}
+
+func collectIDs(t *testing.T, rows *Table.Rows) []int64 {
+	t.Helper()
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Valid() {
+		var rec Table.Record
+		rows.Deref(&rec)
+		ids = append(ids, rec.Get("id").I64)
+		rows.Next()
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	return ids
+}
+
+func TestQueryOrderBy(t *testing.T) {
+	db := newTestDB(t)
+	users := setupQueryTable(t, db)
+
+	expect := func(less func(a, b queryUser) bool, offset, limit int) []int64 {
+		sorted := append([]queryUser(nil), users...)
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		ids := []int64{}
+		for _, u := range sorted {
+			ids = append(ids, u.id)
+		}
+		ids = ids[offset:]
+		if limit > 0 && limit < len(ids) {
+			ids = ids[:limit]
+		}
+		return ids
+	}
+
+	testCases := []struct {
+		name     string
+		query    Table.Query
+		expected []int64
+	}{
+		{
+			name:     "Primary key descending",
+			query:    Table.Query{OrderBy: []Table.OrderBy{{Col: "id", Desc: true}}, Limit: 3},
+			expected: []int64{20, 19, 18},
+		},
+		{
+			name: "Primary key range descending",
+			query: Table.Query{
+				Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE,
+				Key1:    *(&Table.Record{}).AddInt64("id", 5),
+				Key2:    *(&Table.Record{}).AddInt64("id", 9),
+				OrderBy: []Table.OrderBy{{Col: "id", Desc: true}},
+				Offset:  1,
+			},
+			expected: []int64{8, 7, 6, 5},
+		},
+		{
+			name:  "Indexed column with offset",
+			query: Table.Query{OrderBy: []Table.OrderBy{{Col: "age"}, {Col: "id"}}, Offset: 2, Limit: 5},
+			expected: expect(func(a, b queryUser) bool {
+				return a.age < b.age || (a.age == b.age && a.id < b.id)
+			}, 2, 5),
+		},
+		{
+			name:  "Non-indexed column with external sort",
+			query: Table.Query{OrderBy: []Table.OrderBy{{Col: "name", Desc: true}}, SortMem: 64},
+			expected: expect(func(a, b queryUser) bool {
+				return a.name > b.name
+			}, 0, 0),
+		},
+		{
+			name:  "Non-indexed column with top-N",
+			query: Table.Query{OrderBy: []Table.OrderBy{{Col: "name"}}, Offset: 3, Limit: 4},
+			expected: expect(func(a, b queryUser) bool {
+				return a.name < b.name
+			}, 3, 4),
+		},
+		{
+			name:  "Mixed directions",
+			query: Table.Query{OrderBy: []Table.OrderBy{{Col: "age", Desc: true}, {Col: "id"}}},
+			expected: expect(func(a, b queryUser) bool {
+				return a.age > b.age || (a.age == b.age && a.id < b.id)
+			}, 0, 0),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rows, err := db.Query("users", &tc.query)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			ids := collectIDs(t, rows)
+			if !compareIntSlices(ids, tc.expected) {
+				t.Errorf("Unexpected query results.\nExpected: %v\nGot: %v", tc.expected, ids)
+			}
+		})
+	}
+
+	if _, err := db.Query("users", &Table.Query{OrderBy: []Table.OrderBy{{Col: "nope"}}}); err == nil {
+		t.Error("Expected error when ordering by an unknown column")
+	}
+}
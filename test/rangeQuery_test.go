@@ -217,3 +217,117 @@ func TestScanner(t *testing.T) {
 		fmt.Print(res)
 	}
 }
+
+func TestScanRanges(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:    "points",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_INT64, Table.TYPE_INT64},
+		Cols:    []string{"id", "a", "b"},
+		PKeys:   1,
+		Indexes: [][]string{{"a", "b"}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	// id = a*10 + b
+	for a := int64(0); a < 4; a++ {
+		for b := int64(0); b < 10; b++ {
+			rec := (&Table.Record{}).AddInt64("id", a*10+b).AddInt64("a", a).AddInt64("b", b)
+			if _, err := db.Insert("points", *rec); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+	}
+
+	scan := func(sc *Table.Scanner) []int64 {
+		t.Helper()
+		if err := db.Scan("points", sc); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		ids := []int64{}
+		for sc.Valid() {
+			var rec Table.Record
+			sc.Deref(&rec)
+			ids = append(ids, rec.Get("id").I64)
+			sc.Next()
+		}
+		return ids
+	}
+	a1 := *(&Table.Record{}).AddInt64("a", 1)
+	in := func(vals ...int64) []Table.Value {
+		out := []Table.Value{}
+		for _, v := range vals {
+			out = append(out, Table.Value{Type: Table.TYPE_INT64, I64: v})
+		}
+		return out
+	}
+	rng := func(cmp1 int, k1 int64, cmp2 int, k2 int64) Table.ScanRange {
+		return Table.ScanRange{
+			Cmp1: cmp1, Cmp2: cmp2,
+			Key1: *(&Table.Record{}).AddInt64("a", k1),
+			Key2: *(&Table.Record{}).AddInt64("a", k2),
+		}
+	}
+
+	cases := []struct {
+		name   string
+		ranges []Table.ScanRange
+		expect []int64
+	}{
+		{"a = 1 AND b IN (...)", Table.ScanIn(a1, "b", in(9, 3, 5, 3)), []int64{13, 15, 19}},
+		{"a IN (...)", Table.ScanIn(Table.Record{}, "a", in(3, 0)), []int64{
+			0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39,
+		}},
+		{"primary key OR", Table.ScanEq(
+			*(&Table.Record{}).AddInt64("id", 25),
+			*(&Table.Record{}).AddInt64("id", 7),
+			*(&Table.Record{}).AddInt64("id", 25),
+			*(&Table.Record{}).AddInt64("id", 99),
+		), []int64{7, 25}},
+		{"overlapping", []Table.ScanRange{
+			rng(Table.CMP_GE, 2, Table.CMP_LE, 2),
+			rng(Table.CMP_GT, 1, Table.CMP_LT, 3),
+			rng(Table.CMP_GE, 3, Table.CMP_LE, 3),
+		}, []int64{
+			20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39,
+		}},
+		{"descending", []Table.ScanRange{
+			rng(Table.CMP_LT, 1, Table.CMP_GE, 0),
+			{Cmp1: Table.CMP_LE, Cmp2: Table.CMP_GE,
+				Key1: *(&Table.Record{}).AddInt64("a", 3).AddInt64("b", 1),
+				Key2: *(&Table.Record{}).AddInt64("a", 3).AddInt64("b", 0)},
+		}, []int64{31, 30, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+	}
+	for _, c := range cases {
+		got := scan(&Table.Scanner{Ranges: c.ranges})
+		if !compareIntSlices(got, c.expect) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expect, got)
+		}
+	}
+
+	bad := [][]Table.ScanRange{
+		// different directions
+		{rng(Table.CMP_GE, 1, Table.CMP_LE, 1), rng(Table.CMP_LE, 2, Table.CMP_GE, 2)},
+		// different indexes
+		{Table.ScanEq(*(&Table.Record{}).AddInt64("id", 1))[0], rng(Table.CMP_GE, 1, Table.CMP_LE, 1)},
+	}
+	for i, ranges := range bad {
+		if err := db.Scan("points", &Table.Scanner{Ranges: ranges}); err == nil {
+			t.Errorf("bad ranges %d should be rejected", i)
+		}
+	}
+
+	// the IN list is returned in the index order
+	rows, err := db.Query("points", &Table.Query{
+		Ranges:  Table.ScanIn(a1, "b", in(2, 8, 4)),
+		OrderBy: []Table.OrderBy{{Col: "b", Desc: true}},
+		Limit:   2,
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if got := collectIDs(t, rows); !compareIntSlices(got, []int64{18, 14}) {
+		t.Errorf("expected [18 14], got %v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func TestScanSeq(t *testing.T) {
+	fp, err := os.CreateTemp("", "relixdb_test.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	fp.Close()
+	defer os.Remove(fp.Name())
+	db := (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	users := &Table.TableDef{
+		Name:    "users",
+		Types:   []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64},
+		Cols:    []string{"id", "name", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}},
+	}
+	if err := db.TableNew(users); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	for i := int64(1); i <= 5; i++ {
+		rec := (&Table.Record{}).
+			AddInt64("id", i).
+			AddStr("name", []byte(fmt.Sprintf("marker%d", i))).
+			AddInt64("age", 20+i)
+		if _, err := db.Insert("users", *rec); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	byAge := func() *Table.Scanner {
+		return &Table.Scanner{
+			Cmp1: Table.CMP_GE, Cmp2: Table.CMP_LE,
+			Key1: *(&Table.Record{}).AddInt64("age", 0),
+			Key2: *(&Table.Record{}).AddInt64("age", 100),
+		}
+	}
+	// the ids of the rows before an error
+	scan := func(stop int) ([]int64, error) {
+		ids := []int64{}
+		for rec, err := range db.ScanSeq("users", byAge()) {
+			if err != nil {
+				return ids, err
+			}
+			ids = append(ids, rec.Get("id").I64)
+			if len(ids) == stop {
+				break
+			}
+		}
+		return ids, nil
+	}
+	byAgeQuery := func() *Table.Query {
+		sc := byAge()
+		return &Table.Query{Cmp1: sc.Cmp1, Cmp2: sc.Cmp2, Key1: sc.Key1, Key2: sc.Key2}
+	}
+	query := func(stop int) ([]int64, error) {
+		rows, err := db.Query("users", byAgeQuery())
+		if err != nil {
+			return nil, err
+		}
+		ids := []int64{}
+		for rec, err := range rows.All() {
+			if err != nil {
+				return ids, err
+			}
+			ids = append(ids, rec.Get("id").I64)
+			if len(ids) == stop {
+				break
+			}
+		}
+		if rows.Valid() {
+			t.Fatalf("expected the rows to be closed")
+		}
+		return ids, nil
+	}
+
+	for _, fn := range []func(int) ([]int64, error){scan, query} {
+		if ids, err := fn(0); err != nil || len(ids) != 5 {
+			t.Fatalf("unexpected rows: %v %v", ids, err)
+		}
+		// an early break
+		if ids, err := fn(2); err != nil || len(ids) != 2 || ids[1] != 2 {
+			t.Fatalf("unexpected rows: %v %v", ids, err)
+		}
+	}
+	for _, err := range db.ScanSeq("missing", byAge()) {
+		if err == nil {
+			t.Fatalf("expected an error for a missing table")
+		}
+	}
+
+	// an index entry without the row
+	db.Close()
+	kv := Table.KV{Path: fp.Name()}
+	if err := kv.Open(); err != nil {
+		t.Fatalf("KV.Open() failed: %v", err)
+	}
+	var row []byte
+	for key, val := range kv.Range(nil, nil) {
+		if bytes.Contains(val, []byte("marker3")) {
+			row = bytes.Clone(key)
+		}
+	}
+	if row == nil {
+		t.Fatalf("row not found")
+	}
+	if _, err := kv.Del(row); err != nil {
+		t.Fatalf("KV.Del() failed: %v", err)
+	}
+	kv.Close()
+	db = (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	for _, fn := range []func(int) ([]int64, error){scan, query} {
+		ids, err := fn(0)
+		if err == nil || len(ids) != 2 {
+			t.Fatalf("expected an error after 2 rows, got %v %v", ids, err)
+		}
+		// the error is not reached
+		if ids, err := fn(2); err != nil || len(ids) != 2 {
+			t.Fatalf("unexpected rows: %v %v", ids, err)
+		}
+	}
+	q := byAgeQuery()
+	q.OrderBy = []Table.OrderBy{{Col: "name"}}
+	if _, err := db.Query("users", q); err == nil {
+		t.Fatalf("expected an error for sorting")
+	}
+}
@@ -1,7 +1,9 @@
 package test
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"testing"
 
 	Table "github.com/yash7xm/RelixDB/app"
@@ -380,7 +382,7 @@ func TestDataTypes(t *testing.T) {
 				AddInt64("id", 2).
 				AddStr("data", make([]byte, 1024*1024)). // 1MB of data
 				AddInt64("value", 1<<60),
-			wantErr: false,
+			wantErr: true, // over the B-tree value limit
 		},
 		// Add more test cases for different data types and edge cases
 	}
@@ -405,4 +407,434 @@ func TestDataTypes(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestAutoIncrement(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:          "posts",
+		Types:         []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:          []string{"id", "title"},
+		PKeys:         1,
+		AutoIncrement: true,
+		NotNull:       []bool{false, true},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	bad := &Table.TableDef{
+		Name:          "bad",
+		Types:         []uint32{Table.TYPE_BYTES, Table.TYPE_BYTES},
+		Cols:          []string{"id", "title"},
+		PKeys:         1,
+		AutoIncrement: true,
+	}
+	if err := db.TableNew(bad); err == nil {
+		t.Fatalf("auto-increment on a bytes key should be rejected")
+	}
+
+	insert := func(title string) int64 {
+		t.Helper()
+		id, err := db.InsertID("posts", *(&Table.Record{}).AddStr("title", []byte(title)))
+		if err != nil {
+			t.Fatalf("InsertID failed: %v", err)
+		}
+		return id
+	}
+	if id := insert("a"); id != 1 {
+		t.Fatalf("expected id 1, got %d", id)
+	}
+	if id := insert("b"); id != 2 {
+		t.Fatalf("expected id 2, got %d", id)
+	}
+
+	// an explicit key moves the counter forward
+	if _, err := db.Insert("posts", *(&Table.Record{}).AddInt64("id", 10).AddStr("title", []byte("c"))); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if id := insert("d"); id != 11 {
+		t.Fatalf("expected id 11, got %d", id)
+	}
+
+	// a failed insert doesn't consume a key
+	if _, err := db.InsertID("posts", *(&Table.Record{}).AddInt64("title", 1)); err == nil {
+		t.Fatalf("InsertID with a bad column should fail")
+	}
+	if id := insert("e"); id != 12 {
+		t.Fatalf("expected id 12, got %d", id)
+	}
+
+	// Insert also assigns the key
+	if _, err := db.Insert("posts", *(&Table.Record{}).AddStr("title", []byte("f"))); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	rec := (&Table.Record{}).AddInt64("id", 13)
+	if ok, err := db.Get("posts", rec); err != nil || !ok || string(rec.Get("title").Str) != "f" {
+		t.Fatalf("row 13 not found: %v", err)
+	}
+
+	// only the added rows use the keys
+	if _, err := db.Update("posts", *(&Table.Record{}).AddStr("title", []byte("g"))); err == nil {
+		t.Fatalf("Update without the key should fail")
+	}
+	tx := Table.DBTX{}
+	db.Begin(&tx)
+	if added, err := tx.Set("posts", *(&Table.Record{}).AddInt64("id", 100).AddStr("title", []byte("h")), Table.MODE_UPDATE_ONLY); err != nil || added {
+		t.Fatalf("unexpected update: %v %v", added, err)
+	}
+	if added, err := tx.Set("posts", *(&Table.Record{}).AddInt64("id", 13).AddStr("title", []byte("i")), Table.MODE_INSERT_ONLY); err != nil || added {
+		t.Fatalf("unexpected insert: %v %v", added, err)
+	}
+	if _, err := tx.Set("posts", Table.Record{}, Table.MODE_INSERT_ONLY); err == nil {
+		t.Fatalf("expected a NOT NULL error")
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if id := insert("j"); id != 14 {
+		t.Fatalf("expected id 14, got %d", id)
+	}
+}
+
+func TestSequences(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.CurrVal("orders"); err == nil {
+		t.Fatalf("CurrVal of an unused sequence should fail")
+	}
+	for i := int64(1); i <= 3; i++ {
+		v, err := db.NextVal("orders")
+		if err != nil || v != i {
+			t.Fatalf("expected %d, got %d (%v)", i, v, err)
+		}
+	}
+	if v, err := db.NextVal("invoices"); err != nil || v != 1 {
+		t.Fatalf("sequences should be independent: %d (%v)", v, err)
+	}
+	if v, err := db.CurrVal("orders"); err != nil || v != 3 {
+		t.Fatalf("expected 3, got %d (%v)", v, err)
+	}
+
+	// values from an aborted transaction are not kept
+	tx := Table.DBTX{}
+	db.Begin(&tx)
+	if v, _ := tx.NextVal("orders"); v != 4 {
+		t.Fatalf("expected 4, got %d", v)
+	}
+	db.Abort(&tx)
+	if v, _ := db.CurrVal("orders"); v != 3 {
+		t.Fatalf("expected 3 after abort, got %d", v)
+	}
+}
+
+func TestColumnConstraints(t *testing.T) {
+	db := newTestDB(t)
+	minAge, maxAge := int64(0), int64(150)
+	table := &Table.TableDef{
+		Name:     "people",
+		Types:    []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_BYTES},
+		Cols:     []string{"id", "name", "age", "role", "note"},
+		PKeys:    1,
+		Defaults: []*Table.Value{nil, nil, nil, {Type: Table.TYPE_BYTES, Str: []byte("user")}, nil},
+		NotNull:  []bool{true, true, false, false, false},
+		Checks: []*Table.Check{
+			nil,
+			{MinLen: 1, MaxLen: 8},
+			{Min: &minAge, Max: &maxAge},
+			{Enum: []Table.Value{
+				{Type: Table.TYPE_BYTES, Str: []byte("user")},
+				{Type: Table.TYPE_BYTES, Str: []byte("admin")},
+			}},
+			nil,
+		},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// a default violating its own check is rejected
+	bad := &Table.TableDef{
+		Name:     "bad",
+		Types:    []uint32{Table.TYPE_INT64, Table.TYPE_INT64},
+		Cols:     []string{"id", "n"},
+		PKeys:    1,
+		Defaults: []*Table.Value{nil, {Type: Table.TYPE_INT64, I64: -1}},
+		Checks:   []*Table.Check{nil, {Min: &minAge}},
+	}
+	if err := db.TableNew(bad); err == nil {
+		t.Fatalf("a default violating the check should be rejected")
+	}
+
+	// omitted columns take the defaults or the zero values
+	rec := (&Table.Record{}).AddInt64("id", 1).AddStr("name", []byte("ann"))
+	if _, err := db.Insert("people", *rec); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	got := (&Table.Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("people", got); err != nil || !ok {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(got.Get("role").Str) != "user" || got.Get("age").I64 != 0 || len(got.Get("note").Str) != 0 {
+		t.Fatalf("unexpected row: %+v", got)
+	}
+
+	violations := []struct {
+		rec    *Table.Record
+		expect string
+	}{
+		{(&Table.Record{}).AddInt64("id", 2), "column name: NOT NULL violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("")), "column name: CHECK length >= 1 violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("bartholomew")), "column name: CHECK length <= 8 violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("bob")).AddInt64("age", -1), "column age: CHECK >= 0 violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("bob")).AddInt64("age", 200), "column age: CHECK <= 150 violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("bob")).AddStr("role", []byte("root")), "column role: CHECK IN violated"},
+		{(&Table.Record{}).AddInt64("id", 2).AddStr("name", []byte("bob")).AddStr("age", []byte("x")), "column age: type mismatch"},
+	}
+	for _, v := range violations {
+		_, err := db.Insert("people", *v.rec)
+		if err == nil || err.Error() != v.expect {
+			t.Errorf("expected %q, got %v", v.expect, err)
+		}
+	}
+	if ok, _ := db.Get("people", (&Table.Record{}).AddInt64("id", 2)); ok {
+		t.Fatalf("rejected rows should not be stored")
+	}
+
+	// the omitted columns of an update keep the stored values
+	rec = (&Table.Record{}).AddInt64("id", 1).AddStr("name", []byte("ann")).
+		AddInt64("age", 30).AddStr("role", []byte("admin")).AddStr("note", []byte("hi"))
+	if _, err := db.Upsert("people", *rec); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	if _, err := db.Update("people", *(&Table.Record{}).AddInt64("id", 1).AddInt64("age", 31)); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := db.Upsert("people", *(&Table.Record{}).AddInt64("id", 1).AddStr("note", []byte("ho"))); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	got = (&Table.Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("people", got); err != nil || !ok {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if string(got.Get("name").Str) != "ann" || got.Get("age").I64 != 31 ||
+		string(got.Get("role").Str) != "admin" || string(got.Get("note").Str) != "ho" {
+		t.Fatalf("unexpected row: %+v", got)
+	}
+	// an update of a missing row with omitted NOT NULL columns does nothing
+	if added, err := db.Update("people", *(&Table.Record{}).AddInt64("id", 3).AddInt64("age", 1)); added || err != nil {
+		t.Fatalf("unexpected update: %v %v", added, err)
+	}
+	// upserts of new rows still apply the defaults and constraints
+	if _, err := db.Upsert("people", *(&Table.Record{}).AddInt64("id", 3)); err == nil {
+		t.Fatalf("expected a NOT NULL error")
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := newTestDB(t)
+	tables := []*Table.TableDef{
+		{
+			Name:  "authors",
+			Types: []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+			Cols:  []string{"id", "name"},
+			PKeys: 1,
+		},
+		{
+			Name:        "books",
+			Types:       []uint32{Table.TYPE_INT64, Table.TYPE_INT64},
+			Cols:        []string{"id", "author"},
+			PKeys:       1,
+			ForeignKeys: []Table.ForeignKey{{Cols: []string{"author"}, Table: "authors", OnDelete: Table.FK_CASCADE}},
+		},
+		{
+			Name:        "reviews",
+			Types:       []uint32{Table.TYPE_INT64, Table.TYPE_INT64, Table.TYPE_BYTES},
+			Cols:        []string{"id", "book", "text"},
+			PKeys:       1,
+			ForeignKeys: []Table.ForeignKey{{Cols: []string{"book"}, Table: "books", OnDelete: Table.FK_RESTRICT}},
+		},
+		{
+			Name:        "quotes",
+			Types:       []uint32{Table.TYPE_INT64, Table.TYPE_INT64},
+			Cols:        []string{"id", "author"},
+			PKeys:       1,
+			ForeignKeys: []Table.ForeignKey{{Cols: []string{"author"}, Table: "authors", OnDelete: Table.FK_SET_NULL}},
+		},
+	}
+	for _, tdef := range tables {
+		if err := db.TableNew(tdef); err != nil {
+			t.Fatalf("Failed to create table %s: %v", tdef.Name, err)
+		}
+	}
+	bad := &Table.TableDef{
+		Name:        "bad",
+		Types:       []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:        []string{"id", "author"},
+		PKeys:       1,
+		ForeignKeys: []Table.ForeignKey{{Cols: []string{"author"}, Table: "authors"}},
+	}
+	if err := db.TableNew(bad); err == nil {
+		t.Fatalf("a foreign key with a different type should be rejected")
+	}
+
+	insert := func(table string, vals ...int64) error {
+		rec := &Table.Record{}
+		cols := []string{"id", "author"}
+		if table == "reviews" {
+			cols[1] = "book"
+		}
+		for i, v := range vals {
+			rec.AddInt64(cols[i], v)
+		}
+		_, err := db.Insert(table, *rec)
+		return err
+	}
+	exists := func(table string, id int64) bool {
+		ok, err := db.Get(table, (&Table.Record{}).AddInt64("id", id))
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		return ok
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	must(insert("authors", 1))
+	must(insert("authors", 2))
+	must(insert("books", 10, 1))
+	must(insert("books", 11, 1))
+	must(insert("books", 12, 2))
+	must(insert("quotes", 20, 1))
+	must(insert("quotes", 21, 0)) // NULL
+	must(insert("reviews", 30, 12))
+
+	// orphans are rejected
+	if err := insert("books", 13, 3); err == nil {
+		t.Fatalf("a book without an author should be rejected")
+	}
+
+	// CASCADE deletes the books, SET NULL clears the quote
+	if _, err := db.Delete("authors", *(&Table.Record{}).AddInt64("id", 1)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if exists("books", 10) || exists("books", 11) || !exists("books", 12) {
+		t.Fatalf("the books of author 1 should be deleted")
+	}
+	quote := (&Table.Record{}).AddInt64("id", 20)
+	if ok, _ := db.Get("quotes", quote); !ok || quote.Get("author").I64 != 0 {
+		t.Fatalf("the quote should reference NULL: %+v", quote)
+	}
+
+	// RESTRICT through a cascade rejects the whole delete
+	if _, err := db.Delete("authors", *(&Table.Record{}).AddInt64("id", 2)); err == nil {
+		t.Fatalf("deleting a reviewed book should be rejected")
+	}
+	if !exists("authors", 2) || !exists("books", 12) {
+		t.Fatalf("a rejected delete should be rolled back")
+	}
+	if _, err := db.Delete("reviews", *(&Table.Record{}).AddInt64("id", 30)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := db.Delete("authors", *(&Table.Record{}).AddInt64("id", 2)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if exists("books", 12) {
+		t.Fatalf("book 12 should be deleted")
+	}
+
+	// a rejected delete leaves nothing behind in a transaction
+	must(insert("authors", 5))
+	must(insert("books", 15, 5))
+	must(insert("reviews", 32, 15))
+	tx := Table.DBTX{}
+	db.Begin(&tx)
+	if _, err := tx.Delete("authors", *(&Table.Record{}).AddInt64("id", 5)); err == nil {
+		db.Abort(&tx)
+		t.Fatalf("deleting a reviewed book should be rejected")
+	}
+	if _, err := tx.Delete("books", *(&Table.Record{}).AddInt64("id", 15)); err == nil {
+		db.Abort(&tx)
+		t.Fatalf("deleting a reviewed book should be rejected")
+	}
+	must(db.Commit(&tx))
+	if !exists("authors", 5) || !exists("books", 15) || !exists("reviews", 32) {
+		t.Fatalf("a rejected delete should not be committed")
+	}
+
+	// a zero parent key is not referenced by the NULL foreign keys
+	must(insert("authors", 0))
+	must(insert("books", 0, 0))
+	must(insert("books", 14, 0))
+	must(insert("reviews", 31, 0))
+	if _, err := db.Delete("authors", *(&Table.Record{}).AddInt64("id", 0)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if !exists("books", 0) || !exists("books", 14) {
+		t.Fatalf("the books with a NULL author should be kept")
+	}
+	if _, err := db.Delete("books", *(&Table.Record{}).AddInt64("id", 0)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if !exists("reviews", 31) {
+		t.Fatalf("the review with a NULL book should be kept")
+	}
+}
+
+func TestReadOnlyDB(t *testing.T) {
+	fp, err := os.CreateTemp("", "relixdb_test.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	fp.Close()
+	defer os.Remove(fp.Name())
+
+	db := (&Table.DB{}).NewDB(fp.Name())
+	if err := db.Open(); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	table := &Table.TableDef{
+		Name:  "kv",
+		Types: []uint32{Table.TYPE_INT64, Table.TYPE_BYTES},
+		Cols:  []string{"id", "val"},
+		PKeys: 1,
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	rec := (&Table.Record{}).AddInt64("id", 1).AddStr("val", []byte("one"))
+	if _, err := db.Insert("kv", *rec); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	db.Close()
+
+	ro := (&Table.DB{}).NewDB(fp.Name())
+	if err := ro.Open(Table.Options{ReadOnly: true}); err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer ro.Close()
+
+	got := (&Table.Record{}).AddInt64("id", 1)
+	if ok, err := ro.Get("kv", got); err != nil || !ok || string(got.Get("val").Str) != "one" {
+		t.Fatalf("Get failed on a read-only database: %v", err)
+	}
+	rec = (&Table.Record{}).AddInt64("id", 2).AddStr("val", []byte("two"))
+	if _, err := ro.Insert("kv", *rec); !errors.Is(err, Table.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := ro.Delete("kv", *(&Table.Record{}).AddInt64("id", 1)); !errors.Is(err, Table.ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if ok, _ := ro.Get("kv", (&Table.Record{}).AddInt64("id", 2)); ok {
+		t.Fatalf("the failed insert is visible")
+	}
+
+	// a writer can't open it while it's being read
+	rw := (&Table.DB{}).NewDB(fp.Name())
+	if err := rw.Open(); !errors.Is(err, Table.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	Table "github.com/yash7xm/RelixDB/app"
+)
+
+func searchIDs(t *testing.T, db *Table.DB, query string) []int64 {
+	t.Helper()
+	hits, err := db.Search("docs", "body", query, 0)
+	if err != nil {
+		t.Fatalf("Search(%q) failed: %v", query, err)
+	}
+	ids := []int64{}
+	for _, hit := range hits {
+		ids = append(ids, hit.Rec.Get("id").I64)
+	}
+	return ids
+}
+
+func TestFullTextSearch(t *testing.T) {
+	db := newTestDB(t)
+	table := &Table.TableDef{
+		Name:  "docs",
+		Types: []uint32{Table.TYPE_INT64, Table.TYPE_BYTES, Table.TYPE_BYTES},
+		Cols:  []string{"id", "title", "text"},
+		PKeys: 1,
+		TextIndexes: []Table.TextIndex{{
+			Name:      "body",
+			Cols:      []string{"title", "text"},
+			StopWords: []string{"the", "a"},
+		}},
+	}
+	if err := db.TableNew(table); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	docs := []struct {
+		id          int64
+		title, text string
+	}{
+		{1, "The quick brown fox", "jumps over the lazy dog"},
+		{2, "Lazy dogs", "a dog sleeps all day, dog dog dog"},
+		{3, "Brown bears", "the bear eats a quick lunch"},
+		{4, "Foxes", "a fox is quick and brown"},
+	}
+	for _, d := range docs {
+		rec := (&Table.Record{}).AddInt64("id", d.id).
+			AddStr("title", []byte(d.title)).AddStr("text", []byte(d.text))
+		if _, err := db.Insert("docs", *rec); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	cases := []struct {
+		query  string
+		expect []int64
+	}{
+		{"dog", []int64{2, 1}},            // ranked by term frequency
+		{"QUICK brown", []int64{4, 1, 3}}, // AND, lowercased
+		{`"quick brown"`, []int64{1}},     // phrase
+		{`"brown fox"`, []int64{1}},       // phrases don't cross columns
+		{`"fox the dog"`, []int64{}},      // stop words keep their positions
+		{`"over the lazy"`, []int64{1}},
+		{"fox OR bear", []int64{1, 3, 4}},
+		{"quick -fox", []int64{3}},
+		{"brown NOT bears", []int64{1, 4}},
+		{"zebra", []int64{}},
+	}
+	for _, c := range cases {
+		got := searchIDs(t, db, c.query)
+		if c.query == "fox OR bear" || c.query == "QUICK brown" || c.query == "brown NOT bears" {
+			// equal scores; compare as sets
+			got = sortedIDs(got)
+			c.expect = sortedIDs(c.expect)
+		}
+		if !compareIntSlices(got, c.expect) {
+			t.Errorf("Search(%q): expected %v, got %v", c.query, c.expect, got)
+		}
+	}
+
+	for _, bad := range []string{"", `"unterminated`, "OR dog", "the"} {
+		if _, err := db.Search("docs", "body", bad, 0); err == nil {
+			t.Errorf("Search(%q) should fail", bad)
+		}
+	}
+
+	// the index follows updates and deletes
+	rec := (&Table.Record{}).AddInt64("id", 2).
+		AddStr("title", []byte("Cats")).AddStr("text", []byte("a cat sleeps"))
+	if _, err := db.Update("docs", *rec); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := db.Delete("docs", *(&Table.Record{}).AddInt64("id", 4)); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if got := searchIDs(t, db, "dog"); !compareIntSlices(got, []int64{1}) {
+		t.Errorf("expected [1], got %v", got)
+	}
+	if got := searchIDs(t, db, "sleeps"); !compareIntSlices(got, []int64{2}) {
+		t.Errorf("expected [2], got %v", got)
+	}
+	if got := searchIDs(t, db, "fox"); !compareIntSlices(got, []int64{1}) {
+		t.Errorf("expected [1], got %v", got)
+	}
+
+	hits, err := db.Search("docs", "body", "quick", 1)
+	if err != nil || len(hits) != 1 || hits[0].Score <= 0 {
+		t.Fatalf("unexpected hits: %v %v", hits, err)
+	}
+
+	// a term too long for a key is an error, not a crash
+	long := strings.Repeat("x", 2000)
+	rec = (&Table.Record{}).AddInt64("id", 5).
+		AddStr("title", []byte("Long")).AddStr("text", []byte("quick "+long))
+	if _, err := db.Insert("docs", *rec); err == nil {
+		t.Fatalf("expected an error for a long term")
+	}
+	rec = (&Table.Record{}).AddInt64("id", 1).
+		AddStr("title", []byte("Long")).AddStr("text", []byte(long))
+	if _, err := db.Update("docs", *rec); err == nil {
+		t.Fatalf("expected an error for a long term")
+	}
+	if ok, err := db.Get("docs", (&Table.Record{}).AddInt64("id", 5)); err != nil || ok {
+		t.Fatalf("unexpected row: %v %v", ok, err)
+	}
+	if got := searchIDs(t, db, "quick"); !compareIntSlices(sortedIDs(got), []int64{1, 3}) {
+		t.Errorf("expected [1 3], got %v", got)
+	}
+}
+
+func sortedIDs(ids []int64) []int64 {
+	out := append([]int64{}, ids...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}